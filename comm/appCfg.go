@@ -5,7 +5,10 @@
 
 package comm
 
-import "net"
+import (
+	"net"
+	"time"
+)
 
 // AppCfg is the global configurations of Aqua
 var AppCfg = struct {
@@ -13,15 +16,102 @@ var AppCfg = struct {
 
 	TransitSvr net.IP
 
+	// EPNum and DPNum are the number of paths, 0 to be the
+	// number of workers
 	EPDir  string
 	EPFile string
 	EPNeed []string
+	EPNum  int
 
 	DPDir  string
 	DPFile string
 	DPNeed []string
+	DPNum  int
+
+	// DBBackend is "json" or "bolt"
+	DBBackend string
+
+	// DBBackups is the number of rolling backups kept for DB files
+	DBBackups int
+
+	// HistoryMax is the number of revisions kept for each kind
+	HistoryMax int
+
+	// AuditFile is the audit log. Entries older than AuditMaxAge,
+	// or beyond AuditMax are dropped, 0 to keep all
+	AuditFile   string
+	AuditMax    int
+	AuditMaxAge time.Duration
+
+	// ScheduleFile keeps scheduled jobs. Missed runs older than
+	// ScheduleGrace are never run, conflicts are checked within
+	// ScheduleHorizon
+	ScheduleFile    string
+	ScheduleGrace   time.Duration
+	ScheduleHorizon time.Duration
+
+	// GroupFile keeps path groups
+	GroupFile string
+
+	// Placement is the default policy to place a path by
+	// WorkerType, "least-loaded" or "spread"
+	Placement string
+
+	// FFmpegBin is the ffmpeg run by local encoders and decoders.
+	// It's stopped by SIGINT, and killed after FFmpegStopTimeout.
+	// It's unhealthy if no progress is made for FFmpegStall
+	FFmpegBin         string
+	FFmpegStopTimeout time.Duration
+	FFmpegStall       time.Duration
+
+	// SRTBin is the srt-live-transmit run by SRT workers. It's
+	// unhealthy if no data passes for SRTStall
+	SRTBin   string
+	SRTStall time.Duration
+
+	// RTSPInPoll is how often RTSP sources are polled for status
+	RTSPInPoll time.Duration
+
+	// RPCTimeout limits one RPC to a card
+	RPCTimeout time.Duration
+
+	// SoftSlots are slots of software-only cards by name, they
+	// run on this host. A card not listed is not registered
+	SoftSlots map[string]int
+
+	// RecordDir keeps recordings, in a sub-dir for each recorder
+	RecordDir string
+
+	// PlayoutDir is where files of playout playlists are
+	PlayoutDir string
+
+	// RTSPListen is where encode paths are re-published as
+	// rtsp://host/path/{id}, empty to disable
+	RTSPListen string
 
 	IsHTTPPipeOn bool
+
+	// WebListen are addresses web serves on, IPv6 in "[::]:port" form
+	WebListen []string
+
+	// WebTLS enables HTTPS on WebListen. If WebCertFile or WebKeyFile
+	// is empty, a self-signed cert is generated and kept in WebCertDir
+	WebTLS      bool
+	WebCertFile string
+	WebKeyFile  string
+	WebCertDir  string
+
+	// WebRedirect are plain HTTP addresses which redirect to HTTPS,
+	// empty to disable
+	WebRedirect []string
+
+	// WebUsers are user names and passwords, which HTTP basic auth
+	// is checked against to tell who makes a change
+	WebUsers map[string]string
+
+	// WebTrustedProxies are addresses of front proxies, whose
+	// X-Remote-User is trusted
+	WebTrustedProxies []string
 }{
 	HW: "以太网",
 
@@ -29,11 +119,61 @@ var AppCfg = struct {
 
 	EPDir:  "testdata",
 	EPFile: "encode.json",
-	EPNeed: []string{"C9830", "local_encoder"},
+	EPNeed: []string{"C9830", "local_encoder", "pattern", "playout", "srt_in"},
+	EPNum:  4,
 
 	DPDir:  "testdata",
 	DPFile: "decode.json",
-	DPNeed: []string{"local_decoder"},
+	DPNeed: []string{"local_decoder", "recorder", "hls", "srt_out"},
+	DPNum:  0,
+
+	DBBackend: "json",
+	DBBackups: 3,
+
+	HistoryMax: 1000,
+
+	AuditFile:   "testdata/audit.log",
+	AuditMax:    10000,
+	AuditMaxAge: 90 * 24 * time.Hour,
+
+	ScheduleFile:    "testdata/schedule.json",
+	ScheduleGrace:   10 * time.Minute,
+	ScheduleHorizon: 7 * 24 * time.Hour,
+
+	GroupFile: "testdata/groups.json",
+
+	Placement: "least-loaded",
+
+	FFmpegBin:         "ffmpeg",
+	FFmpegStopTimeout: 5 * time.Second,
+	FFmpegStall:       10 * time.Second,
+
+	SRTBin:   "srt-live-transmit",
+	SRTStall: 10 * time.Second,
+
+	RTSPInPoll: 5 * time.Second,
+
+	RPCTimeout: 5 * time.Second,
+
+	SoftSlots: map[string]int{"pattern": 34, "recorder": 35, "playout": 36,
+		"hls": 37, "srt_in": 38, "srt_out": 39},
+
+	RecordDir:  "testdata/records",
+	PlayoutDir: "testdata/media",
+
+	RTSPListen: ":8554",
 
 	IsHTTPPipeOn: true,
+
+	WebListen: []string{"0.0.0.0:8443", "[::]:8443"},
+
+	WebTLS:      true,
+	WebCertFile: "",
+	WebKeyFile:  "",
+	WebCertDir:  "testdata",
+
+	WebRedirect: []string{"0.0.0.0:8000"},
+
+	WebUsers:          map[string]string{},
+	WebTrustedProxies: []string{},
 }
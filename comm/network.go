@@ -6,11 +6,15 @@
 package comm
 
 import (
+	"errors"
 	"net"
 	"runtime"
 	"strings"
 )
 
+// ErrNotSupported is returned by what is not supported yet
+var ErrNotSupported = errors.New("Not supported")
+
 // NetCfg mainly wrappers Ifconfig
 type NetCfg struct {
 	Name string
@@ -53,7 +57,8 @@ func (n *NetCfg) GetIPv4() net.IP {
 	return n.ip
 }
 
-// SetIPv4 set hw to IP
+// SetIPv4 set hw to IP, ErrNotSupported is returned until it's
+// done
 func (n *NetCfg) SetIPv4(ip net.IP) error {
 	if runtime.GOOS == "windows" {
 
@@ -61,5 +66,5 @@ func (n *NetCfg) SetIPv4(ip net.IP) error {
 
 	// TODO:
 
-	return nil
+	return ErrNotSupported
 }
@@ -116,11 +116,21 @@ func (w *C9830Worker) Control(c CtlCmd, arg interface{}) interface{} {
 	return nil
 }
 
-// Encode method
+// Monitor method, the card must answer transcoder.get
+func (w *C9830Worker) Monitor() bool {
+	var reply map[string]interface{}
+	if err := RPC(w.card.URL, "transcoder.get", map[string]interface{}{}, &reply); err != nil {
+		return false
+	}
+
+	return true
+}
+
+// Encode method, TS of the transcoder carries all streams
 func (w *C9830Worker) Encode(sess *Session) error {
 	settings := map[string]interface{}{
 		"send_ip":   sess.IP.String(),
-		"send_port": sess.Ports[0],
+		"send_port": sess.Port(StreamVideo),
 	}
 	if err := w.card.set(w.workerID, settings); err != nil {
 		return err
@@ -129,10 +139,11 @@ func (w *C9830Worker) Encode(sess *Session) error {
 	return nil
 }
 
-// Decode method
+// Decode method, the transcoder takes video and audio
 func (w *C9830Worker) Decode(sess *Session) error {
 	settings := map[string]interface{}{
-		"vid_port": sess.Ports[0],
+		"vid_port": sess.Port(StreamVideo),
+		"aud_port": sess.Port(StreamAudio),
 	}
 	if err := w.card.set(w.workerID, settings); err != nil {
 		return err
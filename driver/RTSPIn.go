@@ -8,12 +8,40 @@ package driver
 import (
 	"fmt"
 	"net"
+	"reflect"
 	"sync"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
 )
 
 // RTSPInName is the sub-card's name
 const RTSPInName string = "RTSPIn"
 
+// rtspEstablished is the status of a transpond connected
+const rtspEstablished = "Established"
+
+// rtspURLField is the RTSP source
+var rtspURLField = Field{Name: "rtsp_url", Label: "RTSP地址", Type: FieldString,
+	Required: true, Pattern: `^rtsp://\S+$`}
+
+// rtspInOptions are settings of RTSPInWorker other than the URL.
+// A source not established is re-added every reconnect seconds,
+// 0 to never, and at most max_retries times in a row, 0 to always
+var rtspInOptions = Schema{
+	{Name: "rtsp_user", Label: "用户名", Type: FieldString, Default: ""},
+	{Name: "rtsp_password", Label: "密码", Type: FieldString, Default: ""},
+	{Name: "rtsp_transport", Label: "传输方式", Type: FieldString,
+		Default: "tcp", Enum: []string{"tcp", "udp"}},
+	{Name: "reconnect", Label: "重连间隔(秒)", Type: FieldInt, Default: 5,
+		Min: 0, Max: 3600},
+	{Name: "max_retries", Label: "最大重连次数", Type: FieldInt, Default: 0,
+		Min: 0, Max: 10000},
+}
+
+// rtspInSchema is the settings of RTSPInWorker
+var rtspInSchema = append(Schema{rtspURLField}, rtspInOptions...)
+
 // RTSPIn is the main struct for sub-card
 type RTSPIn struct {
 	lock sync.RWMutex
@@ -28,31 +56,48 @@ type RTSPIn struct {
 }
 
 // RTSPInWorker is the main struct for sub-card's
-// Worker
+// Worker. It adds a transpond by rtsp_client.add on start, and
+// deletes it by rtsp_client.del on stop or changes. The status
+// is polled while running
 type RTSPInWorker struct {
 	workerID int
 
 	card *RTSPIn
 
-	rpc map[string]interface{}
+	lock sync.Mutex
+
+	cfg rtspInCfg
+
+	// sendIP and ports are of Encode, ports are RTP ports by
+	// stream names
+	sendIP net.IP
+	ports  map[string]int
+
+	// added is the transpond of the last rtsp_client.add, nil if
+	// none is added
+	added map[string]interface{}
+
+	running bool
+	stop    chan struct{}
+	done    chan struct{}
+
+	// status is of the last add or poll, retries are reconnects
+	// since established
+	status      string
+	established bool
+	retries     int
+	lastAdd     time.Time
 }
 
-func newRPC(ip net.IP) map[string]interface{} {
+// rtspInCfg is parsed settings
+type rtspInCfg struct {
+	url       string
+	user      string
+	password  string
+	transport string
 
-	// XXX: RTSP shared the same IP with udp transit
-	return map[string]interface{}{
-		"transponds": []interface{}{
-			map[string]interface{}{
-				"type":     "udp2udp",
-				"rtsp_url": "",
-				"recv_ip":  ip.String(),
-				"send_ip":  ip.String(),
-				"send_port": map[string]interface{}{
-					"video": 0,
-					"audio": 0},
-			},
-		},
-	}
+	reconnect  time.Duration
+	maxRetries int
 }
 
 // Open method
@@ -62,12 +107,12 @@ func (c *RTSPIn) Open() ([]Worker, error) {
 		&RTSPInWorker{
 			workerID: 0,
 			card:     c,
-			rpc:      newRPC(c.IP),
+			sendIP:   c.IP,
 		},
 		&RTSPInWorker{
 			workerID: 1,
 			card:     c,
-			rpc:      newRPC(c.IP),
+			sendIP:   c.IP,
 		},
 	}, nil
 }
@@ -77,16 +122,29 @@ func (c *RTSPIn) Close() error {
 	return nil
 }
 
+// rpc calls the card, one at a time
+func (c *RTSPIn) rpc(cmd string, args interface{}, reply interface{}) error {
+	c.lock.Lock()
+
+	defer c.lock.Unlock()
+
+	return RPC(c.URL, cmd, args, reply)
+}
+
 // Control method
 func (w *RTSPInWorker) Control(c CtlCmd, arg interface{}) interface{} {
 	card := w.card
 
 	switch c {
 	case CtlCmdStart:
-		// leave to CtlCmdSetting
+		if err := w.start(); err != nil {
+			return err
+		}
 
 	case CtlCmdStop:
-		// leave to CtlCmdSetting
+		if err := w.halt(); err != nil {
+			return err
+		}
 
 	case CtlCmdName:
 		return fmt.Sprintf("%s_%d_%d", C9830TranscoderName,
@@ -98,9 +156,17 @@ func (w *RTSPInWorker) Control(c CtlCmd, arg interface{}) interface{} {
 	case CtlCmdWorkerID:
 		return w.workerID
 
+	case CtlCmdSchema:
+		return rtspInSchema
+
 	case CtlCmdSetting:
 		if settings, ok := arg.(map[string]interface{}); ok {
-			if err := w.set(w.workerID, settings); err != nil {
+			w.lock.Lock()
+			w.cfg = rtspInCfgOf(settings)
+			err := w.update()
+			w.lock.Unlock()
+
+			if err != nil {
 				return err
 			}
 		}
@@ -110,43 +176,280 @@ func (w *RTSPInWorker) Control(c CtlCmd, arg interface{}) interface{} {
 	return nil
 }
 
-// Encode method
-func (w *RTSPInWorker) Encode(sess *Session) error {
+// Monitor method
+func (w *RTSPInWorker) Monitor() bool {
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	return w.established
+}
+
+// Report method
+func (w *RTSPInWorker) Report() []string {
+	w.lock.Lock()
 
-	settings := map[string]interface{}{
-		"send_ip": sess.IP.String(),
-		"video":   sess.Ports[0],
+	defer w.lock.Unlock()
+
+	if !w.running {
+		return []string{"not running"}
 	}
 
-	if err := w.set(w.workerID, settings); err != nil {
-		return err
+	status := w.status
+	if status == "" {
+		status = "no status"
 	}
 
-	return nil
+	report := fmt.Sprintf("%s %s", w.cfg.url, status)
+	if w.retries > 0 {
+		report += fmt.Sprintf(", %d reconnects", w.retries)
+	}
+
+	return []string{report}
 }
 
-func (w *RTSPInWorker) set(id int, settings map[string]interface{}) error {
-	w.card.lock.Lock()
+// Encode method, each stream of the source is sent to the
+// stream of the same name in sess
+func (w *RTSPInWorker) Encode(sess *Session) error {
+
+	w.lock.Lock()
 
-	defer w.card.lock.Unlock()
+	defer w.lock.Unlock()
 
-	for k := range settings {
-		helperSetMap(w.rpc, 0, k, settings[k])
+	w.sendIP = sess.IP
+	w.ports = make(map[string]int)
+	for _, st := range sess.Streams {
+		w.ports[st.Name] = st.RTP
 	}
 
-	// hack: ["rtsp_url"] must be set
-	if w.rpc["transponds"].([]interface{})[0].(map[string]interface{})["rtsp_url"].(string) == "" {
+	return w.update()
+}
+
+// start adds the transpond, and polls it until halt. A failed
+// add is retried by the reconnect policy
+func (w *RTSPInWorker) start() error {
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	if w.cfg.url == "" {
+		return errInputError
+	}
+
+	if !w.running {
+		w.running = true
+		w.retries = 0
+		w.stop, w.done = make(chan struct{}), make(chan struct{})
+
+		go w.poll(w.stop, w.done)
+	}
+
+	if w.added != nil && reflect.DeepEqual(w.added, w.transpond()) {
 		return nil
 	}
 
+	return w.add()
+}
+
+// halt stops polling, and deletes the transpond
+func (w *RTSPInWorker) halt() error {
+	w.lock.Lock()
+	stop, done := w.stop, w.done
+	w.running = false
+	w.stop, w.done = nil, nil
+	w.lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	return w.del()
+}
+
+// update re-adds the transpond if it's changed while running,
+// w.lock must be held
+func (w *RTSPInWorker) update() error {
+	if !w.running || reflect.DeepEqual(w.added, w.transpond()) {
+		return nil
+	}
+
+	w.retries = 0
+
+	return w.add()
+}
+
+// transpond is the rtsp_client transpond of w
+func (w *RTSPInWorker) transpond() map[string]interface{} {
+	ports := map[string]interface{}{StreamVideo: 0, StreamAudio: 0}
+	for name, port := range w.ports {
+		ports[name] = port
+	}
+
+	t := map[string]interface{}{
+		"type":           "udp2udp",
+		"rtsp_url":       w.cfg.url,
+		"rtsp_transport": w.cfg.transport,
+		// XXX: RTSP shared the same IP with udp transit
+		"recv_ip":   w.card.IP.String(),
+		"send_ip":   w.sendIP.String(),
+		"send_port": ports,
+	}
+
+	if w.cfg.user != "" {
+		t["username"] = w.cfg.user
+		t["password"] = w.cfg.password
+	}
+
+	return t
+}
+
+// add adds the transpond, the last one is deleted first. w.lock
+// must be held
+func (w *RTSPInWorker) add() error {
+	if err := w.del(); err != nil {
+		// it may be gone with a reboot of the card
+		comm.Warning.Printf("RTSPIn %s delete failed: %v", GetWorkerName(w), err)
+	}
+
+	t := w.transpond()
+	w.lastAdd = time.Now()
+
 	reply := make(map[string]interface{})
-	if err := RPC(w.card.URL, "rtsp_client.add", w.rpc, &reply); err != nil {
+	if err := w.card.rpc("rtsp_client.add", map[string]interface{}{
+		"transponds": []interface{}{t}}, &reply); err != nil {
+		w.status = err.Error()
 		return err
 	}
 
-	if reply["transponds"].([]interface{})[0].(map[string]interface{})["status"].(string) != "Established" {
-		return errInputError
-	}
+	w.added = t
+	w.setStatus(rtspStatusOf(reply, t))
 
 	return nil
 }
+
+// del deletes the transpond added, w.lock must be held
+func (w *RTSPInWorker) del() error {
+	if w.added == nil {
+		return nil
+	}
+
+	t := w.added
+	w.added = nil
+	w.setStatus("")
+
+	reply := make(map[string]interface{})
+	return w.card.rpc("rtsp_client.del", map[string]interface{}{
+		"transponds": []interface{}{t}}, &reply)
+}
+
+// poll polls the status by rtsp_client.get until stop, and
+// reconnects by the policy
+func (w *RTSPInWorker) poll(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	tick := time.NewTicker(comm.AppCfg.RTSPInPoll)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+
+		w.lock.Lock()
+		w.check()
+		w.lock.Unlock()
+	}
+}
+
+// check does one poll, w.lock must be held
+func (w *RTSPInWorker) check() {
+	if w.added != nil {
+		reply := make(map[string]interface{})
+		if err := w.card.rpc("rtsp_client.get", map[string]interface{}{}, &reply); err != nil {
+			w.setStatus(err.Error())
+		} else {
+			w.setStatus(rtspStatusOf(reply, w.added))
+		}
+	}
+
+	cfg := w.cfg
+	if w.established || cfg.reconnect <= 0 || time.Since(w.lastAdd) < cfg.reconnect {
+		return
+	}
+
+	if cfg.maxRetries > 0 && w.retries >= cfg.maxRetries {
+		return
+	}
+
+	w.retries++
+
+	comm.Warning.Printf("RTSPIn %s is %q, reconnecting %s (%d)", GetWorkerName(w),
+		w.status, cfg.url, w.retries)
+
+	w.add()
+}
+
+// setStatus sets status, a transpond established resets retries
+func (w *RTSPInWorker) setStatus(status string) {
+	w.status = status
+	w.established = status == rtspEstablished
+
+	if w.established {
+		w.retries = 0
+	}
+}
+
+// rtspStatusOf finds status of t in transponds of reply, "" if
+// it's not found. Transponds of other workers may be in reply
+func rtspStatusOf(reply map[string]interface{}, t map[string]interface{}) string {
+	all, _ := reply["transponds"].([]interface{})
+	for _, one := range all {
+		m, ok := one.(map[string]interface{})
+		if !ok || m["rtsp_url"] != t["rtsp_url"] {
+			continue
+		}
+
+		// send_port tells transponds of the same URL
+		if port, ok := m["send_port"].(map[string]interface{}); ok {
+			video, _ := intOf(port[StreamVideo])
+			if video != t["send_port"].(map[string]interface{})[StreamVideo] {
+				continue
+			}
+		}
+
+		status, _ := m["status"].(string)
+		return status
+	}
+
+	return ""
+}
+
+// rtspInCfgOf parses settings, defaults are of rtspInSchema
+func rtspInCfgOf(settings map[string]interface{}) rtspInCfg {
+	cfg := rtspInCfg{transport: "tcp", reconnect: 5 * time.Second}
+
+	cfg.url, _ = settings["rtsp_url"].(string)
+	cfg.user, _ = settings["rtsp_user"].(string)
+	cfg.password, _ = settings["rtsp_password"].(string)
+
+	if s, ok := settings["rtsp_transport"].(string); ok && s != "" {
+		cfg.transport = s
+	}
+
+	if n, ok := intOf(settings["reconnect"]); ok && n >= 0 {
+		cfg.reconnect = time.Duration(n) * time.Second
+	}
+
+	if n, ok := intOf(settings["max_retries"]); ok && n >= 0 {
+		cfg.maxRetries = n
+	}
+
+	return cfg
+}
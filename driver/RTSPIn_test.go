@@ -0,0 +1,177 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+// fakeRTSPClient serves rtsp_client.* of the transit, all
+// transponds are in status
+type fakeRTSPClient struct {
+	lock sync.Mutex
+
+	status     string
+	transponds []map[string]interface{}
+	calls      []string
+}
+
+func (f *fakeRTSPClient) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method string
+		Params struct {
+			Transponds []map[string]interface{}
+		}
+		ID uint64
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.calls = append(f.calls, req.Method)
+
+	switch req.Method {
+	case "rtsp_client.add":
+		f.transponds = append(f.transponds, req.Params.Transponds...)
+	case "rtsp_client.del":
+		for _, d := range req.Params.Transponds {
+			for i, t := range f.transponds {
+				if t["rtsp_url"] == d["rtsp_url"] {
+					f.transponds = append(f.transponds[:i], f.transponds[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+
+	var all []map[string]interface{}
+	for _, t := range f.transponds {
+		one := map[string]interface{}{"status": f.status}
+		for k, v := range t {
+			one[k] = v
+		}
+		all = append(all, one)
+	}
+
+	json.NewEncoder(rw).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID,
+		"result": map[string]interface{}{"transponds": all}})
+}
+
+func (f *fakeRTSPClient) get() ([]string, []map[string]interface{}) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	calls := f.calls
+	f.calls = nil
+
+	return calls, append([]map[string]interface{}{}, f.transponds...)
+}
+
+func (f *fakeRTSPClient) set(status string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.status = status
+}
+
+func TestRTSPInWorker(t *testing.T) {
+	saved := comm.AppCfg.RTSPInPoll
+	comm.AppCfg.RTSPInPoll = 50 * time.Millisecond
+	defer func() { comm.AppCfg.RTSPInPoll = saved }()
+
+	f := &fakeRTSPClient{status: "Connecting"}
+	svr := httptest.NewServer(f)
+	defer svr.Close()
+
+	card := &RTSPIn{Slot: 255, IP: net.IPv4(127, 0, 0, 1), URL: svr.URL}
+	ws, _ := card.Open()
+	w := ws[0].(*RTSPInWorker)
+
+	w.Control(CtlCmdSetting, map[string]interface{}{"rtsp_url": "rtsp://a",
+		"rtsp_user": "admin", "rtsp_password": "pass", "rtsp_transport": "udp",
+		"reconnect": 1, "max_retries": 1})
+	w.Encode(&Session{IP: net.IPv4(10, 0, 0, 1), Streams: []Stream{
+		{Name: StreamVideo, RTP: 8000, RTCP: 8001},
+		{Name: StreamAudio, RTP: 8002, RTCP: 8003},
+		{Name: StreamData, RTP: 8006, RTCP: 8007}}})
+
+	// nothing is added until start
+	if calls, _ := f.get(); len(calls) != 0 {
+		t.Fatalf("calls = %v before start", calls)
+	}
+
+	if err, ok := w.Control(CtlCmdStart, nil).(error); ok {
+		t.Fatalf("Start error = %v", err)
+	}
+	defer w.Control(CtlCmdStop, nil)
+
+	calls, all := f.get()
+	if len(calls) != 1 || calls[0] != "rtsp_client.add" || len(all) != 1 {
+		t.Fatalf("calls = %v, transponds = %v", calls, all)
+	}
+
+	port, _ := all[0]["send_port"].(map[string]interface{})
+	if all[0]["send_ip"] != "10.0.0.1" || port["video"] != float64(8000) ||
+		port["audio"] != float64(8002) || port["data"] != float64(8006) ||
+		all[0]["username"] != "admin" ||
+		all[0]["password"] != "pass" || all[0]["rtsp_transport"] != "udp" {
+		t.Errorf("transpond = %v", all[0])
+	}
+
+	if w.Monitor() {
+		t.Errorf("Monitor() = true while connecting")
+	}
+
+	// reconnected once, then polled only
+	time.Sleep(2500 * time.Millisecond)
+	calls, all = f.get()
+	if strings.Count(strings.Join(calls, " "), "rtsp_client.add") != 1 ||
+		strings.Count(strings.Join(calls, " "), "rtsp_client.get") < 10 || len(all) != 1 {
+		t.Errorf("calls = %v, transponds = %v", calls, all)
+	}
+	if report := w.Report(); !strings.Contains(report[0], "rtsp://a Connecting, 1 reconnects") {
+		t.Errorf("Report() = %v", report)
+	}
+
+	f.set(rtspEstablished)
+	time.Sleep(200 * time.Millisecond)
+	if !w.Monitor() {
+		t.Errorf("Monitor() = false, %v", w.Report())
+	}
+
+	// a new URL replaces the transpond
+	f.get()
+	w.Control(CtlCmdSetting, map[string]interface{}{"rtsp_url": "rtsp://b"})
+	calls, all = f.get()
+	if strings.Join(calls, " ") != "rtsp_client.del rtsp_client.add" ||
+		len(all) != 1 || all[0]["rtsp_url"] != "rtsp://b" {
+		t.Errorf("calls = %v, transponds = %v", calls, all)
+	}
+
+	// the same settings change nothing
+	w.Control(CtlCmdSetting, map[string]interface{}{"rtsp_url": "rtsp://b"})
+	w.Control(CtlCmdStart, nil)
+	if calls, _ := f.get(); strings.Contains(strings.Join(calls, " "), "add") {
+		t.Errorf("calls = %v for the same settings", calls)
+	}
+
+	if err, ok := w.Control(CtlCmdStop, nil).(error); ok {
+		t.Fatalf("Stop error = %v", err)
+	}
+	if _, all := f.get(); len(all) != 0 || w.Monitor() {
+		t.Errorf("transponds = %v after Stop", all)
+	}
+}
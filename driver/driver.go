@@ -27,6 +27,7 @@ const (
 	CtlCmdIP
 	CtlCmdWorkerID
 	CtlCmdSetting
+	CtlCmdSchema
 )
 
 // CtlCmd is ID style type for control()
@@ -56,10 +57,22 @@ type Decoder interface {
 	Decode(sess *Session) error
 }
 
+// Reporter is implemented by workers which report more than
+// Monitor, like exit codes of a supervised process
+type Reporter interface {
+	Report() []string
+}
+
+// Logger is implemented by workers which keep logs
+type Logger interface {
+	Logs() []string
+}
+
 // StatusMonitor struct for monitoring worker status
 type StatusMonitor struct {
 	sync.RWMutex
 	status bool
+	report []string
 	stop   chan struct{}
 	w      Worker
 }
@@ -114,8 +127,16 @@ func (sm *StatusMonitor) updateMonitor() {
 		}
 		select {
 		case <-tick.C:
+			status := sm.w.Monitor()
+
+			var report []string
+			if r, ok := sm.w.(Reporter); ok {
+				report = r.Report()
+			}
+
 			sm.Lock()
-			sm.status = sm.w.Monitor()
+			sm.status = status
+			sm.report = report
 			sm.Unlock()
 		}
 
@@ -141,6 +162,23 @@ func (sm *StatusMonitor) GetStatus() bool {
 	return sm.status
 }
 
+// GetReport return the last report, nil if the worker is not a
+// Reporter
+func (sm *StatusMonitor) GetReport() []string {
+	sm.RLock()
+	defer sm.RUnlock()
+	return sm.report
+}
+
+// GetWorkerLogs get Worker's logs, nil if it keeps none
+func GetWorkerLogs(w Worker) []string {
+	if l, ok := w.(Logger); ok {
+		return l.Logs()
+	}
+
+	return nil
+}
+
 // GetWorkerName get Worker's Name
 func GetWorkerName(w Worker) string {
 	if n, ok := w.Control(CtlCmdName, nil).(string); ok {
@@ -233,17 +271,22 @@ func IsWorkerEnc(w Worker) bool {
 	return false
 }
 
-// RPC wrappers JSON-rpc queries
-func RPC(url string, cmd string, args interface{}, reply interface{}) error {
+// RPC wrappers JSON-rpc queries, each is limited by
+// AppCfg.RPCTimeout
+func RPC(url string, cmd string, args interface{}, reply interface{}) (err error) {
+
+	defer func(start time.Time) {
+		observeRPC(cmd, start, err)
+	}(time.Now())
 
 	var message []byte
-	var err error
 	if message, err = json2.EncodeClientRequest(cmd, args); err != nil {
 		comm.Error.Panicf("%v", err)
 	}
 
 	var resp *http.Response
-	if resp, err = http.Post(url, "application/json", bytes.NewReader(message)); err != nil {
+	client := &http.Client{Timeout: comm.AppCfg.RPCTimeout}
+	if resp, err = client.Post(url, "application/json", bytes.NewReader(message)); err != nil {
 		return err
 	}
 
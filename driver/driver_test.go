@@ -6,7 +6,18 @@
 package driver
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
 	"testing"
+
+	"github.com/zhanglongx/Aqua/comm"
 )
 
 func Test(t *testing.T) {
@@ -64,3 +75,162 @@ func Test(t *testing.T) {
 		t.Error("failed: ", test2)
 	}
 }
+
+func Test_helperStreams(t *testing.T) {
+	all := helperStreams(inBasePort, 3000, 1)
+	if len(all) != len(pipeStreams) || all[0] != (Stream{StreamVideo, 8008, 8009}) ||
+		all[3] != (Stream{StreamData, 8014, 8015}) {
+		t.Errorf("helperStreams() = %v", all)
+	}
+
+	sess := Session{Streams: all}
+	if sess.Port(StreamAudio) != 8010 || sess.Port("none") != 0 {
+		t.Errorf("Port() is wrong")
+	}
+}
+
+func Test_transponds(t *testing.T) {
+	tr := transit{selfIP: net.IPv4(10, 0, 0, 1)}
+
+	src := []Stream{{StreamVideo, 5000, 5001}, {StreamAudio, 5002, 5003},
+		{StreamData, 5006, 5007}}
+	dst := []Stream{{StreamVideo, 6000, 6001}, {StreamAudio, 6002, 0}}
+
+	args := tr.transponds(src, net.IPv4(10, 0, 0, 2), dst)
+
+	// data is not in dst, and audio has no RTCP
+	var got []string
+	for _, one := range args["transponds"].([]map[string]interface{}) {
+		got = append(got, fmt.Sprintf("%v:%v>%v:%v", one["recv_ip"], one["recv_port"],
+			one["send_ip"], one["send_port"]))
+	}
+
+	want := []string{"10.0.0.1:5000>10.0.0.2:6000", "10.0.0.1:5001>10.0.0.2:6001",
+		"10.0.0.1:5002>10.0.0.2:6002"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("transponds() = %v", got)
+	}
+}
+
+// fakeTransit serves udp_transpond.* of the transit, forwards are
+// counted by send address
+type fakeTransit struct {
+	lock sync.Mutex
+
+	forwards map[string]int
+}
+
+func (f *fakeTransit) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method string
+		Params struct {
+			Transponds []map[string]interface{}
+		}
+		ID uint64
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, one := range req.Params.Transponds {
+		dst := fmt.Sprintf("%v:%v", one["send_ip"], one["send_port"])
+		switch req.Method {
+		case "udp_transpond.add":
+			f.forwards[dst]++
+		case "udp_transpond.del":
+			if f.forwards[dst]--; f.forwards[dst] == 0 {
+				delete(f.forwards, dst)
+			}
+		}
+	}
+
+	json.NewEncoder(rw).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID,
+		"result": map[string]interface{}{}})
+}
+
+// dup returns send addresses forwarded to more than once
+func (f *fakeTransit) dup() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var all []string
+	for dst, n := range f.forwards {
+		if n > 1 {
+			all = append(all, dst)
+		}
+	}
+
+	return all
+}
+
+// pullAtOnce pulls each of ws on a path of its own through a fake
+// transit, and checks no decode port is shared. The returned func
+// frees them
+func pullAtOnce(t *testing.T, ws ...Worker) func() {
+	f := &fakeTransit{forwards: make(map[string]int)}
+	svr := httptest.NewServer(f)
+
+	saved := TransURL
+	TransURL = svr.URL
+
+	sr := &PipeSvr{IP: net.IPv4(127, 0, 0, 1)}
+	sr.Create()
+
+	ports := make(map[int]string)
+	for i, w := range ws {
+		if err := sr.AllocPull(i+1, w); err != nil {
+			t.Fatalf("AllocPull(%s) error = %v", GetWorkerName(w), err)
+		}
+
+		port := decodePorts.streams(w)[0].RTP
+		if other, ok := ports[port]; ok {
+			t.Errorf("%s and %s both on port %d", other, GetWorkerName(w), port)
+		}
+		ports[port] = GetWorkerName(w)
+	}
+
+	if dup := f.dup(); len(dup) != 0 {
+		t.Errorf("forwarded more than once to %v", dup)
+	}
+
+	return func() {
+		for i, w := range ws {
+			if err := sr.FreePull(i+1, w); err != nil {
+				t.Errorf("FreePull(%s) error = %v", GetWorkerName(w), err)
+			}
+			if decodePorts.streams(w) != nil {
+				t.Errorf("ports of %s not freed", GetWorkerName(w))
+			}
+		}
+
+		TransURL = saved
+		svr.Close()
+	}
+}
+
+func TestPipeSvr_pullSoftware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := comm.AppCfg.RecordDir
+	comm.AppCfg.RecordDir = dir
+	defer func() { comm.AppCfg.RecordDir = saved }()
+
+	// software cards are all of the host IP
+	recs, _ := (&Recorder{Slot: 35, IP: net.IPv4(127, 0, 0, 1)}).Open()
+	hlss, _ := (&HLS{Slot: 37, IP: net.IPv4(127, 0, 0, 1)}).Open()
+
+	free := pullAtOnce(t, recs[0], hlss[0], recs[1])
+	defer free()
+
+	for _, w := range []Worker{recs[0], hlss[0], recs[1]} {
+		if err, ok := w.Control(CtlCmdStart, nil).(error); ok {
+			t.Errorf("Start %s error = %v", GetWorkerName(w), err)
+		}
+		defer w.Control(CtlCmdStop, nil)
+	}
+}
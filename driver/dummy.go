@@ -88,6 +88,12 @@ func (w *DummyWorker) Control(c CtlCmd, arg interface{}) interface{} {
 	return nil
 }
 
+// Monitor reports if the worker is healthy, it's polled by
+// StatusMonitor
+func (w *DummyWorker) Monitor() bool {
+	return true
+}
+
 // Report do reporting
 func (w *DummyWorker) Report() []string {
 	return nil
@@ -0,0 +1,205 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+// ffStats is the last stats line of ffmpeg, like
+// "frame=  250 fps= 25 q=28.0 size=  1024kB time=00:00:10.00
+// bitrate= 838.9kbits/s speed=   1x"
+type ffStats struct {
+	Frame   int
+	FPS     float64
+	Time    string
+	Bitrate string
+	Speed   string
+}
+
+// ffmpeg runs one ffmpeg process of a worker by Supervisor, and
+// parses its stats
+type ffmpeg struct {
+	sup Supervisor
+
+	lock sync.Mutex
+
+	stats ffStats
+
+	// advanced is when stats last moved on, started at start
+	advanced time.Time
+
+	// lastErr is the last line which is not stats
+	lastErr string
+}
+
+var reFFStats = regexp.MustCompile(`(\w+)=\s*(\S+)`)
+
+// init sets up f for worker name
+func (f *ffmpeg) init(name string) {
+	f.sup.Name = name
+	f.sup.StopTimeout = comm.AppCfg.FFmpegStopTimeout
+	f.sup.OnStart = f.reset
+	f.sup.OnLine = f.parse
+}
+
+// start runs ffmpeg with args. If it's running with other args,
+// it's restarted
+func (f *ffmpeg) start(args []string) error {
+
+	all := append([]string{"-hide_banner", "-nostdin",
+		"-loglevel", "error", "-stats"}, args...)
+
+	if f.sup.Supervising() {
+		if reflect.DeepEqual(f.sup.Args(), all) {
+			return nil
+		}
+
+		comm.Info.Printf("Restarting %s for new settings", f.sup.Name)
+		if err := f.sup.Stop(); err != nil {
+			return err
+		}
+	}
+
+	return f.sup.Start(comm.AppCfg.FFmpegBin, all)
+}
+
+// stop stops ffmpeg
+func (f *ffmpeg) stop() error {
+	return f.sup.Stop()
+}
+
+// healthy tells if ffmpeg is running, and its stats moved on
+// within AppCfg.FFmpegStall
+func (f *ffmpeg) healthy() bool {
+	if !f.sup.Alive() {
+		return false
+	}
+
+	f.lock.Lock()
+
+	defer f.lock.Unlock()
+
+	return time.Since(f.advanced) < comm.AppCfg.FFmpegStall
+}
+
+// report returns the process status, and the stats
+func (f *ffmpeg) report() []string {
+	all := f.sup.Report()
+
+	f.lock.Lock()
+
+	defer f.lock.Unlock()
+
+	if f.stats.Time != "" {
+		all = append(all, fmt.Sprintf("frame %d, fps %g, time %s, bitrate %s, speed %s",
+			f.stats.Frame, f.stats.FPS, f.stats.Time, f.stats.Bitrate, f.stats.Speed))
+	}
+
+	if f.lastErr != "" {
+		all = append(all, "error: "+f.lastErr)
+	}
+
+	return all
+}
+
+// reset is called when a process is started
+func (f *ffmpeg) reset() {
+
+	f.lock.Lock()
+
+	defer f.lock.Unlock()
+
+	f.stats = ffStats{}
+	f.advanced = time.Now()
+	f.lastErr = ""
+}
+
+// parse handles one line of output, stats are not logged
+func (f *ffmpeg) parse(line string) bool {
+
+	st, ok := parseStats(line)
+
+	f.lock.Lock()
+
+	defer f.lock.Unlock()
+
+	if !ok {
+		f.lastErr = line
+		comm.Warning.Printf("%s: %s", f.sup.Name, line)
+		return true
+	}
+
+	if st.Frame != f.stats.Frame || st.Time != f.stats.Time {
+		f.advanced = time.Now()
+	}
+
+	f.stats = st
+
+	return false
+}
+
+// parseStats parses a stats line, false if it's not
+func parseStats(line string) (ffStats, bool) {
+	var st ffStats
+
+	found := false
+	for _, m := range reFFStats.FindAllStringSubmatch(line, -1) {
+		switch m[1] {
+		case "frame":
+			st.Frame, _ = strconv.Atoi(m[2])
+		case "fps":
+			st.FPS, _ = strconv.ParseFloat(m[2], 64)
+		case "time":
+			st.Time = m[2]
+			found = true
+		case "bitrate":
+			st.Bitrate = m[2]
+		case "speed":
+			st.Speed = m[2]
+		}
+	}
+
+	return st, found
+}
+
+// scanLines splits on '\r' or '\n', ffmpeg ends stats lines
+// with '\r'
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+
+	if atEOF {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
+
+// intOf returns v as int, JSON numbers are float64
+func intOf(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case float64:
+		return int(n), true
+	}
+
+	return 0, false
+}
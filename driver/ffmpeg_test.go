@@ -0,0 +1,178 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+func Test_parseStats(t *testing.T) {
+	st, ok := parseStats("frame=  250 fps= 25 q=28.0 size=  1024kB time=00:00:10.00 bitrate= 838.9kbits/s speed=   1x")
+	if !ok || st.Frame != 250 || st.FPS != 25 || st.Time != "00:00:10.00" ||
+		st.Bitrate != "838.9kbits/s" || st.Speed != "1x" {
+		t.Errorf("parseStats() = %v, %v", st, ok)
+	}
+
+	if _, ok := parseStats("rtp://1.2.3.4:5000: Connection refused"); ok {
+		t.Errorf("parseStats() error line is stats")
+	}
+}
+
+func Test_encoderArgs(t *testing.T) {
+	settings := map[string]interface{}{"Input": "/srv/a.ts", "BitRate": 4000,
+		"Resolution": "1280x720", "ACodec": "none"}
+
+	got, err := encoderArgs(settings, net.IPv4(10, 0, 0, 1), 5000)
+	want := []string{"-re", "-stream_loop", "-1", "-i", "/srv/a.ts",
+		"-c:v", "libx264", "-preset", "veryfast",
+		"-b:v", "4000k", "-maxrate", "4000k", "-bufsize", "8000k",
+		"-s", "1280x720", "-an", "-f", "rtp_mpegts", "rtp://10.0.0.1:5000"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("encoderArgs() = %v, %v", got, err)
+	}
+
+	if _, err := encoderArgs(settings, nil, 0); err == nil {
+		t.Errorf("encoderArgs() no session")
+	}
+
+	got, _ = decoderArgs(nil, 5000)
+	want = []string{"-i", "rtp://0.0.0.0:5000", "-f", "null", "-"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoderArgs() = %v", got)
+	}
+
+	// Output is the last arg of ffmpeg, only URLs are taken
+	re := regexp.MustCompile(localDecoderSchema[0].Pattern)
+	for output, ok := range map[string]bool{"": true, "udp://239.0.0.1:1234": true,
+		"srt://10.0.0.1:9000?mode=caller": true, "-y": false, "/etc/passwd": false,
+		"file:///tmp/a.ts": false, "-f udp://a": false} {
+		if re.MatchString(output) != ok {
+			t.Errorf("Output %q matched = %v", output, !ok)
+		}
+	}
+}
+
+// fakeFFmpeg writes a ffmpeg which prints stats until interrupted
+func fakeFFmpeg(t *testing.T, dir string) {
+	bin := path.Join(dir, "ffmpeg")
+	script := "#!/bin/sh\ntrap 'exit 0' INT\ni=0\nwhile true; do\n" +
+		"  printf 'frame=%d fps=25 time=00:00:0%d.00 bitrate=1.0kbits/s speed=1x\\r' $i $i >&2\n" +
+		"  i=$((i+1)); sleep 0.1\ndone\n"
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := comm.AppCfg.FFmpegBin
+	comm.AppCfg.FFmpegBin = bin
+	t.Cleanup(func() { comm.AppCfg.FFmpegBin = saved })
+}
+
+func Test_ffmpeg(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+
+	dir, err := ioutil.TempDir("", "aqua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fakeFFmpeg(t, dir)
+
+	var f ffmpeg
+	f.init("test")
+	if err := f.start([]string{"-i", "x"}); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	f.lock.Lock()
+	frame := f.stats.Frame
+	f.lock.Unlock()
+
+	if !f.healthy() || frame == 0 {
+		t.Errorf("healthy() = %v, frame = %d", f.healthy(), frame)
+	}
+
+	if err := f.stop(); err != nil || f.sup.Alive() {
+		t.Errorf("stop() error = %v, alive = %v", err, f.sup.Alive())
+	}
+
+	// stopped by SIGINT
+	if st := f.sup.Status(); st.ExitCode != 0 || st.Restarts != 0 {
+		t.Errorf("Status() = %v", st)
+	}
+
+	// a running encoder follows its session, and stops on an
+	// invalid one
+	ws, _ := (&LocalE{Slot: 32}).Open()
+	w := ws[0].(*LocalEWorker)
+	w.Control(CtlCmdSetting, map[string]interface{}{"Input": "x"})
+	w.Encode(&Session{IP: net.IPv4(127, 0, 0, 1), Streams: helperStreams(inBasePort, 0, 0)})
+	if err, ok := w.Control(CtlCmdStart, nil).(error); ok {
+		t.Fatalf("Start error = %v", err)
+	}
+	defer w.Control(CtlCmdStop, nil)
+
+	w.Encode(&Session{IP: net.IPv4(127, 0, 0, 1), Streams: helperStreams(inBasePort, 0, 1)})
+	if args := strings.Join(w.proc.sup.Args(), " "); !strings.Contains(args, "rtp://127.0.0.1:5008") {
+		t.Errorf("args = %s after Encode", args)
+	}
+
+	w.Encode(&Session{IP: net.IPv4(127, 0, 0, 1), Streams: invalidStreams})
+	if w.proc.sup.Supervising() {
+		t.Errorf("running after an invalid Encode")
+	}
+}
+
+func TestLocalDWorker_pullTwo(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+
+	dir, err := ioutil.TempDir("", "aqua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fakeFFmpeg(t, dir)
+
+	// two cards of the host, pulled on two paths at once
+	a, _ := (&LocalD{Slot: 33, IP: net.IPv4(127, 0, 0, 1)}).Open()
+	b, _ := (&LocalD{Slot: 40, IP: net.IPv4(127, 0, 0, 1)}).Open()
+
+	free := pullAtOnce(t, a[0], b[0])
+	defer free()
+
+	inputs := make(map[string]bool)
+	for _, w := range []Worker{a[0], b[0]} {
+		if err, ok := w.Control(CtlCmdStart, nil).(error); ok {
+			t.Fatalf("Start %s error = %v", GetWorkerName(w), err)
+		}
+		defer w.Control(CtlCmdStop, nil)
+
+		args := strings.Join(w.(*LocalDWorker).proc.sup.Args(), " ")
+		inputs[args[strings.Index(args, "rtp://"):]] = true
+	}
+
+	if len(inputs) != 2 {
+		t.Errorf("inputs = %v", inputs)
+	}
+}
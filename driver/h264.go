@@ -0,0 +1,381 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+// A minimal H.264 encoder for synthetic pictures. IDR pictures
+// are coded all I_PCM, and P pictures code changed macroblocks
+// as I_PCM and skip others, so no transform or entropy coding of
+// residuals is needed. It's Constrained Baseline, CAVLC.
+
+// NAL unit types
+const (
+	nalSlice = 1
+	nalIDR   = 5
+	nalSPS   = 7
+	nalPPS   = 8
+	nalAUD   = 9
+)
+
+// mb_type of I_PCM in I slices, and in P slices
+const (
+	mbIPCM  = 25
+	mbPIPCM = 5 + mbIPCM
+)
+
+// log2MaxFrameNum is log2_max_frame_num in SPS
+const log2MaxFrameNum = 16
+
+// mbBytes is the size of an I_PCM macroblock of 4:2:0
+const mbBytes = 256 + 2*64
+
+// bitWriter writes bits MSB first
+type bitWriter struct {
+	buf []byte
+	cur byte
+	n   uint
+}
+
+// u writes v in n bits
+func (b *bitWriter) u(n uint, v uint64) {
+	for i := int(n) - 1; i >= 0; i-- {
+		b.cur = b.cur<<1 | byte(v>>uint(i)&1)
+		if b.n++; b.n == 8 {
+			b.buf = append(b.buf, b.cur)
+			b.cur, b.n = 0, 0
+		}
+	}
+}
+
+// ue writes Exp-Golomb coded v
+func (b *bitWriter) ue(v uint) {
+	x := uint64(v) + 1
+
+	bits := uint(0)
+	for t := x; t > 1; t >>= 1 {
+		bits++
+	}
+
+	b.u(bits, 0)
+	b.u(bits+1, x)
+}
+
+// se writes signed Exp-Golomb coded v
+func (b *bitWriter) se(v int) {
+	if v > 0 {
+		b.ue(uint(2*v - 1))
+	} else {
+		b.ue(uint(-2 * v))
+	}
+}
+
+func (b *bitWriter) aligned() bool {
+	return b.n == 0
+}
+
+// align writes zero bits to byte boundary
+func (b *bitWriter) align() {
+	for !b.aligned() {
+		b.u(1, 0)
+	}
+}
+
+// raw writes p, b must be aligned
+func (b *bitWriter) raw(p []byte) {
+	b.buf = append(b.buf, p...)
+}
+
+// trailing writes rbsp_trailing_bits
+func (b *bitWriter) trailing() {
+	b.u(1, 1)
+	b.align()
+}
+
+func (b *bitWriter) bytes() []byte {
+	return b.buf
+}
+
+// nalUnit returns a NAL unit with start code, rbsp is escaped
+// against start code emulation
+func nalUnit(refIdc byte, typ byte, rbsp []byte) []byte {
+	out := make([]byte, 0, len(rbsp)+len(rbsp)/64+5)
+	out = append(out, 0, 0, 0, 1, refIdc<<5|typ)
+
+	zeros := 0
+	for _, c := range rbsp {
+		if zeros >= 2 && c <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+
+	return out
+}
+
+// picture is a 4:2:0 picture, padded to macroblocks
+type picture struct {
+	// mbW and mbH are in macroblocks
+	mbW int
+	mbH int
+
+	y  []byte
+	cb []byte
+	cr []byte
+}
+
+func newPicture(mbW int, mbH int) *picture {
+	return &picture{mbW: mbW, mbH: mbH,
+		y:  make([]byte, mbW*16*mbH*16),
+		cb: make([]byte, mbW*8*mbH*8),
+		cr: make([]byte, mbW*8*mbH*8),
+	}
+}
+
+func (p *picture) copyFrom(o *picture) {
+	copy(p.y, o.y)
+	copy(p.cb, o.cb)
+	copy(p.cr, o.cr)
+}
+
+// fill fills the rectangle in luma samples with a color
+func (p *picture) fill(x int, y int, w int, h int, c yuv) {
+	stride := p.mbW * 16
+	for j := y; j < y+h; j++ {
+		for i := x; i < x+w; i++ {
+			p.y[j*stride+i] = c.y
+		}
+	}
+
+	for j := y / 2; j < (y+h)/2; j++ {
+		for i := x / 2; i < (x+w)/2; i++ {
+			p.cb[j*stride/2+i] = c.cb
+			p.cr[j*stride/2+i] = c.cr
+		}
+	}
+}
+
+// mb appends I_PCM samples of macroblock addr to out
+func (p *picture) mb(addr int, out []byte) []byte {
+	x, y := addr%p.mbW, addr/p.mbW
+
+	stride := p.mbW * 16
+	for j := 0; j < 16; j++ {
+		off := (y*16+j)*stride + x*16
+		out = append(out, p.y[off:off+16]...)
+	}
+
+	for _, plane := range [][]byte{p.cb, p.cr} {
+		for j := 0; j < 8; j++ {
+			off := (y*8+j)*stride/2 + x*8
+			out = append(out, plane[off:off+8]...)
+		}
+	}
+
+	return out
+}
+
+// mbEqual tells if macroblock addr of p and o are the same
+func (p *picture) mbEqual(o *picture, addr int) bool {
+	x, y := addr%p.mbW, addr/p.mbW
+
+	stride := p.mbW * 16
+	for j := 0; j < 16; j++ {
+		off := (y*16+j)*stride + x*16
+		if string(p.y[off:off+16]) != string(o.y[off:off+16]) {
+			return false
+		}
+	}
+
+	for j := 0; j < 8; j++ {
+		off := (y*8+j)*stride/2 + x*8
+		if string(p.cb[off:off+8]) != string(o.cb[off:off+8]) ||
+			string(p.cr[off:off+8]) != string(o.cr[off:off+8]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// h264Enc codes pictures of width x height at fps
+type h264Enc struct {
+	width  int
+	height int
+	fps    int
+
+	mbW int
+	mbH int
+
+	frameNum int
+	idrID    int
+
+	buf []byte
+}
+
+func newH264Enc(width int, height int, fps int) *h264Enc {
+	return &h264Enc{width: width, height: height, fps: fps,
+		mbW: (width + 15) / 16, mbH: (height + 15) / 16}
+}
+
+// sps returns the SPS NAL unit
+func (e *h264Enc) sps() []byte {
+	var b bitWriter
+
+	b.u(8, 66)   // profile_idc, Baseline
+	b.u(8, 0xC0) // constraint_set0 and 1, Constrained Baseline
+	b.u(8, 40)   // level_idc
+	b.ue(0)      // seq_parameter_set_id
+	b.ue(log2MaxFrameNum - 4)
+	b.ue(2) // pic_order_cnt_type, in decoding order
+	b.ue(1) // max_num_ref_frames
+	b.u(1, 0)
+	b.ue(uint(e.mbW - 1))
+	b.ue(uint(e.mbH - 1))
+	b.u(1, 1) // frame_mbs_only_flag
+	b.u(1, 1) // direct_8x8_inference_flag
+
+	right, bottom := (e.mbW*16-e.width)/2, (e.mbH*16-e.height)/2
+	if right > 0 || bottom > 0 {
+		b.u(1, 1)
+		b.ue(0)
+		b.ue(uint(right))
+		b.ue(0)
+		b.ue(uint(bottom))
+	} else {
+		b.u(1, 0)
+	}
+
+	// VUI with timing only
+	b.u(1, 1)
+	b.u(4, 0) // aspect_ratio, overscan, video_signal_type, chroma_loc
+	b.u(1, 1) // timing_info_present_flag
+	b.u(32, 1)
+	b.u(32, uint64(2*e.fps))
+	b.u(1, 1) // fixed_frame_rate_flag
+	b.u(2, 0) // nal_hrd, vcl_hrd
+	b.u(1, 0) // pic_struct_present_flag
+	b.u(1, 0) // bitstream_restriction_flag
+
+	b.trailing()
+
+	return nalUnit(3, nalSPS, b.bytes())
+}
+
+// pps returns the PPS NAL unit
+func (e *h264Enc) pps() []byte {
+	var b bitWriter
+
+	b.ue(0)   // pic_parameter_set_id
+	b.ue(0)   // seq_parameter_set_id
+	b.u(1, 0) // entropy_coding_mode_flag, CAVLC
+	b.u(1, 0)
+	b.ue(0) // num_slice_groups_minus1
+	b.ue(0)
+	b.ue(0)
+	b.u(1, 0) // weighted_pred_flag
+	b.u(2, 0)
+	b.se(0) // pic_init_qp_minus26
+	b.se(0)
+	b.se(0)
+	b.u(1, 1) // deblocking_filter_control_present_flag
+	b.u(1, 0)
+	b.u(1, 0)
+
+	b.trailing()
+
+	return nalUnit(3, nalPPS, b.bytes())
+}
+
+// aud returns an access unit delimiter
+func aud() []byte {
+	return []byte{0, 0, 0, 1, nalAUD, 0xF0}
+}
+
+// idr codes pic as an IDR access unit, with SPS and PPS
+func (e *h264Enc) idr(pic *picture) []byte {
+
+	e.frameNum = 0
+
+	var b bitWriter
+	b.buf = e.buf[:0]
+
+	b.ue(0) // first_mb_in_slice
+	b.ue(7) // slice_type, all I
+	b.ue(0) // pic_parameter_set_id
+	b.u(log2MaxFrameNum, 0)
+	b.ue(uint(e.idrID))
+	b.u(1, 0) // no_output_of_prior_pics_flag
+	b.u(1, 0) // long_term_reference_flag
+	b.se(0)   // slice_qp_delta
+	b.ue(1)   // disable_deblocking_filter_idc
+
+	for addr := 0; addr < e.mbW*e.mbH; addr++ {
+		b.ue(mbIPCM)
+		b.align()
+		b.buf = pic.mb(addr, b.buf)
+	}
+
+	b.trailing()
+
+	e.buf = b.buf
+	e.idrID = (e.idrID + 1) % 2
+
+	out := aud()
+	out = append(out, e.sps()...)
+	out = append(out, e.pps()...)
+	return append(out, nalUnit(3, nalIDR, b.bytes())...)
+}
+
+// p codes pic as a P access unit, macroblocks not changed from
+// prev are skipped
+func (e *h264Enc) p(pic *picture, prev *picture) []byte {
+
+	e.frameNum = (e.frameNum + 1) % (1 << log2MaxFrameNum)
+
+	var b bitWriter
+	b.buf = e.buf[:0]
+
+	b.ue(0) // first_mb_in_slice
+	b.ue(5) // slice_type, all P
+	b.ue(0) // pic_parameter_set_id
+	b.u(log2MaxFrameNum, uint64(e.frameNum))
+	b.u(1, 0) // num_ref_idx_active_override_flag
+	b.u(1, 0) // ref_pic_list_modification_flag_l0
+	b.u(1, 0) // adaptive_ref_pic_marking_mode_flag
+	b.se(0)   // slice_qp_delta
+	b.ue(1)   // disable_deblocking_filter_idc
+
+	skip := 0
+	for addr := 0; addr < e.mbW*e.mbH; addr++ {
+		if pic.mbEqual(prev, addr) {
+			skip++
+			continue
+		}
+
+		b.ue(uint(skip))
+		skip = 0
+
+		b.ue(mbPIPCM)
+		b.align()
+		b.buf = pic.mb(addr, b.buf)
+	}
+
+	if skip > 0 {
+		b.ue(uint(skip))
+	}
+
+	b.trailing()
+
+	e.buf = b.buf
+
+	return append(aud(), nalUnit(2, nalSlice, b.bytes())...)
+}
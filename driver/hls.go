@@ -0,0 +1,404 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+// HLSName is the sub-card's name
+const HLSName string = "hls"
+
+// hlsSchema is the settings of HLSWorker
+var hlsSchema = Schema{
+	{Name: "Segment", Label: "分片时长(秒)", Type: FieldInt, Default: 2,
+		Min: 1, Max: 10},
+	{Name: "Window", Label: "列表分片数", Type: FieldInt, Default: 6,
+		Min: 3, Max: 30},
+}
+
+// hlsKeep is segments kept out of the playlist, for slow clients
+const hlsKeep = 3
+
+// hlsPlaylist is the name of the playlist
+const hlsPlaylist = "index.m3u8"
+
+var (
+	errHLSNotReady = errors.New("Stream not ready")
+	errHLSNotFound = errors.New("Segment not found")
+)
+
+// HLS is the main struct for sub-card, it's software only
+type HLS struct {
+	// Card Slot
+	Slot int
+
+	// Card IP
+	IP net.IP
+}
+
+// HLSWorker is the main struct for sub-card's Worker. It receives
+// MPEG-TS over RTP or UDP, cuts it to segments in memory, and
+// serves them as HLS by ServeHTTP
+type HLSWorker struct {
+	lock sync.Mutex
+
+	workerID int
+
+	card *HLS
+
+	settings map[string]interface{}
+
+	port int
+
+	// cfg is of the running worker
+	cfg  hlsCfg
+	conn *net.UDPConn
+	done chan struct{}
+
+	// segs are done, oldest first. seq is the sequence of the
+	// next segment, it goes on after restarts
+	segs []*hlsSegment
+	seq  int
+
+	received int64
+	lastRecv time.Time
+}
+
+// hlsSegment is a segment in memory
+type hlsSegment struct {
+	seq  int
+	dur  time.Duration
+	data []byte
+
+	// disc is set for the first segment after a restart
+	disc bool
+}
+
+// hlsCfg is parsed settings
+type hlsCfg struct {
+	segment time.Duration
+	window  int
+}
+
+// Open method
+func (h *HLS) Open() ([]Worker, error) {
+	return []Worker{
+		&HLSWorker{workerID: 0, card: h},
+		&HLSWorker{workerID: 1, card: h},
+	}, nil
+}
+
+// Close method
+func (h *HLS) Close() error {
+	return nil
+}
+
+// Control method
+func (w *HLSWorker) Control(c CtlCmd, arg interface{}) interface{} {
+	switch c {
+	case CtlCmdStart:
+		if err := w.start(); err != nil {
+			return err
+		}
+
+	case CtlCmdStop:
+		w.halt()
+
+	case CtlCmdName:
+		return fmt.Sprintf("%s_%d_%d", HLSName, w.card.Slot, w.workerID)
+
+	case CtlCmdIP:
+		return w.card.IP
+
+	case CtlCmdWorkerID:
+		return w.workerID
+
+	case CtlCmdSchema:
+		return hlsSchema
+
+	case CtlCmdSetting:
+		if settings, ok := arg.(map[string]interface{}); ok {
+			w.lock.Lock()
+			w.settings = settings
+			w.lock.Unlock()
+		}
+
+	default:
+	}
+	return nil
+}
+
+// Monitor method
+func (w *HLSWorker) Monitor() bool {
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	return w.conn != nil && time.Since(w.lastRecv) < recordStall
+}
+
+// Report method
+func (w *HLSWorker) Report() []string {
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	if w.conn == nil {
+		return []string{"not running"}
+	}
+
+	return []string{fmt.Sprintf("%d segments on port %d, %d bytes received",
+		len(w.segs), w.port, w.received)}
+}
+
+// Decode method
+func (w *HLSWorker) Decode(sess *Session) error {
+
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	w.port = sess.Port(StreamVideo)
+	return nil
+}
+
+// start starts receiving, it's restarted if settings changed
+func (w *HLSWorker) start() error {
+
+	w.lock.Lock()
+	cfg := hlsCfgOf(w.settings)
+	port := w.port
+	running := w.conn != nil
+	same := cfg == w.cfg
+	w.lock.Unlock()
+
+	if port == 0 {
+		return errInputError
+	}
+
+	if running && same {
+		return nil
+	}
+
+	w.halt()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	w.cfg = cfg
+	w.conn = conn
+	w.done = make(chan struct{})
+	w.received, w.lastRecv = 0, time.Now()
+	done := w.done
+	w.lock.Unlock()
+
+	comm.Info.Printf("HLS %s segmenting port %d", GetWorkerName(w), port)
+
+	go w.receive(conn, cfg, done)
+
+	return nil
+}
+
+// halt stops receiving, segments are dropped
+func (w *HLSWorker) halt() {
+	w.lock.Lock()
+	conn, done := w.conn, w.done
+	w.conn, w.done = nil, nil
+	w.lock.Unlock()
+
+	if conn != nil {
+		conn.Close()
+		<-done
+	}
+
+	w.lock.Lock()
+	w.segs = nil
+	w.lock.Unlock()
+}
+
+// receive cuts segments until conn is closed
+func (w *HLSWorker) receive(conn *net.UDPConn, cfg hlsCfg, done chan struct{}) {
+
+	defer close(done)
+
+	seg := tsSegmenter{dur: cfg.segment}
+
+	var cur *bytes.Buffer
+	var start time.Time
+	disc := true
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			// closed by halt
+			return
+		}
+
+		now := time.Now()
+
+		ts := tsOfRTP(buf[:n])
+		for ; len(ts) >= tsPacketSize; ts = ts[tsPacketSize:] {
+			pkt := ts[:tsPacketSize]
+			if pkt[0] != 0x47 {
+				continue
+			}
+
+			if seg.cut(pkt, now) {
+				if cur != nil {
+					w.push(cur.Bytes(), now.Sub(start), disc, cfg)
+					disc = false
+				}
+
+				cur = bytes.NewBuffer(seg.header())
+				start = now
+			}
+
+			if cur != nil {
+				cur.Write(pkt)
+			}
+		}
+
+		w.lock.Lock()
+		w.received += int64(n)
+		w.lastRecv = now
+		w.lock.Unlock()
+	}
+}
+
+// push adds a segment done
+func (w *HLSWorker) push(data []byte, dur time.Duration, disc bool, cfg hlsCfg) {
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	w.segs = append(w.segs, &hlsSegment{seq: w.seq, dur: dur, data: data,
+		disc: disc && w.seq > 0})
+	w.seq++
+
+	if n := len(w.segs) - cfg.window - hlsKeep; n > 0 {
+		w.segs = w.segs[n:]
+	}
+}
+
+// playlist returns the live playlist
+func (w *HLSWorker) playlist() ([]byte, error) {
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	if w.conn == nil || len(w.segs) == 0 {
+		return nil, errHLSNotReady
+	}
+
+	segs := w.segs
+	if len(segs) > w.cfg.window {
+		segs = segs[len(segs)-w.cfg.window:]
+	}
+
+	// segments are cut in 2*segment at most
+	target := int(math.Ceil(2 * w.cfg.segment.Seconds()))
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n", target)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segs[0].seq)
+	for _, s := range segs {
+		if s.disc {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%d.ts\n", s.dur.Seconds(), s.seq)
+	}
+
+	return b.Bytes(), nil
+}
+
+// segment returns segment of name
+func (w *HLSWorker) segment(name string) ([]byte, error) {
+	seq, err := strconv.Atoi(strings.TrimSuffix(name, ".ts"))
+	if err != nil || !strings.HasSuffix(name, ".ts") {
+		return nil, errHLSNotFound
+	}
+
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	for _, s := range w.segs {
+		if s.seq == seq {
+			return s.data, nil
+		}
+	}
+
+	return nil, errHLSNotFound
+}
+
+// ServeHTTP serves index.m3u8 and segments, r.URL.Path is the
+// name
+func (w *HLSWorker) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+
+	var data []byte
+	var err error
+	if name == hlsPlaylist {
+		data, err = w.playlist()
+		rw.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		rw.Header().Set("Cache-Control", "no-cache")
+	} else {
+		data, err = w.segment(name)
+		rw.Header().Set("Content-Type", "video/mp2t")
+		rw.Header().Set("Cache-Control", "max-age=60")
+	}
+
+	if err != nil {
+		rw.Header().Del("Cache-Control")
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// players are often on other origins
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.Write(data)
+}
+
+// hlsCfgOf parses settings, defaults are of hlsSchema
+func hlsCfgOf(settings map[string]interface{}) hlsCfg {
+	cfg := hlsCfg{segment: 2 * time.Second, window: 6}
+
+	if n, ok := intOf(settings["Segment"]); ok && n > 0 {
+		cfg.segment = time.Duration(n) * time.Second
+	}
+
+	if n, ok := intOf(settings["Window"]); ok && n > 0 {
+		cfg.window = n
+	}
+
+	return cfg
+}
+
+// GetWorkerHandler get Worker's HTTP handler, nil if it serves
+// nothing
+func GetWorkerHandler(w Worker) http.Handler {
+	if h, ok := w.(http.Handler); ok {
+		return h
+	}
+
+	return nil
+}
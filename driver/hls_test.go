@@ -0,0 +1,104 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHLSWorker(t *testing.T) {
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	l.Close()
+
+	card := &HLS{Slot: 37, IP: net.IPv4(127, 0, 0, 1)}
+	ws, _ := card.Open()
+	w := ws[0].(*HLSWorker)
+
+	w.Control(CtlCmdSetting, map[string]interface{}{"Segment": 1, "Window": 3})
+	w.Decode(&Session{Streams: []Stream{{Name: StreamVideo, RTP: port}}})
+	if err, ok := w.Control(CtlCmdStart, nil).(error); ok {
+		t.Fatalf("Start error = %v", err)
+	}
+	defer w.Control(CtlCmdStop, nil)
+
+	get := func(name string) (int, string) {
+		rec := httptest.NewRecorder()
+		w.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+		body, _ := ioutil.ReadAll(rec.Body)
+		return rec.Code, string(body)
+	}
+
+	if code, _ := get(hlsPlaylist); code != http.StatusNotFound {
+		t.Errorf("GET playlist = %d before segments", code)
+	}
+
+	// short GOPs, so segments are cut in time
+	src := &Pattern{Slot: 34, IP: net.IPv4(127, 0, 0, 1)}
+	srcs, _ := src.Open()
+	pw := srcs[0].(*PatternWorker)
+	pw.Control(CtlCmdSetting, map[string]interface{}{"Resolution": "320x180",
+		"BitRate": 20000})
+	pw.Encode(&Session{IP: net.IPv4(127, 0, 0, 1), Streams: []Stream{{Name: StreamVideo, RTP: port}}})
+	if err, ok := pw.Control(CtlCmdStart, nil).(error); ok {
+		t.Fatalf("Start error = %v", err)
+	}
+	defer pw.Control(CtlCmdStop, nil)
+
+	time.Sleep(2500 * time.Millisecond)
+
+	code, list := get(hlsPlaylist)
+	if code != http.StatusOK || !strings.HasPrefix(list, "#EXTM3U\n") ||
+		!strings.Contains(list, "#EXT-X-TARGETDURATION:2\n") ||
+		!strings.Contains(list, "#EXT-X-MEDIA-SEQUENCE:0\n") ||
+		strings.Contains(list, "DISCONTINUITY") {
+		t.Fatalf("GET playlist = %d\n%s", code, list)
+	}
+
+	code, seg := get("0.ts")
+	if code != http.StatusOK || len(seg)%tsPacketSize != 0 ||
+		tsPID([]byte(seg)) != pidPAT || tsPID([]byte(seg[2*tsPacketSize:])) != pidPatternVideo {
+		t.Errorf("GET 0.ts = %d of %d bytes", code, len(seg))
+	}
+
+	for _, bad := range []string{"99.ts", "0", "../0.ts"} {
+		if code, _ := get(bad); code != http.StatusNotFound {
+			t.Errorf("GET %s = %d", bad, code)
+		}
+	}
+
+	if !w.Monitor() {
+		t.Errorf("Monitor() = false, %v", w.Report())
+	}
+	if GetWorkerHandler(w) == nil || GetWorkerHandler(pw) != nil {
+		t.Errorf("GetWorkerHandler() is wrong")
+	}
+}
+
+func TestHLSWorker_pullTwo(t *testing.T) {
+	// two cards of the host, pulled on two paths at once
+	a, _ := (&HLS{Slot: 37, IP: net.IPv4(127, 0, 0, 1)}).Open()
+	b, _ := (&HLS{Slot: 40, IP: net.IPv4(127, 0, 0, 1)}).Open()
+
+	free := pullAtOnce(t, a[0], b[0])
+	defer free()
+
+	for _, w := range []Worker{a[0], b[0]} {
+		if err, ok := w.Control(CtlCmdStart, nil).(error); ok {
+			t.Errorf("Start %s error = %v", GetWorkerName(w), err)
+		}
+		defer w.Control(CtlCmdStop, nil)
+	}
+}
@@ -8,14 +8,23 @@ package driver
 import (
 	"fmt"
 	"net"
-	"os/exec"
-
-	"github.com/zhanglongx/Aqua/comm"
+	"strconv"
+	"sync"
 )
 
 // LocalDecoderName is the sub-card's name
 const LocalDecoderName string = "local_decoder"
 
+// localDecoderSchema is the settings of LocalDWorker
+var localDecoderSchema = Schema{
+	{Name: "Output", Label: "输出", Type: FieldString,
+		Pattern: `^((udp|rtp|srt|tcp|rtmp|rtsp|http|https)://\S+)?$`},
+	{Name: "OutputFormat", Label: "输出格式", Type: FieldString,
+		Pattern: `^\w*$`},
+	{Name: "Resolution", Label: "分辨率", Type: FieldString,
+		Pattern: `^(\d+x\d+)?$`},
+}
+
 // LocalD is the main struct for sub-card
 type LocalD struct {
 	// Card Slot
@@ -26,31 +35,35 @@ type LocalD struct {
 }
 
 // LocalDWorker is the main struct for sub-card's
-// Worker
+// Worker, it decodes RTP of MPEG-TS by ffmpeg
 type LocalDWorker struct {
-	workerID int
+	lock sync.Mutex
 
-	isRunning bool
+	workerID int
 
 	card *LocalD
 
-	cmd *exec.Cmd
+	proc ffmpeg
+
+	settings map[string]interface{}
 
-	port [2]int
+	port int
 }
 
 // Open method
 func (l *LocalD) Open() ([]Worker, error) {
-	return []Worker{
-		&LocalDWorker{
-			workerID: 0,
+	var all []Worker
+	for i := 0; i < 2; i++ {
+		w := &LocalDWorker{
+			workerID: i,
 			card:     l,
-		},
-		&LocalDWorker{
-			workerID: 1,
-			card:     l,
-		},
-	}, nil
+		}
+		w.proc.init(fmt.Sprintf("%s_%d_%d", LocalDecoderName, l.Slot, i))
+
+		all = append(all, w)
+	}
+
+	return all, nil
 }
 
 // Close method
@@ -62,33 +75,23 @@ func (l *LocalD) Close() error {
 func (w *LocalDWorker) Control(c CtlCmd, arg interface{}) interface{} {
 	switch c {
 	case CtlCmdStart:
-		if w.isRunning == true {
-			return nil
-		}
-
-		url := fmt.Sprintf("rtp://:%d", w.port[0])
+		w.lock.Lock()
+		args, err := decoderArgs(w.settings, w.port)
+		w.lock.Unlock()
 
-		w.cmd = exec.Command(vlcExe, url)
-		if err := w.cmd.Start(); err != nil {
-			comm.Error.Printf("run vlc failed")
+		if err != nil {
 			return err
 		}
 
-		w.isRunning = true
-
-	case CtlCmdStop:
-		if w.isRunning == false {
-			return nil
+		if err := w.proc.start(args); err != nil {
+			return err
 		}
 
-		fmt.Printf("Waiting for closing VLC manually\n")
-		if err := w.cmd.Wait(); err != nil {
-			comm.Error.Printf("vlc exit with error")
+	case CtlCmdStop:
+		if err := w.proc.stop(); err != nil {
 			return err
 		}
 
-		w.isRunning = false
-
 	case CtlCmdName:
 		return fmt.Sprintf("%s_%d_%d", LocalDecoderName,
 			w.card.Slot, w.workerID)
@@ -99,14 +102,72 @@ func (w *LocalDWorker) Control(c CtlCmd, arg interface{}) interface{} {
 	case CtlCmdWorkerID:
 		return w.workerID
 
+	case CtlCmdSchema:
+		return localDecoderSchema
+
+	case CtlCmdSetting:
+		if settings, ok := arg.(map[string]interface{}); ok {
+			w.lock.Lock()
+			w.settings = settings
+			w.lock.Unlock()
+		}
+
 	default:
 	}
 	return nil
 }
 
+// Monitor method
+func (w *LocalDWorker) Monitor() bool {
+	return w.proc.healthy()
+}
+
+// Report method
+func (w *LocalDWorker) Report() []string {
+	return w.proc.report()
+}
+
+// Logs method
+func (w *LocalDWorker) Logs() []string {
+	return w.proc.sup.Logs()
+}
+
 // Decode method
 func (w *LocalDWorker) Decode(sess *Session) error {
 
-	w.port[0] = sess.Ports[0]
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	w.port = sess.Port(StreamVideo)
 	return nil
 }
+
+// decoderArgs returns ffmpeg args to decode RTP on port by
+// settings. Without Output, it's decoded and dropped, which
+// still checks the stream
+func decoderArgs(settings map[string]interface{}, port int) ([]string, error) {
+
+	if port == 0 {
+		return nil, errInputError
+	}
+
+	args := []string{"-i", "rtp://0.0.0.0:" + strconv.Itoa(port)}
+
+	if res, _ := settings["Resolution"].(string); res != "" {
+		args = append(args, "-s", res)
+	}
+
+	output, _ := settings["Output"].(string)
+	format, _ := settings["OutputFormat"].(string)
+
+	if output == "" {
+		return append(args, "-f", "null", "-"), nil
+	}
+
+	if format != "" {
+		args = append(args, "-f", format)
+	}
+
+	return append(args, output), nil
+}
@@ -6,18 +6,37 @@
 package driver
 
 import (
+	"errors"
 	"fmt"
 	"net"
-	"os/exec"
-
-	"github.com/zhanglongx/Aqua/comm"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 // LocalEncoderName is the sub-card's name
 const LocalEncoderName string = "local_encoder"
 
-const vlcExe = "c:\\Program Files\\VideoLAN\\VLC\\vlc.exe"
-const soutTpl = "#transcode{vcodec=h264,vb=300,acodec=mpga,ab=128,channels=2,samplerate=44100,scodec=none}:rtp{dst=%s,port=%d}"
+// localEncoderSchema is the settings of LocalEWorker
+var localEncoderSchema = Schema{
+	{Name: "Input", Label: "输入源", Type: FieldString},
+	{Name: "InputFormat", Label: "输入格式", Type: FieldString,
+		Pattern: `^\w*$`},
+	{Name: "VCodec", Label: "视频编码", Type: FieldString, Default: "libx264",
+		Enum: []string{"libx264", "libx265", "mpeg2video"}},
+	{Name: "BitRate", Label: "视频码率(kbps)", Type: FieldInt, Default: 2000,
+		Min: 100, Max: 50000},
+	{Name: "Resolution", Label: "分辨率", Type: FieldString,
+		Pattern: `^(\d+x\d+)?$`},
+	{Name: "ACodec", Label: "音频编码", Type: FieldString, Default: "mp2",
+		Enum: []string{"mp2", "aac", "none"}},
+	{Name: "ABitRate", Label: "音频码率(kbps)", Type: FieldInt, Default: 128,
+		Min: 32, Max: 512},
+}
+
+var (
+	errNoInput = errors.New("Input not set")
+)
 
 // LocalE is the main struct for sub-card
 type LocalE struct {
@@ -29,32 +48,36 @@ type LocalE struct {
 }
 
 // LocalEWorker is the main struct for sub-card's
-// Worker
+// Worker, it encodes by ffmpeg to RTP of MPEG-TS
 type LocalEWorker struct {
-	workerID int
+	lock sync.Mutex
 
-	isRunning bool
+	workerID int
 
 	card *LocalE
 
-	cmd *exec.Cmd
+	proc ffmpeg
+
+	settings map[string]interface{}
 
 	dst  net.IP
-	port [2]int
+	port int
 }
 
 // Open method
 func (l *LocalE) Open() ([]Worker, error) {
-	return []Worker{
-		&LocalEWorker{
-			workerID: 0,
-			card:     l,
-		},
-		&LocalEWorker{
-			workerID: 1,
+	var all []Worker
+	for i := 0; i < 2; i++ {
+		w := &LocalEWorker{
+			workerID: i,
 			card:     l,
-		},
-	}, nil
+		}
+		w.proc.init(fmt.Sprintf("%s_%d_%d", LocalEncoderName, l.Slot, i))
+
+		all = append(all, w)
+	}
+
+	return all, nil
 }
 
 // Close method
@@ -66,35 +89,23 @@ func (l *LocalE) Close() error {
 func (w *LocalEWorker) Control(c CtlCmd, arg interface{}) interface{} {
 	switch c {
 	case CtlCmdStart:
-		if w.isRunning == true {
-			return nil
-		}
-
-		sout := fmt.Sprintf(soutTpl, w.dst, w.port[0])
+		w.lock.Lock()
+		args, err := encoderArgs(w.settings, w.dst, w.port)
+		w.lock.Unlock()
 
-		w.cmd = exec.Command(vlcExe,
-			"d:\\Streams\\D1_1M_9330.ts",
-			"--sout", sout)
-		if err := w.cmd.Start(); err != nil {
-			comm.Error.Printf("run vlc failed")
+		if err != nil {
 			return err
 		}
 
-		w.isRunning = true
-
-	case CtlCmdStop:
-		if w.isRunning == false {
-			return nil
+		if err := w.proc.start(args); err != nil {
+			return err
 		}
 
-		fmt.Printf("Waiting for closing VLC manually\n")
-		if err := w.cmd.Wait(); err != nil {
-			comm.Error.Printf("vlc exit with error")
+	case CtlCmdStop:
+		if err := w.proc.stop(); err != nil {
 			return err
 		}
 
-		w.isRunning = false
-
 	case CtlCmdName:
 		return fmt.Sprintf("%s_%d_%d", LocalEncoderName,
 			w.card.Slot, w.workerID)
@@ -105,15 +116,117 @@ func (w *LocalEWorker) Control(c CtlCmd, arg interface{}) interface{} {
 	case CtlCmdWorkerID:
 		return w.workerID
 
+	case CtlCmdSchema:
+		return localEncoderSchema
+
+	case CtlCmdSetting:
+		if settings, ok := arg.(map[string]interface{}); ok {
+			w.lock.Lock()
+			w.settings = settings
+			w.lock.Unlock()
+		}
+
 	default:
 	}
 	return nil
 }
 
-// Encode method
+// Monitor method
+func (w *LocalEWorker) Monitor() bool {
+	return w.proc.healthy()
+}
+
+// Report method
+func (w *LocalEWorker) Report() []string {
+	return w.proc.report()
+}
+
+// Logs method
+func (w *LocalEWorker) Logs() []string {
+	return w.proc.sup.Logs()
+}
+
+// Encode method, a running ffmpeg is restarted to the new
+// destination, or stopped if sess is invalid
 func (w *LocalEWorker) Encode(sess *Session) error {
 
+	w.lock.Lock()
+
+	if isInvalidSession(sess) {
+		w.dst, w.port = nil, 0
+		w.lock.Unlock()
+
+		return w.proc.stop()
+	}
+
 	w.dst = sess.IP
-	w.port[0] = sess.Ports[0]
-	return nil
+	w.port = sess.Port(StreamVideo)
+	args, err := encoderArgs(w.settings, w.dst, w.port)
+	w.lock.Unlock()
+
+	if err != nil || !w.proc.sup.Supervising() {
+		return nil
+	}
+
+	return w.proc.start(args)
+}
+
+// encoderArgs returns ffmpeg args to encode by settings, to RTP
+// dst:port. A local file is read in real time, and looped
+func encoderArgs(settings map[string]interface{}, dst net.IP, port int) ([]string, error) {
+
+	input, _ := settings["Input"].(string)
+	if input == "" {
+		return nil, errNoInput
+	}
+
+	if dst == nil || port == 0 {
+		return nil, errInputError
+	}
+
+	var args []string
+	if f, _ := settings["InputFormat"].(string); f != "" {
+		args = append(args, "-f", f)
+	} else if !strings.Contains(input, "://") {
+		args = append(args, "-re", "-stream_loop", "-1")
+	}
+
+	args = append(args, "-i", input)
+
+	vcodec, _ := settings["VCodec"].(string)
+	if vcodec == "" {
+		vcodec = "libx264"
+	}
+	args = append(args, "-c:v", vcodec)
+	if vcodec == "libx264" || vcodec == "libx265" {
+		args = append(args, "-preset", "veryfast")
+	}
+
+	if br, ok := intOf(settings["BitRate"]); ok && br > 0 {
+		k := strconv.Itoa(br) + "k"
+		args = append(args, "-b:v", k, "-maxrate", k,
+			"-bufsize", strconv.Itoa(2*br)+"k")
+	}
+
+	if res, _ := settings["Resolution"].(string); res != "" {
+		args = append(args, "-s", res)
+	}
+
+	switch acodec, _ := settings["ACodec"].(string); acodec {
+	case "none":
+		args = append(args, "-an")
+	default:
+		if acodec == "" {
+			acodec = "mp2"
+		}
+		args = append(args, "-c:a", acodec)
+		if br, ok := intOf(settings["ABitRate"]); ok && br > 0 {
+			args = append(args, "-b:a", strconv.Itoa(br)+"k")
+		}
+	}
+
+	args = append(args, "-f", "rtp_mpegts",
+		fmt.Sprintf("rtp://%s", net.JoinHostPort(dst.String(), strconv.Itoa(port))))
+
+	return args, nil
 }
@@ -0,0 +1,63 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics of driver, registered to prometheus default registry
+var (
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "aqua",
+		Subsystem: "driver",
+		Name:      "rpc_duration_seconds",
+		Help:      "Latency of RPC calls to cards, by method.",
+	}, []string{"method"})
+
+	rpcErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "aqua",
+		Subsystem: "driver",
+		Name:      "rpc_errors_total",
+		Help:      "Failed RPC calls to cards, by method.",
+	}, []string{"method"})
+
+	transitForwards = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "aqua",
+		Subsystem: "transit",
+		Name:      "forwards_total",
+		Help:      "UDP forwards added or deleted in transit, by op.",
+	}, []string{"op"})
+
+	transitActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "aqua",
+		Subsystem: "transit",
+		Name:      "forwards_active",
+		Help:      "UDP forwards currently in transit.",
+	})
+
+	processRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "aqua",
+		Subsystem: "driver",
+		Name:      "process_restarts_total",
+		Help:      "Restarts of supervised processes, by worker.",
+	}, []string{"worker"})
+)
+
+func init() {
+	prometheus.MustRegister(rpcDuration, rpcErrors,
+		transitForwards, transitActive, processRestarts)
+}
+
+// observeRPC records one RPC call
+func observeRPC(method string, start time.Time, err error) {
+	rpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		rpcErrors.WithLabelValues(method).Inc()
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+// A constant bitrate MPEG-TS muxer of one program
+
+// tsPacketSize is the size of a TS packet
+const tsPacketSize = 188
+
+// PIDs and stream types
+const (
+	pidPAT  = 0x0000
+	pidPMT  = 0x1000
+	pidNull = 0x1FFF
+
+	streamH264    = 0x1B
+	streamPrivate = 0x06
+)
+
+// PES stream ids
+const (
+	pesVideo    = 0xE0
+	pesPrivate1 = 0xBD
+)
+
+// intervals of tsMux, in 27MHz
+const (
+	tsPCRInterval = 27000000 / 50
+	tsPSIInterval = 27000000 / 10
+)
+
+// tsStream is an elementary stream of tsMux
+type tsStream struct {
+	pid  uint16
+	typ  byte
+	desc []byte
+
+	cc byte
+
+	// queued PES packets, sent in order
+	queue [][]byte
+	off   int
+
+	// rai marks random access for queue
+	rai []bool
+}
+
+// tsMux muxes streams at rate bits/s, null packets are stuffed.
+// The stream with the least bytes pending is sent first, so small
+// audio is not blocked by big pictures. PCR is on the first stream
+type tsMux struct {
+	rate int
+
+	streams []*tsStream
+
+	ccPAT byte
+	ccPMT byte
+
+	// n is the number of packets muxed
+	n int64
+
+	lastPCR int64
+	lastPSI int64
+
+	// pmtNext is set after PAT
+	pmtNext bool
+}
+
+func newTSMux(rate int, streams ...*tsStream) *tsMux {
+	return &tsMux{rate: rate, streams: streams,
+		lastPCR: -tsPCRInterval, lastPSI: -tsPSIInterval}
+}
+
+// clock returns the time of packet n in 27MHz
+func (m *tsMux) clock(n int64) int64 {
+	return n * tsPacketSize * 8 * 27000000 / int64(m.rate)
+}
+
+// now returns the time of the next packet in 27MHz
+func (m *tsMux) now() int64 {
+	return m.clock(m.n)
+}
+
+// put queues a PES packet to s, rai marks random access
+func (m *tsMux) put(s *tsStream, pes []byte, rai bool) {
+	s.queue = append(s.queue, pes)
+	s.rai = append(s.rai, rai)
+}
+
+// pending returns bytes not muxed of s
+func (s *tsStream) pending() int {
+	all := -s.off
+	for _, p := range s.queue {
+		all += len(p)
+	}
+
+	return all
+}
+
+// packet returns the next TS packet
+func (m *tsMux) packet() []byte {
+
+	now := m.now()
+	m.n++
+
+	if now-m.lastPSI >= tsPSIInterval {
+		m.lastPSI, m.pmtNext = now, true
+		return m.psi(pidPAT, &m.ccPAT, m.pat())
+	}
+
+	if m.pmtNext {
+		m.pmtNext = false
+		return m.psi(pidPMT, &m.ccPMT, m.pmt())
+	}
+
+	first := m.streams[0]
+	if now-m.lastPCR >= tsPCRInterval {
+		m.lastPCR = now
+		if len(first.queue) > 0 {
+			return m.pes(first, true, now)
+		}
+		return m.pcrOnly(first, now)
+	}
+
+	var next *tsStream
+	for _, s := range m.streams {
+		if len(s.queue) > 0 && (next == nil || s.pending() < next.pending()) {
+			next = s
+		}
+	}
+
+	if next != nil {
+		return m.pes(next, false, now)
+	}
+
+	return nullPacket()
+}
+
+// header writes a TS header to p
+func tsHeader(p []byte, pid uint16, pusi bool, afc byte, cc byte) {
+	p[0] = 0x47
+	p[1] = byte(pid >> 8 & 0x1F)
+	if pusi {
+		p[1] |= 0x40
+	}
+	p[2] = byte(pid)
+	p[3] = afc<<4 | cc&0x0F
+}
+
+// pcrBytes writes pcr in 27MHz to p
+func pcrBytes(p []byte, pcr int64) {
+	base, ext := (pcr/300)&(1<<33-1), pcr%300
+
+	p[0] = byte(base >> 25)
+	p[1] = byte(base >> 17)
+	p[2] = byte(base >> 9)
+	p[3] = byte(base >> 1)
+	p[4] = byte(base&1)<<7 | 0x7E | byte(ext>>8)
+	p[5] = byte(ext)
+}
+
+// pes returns a packet of the queued PES of s
+func (m *tsMux) pes(s *tsStream, pcr bool, now int64) []byte {
+
+	p := make([]byte, tsPacketSize)
+
+	data := s.queue[0][s.off:]
+	start := s.off == 0
+	rai := start && s.rai[0]
+
+	// adaptation field without stuffing, the rest is stuffed
+	af := 0
+	if pcr || rai {
+		af = 2
+		if pcr {
+			af = 8
+		}
+	}
+
+	n := len(data)
+	if n > tsPacketSize-4-af {
+		n = tsPacketSize - 4 - af
+	}
+	af = tsPacketSize - 4 - n
+
+	afc := byte(1)
+	if af > 0 {
+		afc = 3
+	}
+
+	tsHeader(p, s.pid, start, afc, s.cc)
+	s.cc = (s.cc + 1) & 0x0F
+
+	if af > 0 {
+		m.adaptation(p[4:4+af], pcr, rai, now)
+	}
+
+	copy(p[4+af:], data[:n])
+
+	if s.off += n; s.off == len(s.queue[0]) {
+		s.queue, s.rai, s.off = s.queue[1:], s.rai[1:], 0
+	}
+
+	return p
+}
+
+// adaptation writes an adaptation field of len(p) to p
+func (m *tsMux) adaptation(p []byte, pcr bool, rai bool, now int64) {
+	p[0] = byte(len(p) - 1)
+	if len(p) == 1 {
+		return
+	}
+
+	p[1] = 0
+	i := 2
+	if rai {
+		p[1] |= 0x40
+	}
+	if pcr {
+		p[1] |= 0x10
+		pcrBytes(p[2:8], now)
+		i = 8
+	}
+
+	for ; i < len(p); i++ {
+		p[i] = 0xFF
+	}
+}
+
+// pcrOnly returns a packet of s with PCR only
+func (m *tsMux) pcrOnly(s *tsStream, now int64) []byte {
+	p := make([]byte, tsPacketSize)
+
+	// no payload, cc is not incremented
+	tsHeader(p, s.pid, false, 2, (s.cc-1)&0x0F)
+	m.adaptation(p[4:], true, false, now)
+
+	return p
+}
+
+func nullPacket() []byte {
+	p := make([]byte, tsPacketSize)
+	tsHeader(p, pidNull, false, 1, 0)
+	for i := 4; i < tsPacketSize; i++ {
+		p[i] = 0xFF
+	}
+
+	return p
+}
+
+// psi returns a packet of section on pid
+func (m *tsMux) psi(pid uint16, cc *byte, section []byte) []byte {
+	p := make([]byte, tsPacketSize)
+
+	tsHeader(p, pid, true, 1, *cc)
+	*cc = (*cc + 1) & 0x0F
+
+	p[4] = 0 // pointer_field
+	n := copy(p[5:], section)
+	for i := 5 + n; i < tsPacketSize; i++ {
+		p[i] = 0xFF
+	}
+
+	return p
+}
+
+// section returns a PSI section of table with body
+func section(table byte, id uint16, body []byte) []byte {
+	length := 5 + len(body) + 4
+
+	s := []byte{table, 0xB0 | byte(length>>8), byte(length),
+		byte(id >> 8), byte(id), 0xC1, 0, 0}
+	s = append(s, body...)
+
+	crc := crc32MPEG(s)
+	return append(s, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+func (m *tsMux) pat() []byte {
+	return section(0x00, 1, []byte{0, 1, 0xE0 | pidPMT>>8, pidPMT & 0xFF})
+}
+
+func (m *tsMux) pmt() []byte {
+	pcrPID := m.streams[0].pid
+
+	body := []byte{0xE0 | byte(pcrPID>>8), byte(pcrPID), 0xF0, 0}
+	for _, s := range m.streams {
+		body = append(body, s.typ, 0xE0|byte(s.pid>>8), byte(s.pid),
+			0xF0|byte(len(s.desc)>>8), byte(len(s.desc)))
+		body = append(body, s.desc...)
+	}
+
+	return section(0x02, 1, body)
+}
+
+// pesPacket returns a PES packet with PTS in 90kHz. Length is 0
+// for video, which may be too long
+func pesPacket(id byte, pts int64, data []byte) []byte {
+	length := 0
+	if id != pesVideo {
+		length = 3 + 5 + len(data)
+	}
+
+	pts &= 1<<33 - 1
+
+	p := make([]byte, 0, 14+len(data))
+	p = append(p, 0, 0, 1, id, byte(length>>8), byte(length),
+		0x84, 0x80, 5,
+		0x21|byte(pts>>29)&0x0E,
+		byte(pts>>22),
+		byte(pts>>14)|1,
+		byte(pts>>7),
+		byte(pts<<1)|1)
+
+	return append(p, data...)
+}
+
+// crc32MPEG is the CRC of MPEG-2 sections
+func crc32MPEG(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
@@ -0,0 +1,600 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+// PatternName is the sub-card's name
+const PatternName string = "pattern"
+
+// patternSchema is the settings of PatternWorker
+var patternSchema = Schema{
+	{Name: "BitRate", Label: "码率(kbps)", Type: FieldInt, Default: 6000,
+		Min: 1000, Max: 100000},
+	{Name: "Resolution", Label: "分辨率", Type: FieldString, Default: "640x360",
+		Pattern: `^\d+x\d+$`},
+	{Name: "FrameRate", Label: "帧率", Type: FieldInt, Default: 25,
+		Min: 1, Max: 60},
+	{Name: "Tone", Label: "测试音", Type: FieldBool, Default: true},
+}
+
+// PIDs of the test pattern
+const (
+	pidPatternVideo = 0x100
+	pidPatternAudio = 0x101
+)
+
+// tsPerRTP is TS packets in one RTP packet
+const tsPerRTP = 7
+
+// maxGOP is the longest GOP in seconds, a lower BitRate fails
+const maxGOP = 10
+
+var (
+	errPatternResolution = errors.New("Bad resolution")
+	errPatternBitRate    = errors.New("BitRate too low for resolution")
+)
+
+// 75% color bars, and others in BT.601
+type yuv struct{ y, cb, cr byte }
+
+var (
+	colorBars = []yuv{
+		{180, 128, 128}, // white
+		{162, 44, 142},  // yellow
+		{131, 156, 44},  // cyan
+		{112, 72, 58},   // green
+		{84, 184, 198},  // magenta
+		{65, 100, 212},  // red
+		{35, 212, 114},  // blue
+	}
+
+	colorBlack = yuv{16, 128, 128}
+	colorWhite = yuv{235, 128, 128}
+)
+
+// font8x8 has glyphs of timestamps, bit 0 is the left pixel
+var font8x8 = map[rune][8]byte{
+	'0': {0x3E, 0x63, 0x73, 0x7B, 0x6F, 0x67, 0x3E, 0x00},
+	'1': {0x0C, 0x0E, 0x0C, 0x0C, 0x0C, 0x0C, 0x3F, 0x00},
+	'2': {0x1E, 0x33, 0x30, 0x1C, 0x06, 0x33, 0x3F, 0x00},
+	'3': {0x1E, 0x33, 0x30, 0x1C, 0x30, 0x33, 0x1E, 0x00},
+	'4': {0x38, 0x3C, 0x36, 0x33, 0x7F, 0x30, 0x78, 0x00},
+	'5': {0x3F, 0x03, 0x1F, 0x30, 0x30, 0x33, 0x1E, 0x00},
+	'6': {0x1C, 0x06, 0x03, 0x1F, 0x33, 0x33, 0x1E, 0x00},
+	'7': {0x3F, 0x33, 0x30, 0x18, 0x0C, 0x0C, 0x0C, 0x00},
+	'8': {0x1E, 0x33, 0x33, 0x1E, 0x33, 0x33, 0x1E, 0x00},
+	'9': {0x1E, 0x33, 0x33, 0x3E, 0x30, 0x18, 0x0E, 0x00},
+	':': {0x00, 0x0C, 0x0C, 0x00, 0x00, 0x0C, 0x0C, 0x00},
+	'-': {0x00, 0x00, 0x00, 0x3F, 0x00, 0x00, 0x00, 0x00},
+	'.': {0x00, 0x00, 0x00, 0x00, 0x00, 0x0C, 0x0C, 0x00},
+}
+
+// Pattern is the main struct for sub-card, it's software only
+type Pattern struct {
+	// Card Slot
+	Slot int
+
+	// Card IP
+	IP net.IP
+}
+
+// PatternWorker is the main struct for sub-card's Worker. It
+// sends a test pattern of color bars, a moving box, a frame
+// counter and the wall clock, with a 1kHz tone, in MPEG-TS over
+// RTP
+type PatternWorker struct {
+	lock sync.Mutex
+
+	workerID int
+
+	card *Pattern
+
+	settings map[string]interface{}
+
+	dst  net.IP
+	port int
+
+	// cfg and addr are of the running stream
+	cfg  patternCfg
+	addr string
+	stop chan struct{}
+	done chan struct{}
+
+	// stats of the running stream
+	sent    int64
+	lastErr error
+	lagging bool
+}
+
+// patternCfg is parsed settings
+type patternCfg struct {
+	width  int
+	height int
+	fps    int
+
+	// rate is in bits/s
+	rate int
+	tone bool
+}
+
+// Open method
+func (p *Pattern) Open() ([]Worker, error) {
+	return []Worker{
+		&PatternWorker{workerID: 0, card: p},
+		&PatternWorker{workerID: 1, card: p},
+	}, nil
+}
+
+// Close method
+func (p *Pattern) Close() error {
+	return nil
+}
+
+// Control method
+func (w *PatternWorker) Control(c CtlCmd, arg interface{}) interface{} {
+	switch c {
+	case CtlCmdStart:
+		if err := w.start(); err != nil {
+			return err
+		}
+
+	case CtlCmdStop:
+		w.halt()
+
+	case CtlCmdName:
+		return fmt.Sprintf("%s_%d_%d", PatternName, w.card.Slot, w.workerID)
+
+	case CtlCmdIP:
+		return w.card.IP
+
+	case CtlCmdWorkerID:
+		return w.workerID
+
+	case CtlCmdSchema:
+		return patternSchema
+
+	case CtlCmdSetting:
+		if settings, ok := arg.(map[string]interface{}); ok {
+			w.lock.Lock()
+			w.settings = settings
+			w.lock.Unlock()
+		}
+
+	default:
+	}
+	return nil
+}
+
+// Monitor method
+func (w *PatternWorker) Monitor() bool {
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	return w.stop != nil && w.lastErr == nil && !w.lagging
+}
+
+// Report method
+func (w *PatternWorker) Report() []string {
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	if w.stop == nil {
+		return []string{"not running"}
+	}
+
+	all := []string{fmt.Sprintf("%dx%d@%d %dkbps to %s, %d packets sent",
+		w.cfg.width, w.cfg.height, w.cfg.fps, w.cfg.rate/1000, w.addr, w.sent)}
+	if w.lastErr != nil {
+		all = append(all, "error: "+w.lastErr.Error())
+	}
+	if w.lagging {
+		all = append(all, "lagging behind real time")
+	}
+
+	return all
+}
+
+// Encode method, a running stream is restarted to the new
+// destination, or stopped if sess is invalid
+func (w *PatternWorker) Encode(sess *Session) error {
+
+	w.lock.Lock()
+	if isInvalidSession(sess) {
+		w.dst, w.port = nil, 0
+	} else {
+		w.dst = sess.IP
+		w.port = sess.Port(StreamVideo)
+	}
+	running := w.stop != nil
+	w.lock.Unlock()
+
+	if !running {
+		return nil
+	}
+
+	if isInvalidSession(sess) {
+		w.halt()
+		return nil
+	}
+
+	return w.start()
+}
+
+// start starts sending, it's restarted if settings or the
+// destination changed
+func (w *PatternWorker) start() error {
+
+	w.lock.Lock()
+	cfg, err := patternCfgOf(w.settings)
+	dst, port := w.dst, w.port
+	running := w.stop != nil
+	same := cfg == w.cfg && w.addr == net.JoinHostPort(dst.String(), strconv.Itoa(port))
+	w.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if dst == nil || port == 0 {
+		return errInputError
+	}
+
+	if running && same {
+		return nil
+	}
+
+	w.halt()
+
+	st, err := newPatternStream(cfg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(dst.String(), strconv.Itoa(port))
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	w.cfg = cfg
+	w.addr = addr
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	w.sent, w.lastErr, w.lagging = 0, nil, false
+	stop, done := w.stop, w.done
+	w.lock.Unlock()
+
+	comm.Info.Printf("Pattern %s sending %dx%d@%d GOP %d to %s",
+		GetWorkerName(w), cfg.width, cfg.height, cfg.fps, st.gop, addr)
+
+	go w.send(conn, st, stop, done)
+
+	return nil
+}
+
+// halt stops sending
+func (w *PatternWorker) halt() {
+	w.lock.Lock()
+	stop, done := w.stop, w.done
+	w.stop, w.done = nil, nil
+	w.lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// send sends st in real time until stop
+func (w *PatternWorker) send(conn net.Conn, st *patternStream,
+	stop chan struct{}, done chan struct{}) {
+
+	defer close(done)
+	defer conn.Close()
+
+	rtp := newRTPPacketizer()
+	start := time.Now()
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		var ts [][]byte
+		for i := 0; i < tsPerRTP; i++ {
+			ts = append(ts, st.next())
+		}
+
+		at := st.mux.clock(st.mux.n - tsPerRTP)
+		due := start.Add(time.Duration(at * 1000 / 27))
+
+		// sleep only when ahead, timers are coarse
+		ahead := time.Until(due)
+		if ahead > 2*time.Millisecond {
+			time.Sleep(ahead)
+		}
+
+		_, err := conn.Write(rtp.packet(at/300, ts))
+
+		w.lock.Lock()
+		w.sent++
+		w.lastErr = err
+		w.lagging = ahead < -time.Second
+		w.lock.Unlock()
+	}
+}
+
+// patternCfgOf parses settings, defaults are of patternSchema
+func patternCfgOf(settings map[string]interface{}) (patternCfg, error) {
+	cfg := patternCfg{width: 640, height: 360, fps: 25, rate: 6000000, tone: true}
+
+	if res, _ := settings["Resolution"].(string); res != "" {
+		var err error
+		wh := strings.SplitN(res, "x", 2)
+		if len(wh) != 2 {
+			return cfg, errPatternResolution
+		}
+		if cfg.width, err = strconv.Atoi(wh[0]); err != nil {
+			return cfg, errPatternResolution
+		}
+		if cfg.height, err = strconv.Atoi(wh[1]); err != nil {
+			return cfg, errPatternResolution
+		}
+	}
+
+	if cfg.width < 64 || cfg.height < 64 || cfg.width > 1920 || cfg.height > 1088 ||
+		cfg.width%2 != 0 || cfg.height%2 != 0 {
+		return cfg, errPatternResolution
+	}
+
+	if fps, ok := intOf(settings["FrameRate"]); ok && fps > 0 {
+		cfg.fps = fps
+	}
+
+	if br, ok := intOf(settings["BitRate"]); ok && br > 0 {
+		cfg.rate = br * 1000
+	}
+
+	if t, ok := settings["Tone"].(bool); ok {
+		cfg.tone = t
+	}
+
+	return cfg, nil
+}
+
+// patternStream generates the TS of a test pattern. Pictures and
+// audio are generated as the mux clock goes
+type patternStream struct {
+	cfg patternCfg
+
+	// start is the wall clock of the stream
+	start time.Time
+
+	enc *h264Enc
+
+	bg   *picture
+	prev *picture
+	cur  *picture
+
+	mux   *tsMux
+	video *tsStream
+	audio *tsStream
+
+	// gop is pictures between IDRs, delay is PTS after the mux
+	// clock, in 27MHz
+	gop   int
+	delay int64
+
+	frames  int64
+	samples int64
+}
+
+func newPatternStream(cfg patternCfg, start time.Time) (*patternStream, error) {
+
+	st := &patternStream{cfg: cfg, start: start,
+		enc: newH264Enc(cfg.width, cfg.height, cfg.fps)}
+
+	st.bg = newPicture(st.enc.mbW, st.enc.mbH)
+	st.prev = newPicture(st.enc.mbW, st.enc.mbH)
+	st.cur = newPicture(st.enc.mbW, st.enc.mbH)
+	st.drawBars()
+
+	// budget of video, after audio and overhead
+	budget := float64(cfg.rate) * 0.85
+	if cfg.tone {
+		budget -= audioRate * 5 * 8 * 1.05
+	}
+
+	// an IDR, and changes of a P picture, in bits
+	idr := float64(st.enc.mbW*st.enc.mbH*(mbBytes+1)) * 8
+	p := float64(6*(mbBytes+1)) * 8
+
+	spare := budget/float64(cfg.fps) - p
+	if spare <= 0 {
+		return nil, errPatternBitRate
+	}
+
+	st.gop = int(idr/spare) + 1
+	if st.gop > maxGOP*cfg.fps {
+		return nil, errPatternBitRate
+	}
+
+	// an IDR is sent in time
+	st.delay = int64(idr/budget*27000000) + 27000000/5
+
+	st.video = &tsStream{pid: pidPatternVideo, typ: streamH264}
+	st.audio = &tsStream{pid: pidPatternAudio, typ: streamPrivate,
+		desc: s302mRegistration}
+
+	streams := []*tsStream{st.video}
+	if cfg.tone {
+		streams = append(streams, st.audio)
+	}
+
+	st.mux = newTSMux(cfg.rate, streams...)
+
+	return st, nil
+}
+
+// next returns the next TS packet
+func (st *patternStream) next() []byte {
+	now := st.mux.now()
+
+	for st.frames*27000000/int64(st.cfg.fps) <= now {
+		st.picture()
+	}
+
+	for st.cfg.tone && st.samples*27000000/audioRate <= now {
+		st.tone()
+	}
+
+	return st.mux.packet()
+}
+
+// picture generates the next picture
+func (st *patternStream) picture() {
+	at := st.frames * 27000000 / int64(st.cfg.fps)
+
+	st.cur.copyFrom(st.bg)
+	st.drawDynamic(st.frames)
+
+	var au []byte
+	idr := st.frames%int64(st.gop) == 0
+	if idr {
+		au = st.enc.idr(st.cur)
+	} else {
+		au = st.enc.p(st.cur, st.prev)
+	}
+
+	st.mux.put(st.video, pesPacket(pesVideo, (at+st.delay)/300, au), idr)
+
+	st.prev, st.cur = st.cur, st.prev
+	st.frames++
+}
+
+// tone generates the next audio frame
+func (st *patternStream) tone() {
+	at := st.samples * 27000000 / audioRate
+
+	frame := s302m(tone(st.samples, audioFrame), st.samples)
+	st.mux.put(st.audio, pesPacket(pesPrivate1, (at+st.delay)/300, frame), false)
+
+	st.samples += audioFrame
+}
+
+// drawBars draws the background, bars on the top 2/3
+func (st *patternStream) drawBars() {
+	w, h := st.bg.mbW*16, st.bg.mbH*16
+	barH := st.cfg.height * 2 / 3 &^ 1
+
+	st.bg.fill(0, 0, w, h, colorBlack)
+	for i, c := range colorBars {
+		x0 := st.cfg.width * i / len(colorBars) &^ 1
+		x1 := st.cfg.width * (i + 1) / len(colorBars) &^ 1
+		if i == len(colorBars)-1 {
+			x1 = w
+		}
+		st.bg.fill(x0, 0, x1-x0, barH, c)
+	}
+}
+
+// drawDynamic draws the moving box, frame counter as timecode,
+// and wall clock of picture n. Glyphs are 16x16, each is one
+// macroblock
+func (st *patternStream) drawDynamic(n int64) {
+	mbW, mbH := st.cur.mbW, st.cur.mbH
+
+	// a box moves one macroblock a picture, below the bars
+	if row := (st.cfg.height*2/3 + 15) / 16; row < mbH-3 {
+		col := int(n % int64(mbW))
+		st.cur.fill(col*16, row*16, 16, 16, colorWhite)
+	}
+
+	fps := int64(st.cfg.fps)
+	secs := n / fps
+	tc := fmt.Sprintf("%02d:%02d:%02d:%02d", secs/3600%24, secs/60%60, secs%60, n%fps)
+
+	wall := st.start.Add(time.Duration(n) * time.Second / time.Duration(fps))
+
+	st.drawText(1, mbH-3, tc)
+	st.drawText(1, mbH-2, wall.Format("2006-01-02 15:04:05"))
+}
+
+// drawText draws s at macroblock col, row, clipped
+func (st *patternStream) drawText(col int, row int, s string) {
+	if row < 0 {
+		return
+	}
+
+	stride := st.cur.mbW * 16
+	for i, r := range s {
+		x := (col + i) * 16
+		if x+16 > st.cur.mbW*16 {
+			return
+		}
+
+		glyph, ok := font8x8[r]
+		if !ok {
+			continue
+		}
+
+		for j := 0; j < 16; j++ {
+			bits := glyph[j/2]
+			for k := 0; k < 16; k++ {
+				if bits>>(uint(k)/2)&1 != 0 {
+					st.cur.y[(row*16+j)*stride+x+k] = colorWhite.y
+				}
+			}
+		}
+	}
+}
+
+// rtpPacketizer packs TS in RTP, RFC 2250
+type rtpPacketizer struct {
+	seq  uint16
+	ssrc uint32
+}
+
+func newRTPPacketizer() *rtpPacketizer {
+	return &rtpPacketizer{seq: uint16(rand.Uint32()), ssrc: rand.Uint32()}
+}
+
+// packet returns an RTP packet of ts at ts90k in 90kHz
+func (r *rtpPacketizer) packet(ts90k int64, ts [][]byte) []byte {
+	p := make([]byte, 12, 12+len(ts)*tsPacketSize)
+
+	p[0] = 0x80
+	p[1] = 33 // MP2T
+	binary.BigEndian.PutUint16(p[2:], r.seq)
+	binary.BigEndian.PutUint32(p[4:], uint32(ts90k))
+	binary.BigEndian.PutUint32(p[8:], r.ssrc)
+
+	r.seq++
+
+	for _, t := range ts {
+		p = append(p, t...)
+	}
+
+	return p
+}
@@ -0,0 +1,338 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// bitReader reads what bitWriter writes
+type bitReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *bitReader) u(n int) uint64 {
+	var v uint64
+	for i := 0; i < n; i++ {
+		v = v<<1 | uint64(r.buf[r.pos/8]>>(7-uint(r.pos%8))&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) ue() int {
+	zeros := 0
+	for r.u(1) == 0 {
+		zeros++
+	}
+	return int(1<<uint(zeros) - 1 + r.u(zeros))
+}
+
+func (r *bitReader) se() int {
+	k := r.ue()
+	if k%2 == 1 {
+		return (k + 1) / 2
+	}
+	return -k / 2
+}
+
+// moreData is more_rbsp_data()
+func (r *bitReader) moreData() bool {
+	last := len(r.buf)*8 - 1
+	for last >= 0 && r.buf[last/8]>>(7-uint(last%8))&1 == 0 {
+		last--
+	}
+	return r.pos < last
+}
+
+func unescape(nal []byte) []byte {
+	var out []byte
+	zeros := 0
+	for _, c := range nal {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// splitNALs splits an Annex B access unit
+func splitNALs(au []byte) [][]byte {
+	var all [][]byte
+	for _, p := range bytes.Split(au, []byte{0, 0, 1}) {
+		p = bytes.TrimRight(p, "\x00")
+		if len(p) > 0 {
+			all = append(all, p)
+		}
+	}
+	return all
+}
+
+func Test_bitWriter(t *testing.T) {
+	var w bitWriter
+	for _, v := range []uint{0, 1, 2, 7, 30, 1000} {
+		w.ue(v)
+	}
+	for _, v := range []int{0, 1, -1, 5, -26} {
+		w.se(v)
+	}
+	w.trailing()
+
+	r := bitReader{buf: w.bytes()}
+	for _, v := range []int{0, 1, 2, 7, 30, 1000} {
+		if got := r.ue(); got != v {
+			t.Errorf("ue() = %d, want %d", got, v)
+		}
+	}
+	for _, v := range []int{0, 1, -1, 5, -26} {
+		if got := r.se(); got != v {
+			t.Errorf("se() = %d, want %d", got, v)
+		}
+	}
+	if r.moreData() {
+		t.Errorf("moreData() at trailing bits")
+	}
+
+	got := nalUnit(0, 1, []byte{0, 0, 0, 0, 1, 0, 0, 3})
+	want := []byte{0, 0, 0, 1, 1, 0, 0, 3, 0, 0, 3, 1, 0, 0, 3, 3}
+	if !bytes.Equal(got, want) {
+		t.Errorf("nalUnit() = %x", got)
+	}
+}
+
+// walkSlice checks slice syntax of a picture of mbs, it returns
+// coded macroblocks
+func walkSlice(t *testing.T, nal []byte, mbs int) int {
+	r := bitReader{buf: unescape(nal[1:])}
+
+	idr := nal[0]&0x1F == nalIDR
+
+	r.ue() // first_mb_in_slice
+	typ := r.ue()
+	r.ue()
+	r.u(log2MaxFrameNum)
+	if idr {
+		r.ue()
+		r.u(2)
+	} else {
+		r.u(3)
+	}
+	if qp := r.se(); qp != 0 {
+		t.Errorf("slice_qp_delta = %d", qp)
+	}
+	if d := r.ue(); d != 1 {
+		t.Errorf("disable_deblocking_filter_idc = %d", d)
+	}
+
+	coded, addr := 0, 0
+	for addr < mbs {
+		if typ == 5 {
+			run := r.ue()
+			if addr += run; addr >= mbs {
+				break
+			}
+		}
+
+		mbType := r.ue()
+		if (typ == 7 && mbType != mbIPCM) || (typ == 5 && mbType != mbPIPCM) {
+			t.Fatalf("mb %d type = %d", addr, mbType)
+		}
+		r.pos = (r.pos + 7) / 8 * 8
+		r.pos += mbBytes * 8
+
+		coded++
+		addr++
+	}
+
+	if addr != mbs || r.moreData() {
+		t.Errorf("slice ends at mb %d bit %d of %d", addr, r.pos, len(r.buf)*8)
+	}
+
+	return coded
+}
+
+func TestPatternStream(t *testing.T) {
+	cfg, err := patternCfgOf(map[string]interface{}{"Resolution": "320x180",
+		"BitRate": 4000, "FrameRate": 25})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := newPatternStream(cfg, time.Date(2020, 6, 1, 8, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 seconds
+	var pes = map[uint16][][]byte{}
+	cc := map[uint16]byte{}
+	pcrs := 0
+	for st.mux.now() < 2*27000000 {
+		p := st.next()
+		if len(p) != tsPacketSize || p[0] != 0x47 {
+			t.Fatalf("bad packet %x", p[:4])
+		}
+
+		pid := uint16(p[1]&0x1F)<<8 | uint16(p[2])
+		afc := p[3] >> 4 & 3
+
+		payload := p[4:]
+		if afc&2 != 0 {
+			if payload[0] > 0 && payload[1]&0x10 != 0 {
+				pcrs++
+			}
+			payload = payload[1+payload[0]:]
+		}
+
+		if afc&1 == 0 || pid == pidNull {
+			continue
+		}
+
+		if last, ok := cc[pid]; ok && p[3]&0x0F != (last+1)&0x0F {
+			t.Errorf("pid %x cc %d after %d", pid, p[3]&0x0F, last)
+		}
+		cc[pid] = p[3] & 0x0F
+
+		switch pid {
+		case pidPAT, pidPMT:
+			sec := payload[1:]
+			n := int(sec[1]&0x0F)<<8 | int(sec[2])
+			if crc32MPEG(sec[:3+n]) != 0 {
+				t.Errorf("pid %x bad CRC", pid)
+			}
+			if pid == pidPMT && !bytes.Contains(sec, []byte("BSSD")) {
+				t.Errorf("PMT has no 302M")
+			}
+
+		default:
+			if p[1]&0x40 != 0 {
+				pes[pid] = append(pes[pid], nil)
+			}
+			if l := len(pes[pid]); l > 0 {
+				pes[pid][l-1] = append(pes[pid][l-1], payload...)
+			}
+		}
+	}
+
+	// the last PES may be cut
+	for pid := range pes {
+		pes[pid] = pes[pid][:len(pes[pid])-1]
+	}
+
+	if pcrs < 90 {
+		t.Errorf("%d PCR in 2s", pcrs)
+	}
+
+	// 302M of 1920 samples
+	if n := len(pes[pidPatternAudio]); n < 45 {
+		t.Errorf("%d audio PES", n)
+	}
+	for _, a := range pes[pidPatternAudio] {
+		if len(a) != 14+4+audioFrame*5 || a[3] != pesPrivate1 {
+			t.Fatalf("audio PES %d bytes", len(a))
+		}
+	}
+
+	mbs := st.enc.mbW * st.enc.mbH
+	for i, v := range pes[pidPatternVideo] {
+		nals := splitNALs(v[14:])
+		if nals[0][0] != nalAUD {
+			t.Fatalf("picture %d no AUD", i)
+		}
+
+		slice := nals[len(nals)-1]
+		if i%st.gop == 0 {
+			if len(nals) != 4 || nals[1][0] != 0x67 || slice[0] != 0x65 {
+				t.Fatalf("picture %d is not IDR", i)
+			}
+
+			r := bitReader{buf: unescape(nals[1][1:])}
+			r.u(24)
+			r.ue()
+			r.ue()
+			r.ue()
+			r.ue()
+			r.u(1)
+			if w, h := r.ue()+1, r.ue()+1; w != 20 || h != 12 {
+				t.Errorf("SPS %dx%d mbs", w, h)
+			}
+
+			if coded := walkSlice(t, slice, mbs); coded != mbs {
+				t.Errorf("IDR codes %d mbs", coded)
+			}
+		} else if coded := walkSlice(t, slice, mbs); coded == 0 || coded > 12 {
+			t.Errorf("picture %d codes %d mbs", i, coded)
+		}
+	}
+
+	if n := len(pes[pidPatternVideo]); n < 40 {
+		t.Errorf("%d pictures", n)
+	}
+
+	if _, err := newPatternStream(patternCfg{width: 1920, height: 1080,
+		fps: 25, rate: 3000000, tone: true}, time.Now()); err != errPatternBitRate {
+		t.Errorf("newPatternStream() error = %v", err)
+	}
+}
+
+func TestPatternWorker(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	card := &Pattern{Slot: 34, IP: net.IPv4(127, 0, 0, 1)}
+	ws, _ := card.Open()
+	w := ws[0].(*PatternWorker)
+
+	w.Control(CtlCmdSetting, map[string]interface{}{"Resolution": "320x180", "BitRate": 4000})
+	w.Encode(&Session{IP: net.IPv4(127, 0, 0, 1), Streams: []Stream{{Name: StreamVideo, RTP: conn.LocalAddr().(*net.UDPAddr).Port}}})
+	if err, ok := w.Control(CtlCmdStart, nil).(error); ok {
+		t.Fatalf("Start error = %v", err)
+	}
+	defer w.Control(CtlCmdStop, nil)
+
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || n != 12+tsPerRTP*tsPacketSize || buf[1] != 33 || buf[12] != 0x47 {
+		t.Fatalf("Read() = %d, %v", n, err)
+	}
+
+	if !w.Monitor() {
+		t.Errorf("Monitor() = false")
+	}
+
+	// moved to another port while running
+	conn2, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+
+	w.Encode(&Session{IP: net.IPv4(127, 0, 0, 1), Streams: []Stream{{Name: StreamVideo, RTP: conn2.LocalAddr().(*net.UDPAddr).Port}}})
+	conn2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn2.Read(buf); err != nil {
+		t.Errorf("Read() after Encode = %v", err)
+	}
+
+	w.Encode(&Session{IP: net.IPv4(127, 0, 0, 1), Streams: invalidStreams})
+	if w.Monitor() {
+		t.Errorf("Monitor() = true after an invalid Encode")
+	}
+}
@@ -8,6 +8,7 @@ package driver
 import (
 	"errors"
 	"net"
+	"reflect"
 	"sync"
 )
 
@@ -31,7 +32,7 @@ type PipeSvr struct {
 
 // Pipe contains pipeline info used by PipeSvr
 type Pipe struct {
-	inPorts []int
+	inStreams []Stream
 
 	outIP []net.IP
 
@@ -41,21 +42,152 @@ type Pipe struct {
 	OutWorkers []Worker
 }
 
+// Stream names. MPEG-TS carries all elementary streams muxed,
+// in StreamVideo
+const (
+	StreamVideo  = "video"
+	StreamAudio  = "audio"
+	StreamAudio2 = "audio2"
+	StreamData   = "data"
+)
+
+// pipeStreams are streams of each pipe, in the order of ports
+var pipeStreams = []string{StreamVideo, StreamAudio, StreamAudio2, StreamData}
+
+// Stream is a named elementary stream of a Session
+type Stream struct {
+	Name string
+
+	// RTP and RTCP are ports, RTCP is 0 if none
+	RTP  int
+	RTCP int
+}
+
 // Session is src or dst for workers
 type Session struct {
 	IP net.IP
 
-	Ports []int
+	Streams []Stream
+}
+
+// Stream returns the stream of name, nil if none
+func (s *Session) Stream(name string) *Stream {
+	for i := range s.Streams {
+		if s.Streams[i].Name == name {
+			return &s.Streams[i]
+		}
+	}
+
+	return nil
+}
+
+// Port returns the RTP port of stream name, 0 if none
+func (s *Session) Port(name string) int {
+	if st := s.Stream(name); st != nil {
+		return st.RTP
+	}
+
+	return 0
 }
 
 var (
 	errNodeBadInput = errors.New("Bad input for node")
 )
 
-var invalidPorts = []int{60000, 60002}
+var invalidStreams = helperStreams(60000, 0, 0)
+
+// isInvalidSession tells if sess is of invalidStreams, which is
+// given to stop an encoder removed from a pipe
+func isInvalidSession(sess *Session) bool {
+	return len(sess.Streams) > 0 && reflect.DeepEqual(sess.Streams, invalidStreams)
+}
+
+// helperStreams returns pipeStreams of id, each takes a pair of
+// RTP and RTCP ports
+func helperStreams(base int, prefix int, id int) []Stream {
+	first := base + prefix + 2*len(pipeStreams)*id
+
+	var all []Stream
+	for i, name := range pipeStreams {
+		all = append(all, Stream{Name: name, RTP: first + 2*i, RTCP: first + 2*i + 1})
+	}
+
+	return all
+}
+
+// decodeBlock is a block of decode ports taken by a worker
+type decodeBlock struct {
+	ip    string
+	block int
+	refs  int
+}
+
+// portPool allocates decode ports. Each worker takes a block of
+// helperStreams, which is unique on its IP. Software cards all
+// have the IP of this host, so their worker IDs are not enough
+type portPool struct {
+	lock sync.Mutex
+
+	all map[Worker]*decodeBlock
+}
+
+var decodePorts = portPool{all: make(map[Worker]*decodeBlock)}
+
+// alloc returns decode streams of w. The block of its worker ID is
+// taken if it's free, or else the next free one
+func (pp *portPool) alloc(w Worker) []Stream {
+	pp.lock.Lock()
+
+	defer pp.lock.Unlock()
+
+	if b, ok := pp.all[w]; ok {
+		b.refs++
+		return helperStreams(outBasePort, 0, b.block)
+	}
+
+	ip := GetWorkerWorkerIP(w).String()
+
+	taken := make(map[int]bool)
+	for _, b := range pp.all {
+		if b.ip == ip {
+			taken[b.block] = true
+		}
+	}
+
+	block := GetWorkerWorkerID(w)
+	for taken[block] {
+		block++
+	}
+
+	pp.all[w] = &decodeBlock{ip: ip, block: block, refs: 1}
 
-func helperPort(base int, prefix int, id int) []int {
-	return []int{base + prefix + 4*id, base + prefix + 4*id + 2}
+	return helperStreams(outBasePort, 0, block)
+}
+
+// streams returns decode streams allocated to w, nil if none
+func (pp *portPool) streams(w Worker) []Stream {
+	pp.lock.Lock()
+
+	defer pp.lock.Unlock()
+
+	if b, ok := pp.all[w]; ok {
+		return helperStreams(outBasePort, 0, b.block)
+	}
+
+	return nil
+}
+
+// free releases one alloc of w
+func (pp *portPool) free(w Worker) {
+	pp.lock.Lock()
+
+	defer pp.lock.Unlock()
+
+	if b, ok := pp.all[w]; ok {
+		if b.refs--; b.refs <= 0 {
+			delete(pp.all, w)
+		}
+	}
 }
 
 // Create a svr
@@ -73,7 +205,7 @@ func (sr *PipeSvr) AllocPull(id int, w Worker) error {
 
 	// XXX: id - 1 to start with zero
 	if p = sr.all[id]; p == nil {
-		p = &Pipe{inPorts: helperPort(inBasePort, sr.Prefix, id-1)}
+		p = &Pipe{inStreams: helperStreams(inBasePort, sr.Prefix, id-1)}
 		sr.all[id] = p
 	}
 
@@ -87,15 +219,16 @@ func (sr *PipeSvr) AllocPull(id int, w Worker) error {
 		}
 	}
 
-	wid := GetWorkerWorkerID(w)
 	IP := GetWorkerWorkerIP(w)
 
-	ses := Session{Ports: helperPort(outBasePort, 0, wid)}
+	ses := Session{Streams: decodePorts.alloc(w)}
 	if err := SetDecodeSes(w, &ses); err != nil {
+		decodePorts.free(w)
 		return err
 	}
 
-	if err := transitSvr.add(p.inPorts[0], IP, ses.Ports[0], true); err != nil {
+	if err := transitSvr.add(p.inStreams, IP, ses.Streams); err != nil {
+		decodePorts.free(w)
 		return err
 	}
 
@@ -132,14 +265,15 @@ func (sr *PipeSvr) FreePull(id int, w Worker) error {
 		return nil
 	}
 
-	wid := GetWorkerWorkerID(w)
 	IP := GetWorkerWorkerIP(w)
 
-	if err := transitSvr.del(p.inPorts[0], IP,
-		helperPort(outBasePort, 0, wid)[0], true); err != nil {
+	if err := transitSvr.del(p.inStreams, IP,
+		decodePorts.streams(w)); err != nil {
 		return err
 	}
 
+	decodePorts.free(w)
+
 	p.OutWorkers = remove(p.OutWorkers, k)
 
 	return nil
@@ -156,7 +290,7 @@ func (sr *PipeSvr) AllocPush(id int, w Worker) error {
 
 	// XXX: id - 1 to start with zero
 	if p = sr.all[id]; p == nil {
-		p = &Pipe{inPorts: helperPort(inBasePort, sr.Prefix, id-1)}
+		p = &Pipe{inStreams: helperStreams(inBasePort, sr.Prefix, id-1)}
 		sr.all[id] = p
 	}
 
@@ -171,7 +305,7 @@ func (sr *PipeSvr) AllocPush(id int, w Worker) error {
 
 		// TODO: un-do ?
 		// FIXME: hacks to stop exists
-		ses := Session{IP: sr.IP, Ports: invalidPorts}
+		ses := Session{IP: sr.IP, Streams: invalidStreams}
 
 		if err := SetEncodeSes(exists, &ses); err != nil {
 			return err
@@ -180,7 +314,7 @@ func (sr *PipeSvr) AllocPush(id int, w Worker) error {
 		p.InWorkers = nil
 	}
 
-	ses := Session{IP: sr.IP, Ports: p.inPorts}
+	ses := Session{IP: sr.IP, Streams: p.inStreams}
 
 	if err := SetEncodeSes(w, &ses); err != nil {
 		return err
@@ -210,7 +344,7 @@ func (sr *PipeSvr) FreePush(id int) error {
 
 	// TODO: un-do?
 	// FIXME: hacks to stop exists
-	ses := Session{IP: sr.IP, Ports: invalidPorts}
+	ses := Session{IP: sr.IP, Streams: invalidStreams}
 
 	if err := SetEncodeSes(p.InWorkers, &ses); err != nil {
 		return err
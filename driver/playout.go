@@ -0,0 +1,615 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+// PlayoutName is the sub-card's name
+const PlayoutName string = "playout"
+
+// playoutSchema is the settings of PlayoutWorker. An item of
+// Playlist is "file", or "start file" to start at a time, where
+// start is "15:04:05" for the next such time, or
+// "2006-01-02T15:04:05". Files are in comm.AppCfg.PlayoutDir
+var playoutSchema = Schema{
+	{Name: "Playlist", Label: "播放列表", Type: FieldStrings,
+		Pattern: `^((\d{4}-\d{2}-\d{2}T)?\d{2}:\d{2}:\d{2}\s+)?\S.*$`},
+	{Name: "Loop", Label: "循环播放", Type: FieldBool, Default: true},
+}
+
+// layouts of start of playlist items
+const (
+	playoutDaily = "15:04:05"
+	playoutOnce  = "2006-01-02T15:04:05"
+)
+
+// playoutNoPCR is TS packets read before a file is given up for
+// no PCR
+const playoutNoPCR = 50000
+
+// playoutMaxGap is the longest gap between PCRs, in 27MHz, or
+// it's a discontinuity
+const playoutMaxGap = 27000000
+
+var (
+	errPlayoutEmpty = errors.New("Playlist is empty")
+	errPlayoutFile  = errors.New("Bad file in playlist")
+	errPlayoutNotTS = errors.New("Not a MPEG-TS file")
+	errPlayoutNoPCR = errors.New("No PCR in file")
+)
+
+// Playout is the main struct for sub-card, it's software only
+type Playout struct {
+	// Card Slot
+	Slot int
+
+	// Card IP
+	IP net.IP
+}
+
+// PlayoutWorker is the main struct for sub-card's Worker. It
+// plays TS files of a playlist in RTP, paced by PCR
+type PlayoutWorker struct {
+	lock sync.Mutex
+
+	workerID int
+
+	card *Playout
+
+	settings map[string]interface{}
+
+	dst  net.IP
+	port int
+
+	// list, loop and addr are of the running playout
+	list []playItem
+	loop bool
+	addr string
+	stop chan struct{}
+	done chan struct{}
+
+	// stats of the running playout
+	current  string
+	waiting  time.Time
+	loops    int
+	sent     int64
+	slips    int
+	finished bool
+	lastErr  error
+}
+
+// playItem is an item of playlist
+type playItem struct {
+	file string
+
+	// start is "" to play after the previous item
+	start string
+}
+
+// Open method
+func (p *Playout) Open() ([]Worker, error) {
+	return []Worker{
+		&PlayoutWorker{workerID: 0, card: p},
+		&PlayoutWorker{workerID: 1, card: p},
+	}, nil
+}
+
+// Close method
+func (p *Playout) Close() error {
+	return nil
+}
+
+// Control method
+func (w *PlayoutWorker) Control(c CtlCmd, arg interface{}) interface{} {
+	switch c {
+	case CtlCmdStart:
+		if err := w.start(); err != nil {
+			return err
+		}
+
+	case CtlCmdStop:
+		w.halt()
+
+	case CtlCmdName:
+		return fmt.Sprintf("%s_%d_%d", PlayoutName, w.card.Slot, w.workerID)
+
+	case CtlCmdIP:
+		return w.card.IP
+
+	case CtlCmdWorkerID:
+		return w.workerID
+
+	case CtlCmdSchema:
+		return playoutSchema
+
+	case CtlCmdSetting:
+		if settings, ok := arg.(map[string]interface{}); ok {
+			w.lock.Lock()
+			w.settings = settings
+			w.lock.Unlock()
+		}
+
+	default:
+	}
+	return nil
+}
+
+// Monitor method, it's healthy while waiting for a scheduled item
+func (w *PlayoutWorker) Monitor() bool {
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	return w.stop != nil && !w.finished && w.lastErr == nil
+}
+
+// Report method
+func (w *PlayoutWorker) Report() []string {
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	if w.stop == nil {
+		return []string{"not running"}
+	}
+
+	var all []string
+	switch {
+	case w.finished:
+		all = append(all, "playlist finished")
+	case !w.waiting.IsZero():
+		all = append(all, fmt.Sprintf("waiting to play %s at %s", w.current,
+			w.waiting.Format(playoutOnce)))
+	default:
+		all = append(all, fmt.Sprintf("playing %s to %s", w.current, w.addr))
+	}
+
+	all = append(all, fmt.Sprintf("%d packets sent, %d loops, %d slips",
+		w.sent, w.loops, w.slips))
+	if w.lastErr != nil {
+		all = append(all, "error: "+w.lastErr.Error())
+	}
+
+	return all
+}
+
+// Encode method, a running playout is restarted to the new
+// destination, or stopped if sess is invalid
+func (w *PlayoutWorker) Encode(sess *Session) error {
+
+	w.lock.Lock()
+	if isInvalidSession(sess) {
+		w.dst, w.port = nil, 0
+	} else {
+		w.dst = sess.IP
+		w.port = sess.Port(StreamVideo)
+	}
+	running := w.stop != nil
+	w.lock.Unlock()
+
+	if !running {
+		return nil
+	}
+
+	if isInvalidSession(sess) {
+		w.halt()
+		return nil
+	}
+
+	return w.start()
+}
+
+// start starts playout, it's restarted if settings or the
+// destination changed
+func (w *PlayoutWorker) start() error {
+
+	w.lock.Lock()
+	list, err := playlistOf(w.settings)
+	loop, ok := w.settings["Loop"].(bool)
+	if !ok {
+		loop = true
+	}
+	dst, port := w.dst, w.port
+	running := w.stop != nil
+	same := reflect.DeepEqual(list, w.list) && loop == w.loop &&
+		w.addr == net.JoinHostPort(dst.String(), strconv.Itoa(port))
+	w.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if dst == nil || port == 0 {
+		return errInputError
+	}
+
+	if running && same {
+		return nil
+	}
+
+	w.halt()
+
+	addr := net.JoinHostPort(dst.String(), strconv.Itoa(port))
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	w.list, w.loop, w.addr = list, loop, addr
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	w.current, w.waiting = "", time.Time{}
+	w.loops, w.sent, w.slips = 0, 0, 0
+	w.finished, w.lastErr = false, nil
+	stop, done := w.stop, w.done
+	w.lock.Unlock()
+
+	comm.Info.Printf("Playout %s playing %d items to %s", GetWorkerName(w),
+		len(list), addr)
+
+	go w.play(conn, list, loop, stop, done)
+
+	return nil
+}
+
+// halt stops playout
+func (w *PlayoutWorker) halt() {
+	w.lock.Lock()
+	stop, done := w.stop, w.done
+	w.stop, w.done = nil, nil
+	w.lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// play plays list until stop, or the end of list if not loop
+func (w *PlayoutWorker) play(conn net.Conn, list []playItem, loop bool,
+	stop chan struct{}, done chan struct{}) {
+
+	defer close(done)
+	defer conn.Close()
+
+	p := &tsPacer{conn: conn, rtp: newRTPPacketizer(), epoch: time.Now(),
+		stop: stop, w: w}
+
+	// at is when the item starts, it's resolved when the previous
+	// one starts, which is cut then
+	at := nextStart(list[0].start, time.Now())
+	for {
+		for i, item := range list {
+			started := time.Now()
+
+			if at.After(started) {
+				w.lock.Lock()
+				w.current, w.waiting = item.file, at
+				w.lock.Unlock()
+
+				select {
+				case <-stop:
+					return
+				case <-time.After(time.Until(at)):
+				}
+
+				started = at
+			}
+
+			at = time.Time{}
+			if i+1 < len(list) {
+				at = nextStart(list[i+1].start, started)
+			} else if loop {
+				at = nextStart(list[0].start, started)
+			}
+
+			w.lock.Lock()
+			w.current, w.waiting = item.file, time.Time{}
+			w.lock.Unlock()
+
+			err := p.playFile(filepath.Join(comm.AppCfg.PlayoutDir, item.file), at)
+			if err == errPacerStopped {
+				return
+			}
+
+			w.lock.Lock()
+			w.lastErr = err
+			w.lock.Unlock()
+
+			if err != nil {
+				comm.Error.Printf("Playout %s: %v", item.file, err)
+
+				// not to spin on bad files
+				select {
+				case <-stop:
+					return
+				case <-time.After(time.Second):
+				}
+			}
+		}
+
+		if !loop {
+			break
+		}
+
+		w.lock.Lock()
+		w.loops++
+		w.lock.Unlock()
+	}
+
+	w.lock.Lock()
+	w.finished = true
+	w.lock.Unlock()
+}
+
+// playlistOf parses settings, files are checked
+func playlistOf(settings map[string]interface{}) ([]playItem, error) {
+	var all []string
+	switch l := settings["Playlist"].(type) {
+	case []interface{}:
+		for _, e := range l {
+			if s, ok := e.(string); ok {
+				all = append(all, s)
+			}
+		}
+	case []string:
+		all = l
+	}
+
+	if len(all) == 0 {
+		return nil, errPlayoutEmpty
+	}
+
+	var list []playItem
+	for _, s := range all {
+		var item playItem
+
+		fields := strings.Fields(s)
+		if len(fields) > 1 && isPlayoutStart(fields[0]) {
+			item.start = fields[0]
+			item.file = strings.TrimSpace(strings.TrimPrefix(s, fields[0]))
+		} else {
+			item.file = strings.TrimSpace(s)
+		}
+
+		clean := filepath.Clean(item.file)
+		if filepath.IsAbs(clean) || clean == ".." ||
+			strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return nil, errPlayoutFile
+		}
+		item.file = clean
+
+		if fi, err := os.Stat(filepath.Join(comm.AppCfg.PlayoutDir, clean)); err != nil || fi.IsDir() {
+			return nil, errPlayoutFile
+		}
+
+		list = append(list, item)
+	}
+
+	return list, nil
+}
+
+func isPlayoutStart(s string) bool {
+	for _, layout := range []string{playoutDaily, playoutOnce} {
+		if _, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nextStart returns when start is after from, zero if start is
+// "" or passed
+func nextStart(start string, from time.Time) time.Time {
+	if at, err := time.ParseInLocation(playoutOnce, start, time.Local); err == nil {
+		if at.After(from) {
+			return at
+		}
+		return time.Time{}
+	}
+
+	t, err := time.ParseInLocation(playoutDaily, start, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+
+	y, m, d := from.Date()
+	at := time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, time.Local)
+	if !at.After(from) {
+		at = at.AddDate(0, 0, 1)
+	}
+
+	return at
+}
+
+// errors of tsPacer, not errors of playout
+var (
+	errPacerStopped = errors.New("Stopped")
+	errPacerCut     = errors.New("Cut")
+)
+
+// tsPacer sends TS files in RTP in real time. Packets between two
+// PCRs are spread evenly between them
+type tsPacer struct {
+	conn  net.Conn
+	rtp   *rtpPacketizer
+	epoch time.Time
+	stop  chan struct{}
+
+	// w is for stats, may be nil
+	w *PlayoutWorker
+
+	// out is TS not sent, due is when the last of out is due
+	out [][]byte
+	due time.Time
+
+	// clock is when the last PCR is due
+	clock time.Time
+
+	// perPacket is the last time of a packet
+	perPacket time.Duration
+}
+
+// playFile sends file, until it ends or until if not zero
+func (p *tsPacer) playFile(file string, until time.Time) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 1000*tsPacketSize)
+
+	// the file starts after what's sent
+	p.clock = p.due
+	if now := time.Now(); p.clock.Before(now) {
+		p.clock = now
+	}
+
+	var seg tsSegmenter
+	var pending [][]byte
+	lastPCR := int64(-1)
+	for {
+		if err := p.check(until); err != nil {
+			if err == errPacerCut {
+				return nil
+			}
+			return err
+		}
+
+		pkt := make([]byte, tsPacketSize)
+		if _, err := io.ReadFull(r, pkt); err != nil {
+			// the rest at the last rate
+			if err := p.spread(pending, p.perPacket*time.Duration(len(pending))); err != nil {
+				return err
+			}
+			return p.flush()
+		}
+
+		if pkt[0] != 0x47 {
+			return errPlayoutNotTS
+		}
+
+		seg.learn(pkt)
+		pending = append(pending, pkt)
+
+		pcr, ok := tsPCR(pkt)
+		if !ok || (seg.pcrPID != 0 && tsPID(pkt) != seg.pcrPID) {
+			if lastPCR < 0 && len(pending) > playoutNoPCR {
+				return errPlayoutNoPCR
+			}
+			continue
+		}
+
+		// packets before the first PCR, or a discontinuity, are
+		// at the last rate
+		span := p.perPacket * time.Duration(len(pending))
+		if gap := pcr - lastPCR; lastPCR >= 0 && gap >= 0 && gap <= playoutMaxGap {
+			span = time.Duration(gap * 1000 / 27)
+			p.perPacket = span / time.Duration(len(pending))
+		}
+		lastPCR = pcr
+
+		if err := p.spread(pending, span); err != nil {
+			return err
+		}
+		pending = pending[:0]
+	}
+}
+
+// spread schedules pkts over span after clock
+func (p *tsPacer) spread(pkts [][]byte, span time.Duration) error {
+	for i, pkt := range pkts {
+		p.out = append(p.out, pkt)
+		p.due = p.clock.Add(span * time.Duration(i+1) / time.Duration(len(pkts)))
+		if len(p.out) == tsPerRTP {
+			if err := p.write(); err != nil {
+				return err
+			}
+		}
+	}
+
+	p.clock = p.clock.Add(span)
+
+	return nil
+}
+
+// check returns errPacerStopped if stopped, or errPacerCut after
+// until
+func (p *tsPacer) check(until time.Time) error {
+	select {
+	case <-p.stop:
+		return errPacerStopped
+	default:
+	}
+
+	if !until.IsZero() && !time.Now().Before(until) {
+		return errPacerCut
+	}
+
+	return nil
+}
+
+// flush sends TS not sent yet
+func (p *tsPacer) flush() error {
+	if len(p.out) == 0 {
+		return nil
+	}
+
+	return p.write()
+}
+
+// write sends out in an RTP packet when it's due. If it's late
+// for long, clock slips to now. Errors of conn are kept in stats,
+// as a path without a receiver may be refused
+func (p *tsPacer) write() error {
+	ahead := time.Until(p.due)
+	if ahead > 2*time.Millisecond {
+		select {
+		case <-p.stop:
+			return errPacerStopped
+		case <-time.After(ahead):
+		}
+	}
+
+	if ahead < -time.Second {
+		slip := -ahead
+		p.clock, p.due = p.clock.Add(slip), p.due.Add(slip)
+	}
+
+	at := p.due.Sub(p.epoch) * 90000 / time.Second
+	_, err := p.conn.Write(p.rtp.packet(int64(at), p.out))
+	p.out = p.out[:0]
+
+	if p.w != nil {
+		p.w.lock.Lock()
+		p.w.sent++
+		p.w.lastErr = err
+		if ahead < -time.Second {
+			p.w.slips++
+		}
+		p.w.lock.Unlock()
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+// writePattern writes secs of the test pattern to file
+func writePattern(t *testing.T, file string, secs int64) []byte {
+	cfg, _ := patternCfgOf(map[string]interface{}{"Resolution": "320x180",
+		"BitRate": 4000, "Tone": false})
+	st, err := newPatternStream(cfg, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	for st.mux.now() < secs*27000000 {
+		buf.Write(st.next())
+	}
+
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func Test_nextStart(t *testing.T) {
+	from := time.Date(2020, 6, 1, 8, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		start string
+		want  time.Time
+	}{
+		{"", time.Time{}},
+		{"09:30:00", time.Date(2020, 6, 1, 9, 30, 0, 0, time.Local)},
+		{"07:00:00", time.Date(2020, 6, 2, 7, 0, 0, 0, time.Local)},
+		{"2020-06-01T08:00:01", time.Date(2020, 6, 1, 8, 0, 1, 0, time.Local)},
+		{"2020-05-31T08:00:00", time.Time{}},
+	}
+	for _, tt := range tests {
+		if got := nextStart(tt.start, from); !got.Equal(tt.want) {
+			t.Errorf("nextStart(%q) = %v, want %v", tt.start, got, tt.want)
+		}
+	}
+}
+
+func Test_playlistOf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := comm.AppCfg.PlayoutDir
+	comm.AppCfg.PlayoutDir = dir
+	defer func() { comm.AppCfg.PlayoutDir = saved }()
+
+	ioutil.WriteFile(filepath.Join(dir, "a b.ts"), nil, 0644)
+
+	list, err := playlistOf(map[string]interface{}{"Playlist": []interface{}{
+		"a b.ts", "18:00:00  a b.ts", "2020-06-01T08:00:00 ./a b.ts"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []playItem{{"a b.ts", ""}, {"a b.ts", "18:00:00"},
+		{"a b.ts", "2020-06-01T08:00:00"}}
+	for i := range want {
+		if list[i] != want[i] {
+			t.Errorf("playlistOf()[%d] = %v, want %v", i, list[i], want[i])
+		}
+	}
+
+	for _, bad := range []string{"none.ts", "../a b.ts", "/etc/passwd", "."} {
+		if _, err := playlistOf(map[string]interface{}{"Playlist": []interface{}{bad}}); err != errPlayoutFile {
+			t.Errorf("playlistOf(%q) error = %v", bad, err)
+		}
+	}
+	if _, err := playlistOf(nil); err != errPlayoutEmpty {
+		t.Errorf("playlistOf() error = %v", err)
+	}
+}
+
+func TestPlayoutWorker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := comm.AppCfg.PlayoutDir
+	comm.AppCfg.PlayoutDir = dir
+	defer func() { comm.AppCfg.PlayoutDir = saved }()
+
+	data := writePattern(t, filepath.Join(dir, "pattern.ts"), 1)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadBuffer(4 << 20)
+
+	card := &Playout{Slot: 36, IP: net.IPv4(127, 0, 0, 1)}
+	ws, _ := card.Open()
+	w := ws[0].(*PlayoutWorker)
+
+	w.Control(CtlCmdSetting, map[string]interface{}{
+		"Playlist": []interface{}{"pattern.ts"}, "Loop": false})
+	w.Encode(&Session{IP: net.IPv4(127, 0, 0, 1), Streams: []Stream{{Name: StreamVideo, RTP: conn.LocalAddr().(*net.UDPAddr).Port}}})
+
+	start := time.Now()
+	if err, ok := w.Control(CtlCmdStart, nil).(error); ok {
+		t.Fatalf("Start error = %v", err)
+	}
+	defer w.Control(CtlCmdStop, nil)
+
+	// all of the file in about a second
+	var got []byte
+	buf := make([]byte, 2048)
+	for len(got) < len(data) {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Read() after %d bytes: %v", len(got), err)
+		}
+		got = append(got, tsOfRTP(buf[:n])...)
+	}
+
+	if d := time.Since(start); d < 800*time.Millisecond || d > 1500*time.Millisecond {
+		t.Errorf("played in %v", d)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("played %d bytes, not the file", len(got))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if w.Monitor() {
+		t.Errorf("Monitor() = true, %v", w.Report())
+	}
+
+	w.Encode(&Session{IP: net.IPv4(127, 0, 0, 1), Streams: invalidStreams})
+	if report := w.Report(); report[0] != "not running" {
+		t.Errorf("Report() = %v after an invalid Encode", report)
+	}
+}
@@ -0,0 +1,499 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+// RecorderName is the sub-card's name
+const RecorderName string = "recorder"
+
+// recorderSchema is the settings of RecorderWorker
+var recorderSchema = Schema{
+	{Name: "Segment", Label: "分段时长(秒)", Type: FieldInt, Default: 60,
+		Min: 2, Max: 3600},
+	{Name: "MaxAge", Label: "保留时长(小时)", Type: FieldInt, Default: 72,
+		Min: 0, Max: 87600},
+	{Name: "MaxSize", Label: "保留容量(MB)", Type: FieldInt, Default: 10240,
+		Min: 0, Max: 10485760},
+}
+
+// recordStall is how long a recorder is unhealthy without data
+const recordStall = 10 * time.Second
+
+// recordingLayout names a recording by its start, in local time
+const recordingLayout = "20060102-150405"
+
+var recordingName = regexp.MustCompile(`^\d{8}-\d{6}\.ts$`)
+
+var (
+	errNoRecording        = errors.New("Worker does not record")
+	errRecordingNotExists = errors.New("Recording not exists")
+	errRecordingBusy      = errors.New("Recording in progress")
+)
+
+// Recording is a segment recorded
+type Recording struct {
+	Name string
+	Size int64
+
+	// Start is from Name, End is the last write
+	Start time.Time
+	End   time.Time
+}
+
+// Archiver is implemented by workers which record to disk
+type Archiver interface {
+	Recordings() ([]Recording, error)
+	RecordingFile(name string) (string, error)
+	DeleteRecording(name string) error
+}
+
+// Recorder is the main struct for sub-card, it's software only
+type Recorder struct {
+	// Card Slot
+	Slot int
+
+	// Card IP
+	IP net.IP
+}
+
+// RecorderWorker is the main struct for sub-card's Worker. It
+// receives MPEG-TS over RTP or UDP, and writes segments to
+// comm.AppCfg.RecordDir/{worker name}
+type RecorderWorker struct {
+	lock sync.Mutex
+
+	workerID int
+
+	card *Recorder
+
+	settings map[string]interface{}
+
+	port int
+
+	// cfg is of the running recorder
+	cfg  recorderCfg
+	conn *net.UDPConn
+	done chan struct{}
+
+	// current is the segment being written
+	current  string
+	received int64
+	lastRecv time.Time
+	lastErr  error
+}
+
+// recorderCfg is parsed settings, 0 of maxAge or maxSize keeps all
+type recorderCfg struct {
+	segment time.Duration
+	maxAge  time.Duration
+	maxSize int64
+}
+
+// Open method
+func (r *Recorder) Open() ([]Worker, error) {
+	return []Worker{
+		&RecorderWorker{workerID: 0, card: r},
+		&RecorderWorker{workerID: 1, card: r},
+	}, nil
+}
+
+// Close method
+func (r *Recorder) Close() error {
+	return nil
+}
+
+// Control method
+func (w *RecorderWorker) Control(c CtlCmd, arg interface{}) interface{} {
+	switch c {
+	case CtlCmdStart:
+		if err := w.start(); err != nil {
+			return err
+		}
+
+	case CtlCmdStop:
+		w.halt()
+
+	case CtlCmdName:
+		return fmt.Sprintf("%s_%d_%d", RecorderName, w.card.Slot, w.workerID)
+
+	case CtlCmdIP:
+		return w.card.IP
+
+	case CtlCmdWorkerID:
+		return w.workerID
+
+	case CtlCmdSchema:
+		return recorderSchema
+
+	case CtlCmdSetting:
+		if settings, ok := arg.(map[string]interface{}); ok {
+			w.lock.Lock()
+			w.settings = settings
+			w.lock.Unlock()
+		}
+
+	default:
+	}
+	return nil
+}
+
+// Monitor method
+func (w *RecorderWorker) Monitor() bool {
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	return w.conn != nil && w.lastErr == nil &&
+		time.Since(w.lastRecv) < recordStall
+}
+
+// Report method
+func (w *RecorderWorker) Report() []string {
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	if w.conn == nil {
+		return []string{"not running"}
+	}
+
+	all := []string{fmt.Sprintf("recording %s on port %d, %d bytes received",
+		w.current, w.port, w.received)}
+	if w.lastErr != nil {
+		all = append(all, "error: "+w.lastErr.Error())
+	}
+
+	return all
+}
+
+// Decode method
+func (w *RecorderWorker) Decode(sess *Session) error {
+
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	w.port = sess.Port(StreamVideo)
+	return nil
+}
+
+// dir is where recordings are
+func (w *RecorderWorker) dir() string {
+	return filepath.Join(comm.AppCfg.RecordDir, GetWorkerName(w))
+}
+
+// Recordings method, oldest first
+func (w *RecorderWorker) Recordings() ([]Recording, error) {
+	return listRecordings(w.dir())
+}
+
+// RecordingFile method
+func (w *RecorderWorker) RecordingFile(name string) (string, error) {
+	if !recordingName.MatchString(name) {
+		return "", errRecordingNotExists
+	}
+
+	file := filepath.Join(w.dir(), name)
+	if _, err := os.Stat(file); err != nil {
+		return "", errRecordingNotExists
+	}
+
+	return file, nil
+}
+
+// DeleteRecording method, the one being written can't be deleted
+func (w *RecorderWorker) DeleteRecording(name string) error {
+	file, err := w.RecordingFile(name)
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	busy := w.conn != nil && w.current == name
+	w.lock.Unlock()
+
+	if busy {
+		return errRecordingBusy
+	}
+
+	return os.Remove(file)
+}
+
+// start starts recording, it's restarted if settings changed
+func (w *RecorderWorker) start() error {
+
+	w.lock.Lock()
+	cfg := recorderCfgOf(w.settings)
+	port := w.port
+	running := w.conn != nil
+	same := cfg == w.cfg
+	w.lock.Unlock()
+
+	if port == 0 {
+		return errInputError
+	}
+
+	if running && same {
+		return nil
+	}
+
+	w.halt()
+
+	dir := w.dir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	w.cfg = cfg
+	w.conn = conn
+	w.done = make(chan struct{})
+	w.current, w.received, w.lastErr = "", 0, nil
+	w.lastRecv = time.Now()
+	done := w.done
+	w.lock.Unlock()
+
+	comm.Info.Printf("Recorder %s recording port %d to %s", GetWorkerName(w),
+		port, dir)
+
+	go w.record(conn, cfg, dir, done)
+
+	return nil
+}
+
+// halt stops recording, the segment is closed
+func (w *RecorderWorker) halt() {
+	w.lock.Lock()
+	conn, done := w.conn, w.done
+	w.conn, w.done = nil, nil
+	w.lock.Unlock()
+
+	if conn != nil {
+		conn.Close()
+		<-done
+	}
+}
+
+// record writes segments until conn is closed
+func (w *RecorderWorker) record(conn *net.UDPConn, cfg recorderCfg,
+	dir string, done chan struct{}) {
+
+	defer close(done)
+
+	seg := tsSegmenter{dur: cfg.segment}
+
+	var f *os.File
+	var bw *bufio.Writer
+
+	fail := func(err error) {
+		w.lock.Lock()
+		w.lastErr = err
+		w.lock.Unlock()
+
+		comm.Error.Printf("Recorder %s: %v", dir, err)
+	}
+
+	closeSeg := func() {
+		if f == nil {
+			return
+		}
+
+		if err := bw.Flush(); err != nil {
+			fail(err)
+		}
+		f.Close()
+		f, bw = nil, nil
+
+		if _, err := pruneRecordings(dir, cfg.maxAge, cfg.maxSize, time.Now()); err != nil {
+			fail(err)
+		}
+	}
+
+	defer closeSeg()
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			// closed by halt
+			return
+		}
+
+		now := time.Now()
+
+		ts := tsOfRTP(buf[:n])
+		for ; len(ts) >= tsPacketSize; ts = ts[tsPacketSize:] {
+			pkt := ts[:tsPacketSize]
+			if pkt[0] != 0x47 {
+				continue
+			}
+
+			if seg.cut(pkt, now) {
+				closeSeg()
+
+				name := now.Format(recordingLayout) + ".ts"
+				if f, err = os.OpenFile(filepath.Join(dir, name),
+					os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+					fail(err)
+					continue
+				}
+				bw = bufio.NewWriterSize(f, 64*1024)
+				bw.Write(seg.header())
+
+				w.lock.Lock()
+				w.current, w.lastErr = name, nil
+				w.lock.Unlock()
+			}
+
+			if bw != nil {
+				if _, err := bw.Write(pkt); err != nil {
+					fail(err)
+					f.Close()
+					f, bw = nil, nil
+				}
+			}
+		}
+
+		w.lock.Lock()
+		w.received += int64(n)
+		w.lastRecv = now
+		w.lock.Unlock()
+	}
+}
+
+// recorderCfgOf parses settings, defaults are of recorderSchema
+func recorderCfgOf(settings map[string]interface{}) recorderCfg {
+	cfg := recorderCfg{segment: 60 * time.Second, maxAge: 72 * time.Hour,
+		maxSize: 10240 << 20}
+
+	if n, ok := intOf(settings["Segment"]); ok && n > 0 {
+		cfg.segment = time.Duration(n) * time.Second
+	}
+
+	if n, ok := intOf(settings["MaxAge"]); ok && n >= 0 {
+		cfg.maxAge = time.Duration(n) * time.Hour
+	}
+
+	if n, ok := intOf(settings["MaxSize"]); ok && n >= 0 {
+		cfg.maxSize = int64(n) << 20
+	}
+
+	return cfg
+}
+
+// listRecordings returns recordings in dir, oldest first
+func listRecordings(dir string) ([]Recording, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var all []Recording
+	for _, fi := range infos {
+		if fi.IsDir() || !recordingName.MatchString(fi.Name()) {
+			continue
+		}
+
+		start, err := time.ParseInLocation(recordingLayout,
+			strings.TrimSuffix(fi.Name(), ".ts"), time.Local)
+		if err != nil {
+			continue
+		}
+
+		all = append(all, Recording{Name: fi.Name(), Size: fi.Size(),
+			Start: start, End: fi.ModTime()})
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+
+	return all, nil
+}
+
+// pruneRecordings removes recordings of dir ended before maxAge,
+// then the oldest until all are within maxSize. The newest is
+// never removed. Names removed are returned
+func pruneRecordings(dir string, maxAge time.Duration, maxSize int64,
+	now time.Time) ([]string, error) {
+
+	all, err := listRecordings(dir)
+	if err != nil || len(all) == 0 {
+		return nil, err
+	}
+
+	var total int64
+	for _, r := range all {
+		total += r.Size
+	}
+
+	var removed []string
+	for _, r := range all[:len(all)-1] {
+		old := maxAge > 0 && now.Sub(r.End) > maxAge
+		big := maxSize > 0 && total > maxSize
+		if !old && !big {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, r.Name)); err != nil {
+			return removed, err
+		}
+
+		total -= r.Size
+		removed = append(removed, r.Name)
+	}
+
+	return removed, nil
+}
+
+// GetWorkerRecordings get Worker's recordings
+func GetWorkerRecordings(w Worker) ([]Recording, error) {
+	if a, ok := w.(Archiver); ok {
+		return a.Recordings()
+	}
+
+	return nil, errNoRecording
+}
+
+// GetWorkerRecordingFile get the file of Worker's recording name
+func GetWorkerRecordingFile(w Worker, name string) (string, error) {
+	if a, ok := w.(Archiver); ok {
+		return a.RecordingFile(name)
+	}
+
+	return "", errNoRecording
+}
+
+// DeleteWorkerRecording delete Worker's recording name
+func DeleteWorkerRecording(w Worker, name string) error {
+	if a, ok := w.(Archiver); ok {
+		return a.DeleteRecording(name)
+	}
+
+	return errNoRecording
+}
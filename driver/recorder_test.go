@@ -0,0 +1,187 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+func Test_tsSegmenter(t *testing.T) {
+	cfg, _ := patternCfgOf(map[string]interface{}{"Resolution": "320x180",
+		"BitRate": 4000, "FrameRate": 25})
+
+	epoch := time.Date(2020, 6, 1, 8, 0, 0, 0, time.UTC)
+	st, err := newPatternStream(cfg, epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seg := tsSegmenter{dur: 2 * time.Second}
+
+	// GOP is about 1.4s, cuts are at IDR after 2s
+	var cuts []time.Time
+	for st.mux.now() < 20*27000000 {
+		now := epoch.Add(time.Duration(st.mux.now() * 1000 / 27))
+		p := st.next()
+		if !seg.cut(p, now) {
+			continue
+		}
+
+		if !tsRAI(p) || tsPID(p) != pidPatternVideo {
+			t.Errorf("cut at pid %x", tsPID(p))
+		}
+		cuts = append(cuts, now)
+	}
+
+	if len(cuts) < 5 || len(cuts) > 9 {
+		t.Fatalf("%d cuts", len(cuts))
+	}
+	for i := 1; i < len(cuts); i++ {
+		if d := cuts[i].Sub(cuts[i-1]); d < 2*time.Second || d > 4*time.Second {
+			t.Errorf("segment %d of %v", i, d)
+		}
+	}
+
+	h := seg.header()
+	if len(h) != 2*tsPacketSize || tsPID(h) != pidPAT || tsPID(h[tsPacketSize:]) != pidPMT {
+		t.Errorf("header() of %d bytes", len(h))
+	}
+	if seg.pcrPID != pidPatternVideo {
+		t.Errorf("pcrPID = %x", seg.pcrPID)
+	}
+
+	if got := tsOfRTP(newRTPPacketizer().packet(0, [][]byte{h[:tsPacketSize]})); len(got) != tsPacketSize {
+		t.Errorf("tsOfRTP() of %d bytes", len(got))
+	}
+}
+
+func Test_pruneRecordings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	for i, name := range []string{"20200601-080000.ts", "20200601-080100.ts",
+		"20200601-080200.ts", "20200601-080300.ts", "notes.txt"} {
+		file := filepath.Join(dir, name)
+		ioutil.WriteFile(file, make([]byte, 100), 0644)
+
+		end := now.Add(time.Duration(i-3) * time.Hour)
+		os.Chtimes(file, end, end)
+	}
+
+	removed, err := pruneRecordings(dir, 150*time.Minute, 250, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first by age, the second by size
+	if len(removed) != 2 || removed[0] != "20200601-080000.ts" ||
+		removed[1] != "20200601-080100.ts" {
+		t.Errorf("pruneRecordings() = %v", removed)
+	}
+
+	// the newest is kept
+	if removed, _ := pruneRecordings(dir, time.Minute, 1, now.Add(time.Hour)); len(removed) != 1 {
+		t.Errorf("pruneRecordings() = %v", removed)
+	}
+
+	all, _ := listRecordings(dir)
+	if len(all) != 1 || all[0].Name != "20200601-080300.ts" || all[0].Size != 100 {
+		t.Errorf("listRecordings() = %v", all)
+	}
+}
+
+func TestRecorderWorker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := comm.AppCfg.RecordDir
+	comm.AppCfg.RecordDir = dir
+	defer func() { comm.AppCfg.RecordDir = saved }()
+
+	// a free port
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	l.Close()
+
+	card := &Recorder{Slot: 35, IP: net.IPv4(127, 0, 0, 1)}
+	ws, _ := card.Open()
+	w := ws[0].(*RecorderWorker)
+
+	w.Decode(&Session{Streams: []Stream{{Name: StreamVideo, RTP: port}}})
+	if err, ok := w.Control(CtlCmdStart, nil).(error); ok {
+		t.Fatalf("Start error = %v", err)
+	}
+
+	conn, err := net.Dial("udp", l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cfg, _ := patternCfgOf(map[string]interface{}{"Resolution": "320x180",
+		"BitRate": 4000})
+	st, _ := newPatternStream(cfg, time.Now())
+	rtp := newRTPPacketizer()
+	for i := 0; i < 300; i++ {
+		var ts [][]byte
+		for j := 0; j < tsPerRTP; j++ {
+			ts = append(ts, st.next())
+		}
+		conn.Write(rtp.packet(0, ts))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if !w.Monitor() {
+		t.Errorf("Monitor() = false, %v", w.Report())
+	}
+
+	all, err := GetWorkerRecordings(w)
+	if err != nil || len(all) != 1 {
+		t.Fatalf("Recordings() = %v, %v", all, err)
+	}
+	if err := w.DeleteRecording(all[0].Name); err != errRecordingBusy {
+		t.Errorf("DeleteRecording() error = %v", err)
+	}
+
+	w.Control(CtlCmdStop, nil)
+
+	// starts with PAT, and is cut at TS packets
+	file, err := GetWorkerRecordingFile(w, all[0].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(file)
+	if len(data) == 0 || len(data)%tsPacketSize != 0 || tsPID(data) != pidPAT {
+		t.Errorf("recording of %d bytes", len(data))
+	}
+
+	if _, err := w.RecordingFile("../" + all[0].Name); err != errRecordingNotExists {
+		t.Errorf("RecordingFile() error = %v", err)
+	}
+	if err := DeleteWorkerRecording(w, all[0].Name); err != nil {
+		t.Errorf("DeleteRecording() error = %v", err)
+	}
+	if all, _ := w.Recordings(); len(all) != 0 {
+		t.Errorf("Recordings() = %v", all)
+	}
+}
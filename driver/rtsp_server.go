@@ -0,0 +1,1003 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+// rtspTapName is the name of taps, with the path ID
+const rtspTapName string = "rtsp_server"
+
+// rtspTapBase is the WorkerID of the tap of path 1. It's far
+// from WorkerIDs of cards, so pipe ports never overlap
+const rtspTapBase = 1000
+
+// rtspTimeout is how long a UDP session lives without requests
+// or RTCP from the client
+const rtspTimeout = 60 * time.Second
+
+// rtspQueue is RTP packets queued for a TCP session, more are
+// dropped
+const rtspQueue = 512
+
+// rtspMethods are methods supported
+const rtspMethods = "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER"
+
+var (
+	errRTSPRunning    = errors.New("RTSP server already running")
+	errRTSPNotRunning = errors.New("RTSP server not running")
+	errRTSPPorts      = errors.New("No UDP ports for RTP")
+	errRTSPNoPath     = errors.New("Path not published")
+	errRTSPNotReady   = errors.New("Stream not ready")
+	errRTSPNoSession  = errors.New("Session not found")
+	errRTSPTransport  = errors.New("Unsupported transport")
+)
+
+var rtspStatus = map[int]string{
+	200: "OK",
+	400: "Bad Request",
+	404: "Not Found",
+	454: "Session Not Found",
+	455: "Method Not Valid in This State",
+	461: "Unsupported Transport",
+	501: "Not Implemented",
+	503: "Service Unavailable",
+}
+
+// RTSPSession is a session of RTSPServer
+type RTSPSession struct {
+	ID string
+
+	// Path is the encode path ID
+	Path int
+
+	Client string
+
+	// Transport is "UDP" or "TCP"
+	Transport string
+
+	Playing bool
+
+	Start time.Time
+
+	Packets int64
+	Bytes   int64
+
+	// Dropped are packets a slow TCP client missed
+	Dropped int64
+}
+
+// RTSPServer re-publishes encode pipes as rtsp://host/path/{id}.
+// Each pipe is pulled by a tap, whose stream is sent to sessions
+// as RTP over UDP, or interleaved in the RTSP connection
+type RTSPServer struct {
+	// IP is of this host, pipes send streams to it
+	IP net.IP
+
+	lock sync.Mutex
+
+	ln        net.Listener
+	rtp, rtcp *net.UDPConn
+	done      chan struct{}
+
+	taps     map[int]*rtspTap
+	sessions map[string]*rtspSession
+	conns    map[*rtspConn]bool
+
+	wg sync.WaitGroup
+}
+
+// rtspSession is a session, guarded by RTSPServer.lock
+type rtspSession struct {
+	RTSPSession
+
+	seen time.Time
+
+	// dst and rtcpPort are of UDP sessions
+	dst      *net.UDPAddr
+	rtcpPort int
+
+	// conn, channel and queue are of TCP sessions
+	conn    *rtspConn
+	channel int
+	queue   chan []byte
+}
+
+// rtspConn is a client connection, writes are from the
+// connection and its TCP sessions
+type rtspConn struct {
+	c net.Conn
+
+	wlock sync.Mutex
+}
+
+// rtspResponse is a response without CSeq
+type rtspResponse struct {
+	code   int
+	header []string
+	body   []byte
+}
+
+// rtspTransport is the Transport chosen in SETUP
+type rtspTransport struct {
+	tcp bool
+
+	// ports are client ports of UDP, or channels of TCP
+	ports [2]int
+}
+
+// Start serves RTSP on addr
+func (s *RTSPServer) Start(addr string) error {
+
+	s.lock.Lock()
+
+	defer s.lock.Unlock()
+
+	if s.ln != nil {
+		return errRTSPRunning
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	rtp, rtcp, err := listenUDPPair()
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	s.ln, s.rtp, s.rtcp = ln, rtp, rtcp
+	s.done = make(chan struct{})
+	s.taps = make(map[int]*rtspTap)
+	s.sessions = make(map[string]*rtspSession)
+	s.conns = make(map[*rtspConn]bool)
+
+	s.wg.Add(3)
+	go s.accept(ln)
+	go s.readRTCP(rtcp)
+	go s.reap(s.done)
+
+	comm.Info.Printf("RTSP server listening on %s, RTP on port %d", ln.Addr(),
+		rtp.LocalAddr().(*net.UDPAddr).Port)
+
+	return nil
+}
+
+// Stop stops serving, all sessions and taps are closed
+func (s *RTSPServer) Stop() {
+	s.lock.Lock()
+
+	if s.ln == nil {
+		s.lock.Unlock()
+		return
+	}
+
+	close(s.done)
+	s.ln.Close()
+	s.rtcp.Close()
+	s.ln = nil
+
+	for _, sess := range s.sessions {
+		s.remove(sess)
+	}
+
+	var conns []*rtspConn
+	for rc := range s.conns {
+		conns = append(conns, rc)
+	}
+
+	taps := s.taps
+	s.taps = nil
+
+	s.lock.Unlock()
+
+	for _, rc := range conns {
+		rc.c.Close()
+	}
+
+	for _, t := range taps {
+		t.halt()
+	}
+
+	s.wg.Wait()
+	s.rtp.Close()
+}
+
+// Addr is the address serving on, nil if not running
+func (s *RTSPServer) Addr() net.Addr {
+	s.lock.Lock()
+
+	defer s.lock.Unlock()
+
+	if s.ln == nil {
+		return nil
+	}
+
+	return s.ln.Addr()
+}
+
+// Publish pulls encode pipe of id, and serves it as
+// rtsp://host/path/{id}
+func (s *RTSPServer) Publish(id int) error {
+	t := &rtspTap{svr: s, id: id}
+
+	if err := Pipes[PipeEncoder].AllocPull(id, t); err != nil {
+		return err
+	}
+
+	return s.addTap(t)
+}
+
+// addTap starts receiving of t
+func (s *RTSPServer) addTap(t *rtspTap) error {
+	s.lock.Lock()
+
+	defer s.lock.Unlock()
+
+	if s.ln == nil {
+		return errRTSPNotRunning
+	}
+
+	if _, ok := s.taps[t.id]; ok {
+		return nil
+	}
+
+	if err := t.start(); err != nil {
+		return err
+	}
+
+	s.taps[t.id] = t
+
+	return nil
+}
+
+// Sessions returns all sessions, oldest first
+func (s *RTSPServer) Sessions() []RTSPSession {
+	s.lock.Lock()
+
+	defer s.lock.Unlock()
+
+	out := []RTSPSession{}
+	for _, sess := range s.sessions {
+		out = append(out, sess.RTSPSession)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Start.Equal(out[j].Start) {
+			return out[i].Start.Before(out[j].Start)
+		}
+		return out[i].ID < out[j].ID
+	})
+
+	return out
+}
+
+// Kick ends session of id. The connection of a TCP session is
+// closed as well
+func (s *RTSPServer) Kick(id string) error {
+	s.lock.Lock()
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		s.lock.Unlock()
+		return errRTSPNoSession
+	}
+
+	s.remove(sess)
+	s.lock.Unlock()
+
+	if sess.conn != nil {
+		sess.conn.c.Close()
+	}
+
+	comm.Info.Printf("RTSP session %s of path %d kicked", id, sess.Path)
+
+	return nil
+}
+
+// remove removes sess, s.lock must be held
+func (s *RTSPServer) remove(sess *rtspSession) {
+	delete(s.sessions, sess.ID)
+
+	if sess.queue != nil {
+		close(sess.queue)
+		sess.queue = nil
+	}
+}
+
+// send sends pkt of path id to sessions playing
+func (s *RTSPServer) send(id int, pkt []byte) {
+	s.lock.Lock()
+
+	defer s.lock.Unlock()
+
+	for _, sess := range s.sessions {
+		if sess.Path != id || !sess.Playing {
+			continue
+		}
+
+		if sess.queue != nil {
+			frame := make([]byte, 4, 4+len(pkt))
+			frame[0], frame[1] = '$', byte(sess.channel)
+			binary.BigEndian.PutUint16(frame[2:], uint16(len(pkt)))
+
+			select {
+			case sess.queue <- append(frame, pkt...):
+			default:
+				sess.Dropped++
+				continue
+			}
+		} else if _, err := s.rtp.WriteToUDP(pkt, sess.dst); err != nil {
+			// the client may be gone, it's reaped later
+			continue
+		}
+
+		sess.Packets++
+		sess.Bytes += int64(len(pkt))
+	}
+}
+
+func (s *RTSPServer) accept(ln net.Listener) {
+	defer s.wg.Done()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			// closed by Stop
+			return
+		}
+
+		rc := &rtspConn{c: c}
+
+		s.lock.Lock()
+		if s.ln == nil {
+			s.lock.Unlock()
+			c.Close()
+			return
+		}
+		s.conns[rc] = true
+		s.wg.Add(1)
+		s.lock.Unlock()
+
+		go s.serve(rc)
+	}
+}
+
+// serve reads requests of rc until it's closed
+func (s *RTSPServer) serve(rc *rtspConn) {
+	defer s.wg.Done()
+	defer s.closeConn(rc)
+
+	br := bufio.NewReader(rc.c)
+	tp := textproto.NewReader(br)
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return
+		}
+
+		// interleaved RTCP of the client
+		if b[0] == '$' {
+			var hdr [4]byte
+			if _, err := io.ReadFull(br, hdr[:]); err != nil {
+				return
+			}
+			if _, err := br.Discard(int(binary.BigEndian.Uint16(hdr[2:]))); err != nil {
+				return
+			}
+			continue
+		}
+
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		if line == "" {
+			continue
+		}
+
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+
+		if n, err := strconv.Atoi(header.Get("Content-Length")); err == nil && n > 0 {
+			if _, err := br.Discard(n); err != nil {
+				return
+			}
+		}
+
+		req := strings.Fields(line)
+		if len(req) != 3 || !strings.HasPrefix(req[2], "RTSP/") {
+			rc.write((&rtspResponse{code: 400}).bytes(header.Get("CSeq")))
+			return
+		}
+
+		resp := s.handle(rc, req[0], req[1], header)
+		if err := rc.write(resp.bytes(header.Get("CSeq"))); err != nil {
+			return
+		}
+	}
+}
+
+// closeConn closes rc, and its TCP sessions
+func (s *RTSPServer) closeConn(rc *rtspConn) {
+	s.lock.Lock()
+
+	delete(s.conns, rc)
+	for _, sess := range s.sessions {
+		if sess.conn == rc {
+			s.remove(sess)
+		}
+	}
+
+	s.lock.Unlock()
+
+	rc.c.Close()
+}
+
+// handle handles one request
+func (s *RTSPServer) handle(rc *rtspConn, method string, uri string,
+	header textproto.MIMEHeader) *rtspResponse {
+
+	sessID := strings.TrimSpace(strings.SplitN(header.Get("Session"), ";", 2)[0])
+
+	s.lock.Lock()
+	sess := s.sessions[sessID]
+	if sess != nil {
+		sess.seen = time.Now()
+	}
+	s.lock.Unlock()
+
+	switch method {
+	case "OPTIONS":
+		return &rtspResponse{code: 200, header: []string{"Public: " + rtspMethods}}
+
+	case "DESCRIBE":
+		return s.describe(rc, uri)
+
+	case "SETUP":
+		if sess != nil {
+			return &rtspResponse{code: 455}
+		}
+		return s.setup(rc, uri, header.Get("Transport"))
+
+	case "PLAY", "TEARDOWN":
+		if sess == nil {
+			return &rtspResponse{code: 454}
+		}
+
+		s.lock.Lock()
+		if method == "PLAY" {
+			sess.Playing = true
+		} else {
+			s.remove(sess)
+		}
+		s.lock.Unlock()
+
+		resp := &rtspResponse{code: 200, header: []string{"Session: " + sess.ID}}
+		if method == "PLAY" {
+			resp.header = append(resp.header, "Range: npt=now-")
+			comm.Info.Printf("RTSP session %s of path %d playing to %s over %s",
+				sess.ID, sess.Path, sess.Client, sess.Transport)
+		}
+		return resp
+
+	case "GET_PARAMETER":
+		// keep-alive
+		if sessID != "" && sess == nil {
+			return &rtspResponse{code: 454}
+		}
+		return &rtspResponse{code: 200}
+	}
+
+	return &rtspResponse{code: 501}
+}
+
+// describe replies SDP of the stream
+func (s *RTSPServer) describe(rc *rtspConn, uri string) *rtspResponse {
+	id, err := rtspPathOf(uri)
+	if err != nil {
+		return &rtspResponse{code: 404}
+	}
+
+	s.lock.Lock()
+	t := s.taps[id]
+	s.lock.Unlock()
+
+	if t == nil {
+		return &rtspResponse{code: 404}
+	}
+
+	host, _, _ := net.SplitHostPort(rc.c.LocalAddr().String())
+	sdp, err := t.sdp(host)
+	if err != nil {
+		return &rtspResponse{code: 503}
+	}
+
+	base := uri
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+
+	return &rtspResponse{code: 200, header: []string{
+		"Content-Base: " + base,
+		"Content-Type: application/sdp",
+	}, body: sdp}
+}
+
+// setup adds a session
+func (s *RTSPServer) setup(rc *rtspConn, uri string, transport string) *rtspResponse {
+	id, err := rtspPathOf(uri)
+	if err != nil {
+		return &rtspResponse{code: 404}
+	}
+
+	tr, err := parseTransport(transport)
+	if err != nil {
+		return &rtspResponse{code: 461}
+	}
+
+	s.lock.Lock()
+
+	defer s.lock.Unlock()
+
+	t := s.taps[id]
+	if t == nil {
+		return &rtspResponse{code: 404}
+	}
+
+	now := time.Now()
+	sess := &rtspSession{RTSPSession: RTSPSession{ID: newSessionID(), Path: id,
+		Client: rc.c.RemoteAddr().String(), Start: now}, seen: now}
+
+	var reply string
+	if tr.tcp {
+		sess.Transport = "TCP"
+		sess.conn, sess.channel = rc, tr.ports[0]
+		sess.queue = make(chan []byte, rtspQueue)
+
+		s.wg.Add(1)
+		go s.writeQueue(rc, sess.queue)
+
+		reply = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;ssrc=%08X",
+			tr.ports[0], tr.ports[1], t.ssrc())
+	} else {
+		sess.Transport = "UDP"
+
+		ip := rc.c.RemoteAddr().(*net.TCPAddr).IP
+		sess.dst = &net.UDPAddr{IP: ip, Port: tr.ports[0]}
+		sess.rtcpPort = tr.ports[1]
+
+		port := s.rtp.LocalAddr().(*net.UDPAddr).Port
+		reply = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d;ssrc=%08X",
+			tr.ports[0], tr.ports[1], port, port+1, t.ssrc())
+	}
+
+	s.sessions[sess.ID] = sess
+
+	return &rtspResponse{code: 200, header: []string{
+		"Transport: " + reply,
+		fmt.Sprintf("Session: %s;timeout=%d", sess.ID, int(rtspTimeout.Seconds())),
+	}}
+}
+
+// writeQueue writes packets of a TCP session, until the
+// session is removed
+func (s *RTSPServer) writeQueue(rc *rtspConn, queue chan []byte) {
+	defer s.wg.Done()
+
+	for frame := range queue {
+		if err := rc.write(frame); err != nil {
+			// serve ends, and the session is removed
+			rc.c.Close()
+		}
+	}
+}
+
+// readRTCP keeps UDP sessions alive by RTCP of clients
+func (s *RTSPServer) readRTCP(conn *net.UDPConn) {
+	defer s.wg.Done()
+
+	buf := make([]byte, 2048)
+	for {
+		_, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// closed by Stop
+			return
+		}
+
+		s.lock.Lock()
+		for _, sess := range s.sessions {
+			if sess.dst != nil && sess.dst.IP.Equal(addr.IP) &&
+				sess.rtcpPort == addr.Port {
+				sess.seen = time.Now()
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+// reap removes UDP sessions timed out
+func (s *RTSPServer) reap(done chan struct{}) {
+	defer s.wg.Done()
+
+	tick := time.NewTicker(rtspTimeout / 6)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+		}
+
+		s.lock.Lock()
+		for _, sess := range s.sessions {
+			if sess.conn == nil && time.Since(sess.seen) > rtspTimeout {
+				comm.Info.Printf("RTSP session %s of path %d timed out", sess.ID, sess.Path)
+				s.remove(sess)
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+func (rc *rtspConn) write(b []byte) error {
+	rc.wlock.Lock()
+
+	defer rc.wlock.Unlock()
+
+	rc.c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := rc.c.Write(b)
+
+	return err
+}
+
+// bytes returns the response with cseq
+func (r *rtspResponse) bytes(cseq string) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "RTSP/1.0 %d %s\r\n", r.code, rtspStatus[r.code])
+	if cseq != "" {
+		fmt.Fprintf(&b, "CSeq: %s\r\n", cseq)
+	}
+	b.WriteString("Server: Aqua\r\n")
+	for _, h := range r.header {
+		b.WriteString(h + "\r\n")
+	}
+	if len(r.body) > 0 {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(r.body))
+	}
+	b.WriteString("\r\n")
+	b.Write(r.body)
+
+	return b.Bytes()
+}
+
+// rtspPathOf returns the path ID of uri, like
+// rtsp://host/path/1, and its control rtsp://host/path/1/trackID=0
+func rtspPathOf(uri string) (int, error) {
+	u, err := url.Parse(uri)
+	if err != nil || !strings.HasPrefix(u.Path, "/path/") {
+		return 0, errRTSPNoPath
+	}
+
+	args := strings.Split(strings.TrimSuffix(strings.TrimPrefix(u.Path, "/path/"), "/"), "/")
+	if len(args) > 2 || (len(args) == 2 && args[1] != "trackID=0") {
+		return 0, errRTSPNoPath
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil || id <= 0 {
+		return 0, errRTSPNoPath
+	}
+
+	return id, nil
+}
+
+// parseTransport chooses the first unicast transport supported
+func parseTransport(v string) (rtspTransport, error) {
+	for _, spec := range strings.Split(v, ",") {
+		params := strings.Split(strings.TrimSpace(spec), ";")
+
+		var tr rtspTransport
+		switch strings.ToUpper(params[0]) {
+		case "RTP/AVP", "RTP/AVP/UDP":
+		case "RTP/AVP/TCP":
+			tr.tcp = true
+			tr.ports = [2]int{0, 1}
+		default:
+			continue
+		}
+
+		ok, multicast := tr.tcp, false
+		for _, p := range params[1:] {
+			kv := strings.SplitN(p, "=", 2)
+
+			var ports *[2]int
+			switch {
+			case kv[0] == "multicast":
+				multicast = true
+			case kv[0] == "client_port" && !tr.tcp:
+				ports = &tr.ports
+			case kv[0] == "interleaved" && tr.tcp:
+				ports = &tr.ports
+			}
+
+			if ports == nil || len(kv) != 2 {
+				continue
+			}
+
+			lo, hi, err := portRange(kv[1])
+			if err != nil {
+				ok = false
+				break
+			}
+			*ports = [2]int{lo, hi}
+			ok = true
+		}
+
+		if ok && !multicast {
+			return tr, nil
+		}
+	}
+
+	return rtspTransport{}, errRTSPTransport
+}
+
+// portRange parses "a-b" or "a", b is a+1 then
+func portRange(v string) (int, int, error) {
+	args := strings.SplitN(v, "-", 2)
+
+	lo, err := strconv.Atoi(args[0])
+	if err != nil || lo < 0 || lo > 65535 {
+		return 0, 0, errRTSPTransport
+	}
+
+	hi := lo + 1
+	if len(args) == 2 {
+		if hi, err = strconv.Atoi(args[1]); err != nil || hi < 0 || hi > 65535 {
+			return 0, 0, errRTSPTransport
+		}
+	}
+
+	return lo, hi, nil
+}
+
+// listenUDPPair listens on an even port for RTP, and the next
+// for RTCP
+func listenUDPPair() (*net.UDPConn, *net.UDPConn, error) {
+	for i := 0; i < 16; i++ {
+		rtp, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if port := rtp.LocalAddr().(*net.UDPAddr).Port; port%2 == 0 {
+			rtcp, err := net.ListenUDP("udp", &net.UDPAddr{Port: port + 1})
+			if err == nil {
+				return rtp, rtcp, nil
+			}
+		}
+
+		rtp.Close()
+	}
+
+	return nil, nil, errRTSPPorts
+}
+
+func newSessionID() string {
+	return fmt.Sprintf("%08X%08X", rand.Uint32(), rand.Uint32())
+}
+
+// rtspTap is a Decoder pulling an encode pipe for RTSPServer.
+// Streams are re-packed in RTP of its own, so sessions always
+// get MPEG-TS of PT 33
+type rtspTap struct {
+	svr *RTSPServer
+
+	id int
+
+	lock sync.Mutex
+
+	port int
+	conn *net.UDPConn
+	done chan struct{}
+
+	rtp *rtpPacketizer
+
+	received int64
+	lastRecv time.Time
+
+	// bitRate is measured in bits/s every second
+	bitRate   int64
+	rateBytes int64
+	rateStart time.Time
+}
+
+// Control method
+func (t *rtspTap) Control(c CtlCmd, arg interface{}) interface{} {
+	switch c {
+	case CtlCmdName:
+		return fmt.Sprintf("%s_%d", rtspTapName, t.id)
+
+	case CtlCmdIP:
+		return t.svr.IP
+
+	case CtlCmdWorkerID:
+		return rtspTapBase + t.id - 1
+
+	default:
+	}
+	return nil
+}
+
+// Monitor method
+func (t *rtspTap) Monitor() bool {
+	t.lock.Lock()
+
+	defer t.lock.Unlock()
+
+	return t.conn != nil && time.Since(t.lastRecv) < recordStall
+}
+
+// Decode method
+func (t *rtspTap) Decode(sess *Session) error {
+
+	t.lock.Lock()
+
+	defer t.lock.Unlock()
+
+	t.port = sess.Port(StreamVideo)
+	return nil
+}
+
+func (t *rtspTap) ssrc() uint32 {
+	t.lock.Lock()
+
+	defer t.lock.Unlock()
+
+	if t.rtp == nil {
+		return 0
+	}
+
+	return t.rtp.ssrc
+}
+
+// start starts receiving on port
+func (t *rtspTap) start() error {
+	t.lock.Lock()
+
+	defer t.lock.Unlock()
+
+	if t.port == 0 {
+		return errInputError
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: t.port})
+	if err != nil {
+		return err
+	}
+
+	t.conn = conn
+	t.done = make(chan struct{})
+	t.rtp = newRTPPacketizer()
+	t.rateStart = time.Now()
+
+	go t.receive(conn, t.done)
+
+	return nil
+}
+
+// halt stops receiving
+func (t *rtspTap) halt() {
+	t.lock.Lock()
+	conn, done := t.conn, t.done
+	t.conn, t.done = nil, nil
+	t.lock.Unlock()
+
+	if conn != nil {
+		conn.Close()
+		<-done
+	}
+}
+
+// receive re-packs TS until conn is closed
+func (t *rtspTap) receive(conn *net.UDPConn, done chan struct{}) {
+
+	defer close(done)
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			// closed by halt
+			return
+		}
+
+		now := time.Now()
+		ts90k := now.UnixNano() / 100000 * 9
+
+		var pkts [][]byte
+		for ts := tsOfRTP(buf[:n]); len(ts) >= tsPacketSize; ts = ts[tsPacketSize:] {
+			pkts = append(pkts, ts[:tsPacketSize])
+		}
+
+		for len(pkts) > 0 {
+			num := tsPerRTP
+			if num > len(pkts) {
+				num = len(pkts)
+			}
+
+			t.lock.Lock()
+			pkt := t.rtp.packet(ts90k, pkts[:num])
+			t.lock.Unlock()
+
+			t.svr.send(t.id, pkt)
+
+			pkts = pkts[num:]
+		}
+
+		t.lock.Lock()
+		t.received += int64(n)
+		t.lastRecv = now
+		t.rateBytes += int64(n)
+		if d := now.Sub(t.rateStart); d >= time.Second {
+			t.bitRate = t.rateBytes * 8 * int64(time.Second) / int64(d)
+			t.rateBytes, t.rateStart = 0, now
+		}
+		t.lock.Unlock()
+	}
+}
+
+// sdp describes the stream, host is the address of the server
+func (t *rtspTap) sdp(host string) ([]byte, error) {
+	t.lock.Lock()
+
+	defer t.lock.Unlock()
+
+	if t.conn == nil || time.Since(t.lastRecv) >= recordStall {
+		return nil, errRTSPNotReady
+	}
+
+	family := "IP4"
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		family = "IP6"
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "v=0\r\no=- %d 1 IN %s %s\r\n", t.rtp.ssrc, family, host)
+	fmt.Fprintf(&b, "s=Aqua path %d\r\nc=IN %s %s\r\nt=0 0\r\n", t.id, family,
+		map[string]string{"IP4": "0.0.0.0", "IP6": "::"}[family])
+	b.WriteString("a=control:*\r\na=range:npt=now-\r\n")
+	b.WriteString("m=video 0 RTP/AVP 33\r\n")
+	if t.bitRate > 0 {
+		fmt.Fprintf(&b, "b=AS:%d\r\n", (t.bitRate+999)/1000)
+	}
+	b.WriteString("a=rtpmap:33 MP2T/90000\r\na=control:trackID=0\r\n")
+
+	return b.Bytes(), nil
+}
@@ -0,0 +1,296 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseTransport(t *testing.T) {
+	tests := []struct {
+		v       string
+		want    rtspTransport
+		wantErr bool
+	}{
+		{"RTP/AVP;unicast;client_port=5000-5001", rtspTransport{ports: [2]int{5000, 5001}}, false},
+		{"RTP/AVP/UDP;unicast;client_port=5000", rtspTransport{ports: [2]int{5000, 5001}}, false},
+		{"RTP/AVP/TCP;unicast;interleaved=2-3", rtspTransport{tcp: true, ports: [2]int{2, 3}}, false},
+		{"RTP/AVP/TCP;unicast", rtspTransport{tcp: true, ports: [2]int{0, 1}}, false},
+		{"RTP/AVP;multicast;client_port=5000-5001,RTP/AVP/TCP;interleaved=0-1",
+			rtspTransport{tcp: true, ports: [2]int{0, 1}}, false},
+		{"RTP/AVP;unicast", rtspTransport{}, true},
+		{"RTP/AVP;unicast;client_port=x", rtspTransport{}, true},
+		{"RAW/RAW/UDP;unicast;client_port=5000", rtspTransport{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTransport(tt.v)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseTransport(%s) = %v, %v", tt.v, got, err)
+		}
+	}
+}
+
+func Test_rtspPathOf(t *testing.T) {
+	tests := []struct {
+		uri     string
+		want    int
+		wantErr bool
+	}{
+		{"rtsp://127.0.0.1:8554/path/1", 1, false},
+		{"rtsp://127.0.0.1/path/12/", 12, false},
+		{"rtsp://127.0.0.1/path/3/trackID=0", 3, false},
+		{"rtsp://127.0.0.1/path/3/trackID=1", 0, true},
+		{"rtsp://127.0.0.1/path/0", 0, true},
+		{"rtsp://127.0.0.1/live/1", 0, true},
+		{"*", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := rtspPathOf(tt.uri)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("rtspPathOf(%s) = %d, %v", tt.uri, got, err)
+		}
+	}
+}
+
+// rtspClient is a minimal client for tests
+type rtspClient struct {
+	t *testing.T
+
+	conn net.Conn
+	br   *bufio.Reader
+	cseq int
+}
+
+func (c *rtspClient) do(method, uri string, header ...string) (int, textproto.MIMEHeader, []byte) {
+	c.cseq++
+	req := fmt.Sprintf("%s %s RTSP/1.0\r\nCSeq: %d\r\n", method, uri, c.cseq)
+	for _, h := range header {
+		req += h + "\r\n"
+	}
+	if _, err := c.conn.Write([]byte(req + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+
+	// skip RTP ahead of the response
+	for {
+		b, err := c.br.Peek(1)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if b[0] != '$' {
+			break
+		}
+		c.frame()
+	}
+
+	tp := textproto.NewReader(c.br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	resp, err := tp.ReadMIMEHeader()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if resp.Get("CSeq") != strconv.Itoa(c.cseq) {
+		c.t.Errorf("%s CSeq = %s", method, resp.Get("CSeq"))
+	}
+
+	body := make([]byte, 0)
+	if n, _ := strconv.Atoi(resp.Get("Content-Length")); n > 0 {
+		body = make([]byte, n)
+		if _, err := io.ReadFull(c.br, body); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+
+	code, _ := strconv.Atoi(strings.Fields(line)[1])
+	return code, resp, body
+}
+
+// frame reads an interleaved frame
+func (c *rtspClient) frame() (int, []byte) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil || hdr[0] != '$' {
+		c.t.Fatalf("frame() = %v, %v", hdr, err)
+	}
+
+	pkt := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(c.br, pkt); err != nil {
+		c.t.Fatal(err)
+	}
+
+	return int(hdr[1]), pkt
+}
+
+func TestRTSPServer(t *testing.T) {
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	l.Close()
+
+	s := &RTSPServer{IP: net.IPv4(127, 0, 0, 1)}
+	if err := s.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	tap := &rtspTap{svr: s, id: 1}
+	tap.Decode(&Session{Streams: []Stream{{Name: StreamVideo, RTP: port}}})
+	if err := s.addTap(tap); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	c := &rtspClient{t: t, conn: conn, br: bufio.NewReader(conn)}
+	uri := "rtsp://" + s.Addr().String() + "/path/1"
+
+	if code, h, _ := c.do("OPTIONS", "*"); code != 200 || !strings.Contains(h.Get("Public"), "DESCRIBE") {
+		t.Errorf("OPTIONS = %d, %v", code, h)
+	}
+
+	if code, _, _ := c.do("DESCRIBE", uri); code != 503 {
+		t.Errorf("DESCRIBE = %d before stream", code)
+	}
+	if code, _, _ := c.do("DESCRIBE", "rtsp://"+s.Addr().String()+"/path/2"); code != 404 {
+		t.Errorf("DESCRIBE = %d of path not published", code)
+	}
+
+	// raw TS into the pipe
+	src, _ := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	defer src.Close()
+	ts := bytes.Repeat(append([]byte{0x47, 0x01, 0x00, 0x10}, make([]byte, 184)...), tsPerRTP)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				src.Write(ts)
+			}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	code, h, sdp := c.do("DESCRIBE", uri)
+	if code != 200 || h.Get("Content-Type") != "application/sdp" ||
+		h.Get("Content-Base") != uri+"/" ||
+		!bytes.Contains(sdp, []byte("m=video 0 RTP/AVP 33\r\n")) ||
+		!bytes.Contains(sdp, []byte("a=rtpmap:33 MP2T/90000\r\n")) {
+		t.Fatalf("DESCRIBE = %d, %v\n%s", code, h, sdp)
+	}
+
+	// TCP interleaved
+	code, h, _ = c.do("SETUP", uri+"/trackID=0", "Transport: RTP/AVP/TCP;unicast;interleaved=0-1")
+	if code != 200 || !strings.HasPrefix(h.Get("Transport"), "RTP/AVP/TCP;unicast;interleaved=0-1") {
+		t.Fatalf("SETUP = %d, %v", code, h)
+	}
+	sessTCP := strings.Split(h.Get("Session"), ";")[0]
+
+	if code, _, _ := c.do("PLAY", uri, "Session: "+sessTCP); code != 200 {
+		t.Fatalf("PLAY = %d", code)
+	}
+
+	ch, pkt := c.frame()
+	if ch != 0 || pkt[1] != 33 || !bytes.Equal(tsOfRTP(pkt), ts) {
+		t.Errorf("frame() = %d, %d bytes", ch, len(pkt))
+	}
+
+	// UDP
+	rtp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtp.Close()
+	rtpPort := rtp.LocalAddr().(*net.UDPAddr).Port
+
+	code, h, _ = c.do("SETUP", uri, fmt.Sprintf("Transport: RTP/AVP;unicast;client_port=%d-%d", rtpPort, rtpPort+1))
+	if code != 200 || !strings.Contains(h.Get("Transport"), "server_port=") {
+		t.Fatalf("SETUP = %d, %v", code, h)
+	}
+	sessUDP := strings.Split(h.Get("Session"), ";")[0]
+
+	if code, _, _ := c.do("PLAY", uri, "Session: "+sessUDP); code != 200 {
+		t.Fatalf("PLAY = %d", code)
+	}
+
+	buf := make([]byte, 2048)
+	rtp.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err := rtp.Read(buf)
+	if err != nil || buf[1] != 33 || !bytes.Equal(tsOfRTP(buf[:n]), ts) {
+		t.Errorf("Read() = %d, %v", n, err)
+	}
+
+	sessions := s.Sessions()
+	if len(sessions) != 2 || sessions[0].Transport != "TCP" || sessions[1].Transport != "UDP" ||
+		sessions[0].Path != 1 || !sessions[1].Playing {
+		t.Fatalf("Sessions() = %+v", sessions)
+	}
+
+	if code, _, _ := c.do("TEARDOWN", uri, "Session: "+sessUDP); code != 200 {
+		t.Errorf("TEARDOWN = %d", code)
+	}
+	if code, _, _ := c.do("PLAY", uri, "Session: "+sessUDP); code != 454 {
+		t.Errorf("PLAY = %d after TEARDOWN", code)
+	}
+
+	if err := s.Kick("none"); err != errRTSPNoSession {
+		t.Errorf("Kick() = %v", err)
+	}
+	if err := s.Kick(sessTCP); err != nil {
+		t.Errorf("Kick() = %v", err)
+	}
+	if sessions := s.Sessions(); len(sessions) != 0 {
+		t.Errorf("Sessions() = %+v after Kick", sessions)
+	}
+}
+
+func TestRTSPServer_pullTwo(t *testing.T) {
+	s := &RTSPServer{IP: net.IPv4(127, 0, 0, 1)}
+	if err := s.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// taps of two paths, and a decoder of the host, pulled at once
+	a := &rtspTap{svr: s, id: 1}
+	b := &rtspTap{svr: s, id: 2}
+	hlss, _ := (&HLS{Slot: 37, IP: net.IPv4(127, 0, 0, 1)}).Open()
+
+	free := pullAtOnce(t, a, b, hlss[0])
+	defer free()
+
+	for _, tap := range []*rtspTap{a, b} {
+		if err := s.addTap(tap); err != nil {
+			t.Errorf("addTap(%d) error = %v", tap.id, err)
+		}
+	}
+
+	if err, ok := hlss[0].Control(CtlCmdStart, nil).(error); ok {
+		t.Errorf("Start error = %v", err)
+	}
+	defer hlss[0].Control(CtlCmdStop, nil)
+}
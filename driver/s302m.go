@@ -0,0 +1,75 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"math"
+	"math/bits"
+)
+
+// SMPTE 302M is uncompressed PCM in MPEG-TS, so tone needs no
+// audio encoder
+
+// audio of the test pattern, 48kHz stereo 16 bits
+const (
+	audioRate  = 48000
+	audioFrame = 1920
+
+	// toneHz at -20dBFS
+	toneHz = 1000
+)
+
+// s302mRegistration is the registration descriptor of 302M
+var s302mRegistration = []byte{0x05, 4, 'B', 'S', 'S', 'D'}
+
+// toneTable is one period of tone
+var toneTable = func() []int16 {
+	t := make([]int16, audioRate/toneHz)
+	for i := range t {
+		t[i] = int16(3277 * math.Sin(2*math.Pi*float64(i)/float64(len(t))))
+	}
+	return t
+}()
+
+// tone returns n stereo samples of tone, from sample pos
+func tone(pos int64, n int) []int16 {
+	all := make([]int16, 0, 2*n)
+	for i := 0; i < n; i++ {
+		v := toneTable[(pos+int64(i))%int64(len(toneTable))]
+		all = append(all, v, v)
+	}
+
+	return all
+}
+
+// s302m codes stereo samples, interleaved, as a 302M frame. pos
+// is the position of the first sample, for framing
+func s302m(samples []int16, pos int64) []byte {
+	size := len(samples) / 2 * 5
+
+	// 2 channels, 16 bits
+	out := make([]byte, 0, 4+size)
+	out = append(out, byte(size>>8), byte(size), 0, 0)
+
+	for i := 0; i+1 < len(samples); i += 2 {
+		l, r := uint16(samples[i]), uint16(samples[i+1])
+
+		// start of an AES3 block of 192 frames
+		vucf := byte(0)
+		if (pos+int64(i/2))%192 == 0 {
+			vucf = 0x10
+		}
+
+		out = append(out,
+			bits.Reverse8(byte(l)),
+			bits.Reverse8(byte(l>>8)),
+			bits.Reverse8(byte(r&0x0F)<<4)|vucf,
+			bits.Reverse8(byte(r>>4)),
+			bits.Reverse8(byte(r>>12)))
+	}
+
+	return out
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+// FieldType is the value type of a Field
+type FieldType string
+
+// FieldType const
+const (
+	FieldString FieldType = "string"
+	FieldInt    FieldType = "int"
+	FieldBool   FieldType = "bool"
+
+	// FieldWorker is a string, which is one of the worker names
+	FieldWorker FieldType = "worker"
+
+	// FieldStrings is a list of strings, Pattern applies to each
+	FieldStrings FieldType = "strings"
+)
+
+// Field describes one parameter, it's used by both manager
+// and web to handle parameters generically
+type Field struct {
+	// Name is the key in params
+	Name string
+
+	// Label is shown to the user
+	Label string
+
+	Type FieldType
+
+	// Required field must be given, or Default is used
+	Required bool
+	Default  interface{}
+
+	// Min and Max limit FieldInt, only if Max > Min
+	Min int
+	Max int
+
+	// Enum limits FieldString if not empty
+	Enum []string
+
+	// Pattern is a regexp FieldString must match, if not empty
+	Pattern string
+}
+
+// Schema is all Fields of a worker's settings, which are
+// passed by CtlCmdSetting
+type Schema []Field
+
+// GetWorkerSchema get Worker's Schema, nil if the worker takes
+// no settings
+func GetWorkerSchema(w Worker) Schema {
+	if s, ok := w.Control(CtlCmdSchema, nil).(Schema); ok {
+		return s
+	}
+
+	return nil
+}
@@ -0,0 +1,668 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+// names of sub-cards
+const (
+	SRTInName  string = "srt_in"
+	SRTOutName string = "srt_out"
+)
+
+// SRT connection modes
+const (
+	SRTCaller     = "caller"
+	SRTListener   = "listener"
+	SRTRendezvous = "rendezvous"
+)
+
+// srtSchema is the settings of SRT workers. Address is "host:port"
+// to call or to meet, a listener takes ":port" too
+var srtSchema = Schema{
+	{Name: "Mode", Label: "连接模式", Type: FieldString, Default: SRTCaller,
+		Enum: []string{SRTCaller, SRTListener, SRTRendezvous}},
+	{Name: "Address", Label: "地址", Type: FieldString,
+		Pattern: `^(\S*:\d+)?$`},
+	{Name: "Latency", Label: "延迟(毫秒)", Type: FieldInt, Default: 120,
+		Min: 20, Max: 8000},
+	{Name: "Passphrase", Label: "密码", Type: FieldString,
+		Pattern: `^(.{10,79})?$`},
+	{Name: "StreamID", Label: "流ID", Type: FieldString,
+		Pattern: `^\S{0,512}$`},
+}
+
+// srtStatsEvery is packets between stats of srt-live-transmit
+const srtStatsEvery = 500
+
+var (
+	errSRTAddress = errors.New("Bad SRT address")
+)
+
+// srtStats is stats of srt-live-transmit in JSON, counters are
+// of the last interval
+type srtStats struct {
+	Link struct {
+		RTT       float64 `json:"rtt"`
+		Bandwidth float64 `json:"bandwidth"`
+	} `json:"link"`
+
+	Send srtCounters `json:"send"`
+	Recv srtCounters `json:"recv"`
+}
+
+type srtCounters struct {
+	Packets       int64   `json:"packets"`
+	Lost          int64   `json:"packetsLost"`
+	Dropped       int64   `json:"packetsDropped"`
+	Retransmitted int64   `json:"packetsRetransmitted"`
+	MbitRate      float64 `json:"mbitRate"`
+}
+
+// SRTIn is the main struct for sub-card, it's software only
+type SRTIn struct {
+	// Card Slot
+	Slot int
+
+	// Card IP
+	IP net.IP
+}
+
+// SRTOut is the main struct for sub-card, it's software only
+type SRTOut struct {
+	// Card Slot
+	Slot int
+
+	// Card IP
+	IP net.IP
+}
+
+// SRTInWorker is the main struct for sub-card's Worker. It
+// receives MPEG-TS by SRT, and sends it in RTP to the pipe
+type SRTInWorker struct {
+	lock sync.Mutex
+
+	workerID int
+
+	card *SRTIn
+
+	link srtLink
+
+	settings map[string]interface{}
+
+	dst  net.IP
+	port int
+}
+
+// SRTOutWorker is the main struct for sub-card's Worker. It
+// receives RTP from the pipe, and sends MPEG-TS by SRT
+type SRTOutWorker struct {
+	lock sync.Mutex
+
+	workerID int
+
+	card *SRTOut
+
+	link srtLink
+
+	settings map[string]interface{}
+
+	port int
+}
+
+// Open method
+func (s *SRTIn) Open() ([]Worker, error) {
+	var all []Worker
+	for i := 0; i < 2; i++ {
+		w := &SRTInWorker{workerID: i, card: s}
+		w.link.init(fmt.Sprintf("%s_%d_%d", SRTInName, s.Slot, i), true)
+
+		all = append(all, w)
+	}
+
+	return all, nil
+}
+
+// Close method
+func (s *SRTIn) Close() error {
+	return nil
+}
+
+// Open method
+func (s *SRTOut) Open() ([]Worker, error) {
+	var all []Worker
+	for i := 0; i < 2; i++ {
+		w := &SRTOutWorker{workerID: i, card: s}
+		w.link.init(fmt.Sprintf("%s_%d_%d", SRTOutName, s.Slot, i), false)
+
+		all = append(all, w)
+	}
+
+	return all, nil
+}
+
+// Close method
+func (s *SRTOut) Close() error {
+	return nil
+}
+
+// Control method
+func (w *SRTInWorker) Control(c CtlCmd, arg interface{}) interface{} {
+	switch c {
+	case CtlCmdStart:
+		w.lock.Lock()
+		uri, secret, err := srtURI(w.settings)
+		dst, port := w.dst, w.port
+		w.lock.Unlock()
+
+		if err != nil {
+			return err
+		}
+
+		if dst == nil || port == 0 {
+			return errInputError
+		}
+
+		if err := w.link.start(uri, secret, dst, port); err != nil {
+			return err
+		}
+
+	case CtlCmdStop:
+		if err := w.link.stop(); err != nil {
+			return err
+		}
+
+	case CtlCmdName:
+		return fmt.Sprintf("%s_%d_%d", SRTInName, w.card.Slot, w.workerID)
+
+	case CtlCmdIP:
+		return w.card.IP
+
+	case CtlCmdWorkerID:
+		return w.workerID
+
+	case CtlCmdSchema:
+		return srtSchema
+
+	case CtlCmdSetting:
+		if settings, ok := arg.(map[string]interface{}); ok {
+			w.lock.Lock()
+			w.settings = settings
+			w.lock.Unlock()
+		}
+
+	default:
+	}
+	return nil
+}
+
+// Monitor method
+func (w *SRTInWorker) Monitor() bool {
+	return w.link.healthy()
+}
+
+// Report method
+func (w *SRTInWorker) Report() []string {
+	return w.link.report()
+}
+
+// Logs method
+func (w *SRTInWorker) Logs() []string {
+	return w.link.sup.Logs()
+}
+
+// Encode method, a running link is restarted to the new
+// destination, or stopped if sess is invalid
+func (w *SRTInWorker) Encode(sess *Session) error {
+
+	if isInvalidSession(sess) {
+		w.lock.Lock()
+		w.dst, w.port = nil, 0
+		w.lock.Unlock()
+
+		return w.link.stop()
+	}
+
+	w.lock.Lock()
+	w.dst = sess.IP
+	w.port = sess.Port(StreamVideo)
+	w.lock.Unlock()
+
+	if !w.link.sup.Supervising() {
+		return nil
+	}
+
+	if err, ok := w.Control(CtlCmdStart, nil).(error); ok {
+		return err
+	}
+
+	return nil
+}
+
+// Control method
+func (w *SRTOutWorker) Control(c CtlCmd, arg interface{}) interface{} {
+	switch c {
+	case CtlCmdStart:
+		w.lock.Lock()
+		uri, secret, err := srtURI(w.settings)
+		port := w.port
+		w.lock.Unlock()
+
+		if err != nil {
+			return err
+		}
+
+		if port == 0 {
+			return errInputError
+		}
+
+		if err := w.link.start(uri, secret, nil, port); err != nil {
+			return err
+		}
+
+	case CtlCmdStop:
+		if err := w.link.stop(); err != nil {
+			return err
+		}
+
+	case CtlCmdName:
+		return fmt.Sprintf("%s_%d_%d", SRTOutName, w.card.Slot, w.workerID)
+
+	case CtlCmdIP:
+		return w.card.IP
+
+	case CtlCmdWorkerID:
+		return w.workerID
+
+	case CtlCmdSchema:
+		return srtSchema
+
+	case CtlCmdSetting:
+		if settings, ok := arg.(map[string]interface{}); ok {
+			w.lock.Lock()
+			w.settings = settings
+			w.lock.Unlock()
+		}
+
+	default:
+	}
+	return nil
+}
+
+// Monitor method
+func (w *SRTOutWorker) Monitor() bool {
+	return w.link.healthy()
+}
+
+// Report method
+func (w *SRTOutWorker) Report() []string {
+	return w.link.report()
+}
+
+// Logs method
+func (w *SRTOutWorker) Logs() []string {
+	return w.link.sup.Logs()
+}
+
+// Decode method
+func (w *SRTOutWorker) Decode(sess *Session) error {
+
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	w.port = sess.Port(StreamVideo)
+	return nil
+}
+
+// srtLink runs srt-live-transmit of a worker by Supervisor, which
+// speaks UDP with MPEG-TS on loopback. A relay between loopback
+// and the pipe adds or strips RTP
+type srtLink struct {
+	sup Supervisor
+
+	// in is SRT to the pipe, or the pipe to SRT
+	in bool
+
+	lock sync.Mutex
+
+	relay *udpRelay
+
+	// key is uri and the pipe end, to tell if to restart
+	key string
+
+	stats   srtStats
+	statsAt time.Time
+
+	// json is lines of stats not complete
+	json  []string
+	depth int
+
+	lastErr string
+}
+
+// init sets up l for worker name
+func (l *srtLink) init(name string, in bool) {
+	l.in = in
+	l.sup.Name = name
+	l.sup.OnStart = l.reset
+	l.sup.OnLine = l.parse
+}
+
+// start runs srt-live-transmit for uri. The pipe end is ip:port
+// for in, or port to listen. If it's running otherwise, it's
+// restarted
+func (l *srtLink) start(uri string, secret string, ip net.IP, port int) error {
+
+	key := fmt.Sprintf("%s %v:%d", uri, ip, port)
+
+	l.lock.Lock()
+	same := l.key == key
+	l.lock.Unlock()
+
+	if l.sup.Supervising() {
+		if same {
+			return nil
+		}
+
+		comm.Info.Printf("Restarting %s for new settings", l.sup.Name)
+		if err := l.stop(); err != nil {
+			return err
+		}
+	}
+
+	relay, local, err := l.newRelay(ip, port)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"-s:" + strconv.Itoa(srtStatsEvery), "-pf:json"}
+	if l.in {
+		args = append(args, uri, "udp://"+local)
+	} else {
+		args = append(args, "udp://"+local, uri)
+	}
+
+	l.sup.Redact = []string{url.QueryEscape(secret)}
+	if err := l.sup.Start(comm.AppCfg.SRTBin, args); err != nil {
+		relay.close()
+		return err
+	}
+
+	l.lock.Lock()
+	l.relay, l.key = relay, key
+	l.lock.Unlock()
+
+	return nil
+}
+
+// newRelay returns the relay and the loopback address of
+// srt-live-transmit
+func (l *srtLink) newRelay(ip net.IP, port int) (*udpRelay, string, error) {
+	loopback := net.IPv4(127, 0, 0, 1)
+
+	if l.in {
+		in, err := net.ListenUDP("udp", &net.UDPAddr{IP: loopback})
+		if err != nil {
+			return nil, "", err
+		}
+
+		out, err := net.Dial("udp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err != nil {
+			in.Close()
+			return nil, "", err
+		}
+
+		rtp := newRTPPacketizer()
+		epoch := time.Now()
+		wrap := func(p []byte) []byte {
+			var ts [][]byte
+			for ; len(p) >= tsPacketSize; p = p[tsPacketSize:] {
+				ts = append(ts, p[:tsPacketSize])
+			}
+			return rtp.packet(int64(time.Since(epoch)*90000/time.Second), ts)
+		}
+
+		return newUDPRelay(in, out, wrap), in.LocalAddr().String(), nil
+	}
+
+	// a free port of loopback for srt-live-transmit
+	free, err := net.ListenUDP("udp", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		return nil, "", err
+	}
+	local := free.LocalAddr().String()
+	free.Close()
+
+	in, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, "", err
+	}
+
+	out, err := net.Dial("udp", local)
+	if err != nil {
+		in.Close()
+		return nil, "", err
+	}
+
+	return newUDPRelay(in, out, tsOfRTP), local, nil
+}
+
+// stop stops srt-live-transmit and the relay
+func (l *srtLink) stop() error {
+	err := l.sup.Stop()
+
+	l.lock.Lock()
+	relay := l.relay
+	l.relay, l.key = nil, ""
+	l.lock.Unlock()
+
+	if relay != nil {
+		relay.close()
+	}
+
+	return err
+}
+
+// healthy tells if srt-live-transmit is running, and data passed
+// within AppCfg.SRTStall
+func (l *srtLink) healthy() bool {
+	if !l.sup.Alive() {
+		return false
+	}
+
+	l.lock.Lock()
+	relay := l.relay
+	l.lock.Unlock()
+
+	return relay != nil && relay.active(comm.AppCfg.SRTStall)
+}
+
+// report returns the process status, and SRT stats
+func (l *srtLink) report() []string {
+	all := l.sup.Report()
+
+	l.lock.Lock()
+
+	defer l.lock.Unlock()
+
+	if l.relay != nil {
+		all = append(all, fmt.Sprintf("%d packets relayed", l.relay.count()))
+	}
+
+	if !l.statsAt.IsZero() {
+		c := l.stats.Recv
+		if !l.in {
+			c = l.stats.Send
+		}
+
+		all = append(all, fmt.Sprintf("rtt %.1fms, %.2fMbps, lost %d, retransmitted %d, dropped %d at %s",
+			l.stats.Link.RTT, c.MbitRate, c.Lost, c.Retransmitted, c.Dropped,
+			l.statsAt.Format(time.RFC3339)))
+	}
+
+	if l.lastErr != "" {
+		all = append(all, "error: "+l.lastErr)
+	}
+
+	return all
+}
+
+// reset is called when a process is started
+func (l *srtLink) reset() {
+
+	l.lock.Lock()
+
+	defer l.lock.Unlock()
+
+	l.stats, l.statsAt = srtStats{}, time.Time{}
+	l.json, l.depth = nil, 0
+	l.lastErr = ""
+}
+
+// parse handles one line of output, stats in JSON, maybe of
+// lines, are not logged
+func (l *srtLink) parse(line string) bool {
+
+	l.lock.Lock()
+
+	defer l.lock.Unlock()
+
+	if l.depth == 0 && !strings.HasPrefix(line, "{") {
+		l.lastErr = line
+		comm.Warning.Printf("%s: %s", l.sup.Name, line)
+		return true
+	}
+
+	l.json = append(l.json, line)
+	l.depth += strings.Count(line, "{") - strings.Count(line, "}")
+	if l.depth > 0 {
+		return false
+	}
+
+	var st srtStats
+	if err := json.Unmarshal([]byte(strings.Join(l.json, "")), &st); err == nil {
+		l.stats, l.statsAt = st, time.Now()
+	}
+	l.json, l.depth = nil, 0
+
+	return false
+}
+
+// srtURI returns the SRT URI of settings for srt-live-transmit,
+// and the passphrase in it
+func srtURI(settings map[string]interface{}) (string, string, error) {
+	mode, _ := settings["Mode"].(string)
+	if mode == "" {
+		mode = SRTCaller
+	}
+
+	addr, _ := settings["Address"].(string)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port == "" || (host == "" && mode != SRTListener) {
+		return "", "", errSRTAddress
+	}
+
+	q := url.Values{}
+	q.Set("mode", mode)
+
+	latency := 120
+	if n, ok := intOf(settings["Latency"]); ok && n > 0 {
+		latency = n
+	}
+	q.Set("latency", strconv.Itoa(latency))
+
+	secret, _ := settings["Passphrase"].(string)
+	if secret != "" {
+		q.Set("passphrase", secret)
+	}
+
+	if id, _ := settings["StreamID"].(string); id != "" {
+		q.Set("streamid", id)
+	}
+
+	return (&url.URL{Scheme: "srt", Host: addr, RawQuery: q.Encode()}).String(),
+		secret, nil
+}
+
+// udpRelay forwards datagrams from in to out, converted by conv
+type udpRelay struct {
+	in   *net.UDPConn
+	out  net.Conn
+	conv func([]byte) []byte
+
+	lock    sync.Mutex
+	packets int64
+	last    time.Time
+
+	done chan struct{}
+}
+
+func newUDPRelay(in *net.UDPConn, out net.Conn, conv func([]byte) []byte) *udpRelay {
+	r := &udpRelay{in: in, out: out, conv: conv, done: make(chan struct{})}
+	go r.run()
+
+	return r
+}
+
+func (r *udpRelay) run() {
+	defer close(r.done)
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := r.in.Read(buf)
+		if err != nil {
+			// closed
+			return
+		}
+
+		if p := r.conv(buf[:n]); len(p) > 0 {
+			// a refused write is not fatal, the other end may
+			// be late
+			r.out.Write(p)
+		}
+
+		r.lock.Lock()
+		r.packets++
+		r.last = time.Now()
+		r.lock.Unlock()
+	}
+}
+
+// active tells if data is relayed within d
+func (r *udpRelay) active(d time.Duration) bool {
+	r.lock.Lock()
+
+	defer r.lock.Unlock()
+
+	return time.Since(r.last) < d
+}
+
+func (r *udpRelay) count() int64 {
+	r.lock.Lock()
+
+	defer r.lock.Unlock()
+
+	return r.packets
+}
+
+func (r *udpRelay) close() {
+	r.in.Close()
+	<-r.done
+	r.out.Close()
+}
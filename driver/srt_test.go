@@ -0,0 +1,226 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+func Test_srtURI(t *testing.T) {
+	tests := []struct {
+		settings map[string]interface{}
+		want     string
+		wantErr  bool
+	}{
+		{map[string]interface{}{"Address": "10.0.0.1:9000"},
+			"srt://10.0.0.1:9000?latency=120&mode=caller", false},
+		{map[string]interface{}{"Mode": "listener", "Address": ":9000", "Latency": 500,
+			"Passphrase": "secret&12345", "StreamID": "#!::r=live/a,m=publish"},
+			"srt://:9000?latency=500&mode=listener&passphrase=secret%2612345&streamid=%23%21%3A%3Ar%3Dlive%2Fa%2Cm%3Dpublish", false},
+		{map[string]interface{}{"Mode": "rendezvous", "Address": ":9000"}, "", true},
+		{map[string]interface{}{}, "", true},
+	}
+	for _, tt := range tests {
+		got, _, err := srtURI(tt.settings)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("srtURI(%v) = %s, %v", tt.settings, got, err)
+		}
+	}
+}
+
+// fakeSRT writes a srt-live-transmit which prints stats, and
+// sends packets of ts to its udp:// output if any
+func fakeSRT(t *testing.T, dir string, ts []byte) {
+	file := filepath.Join(dir, "ts")
+	if err := ioutil.WriteFile(file, ts, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	script := "#!/bin/bash\ntrap 'exit 0' INT\ndst=${@: -1}\n" +
+		"echo 'warning: not connected yet' >&2\n" +
+		"printf '{\"sid\":1,\\n\"link\":{\"rtt\":12.5,\"bandwidth\":100},\\n" +
+		"\"recv\":{\"packets\":10,\"packetsLost\":2,\"packetsRetransmitted\":3,\"mbitRate\":4.5},\\n" +
+		"\"send\":{\"packets\":20,\"packetsLost\":7,\"mbitRate\":1.5}}\\n'\n" +
+		"while true; do\n" +
+		"  case $dst in udp://*) a=${dst#udp://}; head -c 1316 " + file + " > /dev/udp/${a%:*}/${a##*:};; esac\n" +
+		"  sleep 0.05\ndone\n"
+
+	bin := filepath.Join(dir, "srt-live-transmit")
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := comm.AppCfg.SRTBin
+	comm.AppCfg.SRTBin = bin
+	t.Cleanup(func() { comm.AppCfg.SRTBin = saved })
+}
+
+func TestSRTInWorker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := bytes.Repeat(append([]byte{0x47, 0x01, 0x00, 0x10}, make([]byte, 184)...), tsPerRTP)
+	fakeSRT(t, dir, ts)
+
+	pipe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipe.Close()
+
+	card := &SRTIn{Slot: 38, IP: net.IPv4(127, 0, 0, 1)}
+	ws, _ := card.Open()
+	w := ws[0].(*SRTInWorker)
+
+	w.Control(CtlCmdSetting, map[string]interface{}{"Mode": "listener",
+		"Address": ":9000", "Passphrase": "0123456789"})
+	w.Encode(&Session{IP: net.IPv4(127, 0, 0, 1), Streams: []Stream{{Name: StreamVideo, RTP: pipe.LocalAddr().(*net.UDPAddr).Port}}})
+	if err, ok := w.Control(CtlCmdStart, nil).(error); ok {
+		t.Fatalf("Start error = %v", err)
+	}
+	defer w.Control(CtlCmdStop, nil)
+
+	// TS of SRT comes in RTP
+	buf := make([]byte, 2048)
+	pipe.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err := pipe.Read(buf)
+	if err != nil || buf[1] != 33 || !bytes.Equal(tsOfRTP(buf[:n]), ts) {
+		t.Fatalf("Read() = %d, %v", n, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if !w.Monitor() {
+		t.Errorf("Monitor() = false, %v", w.Report())
+	}
+
+	report := strings.Join(w.Report(), "\n")
+	if !strings.Contains(report, "rtt 12.5ms, 4.50Mbps, lost 2, retransmitted 3") ||
+		!strings.Contains(report, "error: warning: not connected yet") {
+		t.Errorf("Report() = %s", report)
+	}
+	if logs := w.Logs(); len(logs) != 1 {
+		t.Errorf("Logs() = %v", logs)
+	}
+
+	// the same settings keep it running
+	pid := w.link.sup.Status().PID
+	w.Control(CtlCmdStart, nil)
+	if w.link.sup.Status().PID != pid {
+		t.Errorf("restarted for the same settings")
+	}
+
+	// a new destination restarts it, an invalid one stops it
+	w.Encode(&Session{IP: net.IPv4(127, 0, 0, 1), Streams: helperStreams(inBasePort, 0, 1)})
+	if w.link.sup.Status().PID == pid || !w.link.sup.Supervising() {
+		t.Errorf("not restarted for a new destination")
+	}
+
+	w.Encode(&Session{IP: net.IPv4(127, 0, 0, 1), Streams: invalidStreams})
+	if w.link.sup.Supervising() {
+		t.Errorf("running after an invalid Encode")
+	}
+
+	w.Control(CtlCmdStop, nil)
+	if w.Monitor() {
+		t.Errorf("Monitor() = true after Stop")
+	}
+}
+
+func TestSRTOutWorker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fakeSRT(t, dir, nil)
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	l.Close()
+
+	card := &SRTOut{Slot: 39, IP: net.IPv4(127, 0, 0, 1)}
+	ws, _ := card.Open()
+	w := ws[0].(*SRTOutWorker)
+
+	w.Control(CtlCmdSetting, map[string]interface{}{"Address": "127.0.0.1:9000"})
+	w.Decode(&Session{Streams: []Stream{{Name: StreamVideo, RTP: port}}})
+	if err, ok := w.Control(CtlCmdStart, nil).(error); ok {
+		t.Fatalf("Start error = %v", err)
+	}
+	defer w.Control(CtlCmdStop, nil)
+
+	// srt-live-transmit reads the first arg
+	args := w.link.sup.Args()
+	local, err := net.ResolveUDPAddr("udp", strings.TrimPrefix(args[2], "udp://"))
+	if err != nil || args[3] != "srt://127.0.0.1:9000?latency=120&mode=caller" {
+		t.Fatalf("Args() = %v", args)
+	}
+	srt, err := net.ListenUDP("udp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srt.Close()
+
+	pkt := append([]byte{0x47, 0x01, 0x00, 0x10}, make([]byte, 184)...)
+	conn, _ := net.Dial("udp", l.LocalAddr().String())
+	defer conn.Close()
+	conn.Write(newRTPPacketizer().packet(0, [][]byte{pkt}))
+
+	// RTP is stripped for SRT
+	buf := make([]byte, 2048)
+	srt.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err := srt.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], pkt) {
+		t.Fatalf("Read() = %d, %v", n, err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if report := strings.Join(w.Report(), "\n"); !strings.Contains(report, "rtt 12.5ms, 1.50Mbps, lost 7") {
+		t.Errorf("Report() = %s", report)
+	}
+}
+
+func TestSRTOutWorker_pullTwo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fakeSRT(t, dir, nil)
+
+	// two cards of the host, pulled on two paths at once
+	a, _ := (&SRTOut{Slot: 39, IP: net.IPv4(127, 0, 0, 1)}).Open()
+	b, _ := (&SRTOut{Slot: 40, IP: net.IPv4(127, 0, 0, 1)}).Open()
+
+	free := pullAtOnce(t, a[0], b[0])
+	defer free()
+
+	for i, w := range []Worker{a[0], b[0]} {
+		w.Control(CtlCmdSetting, map[string]interface{}{"Address": fmt.Sprintf("127.0.0.1:%d", 9000+i)})
+		if err, ok := w.Control(CtlCmdStart, nil).(error); ok {
+			t.Errorf("Start %s error = %v", GetWorkerName(w), err)
+		}
+		defer w.Control(CtlCmdStop, nil)
+	}
+}
@@ -0,0 +1,433 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+// defaults of Supervisor
+const (
+	supMinBackoff  = time.Second
+	supMaxBackoff  = 30 * time.Second
+	supStopTimeout = 5 * time.Second
+	supLogLines    = 200
+)
+
+var (
+	errSupRunning = errors.New("Process already started")
+)
+
+// Supervisor runs the child process of a local driver. If the
+// process exits unexpectedly, it's restarted after a backoff,
+// which doubles up to MaxBackoff, and is reset once the process
+// runs longer than MaxBackoff. Output is kept in a ring buffer.
+//
+// Zero value is ready to use, with defaults
+type Supervisor struct {
+	// Name is for logging, usually the worker's name
+	Name string
+
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	StopTimeout time.Duration
+
+	// LogLines is the size of the ring buffer
+	LogLines int
+
+	// OnStart is called when a process is started, and OnLine on
+	// each line of stdout and stderr, which is logged if it returns
+	// true. Both are optional
+	OnStart func()
+	OnLine  func(line string) bool
+
+	// Redact are secrets in args, which are not logged
+	Redact []string
+
+	lock sync.Mutex
+
+	bin  string
+	args []string
+
+	cmd *exec.Cmd
+
+	// exited is closed when cmd exits
+	exited chan struct{}
+
+	// stop is closed by Stop, done is closed when supervising ends
+	stop chan struct{}
+	done chan struct{}
+
+	status ProcStatus
+
+	logs ringLog
+}
+
+// ProcStatus is the status of a supervised process
+type ProcStatus struct {
+	Running bool
+	PID     int       `json:",omitempty"`
+	Started time.Time `json:",omitempty"`
+
+	Restarts int
+
+	// ExitCode is of the last exit, -1 if killed by signal
+	ExitCode  int
+	LastExit  time.Time `json:",omitempty"`
+	LastError string    `json:",omitempty"`
+}
+
+// Start starts bin with args, and keeps it running until Stop.
+// It's an error if the first start fails
+func (s *Supervisor) Start(bin string, args []string) error {
+
+	s.lock.Lock()
+
+	if s.stop != nil {
+		s.lock.Unlock()
+		return errSupRunning
+	}
+
+	s.bin, s.args = bin, args
+	s.status.Restarts = 0
+
+	if s.logs.lines == nil {
+		n := s.LogLines
+		if n <= 0 {
+			n = supLogLines
+		}
+		s.logs = ringLog{lines: make([]string, n)}
+	}
+
+	if err := s.spawn(); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	stop, done := s.stop, s.done
+
+	s.lock.Unlock()
+
+	go s.supervise(stop, done)
+
+	return nil
+}
+
+// Stop stops supervising, and interrupts the process, so outputs
+// are closed properly. It's killed if not exited in StopTimeout
+func (s *Supervisor) Stop() error {
+
+	s.lock.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.lock.Unlock()
+
+	if stop == nil {
+		return nil
+	}
+
+	close(stop)
+	<-done
+
+	return nil
+}
+
+// Alive tells if the process is running now, it's false while
+// waiting to restart
+func (s *Supervisor) Alive() bool {
+
+	s.lock.Lock()
+
+	defer s.lock.Unlock()
+
+	return s.status.Running
+}
+
+// Supervising tells if Start is called without Stop
+func (s *Supervisor) Supervising() bool {
+
+	s.lock.Lock()
+
+	defer s.lock.Unlock()
+
+	return s.stop != nil
+}
+
+// Args returns args of the process
+func (s *Supervisor) Args() []string {
+
+	s.lock.Lock()
+
+	defer s.lock.Unlock()
+
+	return s.args
+}
+
+// Status returns the status of the process
+func (s *Supervisor) Status() ProcStatus {
+
+	s.lock.Lock()
+
+	defer s.lock.Unlock()
+
+	return s.status
+}
+
+// Logs returns kept output, oldest first
+func (s *Supervisor) Logs() []string {
+
+	s.lock.Lock()
+
+	defer s.lock.Unlock()
+
+	return s.logs.all()
+}
+
+// Report returns the status in lines, for Reporter
+func (s *Supervisor) Report() []string {
+	st := s.Status()
+
+	var all []string
+	if st.Running {
+		all = append(all, fmt.Sprintf("pid %d, up since %s", st.PID,
+			st.Started.Format(time.RFC3339)))
+	} else {
+		all = append(all, "not running")
+	}
+
+	if !st.LastExit.IsZero() {
+		all = append(all, fmt.Sprintf("last exit %d at %s %s", st.ExitCode,
+			st.LastExit.Format(time.RFC3339), st.LastError))
+	}
+
+	if st.Restarts > 0 {
+		all = append(all, fmt.Sprintf("restarted %d times", st.Restarts))
+	}
+
+	return all
+}
+
+// spawn starts a process. s.lock must be held
+func (s *Supervisor) spawn() error {
+
+	// not cmd.StdoutPipe, a child of the process may keep it
+	// open after the process exits
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(s.bin, s.args...)
+	cmd.Stdout, cmd.Stderr = w, w
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		r.Close()
+		comm.Error.Printf("Run %s for %s failed: %v", s.bin, s.Name, err)
+		s.status.LastError = err.Error()
+		return err
+	}
+
+	cmdline := strings.Join(s.args, " ")
+	for _, secret := range s.Redact {
+		if secret != "" {
+			cmdline = strings.Replace(cmdline, secret, "***", -1)
+		}
+	}
+	comm.Info.Printf("Started %s: %s %s", s.Name, s.bin, cmdline)
+
+	exited := make(chan struct{})
+
+	s.cmd, s.exited = cmd, exited
+	s.status.Running = true
+	s.status.PID = cmd.Process.Pid
+	s.status.Started = time.Now()
+
+	go s.read(r)
+	go s.wait(cmd, exited)
+
+	if s.OnStart != nil {
+		s.OnStart()
+	}
+
+	return nil
+}
+
+// read reads output until all writers are closed
+func (s *Supervisor) read(r io.ReadCloser) {
+
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Split(scanLines)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if s.OnLine != nil && !s.OnLine(line) {
+			continue
+		}
+
+		s.lock.Lock()
+		s.logs.add(line)
+		s.lock.Unlock()
+	}
+}
+
+// wait waits for cmd to exit
+func (s *Supervisor) wait(cmd *exec.Cmd, exited chan struct{}) {
+
+	err := cmd.Wait()
+
+	s.lock.Lock()
+	s.status.Running = false
+	s.status.PID = 0
+	s.status.LastExit = time.Now()
+	s.status.ExitCode = cmd.ProcessState.ExitCode()
+	s.status.LastError = ""
+	if err != nil {
+		s.status.LastError = err.Error()
+	}
+	s.logs.add(fmt.Sprintf("exited with %d", s.status.ExitCode))
+	s.lock.Unlock()
+
+	close(exited)
+}
+
+// supervise restarts the process until stop
+func (s *Supervisor) supervise(stop chan struct{}, done chan struct{}) {
+
+	defer close(done)
+
+	minB, maxB := s.MinBackoff, s.MaxBackoff
+	if minB <= 0 {
+		minB = supMinBackoff
+	}
+	if maxB < minB {
+		maxB = supMaxBackoff
+	}
+
+	backoff := minB
+	for {
+		s.lock.Lock()
+		exited := s.exited
+		s.lock.Unlock()
+
+		select {
+		case <-stop:
+			s.terminate()
+			return
+		case <-exited:
+		}
+
+		st := s.Status()
+		if st.LastExit.Sub(st.Started) > maxB {
+			backoff = minB
+		}
+
+		comm.Warning.Printf("%s exited with %d unexpectedly, restart in %v",
+			s.Name, st.ExitCode, backoff)
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(backoff):
+			}
+
+			if backoff *= 2; backoff > maxB {
+				backoff = maxB
+			}
+
+			s.lock.Lock()
+			err := s.spawn()
+			if err == nil {
+				s.status.Restarts++
+			}
+			s.lock.Unlock()
+
+			if err == nil {
+				processRestarts.WithLabelValues(s.Name).Inc()
+				break
+			}
+		}
+	}
+}
+
+// terminate interrupts the process, and kills it after
+// StopTimeout
+func (s *Supervisor) terminate() {
+
+	s.lock.Lock()
+	cmd, exited := s.cmd, s.exited
+	s.lock.Unlock()
+
+	select {
+	case <-exited:
+		return
+	default:
+	}
+
+	// no SIGINT on Windows
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		cmd.Process.Kill()
+	}
+
+	timeout := s.StopTimeout
+	if timeout <= 0 {
+		timeout = supStopTimeout
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(timeout):
+		comm.Warning.Printf("%s not exited in %v, killed", s.Name, timeout)
+		cmd.Process.Kill()
+		<-exited
+	}
+}
+
+// ringLog keeps the last len(lines) lines
+type ringLog struct {
+	lines []string
+	next  int
+	full  bool
+}
+
+func (r *ringLog) add(line string) {
+	if len(r.lines) == 0 {
+		return
+	}
+
+	r.lines[r.next] = line
+	if r.next++; r.next == len(r.lines) {
+		r.next, r.full = 0, true
+	}
+}
+
+func (r *ringLog) all() []string {
+	if !r.full {
+		return append([]string(nil), r.lines[:r.next]...)
+	}
+
+	return append(append([]string(nil), r.lines[r.next:]...), r.lines[:r.next]...)
+}
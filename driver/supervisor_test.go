@@ -0,0 +1,87 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func Test_ringLog(t *testing.T) {
+	r := ringLog{lines: make([]string, 3)}
+	for _, l := range []string{"a", "b"} {
+		r.add(l)
+	}
+	if got := r.all(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("all() = %v", got)
+	}
+
+	for _, l := range []string{"c", "d"} {
+		r.add(l)
+	}
+	if got := r.all(); !reflect.DeepEqual(got, []string{"b", "c", "d"}) {
+		t.Errorf("all() = %v", got)
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+
+	s := Supervisor{Name: "test", MinBackoff: 50 * time.Millisecond,
+		MaxBackoff: 100 * time.Millisecond, StopTimeout: 200 * time.Millisecond}
+
+	// crashes at once, and restarts
+	if err := s.Start("sh", []string{"-c", "echo crash; exit 3"}); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+
+	st := s.Status()
+	if st.Restarts < 2 || st.ExitCode != 3 {
+		t.Errorf("Status() = %+v", st)
+	}
+
+	found := map[string]bool{}
+	for _, l := range s.Logs() {
+		found[l] = true
+	}
+	if !found["crash"] || !found["exited with 3"] {
+		t.Errorf("Logs() = %v", s.Logs())
+	}
+
+	s.Stop()
+
+	if err := s.Start("no-such-bin-of-aqua", nil); err == nil {
+		t.Errorf("Start() no error")
+	}
+
+	// ignores SIGINT, so killed
+	if err := s.Start("sh", []string{"-c", "trap '' INT; sleep 10"}); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if !s.Alive() {
+		t.Errorf("Alive() = false")
+	}
+
+	start := time.Now()
+	s.Stop()
+
+	if s.Alive() || time.Since(start) > 2*time.Second {
+		t.Errorf("Stop() alive = %v, in %v", s.Alive(), time.Since(start))
+	}
+
+	if st := s.Status(); st.ExitCode != -1 {
+		t.Errorf("Status() = %+v", st)
+	}
+}
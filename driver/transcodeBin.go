@@ -8,6 +8,13 @@ package driver
 // TranscoderBinName is the sub-card's name
 const TranscoderBinName string = "TransCoder"
 
+// tcBinSchema is the settings of TCBinWorker
+var tcBinSchema = append(Schema{
+	rtspURLField,
+	{Name: "BitRate", Label: "码率(kbps)", Type: FieldInt,
+		Default: 2000, Min: 64, Max: 20000},
+}, rtspInOptions...)
+
 // TCBin is the main struct for the Bin
 type TCBin struct {
 	Card9830 Card
@@ -111,6 +118,9 @@ func (w *TCBinWorker) Control(c CtlCmd, arg interface{}) interface{} {
 	case CtlCmdWorkerID:
 		return w.workerID
 
+	case CtlCmdSchema:
+		return tcBinSchema
+
 	case CtlCmdSetting:
 		var settings map[string]interface{}
 		var ok bool
@@ -131,6 +141,21 @@ func (w *TCBinWorker) Control(c CtlCmd, arg interface{}) interface{} {
 	return nil
 }
 
+// Monitor method, both the C9830 and its RTSP source must be up
+func (w *TCBinWorker) Monitor() bool {
+	return w.bin.c9830Ws[w.workerID].Monitor() &&
+		w.bin.rtspWs[w.workerID].Monitor()
+}
+
+// Report method, it's of the RTSP source
+func (w *TCBinWorker) Report() []string {
+	if r, ok := w.bin.rtspWs[w.workerID].(Reporter); ok {
+		return r.Report()
+	}
+
+	return nil
+}
+
 // Encode method
 func (w *TCBinWorker) Encode(sess *Session) error {
 
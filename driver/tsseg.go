@@ -0,0 +1,164 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package driver
+
+import "time"
+
+// tsSegmenter cuts MPEG-TS into segments of about dur. A segment
+// starts at a random access point of the PCR PID, or after 2*dur
+// if there is none. The last PAT and PMT are kept, so a segment
+// plays alone
+type tsSegmenter struct {
+	dur time.Duration
+
+	// start of the segment, zero before the first. first is the
+	// first packet ever seen
+	start time.Time
+	first time.Time
+
+	pat []byte
+	pmt []byte
+
+	// pmtPID and pcrPID are 0 if not known yet
+	pmtPID uint16
+	pcrPID uint16
+}
+
+// tsPID returns PID of a TS packet
+func tsPID(pkt []byte) uint16 {
+	return uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2])
+}
+
+// tsRAI tells if random_access_indicator of pkt is set
+func tsRAI(pkt []byte) bool {
+	return pkt[3]&0x20 != 0 && pkt[4] > 0 && pkt[5]&0x40 != 0
+}
+
+// tsSection returns the PSI section starting in pkt, nil if none
+func tsSection(pkt []byte) []byte {
+	if pkt[1]&0x40 == 0 || pkt[3]&0x10 == 0 {
+		return nil
+	}
+
+	payload := pkt[4:]
+	if pkt[3]&0x20 != 0 {
+		if int(payload[0]) >= len(payload) {
+			return nil
+		}
+		payload = payload[1+int(payload[0]):]
+	}
+
+	if len(payload) < 1 || len(payload) < 1+int(payload[0])+3 {
+		return nil
+	}
+	sec := payload[1+int(payload[0]):]
+
+	n := 3 + (int(sec[1]&0x0F)<<8 | int(sec[2]))
+	if n > len(sec) || n < 12 {
+		return nil
+	}
+
+	return sec[:n]
+}
+
+// learn keeps PAT and PMT of pkt
+func (s *tsSegmenter) learn(pkt []byte) {
+	pid := tsPID(pkt)
+	if pid != pidPAT && (s.pmtPID == 0 || pid != s.pmtPID) {
+		return
+	}
+
+	sec := tsSection(pkt)
+	if sec == nil {
+		return
+	}
+
+	switch {
+	case pid == pidPAT && sec[0] == 0x00:
+		// the first program
+		for i := 8; i+4 <= len(sec)-4; i += 4 {
+			if sec[i] != 0 || sec[i+1] != 0 {
+				s.pmtPID = uint16(sec[i+2]&0x1F)<<8 | uint16(sec[i+3])
+				break
+			}
+		}
+		s.pat = append(s.pat[:0], pkt...)
+
+	case sec[0] == 0x02:
+		s.pcrPID = uint16(sec[8]&0x1F)<<8 | uint16(sec[9])
+		s.pmt = append(s.pmt[:0], pkt...)
+	}
+}
+
+// cut tells if a new segment starts at pkt, received at now
+func (s *tsSegmenter) cut(pkt []byte, now time.Time) bool {
+	s.learn(pkt)
+
+	if s.first.IsZero() {
+		s.first = now
+	}
+
+	from := s.start
+	if from.IsZero() {
+		from = s.first
+	}
+
+	rai := tsRAI(pkt) && (s.pcrPID == 0 || tsPID(pkt) == s.pcrPID)
+
+	elapsed := now.Sub(from)
+	if s.start.IsZero() && rai || elapsed >= s.dur && rai || elapsed >= 2*s.dur {
+		s.start = now
+		return true
+	}
+
+	return false
+}
+
+// header returns PAT and PMT to start a segment
+func (s *tsSegmenter) header() []byte {
+	return append(append([]byte{}, s.pat...), s.pmt...)
+}
+
+// tsOfRTP returns TS packets in p, which is RTP or plain TS over
+// UDP. nil is returned if p is neither
+func tsOfRTP(p []byte) []byte {
+	if len(p) > 0 && p[0] == 0x47 {
+		return p
+	}
+
+	if len(p) < 12 || p[0]&0xC0 != 0x80 {
+		return nil
+	}
+
+	end := len(p)
+	if p[0]&0x20 != 0 {
+		end -= int(p[end-1])
+	}
+
+	off := 12 + 4*int(p[0]&0x0F)
+	if p[0]&0x10 != 0 && off+4 <= end {
+		off += 4 + 4*(int(p[off+2])<<8|int(p[off+3]))
+	}
+
+	if off > end {
+		return nil
+	}
+
+	return p[off:end]
+}
+
+// tsPCR returns PCR of pkt in 27MHz, false if it has none
+func tsPCR(pkt []byte) (int64, bool) {
+	if pkt[3]&0x20 == 0 || pkt[4] < 7 || pkt[5]&0x10 == 0 {
+		return 0, false
+	}
+
+	base := int64(pkt[6])<<25 | int64(pkt[7])<<17 | int64(pkt[8])<<9 |
+		int64(pkt[9])<<1 | int64(pkt[10])>>7
+	ext := int64(pkt[10]&1)<<8 | int64(pkt[11])
+
+	return base*300 + ext, true
+}
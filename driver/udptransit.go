@@ -6,14 +6,11 @@
 package driver
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"net"
-	"net/http"
 	"sync"
 
-	"github.com/gorilla/rpc/v2/json2"
 	"github.com/zhanglongx/Aqua/comm"
 )
 
@@ -34,100 +31,79 @@ type transit struct {
 	seq int
 }
 
-func (t *transit) add(srcPort int, dstIP net.IP, dstPort int,
-	pair bool) error {
+func (t *transit) add(src []Stream, dstIP net.IP, dst []Stream) error {
 
 	t.lock.Lock()
 
 	defer t.lock.Unlock()
 
-	num := 1
-	if pair == true {
-		num = 2
-	}
-
-	transponds := make([]map[string]interface{}, num)
-	for i := 0; i < num; i++ {
-
-		transponds[i] = make(map[string]interface{})
-
-		transponds[i]["type"] = "udp2udp"
-		transponds[i]["recv_ip"] = fmt.Sprintf("%s", t.selfIP)
-		transponds[i]["recv_port"] = srcPort + 2*i
-		transponds[i]["send_ip"] = fmt.Sprintf("%s", dstIP)
-		transponds[i]["send_port"] = dstPort + 2*i
-	}
-
-	args := make(map[string]interface{})
-	args["transponds"] = transponds
-
-	var message []byte
-	var err error
-	if message, err = json2.EncodeClientRequest("udp_transpond.add", args); err != nil {
-		comm.Error.Panicf("%v", err)
-	}
-
-	var resp *http.Response
-	if resp, err = http.Post(TransURL, "application/json", bytes.NewReader(message)); err != nil {
-		return err
-	}
-
-	defer resp.Body.Close()
+	args := t.transponds(src, dstIP, dst)
 
 	reply := make(map[string]interface{})
-	err = json2.DecodeClientResponse(resp.Body, &reply)
-	if err != nil {
+	if err := RPC(TransURL, "udp_transpond.add", args, &reply); err != nil {
 		return err
 	}
 
+	num := len(args["transponds"].([]map[string]interface{}))
+	transitForwards.WithLabelValues("add").Add(float64(num))
+	transitActive.Add(float64(num))
+
 	return nil
 }
 
-func (t *transit) del(srcPort int, dstIP net.IP, dstPort int,
-	pair bool) error {
+func (t *transit) del(src []Stream, dstIP net.IP, dst []Stream) error {
 
 	t.lock.Lock()
 
 	defer t.lock.Unlock()
 
-	num := 1
-	if pair == true {
-		num = 2
+	args := t.transponds(src, dstIP, dst)
+
+	reply := make(map[string]interface{})
+	if err := RPC(TransURL, "udp_transpond.del", args, &reply); err != nil {
+		return err
 	}
 
-	transponds := make([]map[string]interface{}, num)
-	for i := 0; i < num; i++ {
+	num := len(args["transponds"].([]map[string]interface{}))
+	transitForwards.WithLabelValues("del").Add(float64(num))
+	transitActive.Sub(float64(num))
 
-		transponds[i] = make(map[string]interface{})
+	return nil
+}
 
-		transponds[i]["type"] = "udp2udp"
-		transponds[i]["recv_ip"] = fmt.Sprintf("%s", t.selfIP)
-		transponds[i]["recv_port"] = srcPort + 2*i
-		transponds[i]["send_ip"] = fmt.Sprintf("%s", dstIP)
-		transponds[i]["send_port"] = dstPort + 2*i
+// transponds builds args of udp_transpond.add and udp_transpond.del.
+// Streams of src are sent to streams of the same name in dst, RTCP
+// as well if both have it
+func (t *transit) transponds(src []Stream, dstIP net.IP,
+	dst []Stream) map[string]interface{} {
+
+	one := func(srcPort int, dstPort int) map[string]interface{} {
+		return map[string]interface{}{
+			"type":      "udp2udp",
+			"recv_ip":   fmt.Sprintf("%s", t.selfIP),
+			"recv_port": srcPort,
+			"send_ip":   fmt.Sprintf("%s", dstIP),
+			"send_port": dstPort,
+		}
 	}
 
-	args := make(map[string]interface{})
-	args["transponds"] = transponds
+	to := Session{Streams: dst}
 
-	var message []byte
-	var err error
-	if message, err = json2.EncodeClientRequest("udp_transpond.del", args); err != nil {
-		comm.Error.Panicf("%v", err)
-	}
+	transponds := []map[string]interface{}{}
+	for _, s := range src {
+		d := to.Stream(s.Name)
+		if d == nil {
+			continue
+		}
 
-	var resp *http.Response
-	if resp, err = http.Post(TransURL, "application/json", bytes.NewReader(message)); err != nil {
-		return err
+		transponds = append(transponds, one(s.RTP, d.RTP))
+		if s.RTCP != 0 && d.RTCP != 0 {
+			transponds = append(transponds, one(s.RTCP, d.RTCP))
+		}
 	}
 
-	defer resp.Body.Close()
-
-	reply := make(map[string]interface{})
-	err = json2.DecodeClientResponse(resp.Body, &reply)
-	if err != nil {
-		return err
-	}
+	args := make(map[string]interface{})
+	args["transponds"] = transponds
 
-	return nil
+	return args
 }
@@ -6,9 +6,29 @@
 package main
 
 import (
-	_ "github.com/zhanglongx/Aqua/web"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/zhanglongx/Aqua/comm"
+	"github.com/zhanglongx/Aqua/web"
 )
 
 func main() {
 
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		s := <-sig
+		comm.Info.Printf("Got signal %v, exiting", s)
+		cancel()
+	}()
+
+	if err := web.StartAPP(ctx); err != nil {
+		comm.Error.Fatalf("Start web failed: %v", err)
+	}
 }
@@ -6,25 +6,23 @@
 package manager
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path"
 
 	"github.com/zhanglongx/Aqua/comm"
 )
 
 // DBVER is DB File Version
-const DBVER string = "1.0.0"
+const DBVER string = "1.1.0"
 
-// DB contains all path' config. It's degsinged to be easily
-// exported to file (like JSON).
+// DB contains all path' config. It caches all Params in memory,
+// and saves changes to a Store.
 // set() and get() are not thread-safe, it's caller's
 // responsibility to ensure that.
 // It's designed to copy params in set() and get()
 type DB struct {
-	fullPathFile string
+	store Store
 
 	// Version should be used to check DB's compatibility
 	Version string
@@ -33,91 +31,64 @@ type DB struct {
 	Params map[string]Params
 }
 
+var (
+	errDBLocked = errors.New("DB is used by another process")
+)
+
 // create initialize Params
 func (d *DB) create() {
 	d.Params = make(map[string]Params)
 }
 
-// loadFromFile load JSON file to Cfg
+// loadFromFile opens the Store of file, and loads all Params
 func (d *DB) loadFromFile(dir string, file string) error {
 
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		comm.Error.Printf("Dir %s not exists, create", dir)
-		if err := os.Mkdir(dir, 0644); err != nil {
+		if err := os.MkdirAll(dir, 0755); err != nil {
 			return err
 		}
 	}
 
-	fullPathFile := path.Join(dir, file)
-	if fullPathFile == "" {
-		comm.Error.Fatalf("Join %s %s failed", dir, file)
-		return nil
-	}
-
-	if _, err := os.Stat(fullPathFile); err != nil {
-		if os.IsNotExist(err) {
-
-			comm.Info.Printf("DB %s not exists, create", fullPathFile)
-
-			d.Version = DBVER
-			d.fullPathFile = fullPathFile
-			return nil
-		}
-
-		return err
-	}
-
-	buf, err := ioutil.ReadFile(fullPathFile)
+	store, err := openStore(dir, file)
 	if err != nil {
-		comm.Error.Printf("Read DB file %s failed", fullPathFile)
 		return err
 	}
 
-	err = json.Unmarshal(buf, d)
+	version, all, err := store.Load()
 	if err != nil {
-		comm.Error.Printf("Decode DB file %s failed", fullPathFile)
+		store.Close()
 		return err
 	}
 
-	// FIXME: more compatible
-	if d.Version != DBVER {
-		comm.Error.Printf("DB file ver error: %s", d.Version)
-		comm.Error.Printf("Discarding old file: %s", fullPathFile)
-		if err := d.clearDB(); err != nil {
-			return err
-		}
+	d.store = store
+	d.Params = all
 
+	if version == "" {
+		d.Version = DBVER
+		return nil
 	}
 
-	d.fullPathFile = fullPathFile
-
-	return nil
-}
-
-// saveToFile save JSON file to Cfg
-func (d *DB) saveToFile() error {
-
-	buf, err := json.MarshalIndent(d, "", "    ")
-	if err != nil {
-		comm.Error.Printf("Encode DB %s failed", d.fullPathFile)
-		return err
-	}
+	d.Version = version
 
-	err = ioutil.WriteFile(d.fullPathFile, buf, 0644)
-	if err != nil {
-		comm.Error.Printf("Write DB file %s failed", d.fullPathFile)
+	if err := d.migrate(); err != nil {
+		d.close()
 		return err
 	}
 
 	return nil
 }
 
-// clearDB clear DB
-func (d *DB) clearDB() error {
-	comm.Info.Printf("Clearing DB: %s", d.fullPathFile)
+// close closes the Store
+func (d *DB) close() error {
+	if d.store == nil {
+		return nil
+	}
+
+	err := d.store.Close()
+	d.store = nil
 
-	d.Params = make(map[string]Params)
-	return d.saveToFile()
+	return err
 }
 
 // set set a new Param in DB with informed ID
@@ -127,15 +98,35 @@ func (d *DB) set(ID int, p Params) error {
 		return nil
 	}
 
-	id := fmt.Sprintf("%d", ID)
+	return d.setMulti(map[int]Params{ID: p}, nil)
+}
 
-	if p == nil {
-		delete(d.Params, id)
-		return d.saveToFile()
+// setMulti sets many Params at once, which are saved atomically
+// with revs. A nil Params deletes the path
+func (d *DB) setMulti(all map[int]Params, revs []Revision) error {
+
+	changes := make(map[string]Params)
+	for ID, p := range all {
+		if ID < 0 {
+			continue
+		}
+
+		changes[fmt.Sprintf("%d", ID)] = p
+	}
+
+	if err := d.store.Save(d.Version, changes, revs); err != nil {
+		return err
 	}
 
-	d.Params[id] = p
-	return d.saveToFile()
+	for id, p := range changes {
+		if p == nil {
+			delete(d.Params, id)
+		} else {
+			d.Params[id] = p
+		}
+	}
+
+	return nil
 }
 
 // get get a exist Param in DB with informed ID
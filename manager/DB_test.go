@@ -7,7 +7,12 @@ package manager
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
+
+	"github.com/zhanglongx/Aqua/comm"
 )
 
 func TestDB_loadFromFile(t *testing.T) {
@@ -28,3 +33,202 @@ func TestDB_loadFromFile(t *testing.T) {
 		fmt.Printf("%v", db.get(10))
 	}
 }
+
+func TestDB_saveToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aqua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := DB{}
+	db.create()
+	if err := db.loadFromFile(dir, "encode.json"); err != nil {
+		t.Fatalf("loadFromFile() error = %v", err)
+	}
+
+	for i := 1; i <= comm.AppCfg.DBBackups+2; i++ {
+		if err := db.set(i, Params{"WorkerName": fmt.Sprintf("C9830_3_%d", i)}); err != nil {
+			t.Fatalf("set() error = %v", err)
+		}
+	}
+
+	if _, err := os.Stat(path.Join(dir, "encode.json.tmp")); !os.IsNotExist(err) {
+		t.Errorf("temp file left")
+	}
+	if _, err := os.Stat(backupFile(path.Join(dir, "encode.json"),
+		comm.AppCfg.DBBackups+1)); !os.IsNotExist(err) {
+		t.Errorf("too many backups")
+	}
+
+	// a second daemon can't share it
+	db2 := DB{}
+	db2.create()
+	if err := db2.loadFromFile(dir, "encode.json"); err != errDBLocked {
+		t.Errorf("loadFromFile() error = %v, want %v", err, errDBLocked)
+	}
+
+	db.close()
+
+	// broken file falls back to the last good backup, which
+	// doesn't have the last set()
+	if err := ioutil.WriteFile(path.Join(dir, "encode.json"), []byte("{\"Vers"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db3 := DB{}
+	db3.create()
+	if err := db3.loadFromFile(dir, "encode.json"); err != nil {
+		t.Fatalf("loadFromFile() error = %v", err)
+	}
+	defer db3.close()
+
+	n := comm.AppCfg.DBBackups + 1
+	if db3.get(n) == nil || db3.get(n+1) != nil {
+		t.Errorf("loadFromFile() = %v", db3.Params)
+	}
+
+	// the broken file is put aside, not rotated into backups
+	if _, err := os.Stat(path.Join(dir, "encode.json.broken")); err != nil {
+		t.Errorf("broken file not kept: %v", err)
+	}
+	s := &jsonStore{}
+	if err := s.decodeFile(backupFile(path.Join(dir, "encode.json"), 1)); err != nil {
+		t.Errorf("backup 1 broken: %v", err)
+	}
+
+	// a failed Save leaves Params as is
+	s = &jsonStore{fullPathFile: path.Join(dir, "none", "encode.json"),
+		Params: map[string]Params{"1": {"WorkerName": "C9830_3_1"}}}
+	if err := s.Save(DBVER, map[string]Params{"1": nil, "2": {}}, nil); err == nil {
+		t.Fatalf("Save() to a missing dir succeeded")
+	}
+	if len(s.Params) != 1 || s.Params["1"] == nil || s.Version != "" {
+		t.Errorf("Params = %v after a failed Save", s.Params)
+	}
+}
+
+func TestDB_migrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aqua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	orig, err := ioutil.ReadFile("../testdata/encode.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path.Join(dir, "encode.json"), orig, 0644)
+
+	db := DB{}
+	db.create()
+	if err := db.loadFromFile(dir, "encode.json"); err != nil {
+		t.Fatalf("loadFromFile() error = %v", err)
+	}
+	db.close()
+
+	if db.Version != DBVER {
+		t.Errorf("Version = %s, want %s", db.Version, DBVER)
+	}
+
+	p := db.get(1)
+	if _, ok := p["RTSPIn"]; ok {
+		t.Errorf("RTSPIn not moved: %v", p)
+	}
+	if card, ok := p["Card"].(map[string]interface{}); !ok ||
+		card["rtsp_url"] != "" || card["BitRate"] != float64(0) {
+		t.Errorf("Card = %v", p["Card"])
+	}
+
+	if kept, _ := ioutil.ReadFile(path.Join(dir, "encode.json.v1.0.0")); len(kept) == 0 {
+		t.Errorf("original not kept")
+	}
+
+	// unknown versions are refused, and left untouched
+	unknown := []byte(`{"Version": "0.1.0", "Params": {}}`)
+	ioutil.WriteFile(path.Join(dir, "decode.json"), unknown, 0644)
+
+	db2 := DB{}
+	db2.create()
+	if err := db2.loadFromFile(dir, "decode.json"); err != errDBVersion {
+		t.Errorf("loadFromFile() error = %v, want %v", err, errDBVersion)
+	}
+	db2.close()
+
+	if buf, _ := ioutil.ReadFile(path.Join(dir, "decode.json")); string(buf) != string(unknown) {
+		t.Errorf("unknown DB changed: %s", buf)
+	}
+}
+
+func TestDB_bolt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aqua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := comm.AppCfg.DBBackend
+	comm.AppCfg.DBBackend = storeBolt
+	defer func() { comm.AppCfg.DBBackend = backend }()
+
+	// an old JSON file is imported and migrated
+	orig, err := ioutil.ReadFile("../testdata/encode.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path.Join(dir, "encode.json"), orig, 0644)
+
+	db := DB{}
+	db.create()
+	if err := db.loadFromFile(dir, "encode.json"); err != nil {
+		t.Fatalf("loadFromFile() error = %v", err)
+	}
+
+	if _, ok := db.get(2)["Card"]; !ok || db.Version != DBVER {
+		t.Errorf("import failed: %s %v", db.Version, db.get(2))
+	}
+
+	if err := db.setMulti(map[int]Params{1: nil, 3: {"WorkerName": "C9830_3_0"}}, nil); err != nil {
+		t.Fatalf("setMulti() error = %v", err)
+	}
+
+	db2 := DB{}
+	db2.create()
+	if err := db2.loadFromFile(dir, "encode.json"); err != errDBLocked {
+		t.Errorf("loadFromFile() error = %v, want %v", err, errDBLocked)
+	}
+
+	db.close()
+
+	db3 := DB{}
+	db3.create()
+	if err := db3.loadFromFile(dir, "encode.json"); err != nil {
+		t.Fatalf("loadFromFile() error = %v", err)
+	}
+	defer db3.close()
+
+	if db3.get(1) != nil || db3.get(2) == nil ||
+		db3.get(3)["WorkerName"] != "C9830_3_0" {
+		t.Errorf("loadFromFile() = %v", db3.Params)
+	}
+
+	// a failed import is retried on the next open
+	ioutil.WriteFile(path.Join(dir, "decode.json"), []byte("{\"Vers"), 0644)
+
+	db4 := DB{}
+	db4.create()
+	if err := db4.loadFromFile(dir, "decode.json"); err == nil {
+		t.Fatalf("loadFromFile() of a broken file succeeded")
+	}
+
+	ioutil.WriteFile(path.Join(dir, "decode.json"), orig, 0644)
+	if err := db4.loadFromFile(dir, "decode.json"); err != nil {
+		t.Fatalf("loadFromFile() error = %v", err)
+	}
+	defer db4.close()
+
+	if db4.get(2) == nil {
+		t.Errorf("import not retried: %v", db4.Params)
+	}
+}
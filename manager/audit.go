@@ -0,0 +1,303 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+// audit actions
+const (
+	ActionSet     = "set"
+	ActionAssign  = "assign"
+	ActionStart   = "start"
+	ActionStop    = "stop"
+	ActionNetwork = "network"
+
+	// Before of ActionRecordingDelete is the recording's Name
+	ActionRecordingDelete = "recording_delete"
+
+	// ID of job actions is the path of the job
+	ActionJobAdd    = "job_add"
+	ActionJobDelete = "job_delete"
+)
+
+// AuditEntry is one control action
+type AuditEntry struct {
+	Time time.Time
+
+	Action string
+
+	// Kind and ID are empty for ActionNetwork
+	Kind string `json:",omitempty"`
+	ID   int    `json:",omitempty"`
+
+	User string
+	Addr string
+
+	Before Params
+	After  Params
+
+	// Result is "ok", or the error
+	Result string
+}
+
+// AuditFilter selects AuditEntry, zero values match all
+type AuditFilter struct {
+	Kind   string
+	ID     int
+	User   string
+	Action string
+
+	Since time.Time
+	Until time.Time
+
+	// Limit is the max number of entries returned
+	Limit int
+}
+
+// auditLog is an append-only JSON lines file. Entries older than
+// AppCfg.AuditMaxAge, or beyond AppCfg.AuditMax are dropped
+type auditLog struct {
+	lock sync.Mutex
+
+	file string
+
+	// entries are the oldest first
+	entries []AuditEntry
+}
+
+// audit is the log of all Path, opened at the first record
+var (
+	audit     auditLog
+	auditOnce sync.Once
+)
+
+// open loads file, and drops expired entries
+func (a *auditLog) open(file string) error {
+
+	a.lock.Lock()
+
+	defer a.lock.Unlock()
+
+	a.file = file
+	a.entries = nil
+
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, line := range bytes.Split(buf, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var e AuditEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			comm.Warning.Printf("Skip broken audit entry in %s", file)
+			continue
+		}
+
+		a.entries = append(a.entries, e)
+	}
+
+	if a.expired() > 0 {
+		return a.compact()
+	}
+
+	return nil
+}
+
+// record appends one entry
+func (a *auditLog) record(e AuditEntry) error {
+
+	a.lock.Lock()
+
+	defer a.lock.Unlock()
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	a.entries = append(a.entries, e)
+
+	// compacting rewrites the file with e, so it's not appended
+	if n := a.expired(); n > 0 && (n > comm.AppCfg.AuditMax/10 ||
+		time.Since(a.entries[0].Time) > comm.AppCfg.AuditMaxAge+24*time.Hour) {
+		return a.compact()
+	}
+
+	f, err := os.OpenFile(a.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		comm.Error.Printf("Write audit %s failed", a.file)
+		return err
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// expired returns the number of entries to be dropped
+func (a *auditLog) expired() int {
+	n := 0
+	if max := comm.AppCfg.AuditMax; max > 0 && len(a.entries) > max {
+		n = len(a.entries) - max
+	}
+
+	if age := comm.AppCfg.AuditMaxAge; age > 0 {
+		for n < len(a.entries) && time.Since(a.entries[n].Time) > age {
+			n++
+		}
+	}
+
+	return n
+}
+
+// compact drops expired entries, and rewrites file
+func (a *auditLog) compact() error {
+
+	a.entries = a.entries[a.expired():]
+
+	var all []byte
+	for _, e := range a.entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		all = append(append(all, line...), '\n')
+	}
+
+	tmp := a.file + ".tmp"
+	if err := writeSync(tmp, all); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, a.file)
+}
+
+// query returns entries matched by f, the newest first. Expired
+// entries not compacted yet are not returned
+func (a *auditLog) query(f AuditFilter) []AuditEntry {
+
+	a.lock.Lock()
+
+	defer a.lock.Unlock()
+
+	var out []AuditEntry
+	for i := len(a.entries) - 1; i >= a.expired(); i-- {
+		if f.Limit > 0 && len(out) >= f.Limit {
+			break
+		}
+
+		e := a.entries[i]
+		if (f.Kind != "" && e.Kind != f.Kind) ||
+			(f.ID > 0 && e.ID != f.ID) ||
+			(f.User != "" && e.User != f.User) ||
+			(f.Action != "" && e.Action != f.Action) ||
+			(!f.Since.IsZero() && e.Time.Before(f.Since)) ||
+			(!f.Until.IsZero() && e.Time.After(f.Until)) {
+			continue
+		}
+
+		out = append(out, e)
+	}
+
+	return out
+}
+
+// QueryAudit returns audit entries matched by f, the newest first
+func QueryAudit(f AuditFilter) []AuditEntry {
+	openAudit()
+
+	return audit.query(f)
+}
+
+func openAudit() {
+	auditOnce.Do(func() {
+		if err := audit.open(comm.AppCfg.AuditFile); err != nil {
+			comm.Error.Printf("Open audit %s failed: %v", comm.AppCfg.AuditFile, err)
+		}
+	})
+}
+
+// recordAudit records an action, failing to record is only logged
+func recordAudit(action string, kind string, ID int, by Actor,
+	before Params, after Params, err error) {
+
+	openAudit()
+
+	e := AuditEntry{Time: time.Now(), Action: action, Kind: kind, ID: ID,
+		User: by.User, Addr: by.Addr, Before: before, After: after, Result: "ok"}
+	if err != nil {
+		e.Result = err.Error()
+	}
+
+	if err := audit.record(e); err != nil {
+		comm.Error.Printf("Record audit failed: %v", err)
+	}
+}
+
+// actionOf tells the action of a Set from before to after
+func actionOf(before Params, after Params) string {
+	if before == nil || after == nil {
+		return ActionSet
+	}
+
+	if !equalValue(before["WorkerName"], after["WorkerName"]) {
+		return ActionAssign
+	}
+
+	diff := diffParams(before, after)
+	if len(diff) == 1 && diff[0].Field == "IsRunning" {
+		if running, _ := after["IsRunning"].(bool); running {
+			return ActionStart
+		}
+
+		return ActionStop
+	}
+
+	return ActionSet
+}
+
+// SetNetwork changes the IPv4 of AppCfg.HW, it's audited. Nothing
+// is audited if it's not supported
+func SetNetwork(ip net.IP, by Actor) error {
+
+	before := Params{"HW": comm.NetCfgInst.Name}
+	if old := comm.NetCfgInst.GetIPv4(); old != nil {
+		before["IP"] = old.String()
+	}
+
+	err := comm.NetCfgInst.SetIPv4(ip)
+	if err == comm.ErrNotSupported {
+		return err
+	}
+
+	recordAudit(ActionNetwork, "", 0, by, before,
+		Params{"HW": comm.NetCfgInst.Name, "IP": ip.String()}, err)
+
+	return err
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+	"github.com/zhanglongx/Aqua/driver"
+)
+
+func Test_auditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aqua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	max := comm.AppCfg.AuditMax
+	comm.AppCfg.AuditMax = 3
+	defer func() { comm.AppCfg.AuditMax = max }()
+
+	file := path.Join(dir, "audit.log")
+
+	a := auditLog{}
+	if err := a.open(file); err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+
+	old := time.Now().Add(-comm.AppCfg.AuditMaxAge - time.Hour)
+	a.record(AuditEntry{Time: old, Action: ActionSet, Kind: "encode", ID: 1, User: "a"})
+	a.record(AuditEntry{Time: time.Now(), Action: ActionStart, Kind: "encode", ID: 1, User: "a"})
+	a.record(AuditEntry{Time: time.Now(), Action: ActionStop, Kind: "decode", ID: 2, User: "b",
+		Result: errPathNotExists.Error()})
+
+	// reopen drops the expired one
+	b := auditLog{}
+	if err := b.open(file); err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+
+	if got := b.query(AuditFilter{}); len(got) != 2 || got[0].Action != ActionStop {
+		t.Errorf("query() = %v", got)
+	}
+	if got := b.query(AuditFilter{User: "a"}); len(got) != 1 || got[0].Action != ActionStart {
+		t.Errorf("query(User) = %v", got)
+	}
+	if got := b.query(AuditFilter{Kind: "decode", ID: 1}); len(got) != 0 {
+		t.Errorf("query(Kind, ID) = %v", got)
+	}
+	if got := b.query(AuditFilter{Until: old.Add(time.Hour)}); len(got) != 0 {
+		t.Errorf("query(Until) = %v", got)
+	}
+
+	// beyond AuditMax
+	for i := 0; i < 3; i++ {
+		b.record(AuditEntry{Time: time.Now(), Action: ActionSet, ID: i})
+	}
+	if got := b.query(AuditFilter{}); len(got) != 3 || got[0].ID != 2 {
+		t.Errorf("query() = %v", got)
+	}
+
+	// expired, but not compacted yet
+	comm.AppCfg.AuditMax = 20
+
+	c := auditLog{}
+	if err := c.open(path.Join(dir, "audit2.log")); err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+
+	c.record(AuditEntry{Time: old, Action: ActionSet, ID: 100})
+	for i := 0; i < 21; i++ {
+		c.record(AuditEntry{Time: time.Now(), Action: ActionSet, ID: i})
+	}
+	if len(c.entries) != 22 {
+		t.Fatalf("%d entries compacted", len(c.entries))
+	}
+	if got := c.query(AuditFilter{}); len(got) != 20 || got[19].ID != 1 {
+		t.Errorf("query() = %v", got)
+	}
+}
+
+func TestPath_DeleteRecording(t *testing.T) {
+	ep := &Path{kind: DecodeKind, inUse: make(map[int]driver.Worker)}
+
+	start := time.Now()
+
+	by := Actor{User: "recorder-test"}
+	if err := ep.DeleteRecording(3, "a.ts", by); err != errPathNotExists {
+		t.Errorf("DeleteRecording() error = %v", err)
+	}
+
+	got := QueryAudit(AuditFilter{User: by.User, Action: ActionRecordingDelete, Since: start})
+	if len(got) != 1 || got[0].ID != 3 || got[0].Before["Name"] != "a.ts" ||
+		got[0].Result != errPathNotExists.Error() {
+		t.Errorf("QueryAudit() = %v", got)
+	}
+}
+
+func Test_actionOf(t *testing.T) {
+	stopped := Params{"WorkerName": "C9830_3_0", "IsRunning": false}
+
+	tests := []struct {
+		name   string
+		before Params
+		after  Params
+		want   string
+	}{
+		{"new", nil, stopped, ActionSet},
+		{"start", stopped, Params{"WorkerName": "C9830_3_0", "IsRunning": true}, ActionStart},
+		{"assign", stopped, Params{"WorkerName": "C9830_3_1", "IsRunning": false}, ActionAssign},
+		{"set", stopped, Params{"WorkerName": "C9830_3_0", "IsRunning": true, "PathName": "x"}, ActionSet},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := actionOf(tt.before, tt.after); got != tt.want {
+				t.Errorf("actionOf() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,465 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+	"github.com/zhanglongx/Aqua/driver"
+)
+
+// BundleVer is the version of Bundle, only the major one must
+// match on import
+const BundleVer string = "1.0.0"
+
+// Bundle is the whole configuration of one chassis
+type Bundle struct {
+	Version string
+
+	// DBVersion is DBVER of Paths, which are migrated on import
+	DBVersion string
+
+	Created time.Time
+
+	// Paths are Params by kind name, then by ID
+	Paths map[string]map[string]Params
+
+	// Workers are the card inventory by kind name
+	Workers map[string][]string
+
+	Network Network
+
+	// Pipes is the topology when exported, it's rebuilt by Set
+	// on import
+	Pipes []PipeTopo
+}
+
+// Network is the network settings of a chassis
+type Network struct {
+	HW string
+
+	IP string
+
+	TransitSvr string
+}
+
+// PipeTopo is one driver.Pipe with worker names
+type PipeTopo struct {
+	Svr int
+
+	In  string
+	Out []string
+}
+
+// ImportOptions controls ImportBundle
+type ImportOptions struct {
+	// Mapping overrides WorkerName mapping, either by full worker
+	// name ("C9830_3_0") or by card slot ("C9830_3")
+	Mapping map[string]string
+
+	// DryRun only reports, nothing is applied
+	DryRun bool
+
+	// Network applies Bundle.Network too
+	Network bool
+}
+
+// ImportReport is the result of ImportBundle
+type ImportReport struct {
+	// Mapped are WorkerNames changed, from bundle to this chassis
+	Mapped map[string]string
+
+	// Unmapped paths are not applied
+	Unmapped []ImportItem
+
+	// Failed paths are mapped but Set failed
+	Failed []ImportItem
+
+	Applied int
+
+	DryRun bool
+
+	// Network is the error of applying Bundle.Network, empty if
+	// it's applied or not asked
+	Network string `json:",omitempty"`
+}
+
+// ImportItem is one path not imported
+type ImportItem struct {
+	Kind string
+	ID   int
+
+	WorkerName string
+
+	Reason string
+}
+
+var (
+	errBundleVersion = errors.New("Bundle version not supported")
+	errBundleKind    = errors.New("Bundle kind not exists")
+)
+
+var reWorkerName = regexp.MustCompile(`^(\S+)_(\d+)_(\d+)$`)
+
+// ExportBundle exports all paths
+func ExportBundle(paths []*Path) *Bundle {
+
+	b := &Bundle{Version: BundleVer,
+		DBVersion: DBVER,
+		Created:   time.Now(),
+		Paths:     make(map[string]map[string]Params),
+		Workers:   make(map[string][]string),
+	}
+
+	for _, p := range paths {
+		name := p.Kind().Name
+
+		b.Paths[name] = p.getAll()
+		b.Workers[name] = p.GetWorkers()
+	}
+
+	b.Network = Network{HW: comm.NetCfgInst.Name,
+		TransitSvr: comm.AppCfg.TransitSvr.String(),
+	}
+	if ip := comm.NetCfgInst.GetIPv4(); ip != nil {
+		b.Network.IP = ip.String()
+	}
+
+	for k, svr := range driver.Pipes {
+		if svr == nil {
+			continue
+		}
+
+		for _, pipe := range svr.GetInfo() {
+			t := PipeTopo{Svr: k}
+			if pipe.InWorkers != nil {
+				t.In = driver.GetWorkerName(pipe.InWorkers)
+			}
+			for _, o := range pipe.OutWorkers {
+				if o != nil {
+					t.Out = append(t.Out, driver.GetWorkerName(o))
+				}
+			}
+
+			b.Pipes = append(b.Pipes, t)
+		}
+	}
+
+	return b
+}
+
+// ImportBundle applies b to paths, WorkerNames are mapped to
+// workers on this chassis. Paths can't be mapped are reported
+// and skipped
+func ImportBundle(paths []*Path, b *Bundle, opts ImportOptions,
+	by Actor) (*ImportReport, error) {
+
+	if major(b.Version) != major(BundleVer) {
+		return nil, errBundleVersion
+	}
+
+	report := &ImportReport{Mapped: make(map[string]string), DryRun: opts.DryRun}
+
+	// all kinds are checked and mapped first, so a bad bundle
+	// applies nothing
+	var names []string
+	for name := range b.Paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var todo []importPath
+	for _, name := range names {
+		var p *Path
+		for _, exists := range paths {
+			if exists.Kind().Name == name {
+				p = exists
+				break
+			}
+		}
+
+		if p == nil {
+			comm.Error.Printf("Kind %s in bundle not exists", name)
+			return nil, errBundleKind
+		}
+
+		all, err := mapPaths(p, b.Paths[name], b.DBVersion, opts.Mapping, report)
+		if err != nil {
+			return nil, err
+		}
+
+		todo = append(todo, all...)
+	}
+
+	if opts.DryRun {
+		return report, nil
+	}
+
+	for _, one := range todo {
+		if err := one.p.Set(one.id, one.params, by); err != nil {
+			wn, _ := one.params["WorkerName"].(string)
+
+			comm.Error.Printf("Importing %s path %d failed", one.p.Kind().Name, one.id)
+			report.Failed = append(report.Failed,
+				ImportItem{Kind: one.p.Kind().Name, ID: one.id, WorkerName: wn, Reason: err.Error()})
+			continue
+		}
+
+		report.Applied++
+	}
+
+	if opts.Network {
+		if ip := net.ParseIP(b.Network.IP); ip != nil {
+			if err := SetNetwork(ip, by); err == comm.ErrNotSupported {
+				report.Network = err.Error()
+			} else if err != nil {
+				return report, err
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// importPath is a path of a bundle mapped to be Set
+type importPath struct {
+	p  *Path
+	id int
+
+	params Params
+}
+
+// mapPaths migrates and maps all Params of kind of p in a bundle.
+// Paths can't be mapped are added to report, the others are
+// returned in the order of ID. all is not changed
+func mapPaths(p *Path, all map[string]Params, version string,
+	mapping map[string]string, report *ImportReport) ([]importPath, error) {
+
+	name := p.Kind().Name
+
+	copied := make(map[string]Params)
+	for id, params := range all {
+		copied[id] = copyParams(params)
+	}
+
+	if _, err := migrateParams(version, copied); err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	var used []string
+	for IDStr, params := range copied {
+		id, err := strconv.Atoi(IDStr)
+		if err != nil {
+			return nil, errBadParams
+		}
+
+		ids = append(ids, id)
+
+		for _, k := range []string{"WorkerName", "Standby"} {
+			if wn, ok := params[k].(string); ok && wn != "" {
+				used = append(used, wn)
+			}
+		}
+	}
+
+	sort.Ints(ids)
+
+	mapped, reasons := mapWorkers(used, p.GetWorkers(), mapping)
+
+	var out []importPath
+	for _, id := range ids {
+		params := copied[strconv.Itoa(id)]
+		wn, _ := params["WorkerName"].(string)
+
+		to, ok := mapped[wn]
+		if typ, _ := params["WorkerType"].(string); !ok && typ != "" {
+			// placed again on this chassis
+			to, ok = "", true
+		}
+
+		if !ok {
+			report.Unmapped = append(report.Unmapped,
+				ImportItem{Kind: name, ID: id, WorkerName: wn, Reason: reasons[wn]})
+			continue
+		}
+
+		// Standby is mapped the same way, or the path is
+		// not applied
+		standby, _ := params["Standby"].(string)
+		if standby != "" {
+			toStandby, ok := mapped[standby]
+			if !ok {
+				report.Unmapped = append(report.Unmapped,
+					ImportItem{Kind: name, ID: id, WorkerName: standby, Reason: reasons[standby]})
+				continue
+			}
+
+			if toStandby != standby {
+				report.Mapped[standby] = toStandby
+				params["Standby"] = toStandby
+			}
+		}
+
+		if to != wn {
+			if to != "" {
+				report.Mapped[wn] = to
+			}
+			params["WorkerName"] = to
+		}
+
+		out = append(out, importPath{p: p, id: id, params: params})
+	}
+
+	return out, nil
+}
+
+// mapWorkers maps used worker names to workers. A name is kept if
+// it exists, or moved to a free slot of the same card type in
+// ascending order. Unmapped names are returned with reasons
+func mapWorkers(used []string, workers []string,
+	mapping map[string]string) (map[string]string, map[string]string) {
+
+	exists := make(map[string]bool)
+	for _, w := range workers {
+		exists[w] = true
+	}
+
+	// slots to move to, by card type. Slots already used or
+	// explicitly mapped to are not free
+	usedSlots := make(map[string]bool)
+	for _, wn := range used {
+		if m := reWorkerName.FindStringSubmatch(wn); m != nil {
+			usedSlots[m[1]+"_"+m[2]] = true
+		}
+	}
+
+	// slot to slot, the same slot is moved together
+	moved := make(map[string]string)
+	for k, v := range mapping {
+		if reWorkerName.MatchString(k) {
+			continue
+		}
+		moved[k] = v
+		usedSlots[v] = true
+	}
+
+	seen := make(map[string]bool)
+	freeSlots := make(map[string][]int)
+	for _, w := range workers {
+		m := reWorkerName.FindStringSubmatch(w)
+		if m == nil || usedSlots[m[1]+"_"+m[2]] || seen[m[1]+"_"+m[2]] {
+			continue
+		}
+
+		seen[m[1]+"_"+m[2]] = true
+
+		slot, _ := strconv.Atoi(m[2])
+		freeSlots[m[1]] = append(freeSlots[m[1]], slot)
+	}
+	for _, s := range freeSlots {
+		sort.Ints(s)
+	}
+
+	sorted := append([]string{}, used...)
+	sort.Strings(sorted)
+
+	mapped := make(map[string]string)
+	reasons := make(map[string]string)
+	taken := make(map[string]bool)
+	for _, wn := range sorted {
+		if _, done := mapped[wn]; done {
+			continue
+		}
+
+		to := ""
+		m := reWorkerName.FindStringSubmatch(wn)
+		switch {
+		case mapping[wn] != "":
+			to = mapping[wn]
+
+		case m != nil && moved[m[1]+"_"+m[2]] != "":
+			to = moved[m[1]+"_"+m[2]] + "_" + m[3]
+
+		case exists[wn]:
+			to = wn
+
+		case m != nil:
+			slot := m[1] + "_" + m[2]
+			if len(freeSlots[m[1]]) > 0 {
+				moved[slot] = fmt.Sprintf("%s_%d", m[1], freeSlots[m[1]][0])
+				freeSlots[m[1]] = freeSlots[m[1]][1:]
+				to = moved[slot] + "_" + m[3]
+			}
+		}
+
+		switch {
+		case to == "":
+			reasons[wn] = "no free " + cardType(wn) + " slot"
+		case !exists[to]:
+			reasons[wn] = to + " not exists"
+		case taken[to]:
+			reasons[wn] = to + " already mapped"
+		default:
+			mapped[wn] = to
+			taken[to] = true
+		}
+	}
+
+	return mapped, reasons
+}
+
+func cardType(wn string) string {
+	if m := reWorkerName.FindStringSubmatch(wn); m != nil {
+		return m[1]
+	}
+
+	return "card"
+}
+
+func major(version string) string {
+	return strings.SplitN(version, ".", 2)[0]
+}
+
+// copyParams deep copies params, with nested maps
+func copyParams(params Params) Params {
+	if params == nil {
+		return nil
+	}
+
+	out := make(Params)
+	for k, v := range params {
+		if m, ok := v.(map[string]interface{}); ok {
+			v = map[string]interface{}(copyParams(m))
+		}
+		out[k] = v
+	}
+
+	return out
+}
+
+// getAll returns a copy of all Params in DB
+func (ep *Path) getAll() map[string]Params {
+
+	ep.lock.RLock()
+
+	defer ep.lock.RUnlock()
+
+	all := make(map[string]Params)
+	for id, params := range ep.db.Params {
+		all[id] = copyParams(params)
+	}
+
+	return all
+}
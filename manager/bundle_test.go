@@ -0,0 +1,111 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/zhanglongx/Aqua/driver"
+)
+
+func Test_mapWorkers(t *testing.T) {
+	workers := []string{"C9830_10_0", "C9830_10_1", "C9830_5_0", "C9830_5_1",
+		"C9830_7_0", "local_encoder_32_0"}
+
+	tests := []struct {
+		name    string
+		used    []string
+		mapping map[string]string
+		want    map[string]string
+		reasons map[string]string
+	}{
+		{
+			name: "same",
+			used: []string{"C9830_5_1", "local_encoder_32_0"},
+			want: map[string]string{"C9830_5_1": "C9830_5_1",
+				"local_encoder_32_0": "local_encoder_32_0"},
+		},
+		{
+			name: "slot moved together",
+			used: []string{"C9830_3_0", "C9830_3_1", "C9830_7_0"},
+			want: map[string]string{"C9830_3_0": "C9830_5_0", "C9830_3_1": "C9830_5_1",
+				"C9830_7_0": "C9830_7_0"},
+			reasons: map[string]string{},
+		},
+		{
+			name:    "explicit",
+			used:    []string{"C9830_3_0", "C9830_4_0", "C9830_6_1"},
+			mapping: map[string]string{"C9830_3": "C9830_10", "C9830_4_0": "C9830_5_1"},
+			want:    map[string]string{"C9830_3_0": "C9830_10_0", "C9830_4_0": "C9830_5_1"},
+			reasons: map[string]string{"C9830_6_1": "C9830_5_1 already mapped"},
+		},
+		{
+			name: "no slot",
+			used: []string{"C9830_1_0", "C9830_2_0", "C9830_3_0", "C9830_4_0", "LocalX_1_0"},
+			want: map[string]string{"C9830_1_0": "C9830_5_0", "C9830_2_0": "C9830_7_0",
+				"C9830_3_0": "C9830_10_0"},
+			reasons: map[string]string{"C9830_4_0": "no free C9830 slot",
+				"LocalX_1_0": "no free LocalX slot"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reasons := mapWorkers(tt.used, workers, tt.mapping)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mapWorkers() = %v, want %v", got, tt.want)
+			}
+			if tt.reasons != nil && !reflect.DeepEqual(reasons, tt.reasons) {
+				t.Errorf("mapWorkers() reasons = %v, want %v", reasons, tt.reasons)
+			}
+		})
+	}
+}
+
+func TestImportBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aqua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ep := &Path{kind: EncodeKind, inUse: make(map[int]driver.Worker),
+		statusMonitors: make(map[int]*driver.StatusMonitor)}
+	if err := ep.db.loadFromFile(dir, "encode.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer ep.db.close()
+
+	for i := 0; i < 2; i++ {
+		ep.workers = append(ep.workers, &driver.DummyWorker{Slot: 3, WorkerID: i})
+	}
+
+	valid := map[string]Params{"1": {"WorkerName": "local_encoder_3_0", "IsRunning": false},
+		"2": {"WorkerName": "local_encoder_3_1", "IsRunning": false}}
+
+	// an unknown kind next to a valid one, nothing is applied
+	for _, bad := range []map[string]map[string]Params{
+		{"encode": valid, "nope": {"1": {"WorkerName": "x_1_0"}}},
+		{"encode": valid, "aaa": {"1": {"WorkerName": "x_1_0"}}},
+	} {
+		b := &Bundle{Version: BundleVer, DBVersion: DBVER, Paths: bad}
+		if _, err := ImportBundle([]*Path{ep}, b, ImportOptions{}, Actor{}); err != errBundleKind {
+			t.Errorf("ImportBundle() error = %v", err)
+		}
+		if len(ep.db.Params) != 0 {
+			t.Fatalf("applied %v", ep.db.Params)
+		}
+	}
+
+	b := &Bundle{Version: BundleVer, DBVersion: DBVER,
+		Paths: map[string]map[string]Params{"encode": valid}}
+	report, err := ImportBundle([]*Path{ep}, b, ImportOptions{}, Actor{})
+	if err != nil || report.Applied != 2 || len(ep.db.Params) != 2 {
+		t.Errorf("ImportBundle() = %v, %v", report, err)
+	}
+}
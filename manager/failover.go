@@ -0,0 +1,471 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+	"github.com/zhanglongx/Aqua/driver"
+)
+
+// failoverTick is how often running paths are checked, the same
+// as driver.StatusMonitor
+const failoverTick = 2 * time.Second
+
+// failover decisions
+const (
+	doNothing = iota
+	doFailover
+	doFailback
+)
+
+// active sides of a path in FailoverState
+const (
+	ActivePrimary = "primary"
+	ActiveStandby = "standby"
+	ActiveBackup  = "backup"
+
+	// ActiveReplaced is placed on another worker by WorkerType
+	ActiveReplaced = "replaced"
+)
+
+// FailoverState is the redundancy state of a path
+type FailoverState struct {
+	// Active is ActivePrimary, ActiveStandby if moved to Standby
+	// worker, ActiveBackup if switched to a BackupURLs, or
+	// ActiveReplaced if placed on another worker
+	Active string
+
+	Switches   int
+	LastSwitch time.Time `json:",omitempty"`
+	LastError  string    `json:",omitempty"`
+}
+
+// failCfg is the redundancy configuration in Params
+type failCfg struct {
+	standby string
+	backups []string
+
+	// workerType and placement re-place a failed path
+	workerType string
+	placement  string
+
+	after   time.Duration
+	recover time.Duration
+
+	failback bool
+}
+
+// failState tracks one running path
+type failState struct {
+	FailoverState
+
+	badSince  time.Time
+	goodSince time.Time
+
+	// primary is Params before the first switch, nil if not
+	// switched. applied is Params set by the last switch
+	primary Params
+	applied Params
+
+	// failed are workers switched away from, by time
+	failed map[string]time.Time
+}
+
+// excluded returns workers failed within d, they are not placed
+// on again
+func (st *failState) excluded(now time.Time, d time.Duration) map[string]bool {
+	all := make(map[string]bool)
+	for wn, t := range st.failed {
+		if now.Sub(t) < d {
+			all[wn] = true
+		} else {
+			delete(st.failed, wn)
+		}
+	}
+
+	return all
+}
+
+func failCfgOf(params Params) failCfg {
+	cfg := failCfg{after: 10 * time.Second, recover: 60 * time.Second}
+
+	cfg.standby, _ = params["Standby"].(string)
+	cfg.workerType, _ = params["WorkerType"].(string)
+	cfg.placement, _ = params["Placement"].(string)
+	cfg.failback, _ = params["Failback"].(bool)
+
+	if l, ok := params["BackupURLs"].([]interface{}); ok {
+		for _, u := range l {
+			if s, ok := u.(string); ok && s != "" {
+				cfg.backups = append(cfg.backups, s)
+			}
+		}
+	}
+
+	if i, ok := toFloat(params["FailAfter"]); ok && i > 0 {
+		cfg.after = time.Duration(i) * time.Second
+	}
+	if i, ok := toFloat(params["RecoverAfter"]); ok && i > 0 {
+		cfg.recover = time.Duration(i) * time.Second
+	}
+
+	return cfg
+}
+
+// enabled tells if the path has any redundancy
+func (cfg failCfg) enabled() bool {
+	return cfg.standby != "" || len(cfg.backups) > 0 || cfg.workerType != ""
+}
+
+// observe records status at now
+func (st *failState) observe(healthy bool, now time.Time) {
+	if healthy {
+		st.badSince = time.Time{}
+		if st.goodSince.IsZero() {
+			st.goodSince = now
+		}
+	} else {
+		st.goodSince = time.Time{}
+		if st.badSince.IsZero() {
+			st.badSince = now
+		}
+	}
+}
+
+// decide returns what to do at now. A path must be failed for
+// cfg.after, and not switched within cfg.after, to fail over. It
+// must be healthy for cfg.recover to fail back
+func (st *failState) decide(cfg failCfg, now time.Time) int {
+	if !st.badSince.IsZero() && now.Sub(st.badSince) >= cfg.after &&
+		now.Sub(st.LastSwitch) >= cfg.after {
+		return doFailover
+	}
+
+	if cfg.failback && st.primary != nil && !st.goodSince.IsZero() &&
+		now.Sub(st.goodSince) >= cfg.recover {
+		return doFailback
+	}
+
+	return doNothing
+}
+
+// switchParams returns Params after failing over from params. It
+// moves to cfg.standby first, then rotates BackupURLs. nil if
+// nothing to switch
+func switchParams(params Params, cfg failCfg, primary Params) (Params, string) {
+
+	next := copyParams(params)
+
+	wn, _ := params["WorkerName"].(string)
+	orig, _ := primary["WorkerName"].(string)
+	onStandby := primary != nil && wn != orig
+
+	card, _ := next["Card"].(map[string]interface{})
+	url, hasURL := card["rtsp_url"].(string)
+
+	switch {
+	case cfg.standby != "" && !onStandby:
+		next["WorkerName"], next["Standby"] = cfg.standby, wn
+		return next, ActiveStandby
+
+	case hasURL && len(cfg.backups) > 0:
+		card["rtsp_url"] = cfg.backups[0]
+
+		var rotated []interface{}
+		for _, u := range cfg.backups[1:] {
+			rotated = append(rotated, u)
+		}
+		next["BackupURLs"] = append(rotated, url)
+
+		if onStandby {
+			return next, ActiveStandby
+		}
+		return next, ActiveBackup
+
+	case cfg.standby != "":
+		// back to the other worker, it may be good now
+		next["WorkerName"], next["Standby"] = cfg.standby, wn
+		if cfg.standby == orig {
+			return next, ActivePrimary
+		}
+		return next, ActiveStandby
+	}
+
+	return nil, ""
+}
+
+// restoreParams returns params with redundancy fields restored
+// from primary, others are kept
+func restoreParams(params Params, primary Params) Params {
+
+	next := copyParams(params)
+	for _, k := range []string{"WorkerName", "Standby", "BackupURLs"} {
+		if v, ok := primary[k]; ok {
+			next[k] = v
+		} else {
+			delete(next, k)
+		}
+	}
+
+	orig, _ := primary["Card"].(map[string]interface{})
+	if url, ok := orig["rtsp_url"]; ok {
+		if card, ok := next["Card"].(map[string]interface{}); ok {
+			card["rtsp_url"] = url
+		}
+	}
+
+	return next
+}
+
+// watch checks all running paths every failoverTick, until stop
+func (ep *Path) watch(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	tick := time.NewTicker(failoverTick)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-tick.C:
+			ep.checkFailover(now)
+		}
+	}
+}
+
+// watched is a running path with redundancy
+type watched struct {
+	id     int
+	params Params
+
+	w  driver.Worker
+	sm *driver.StatusMonitor
+}
+
+// checkFailover observes all watched paths, and switches the
+// failed ones. Workers are never called with failLock held, as
+// they may block on a failed card
+func (ep *Path) checkFailover(now time.Time) {
+
+	var all []watched
+
+	ep.lock.RLock()
+	for IDStr, params := range ep.db.Params {
+		id, _ := strconv.Atoi(IDStr)
+
+		running, _ := params["IsRunning"].(bool)
+		if w := ep.inUse[id]; running && w != nil && failCfgOf(params).enabled() {
+			all = append(all, watched{id, copyParams(params), w, ep.statusMonitors[id]})
+		}
+	}
+	ep.lock.RUnlock()
+
+	sort.Slice(all, func(i, j int) bool { return all[i].id < all[j].id })
+
+	healthy := make([]bool, len(all))
+	for i, p := range all {
+		if p.sm != nil {
+			healthy[i] = p.sm.GetStatus()
+		} else {
+			healthy[i] = p.w.Monitor()
+		}
+	}
+
+	type decision struct {
+		p   watched
+		cfg failCfg
+		st  *failState
+		do  int
+	}
+
+	var todo []decision
+
+	ep.failLock.Lock()
+	states := make(map[int]*failState)
+	for i, p := range all {
+		st := ep.failStates[p.id]
+		if st == nil {
+			st = &failState{FailoverState: FailoverState{Active: ActivePrimary}}
+		}
+
+		// changed by others, start over
+		if st.applied != nil && len(diffParams(st.applied, p.params)) > 0 {
+			st = &failState{FailoverState: FailoverState{Active: ActivePrimary}}
+		}
+
+		states[p.id] = st
+
+		st.observe(healthy[i], now)
+
+		cfg := failCfgOf(p.params)
+		if do := st.decide(cfg, now); do != doNothing {
+			todo = append(todo, decision{p, cfg, st, do})
+		}
+	}
+
+	// stopped ones are dropped
+	ep.failStates = states
+	ep.failLock.Unlock()
+
+	for _, d := range todo {
+		switch d.do {
+		case doFailover:
+			ep.failover(d.p, d.cfg, d.st, now)
+		case doFailback:
+			ep.failback(d.p, d.st, now)
+		}
+	}
+}
+
+// failover switches p away, the failed worker is stopped by Set
+// when it's replaced
+func (ep *Path) failover(p watched, cfg failCfg, st *failState, now time.Time) {
+
+	ep.failLock.Lock()
+	primary := st.primary
+	if primary == nil {
+		primary = p.params
+	}
+	exclude := st.excluded(now, cfg.recover)
+	ep.failLock.Unlock()
+
+	wn, _ := p.params["WorkerName"].(string)
+	orig, _ := primary["WorkerName"].(string)
+
+	var next Params
+	var active string
+
+	// Standby goes first, then placed on another worker
+	if cfg.workerType != "" && (cfg.standby == "" || wn != orig) {
+		exclude[wn] = true
+		exclude[cfg.standby] = true
+
+		name, err := ep.place(p.id, cfg.workerType, cfg.placement, exclude)
+		if err == nil {
+			next = copyParams(p.params)
+			next["WorkerName"] = name
+			active = ActiveReplaced
+		}
+	}
+
+	if next == nil {
+		if next, active = switchParams(p.params, cfg, primary); next == nil {
+			return
+		}
+	}
+
+	comm.Warning.Printf("Path %s %d failed, switching to %s", ep.kind.Name, p.id, active)
+
+	err := ep.Set(p.id, next, Actor{User: "failover"})
+	applied := ep.getParams(p.id)
+
+	ep.failLock.Lock()
+
+	defer ep.failLock.Unlock()
+
+	st.LastSwitch = now
+	if err != nil {
+		comm.Error.Printf("Failover path %s %d failed: %v", ep.kind.Name, p.id, err)
+		st.LastError = err.Error()
+		failovers.WithLabelValues(ep.kind.Name, "failed").Inc()
+		return
+	}
+
+	if next["WorkerName"] != wn {
+		if st.failed == nil {
+			st.failed = make(map[string]time.Time)
+		}
+		st.failed[wn] = now
+	}
+
+	st.primary = primary
+	st.applied = applied
+	st.Active = active
+	st.Switches++
+	st.LastError = ""
+	st.badSince, st.goodSince = time.Time{}, time.Time{}
+
+	failovers.WithLabelValues(ep.kind.Name, "failover").Inc()
+}
+
+func (ep *Path) failback(p watched, st *failState, now time.Time) {
+
+	ep.failLock.Lock()
+	primary := st.primary
+	ep.failLock.Unlock()
+
+	orig, _ := primary["WorkerName"].(string)
+	if wn, _ := p.params["WorkerName"].(string); orig != wn {
+		ep.lock.RLock()
+		w := ep.workers.findWorker(orig)
+		ep.lock.RUnlock()
+
+		if w == nil || !w.Monitor() {
+			// check again after another cfg.recover
+			ep.failLock.Lock()
+			st.goodSince = now
+			ep.failLock.Unlock()
+			return
+		}
+	}
+
+	comm.Info.Printf("Path %s %d failing back to primary", ep.kind.Name, p.id)
+
+	err := ep.Set(p.id, restoreParams(p.params, primary), Actor{User: "failover"})
+
+	ep.failLock.Lock()
+
+	defer ep.failLock.Unlock()
+
+	st.LastSwitch = now
+	if err != nil {
+		comm.Error.Printf("Failback path %s %d failed: %v", ep.kind.Name, p.id, err)
+		st.LastError = err.Error()
+		st.goodSince = now
+		failovers.WithLabelValues(ep.kind.Name, "failed").Inc()
+		return
+	}
+
+	st.primary = nil
+	st.applied = nil
+	st.Active = ActivePrimary
+	st.Switches++
+	st.LastError = ""
+	st.badSince, st.goodSince = time.Time{}, time.Time{}
+
+	failovers.WithLabelValues(ep.kind.Name, "failback").Inc()
+}
+
+// getParams returns a copy of Params in DB
+func (ep *Path) getParams(ID int) Params {
+
+	ep.lock.RLock()
+
+	defer ep.lock.RUnlock()
+
+	return copyParams(ep.db.get(ID))
+}
+
+// GetFailoverStates returns states of running paths with
+// redundancy, by ID
+func (ep *Path) GetFailoverStates() map[int]FailoverState {
+
+	ep.failLock.Lock()
+
+	defer ep.failLock.Unlock()
+
+	all := make(map[int]FailoverState)
+	for id, st := range ep.failStates {
+		all[id] = st.FailoverState
+	}
+
+	return all
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_failState_decide(t *testing.T) {
+	cfg := failCfg{after: 10 * time.Second, recover: 30 * time.Second, failback: true}
+
+	start := time.Date(2020, 6, 1, 8, 0, 0, 0, time.UTC)
+	at := func(sec int) time.Time { return start.Add(time.Duration(sec) * time.Second) }
+
+	st := failState{}
+
+	// a short glitch is ignored
+	st.observe(false, at(0))
+	st.observe(true, at(4))
+	if got := st.decide(cfg, at(4)); got != doNothing {
+		t.Errorf("decide() glitch = %v", got)
+	}
+
+	st.observe(false, at(6))
+	if got := st.decide(cfg, at(14)); got != doNothing {
+		t.Errorf("decide() at 14 = %v", got)
+	}
+	if got := st.decide(cfg, at(16)); got != doFailover {
+		t.Errorf("decide() at 16 = %v", got)
+	}
+
+	// switched at 16, not again within cfg.after
+	st.LastSwitch = at(16)
+	st.primary = Params{}
+	st.badSince = time.Time{}
+	st.observe(false, at(18))
+	if got := st.decide(cfg, at(24)); got != doNothing {
+		t.Errorf("decide() at 24 = %v", got)
+	}
+	if got := st.decide(cfg, at(28)); got != doFailover {
+		t.Errorf("decide() at 28 = %v", got)
+	}
+
+	st.observe(true, at(30))
+	if got := st.decide(cfg, at(50)); got != doNothing {
+		t.Errorf("decide() at 50 = %v", got)
+	}
+	if got := st.decide(cfg, at(60)); got != doFailback {
+		t.Errorf("decide() at 60 = %v", got)
+	}
+
+	cfg.failback = false
+	if got := st.decide(cfg, at(60)); got != doNothing {
+		t.Errorf("decide() no failback = %v", got)
+	}
+}
+
+func Test_switchParams(t *testing.T) {
+	primary := Params{"WorkerName": "C9830_3_0", "Standby": "C9830_3_1", "IsRunning": true,
+		"BackupURLs": []interface{}{"rtsp://b", "rtsp://c"},
+		"Card":       map[string]interface{}{"rtsp_url": "rtsp://a", "BitRate": 2000}}
+
+	// to the standby worker first
+	next, active := switchParams(primary, failCfgOf(primary), primary)
+	if active != ActiveStandby || next["WorkerName"] != "C9830_3_1" || next["Standby"] != "C9830_3_0" {
+		t.Fatalf("switchParams() = %v, %v", next, active)
+	}
+
+	// then the sources are rotated
+	next, active = switchParams(next, failCfgOf(next), primary)
+	card := next["Card"].(map[string]interface{})
+	if active != ActiveStandby || card["rtsp_url"] != "rtsp://b" ||
+		!reflect.DeepEqual(next["BackupURLs"], []interface{}{"rtsp://c", "rtsp://a"}) {
+		t.Fatalf("switchParams() = %v, %v", next, active)
+	}
+
+	// restored, other settings are kept
+	next["Card"].(map[string]interface{})["BitRate"] = 4000
+	back := restoreParams(next, primary)
+	want := copyParams(primary)
+	want["Card"].(map[string]interface{})["BitRate"] = 4000
+	if !reflect.DeepEqual(back, want) {
+		t.Errorf("restoreParams() = %v, want %v", back, want)
+	}
+
+	// nothing to switch
+	if next, _ := switchParams(Params{"WorkerName": "C9830_3_0"}, failCfg{}, nil); next != nil {
+		t.Errorf("switchParams() = %v", next)
+	}
+}
@@ -0,0 +1,374 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// group states in GroupStatus
+const (
+	GroupUp       = "up"
+	GroupDegraded = "degraded"
+	GroupDown     = "down"
+	GroupEmpty    = "empty"
+)
+
+// Member is a path in a Group
+type Member struct {
+	Kind string
+	ID   int
+}
+
+// Group is a named set of paths, like a bouquet
+type Group struct {
+	Name  string
+	Title string `json:",omitempty"`
+
+	Members []Member
+}
+
+// MemberResult is the result of a bulk operation on a member
+type MemberResult struct {
+	Member
+
+	// Result is "ok", or the error
+	Result string
+
+	// Params is the Params after, if ok
+	Params Params `json:",omitempty"`
+}
+
+// MemberStatus is the status of a member
+type MemberStatus struct {
+	Member
+
+	Running bool
+	Healthy bool
+}
+
+// GroupStatus is the status of a Group. State is GroupUp if all
+// members are running and healthy, GroupDown if none is, or
+// GroupDegraded
+type GroupStatus struct {
+	Group
+
+	State string
+
+	Up    int
+	Total int
+
+	Status []MemberStatus
+}
+
+// Groups keeps all Group, in AppCfg.GroupFile
+type Groups struct {
+	lock sync.Mutex
+
+	file string
+
+	paths []*Path
+
+	Groups map[string]*Group
+}
+
+var (
+	errGroupNotExists = errors.New("Group not exists")
+	errGroupBadName   = errors.New("Bad group name")
+	errGroupBadKind   = errors.New("Group member kind not exists")
+	errGroupBadID     = errors.New("Group member path not exists")
+	errGroupDup       = errors.New("Duplicated group member")
+	errGroupNoParams  = errors.New("Group set needs Params")
+)
+
+var reGroupName = regexp.MustCompile(`^[\w-]+$`)
+
+// Load loads groups from file, of paths
+func (gs *Groups) Load(file string, paths []*Path) error {
+
+	gs.lock.Lock()
+
+	defer gs.lock.Unlock()
+
+	gs.file = file
+	gs.paths = paths
+	gs.Groups = make(map[string]*Group)
+
+	buf, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(buf, gs); err != nil {
+		return fmt.Errorf("decode groups %s: %v", file, err)
+	}
+
+	if gs.Groups == nil {
+		gs.Groups = make(map[string]*Group)
+	}
+
+	return nil
+}
+
+// Put adds or replaces a group
+func (gs *Groups) Put(g Group) error {
+
+	gs.lock.Lock()
+
+	defer gs.lock.Unlock()
+
+	if err := gs.check(&g); err != nil {
+		return err
+	}
+
+	old := gs.Groups[g.Name]
+	gs.Groups[g.Name] = &g
+
+	if err := gs.save(); err != nil {
+		if old != nil {
+			gs.Groups[g.Name] = old
+		} else {
+			delete(gs.Groups, g.Name)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Delete deletes a group, the paths are untouched
+func (gs *Groups) Delete(name string) error {
+
+	gs.lock.Lock()
+
+	defer gs.lock.Unlock()
+
+	old := gs.Groups[name]
+	if old == nil {
+		return errGroupNotExists
+	}
+
+	delete(gs.Groups, name)
+
+	if err := gs.save(); err != nil {
+		gs.Groups[name] = old
+		return err
+	}
+
+	return nil
+}
+
+// Get returns the group of name
+func (gs *Groups) Get(name string) (Group, error) {
+
+	gs.lock.Lock()
+
+	defer gs.lock.Unlock()
+
+	g := gs.Groups[name]
+	if g == nil {
+		return Group{}, errGroupNotExists
+	}
+
+	return *g, nil
+}
+
+// List returns all groups, by name
+func (gs *Groups) List() []Group {
+
+	gs.lock.Lock()
+
+	defer gs.lock.Unlock()
+
+	var all []Group
+	for _, g := range gs.Groups {
+		all = append(all, *g)
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+
+	return all
+}
+
+// Apply does action (ApplyStart, ApplyStop or ApplySet with merge)
+// on all members of group name concurrently. One result for each
+// member, in order of Members
+func (gs *Groups) Apply(name string, action string, merge Params,
+	by Actor) ([]MemberResult, error) {
+
+	switch action {
+	case ApplyStart, ApplyStop:
+	case ApplySet:
+		if len(merge) == 0 {
+			return nil, errGroupNoParams
+		}
+	default:
+		return nil, errBadAction
+	}
+
+	g, err := gs.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]MemberResult, len(g.Members))
+
+	var wg sync.WaitGroup
+	for i, m := range g.Members {
+		wg.Add(1)
+		go func(i int, m Member) {
+			defer wg.Done()
+
+			results[i] = gs.applyOne(m, action, merge, by)
+		}(i, m)
+	}
+
+	wg.Wait()
+
+	return results, nil
+}
+
+func (gs *Groups) applyOne(m Member, action string, merge Params,
+	by Actor) MemberResult {
+
+	r := MemberResult{Member: m, Result: "ok"}
+
+	p := findPath(gs.paths, m.Kind)
+	if p == nil {
+		r.Result = errGroupBadKind.Error()
+		return r
+	}
+
+	if err := p.Apply(m.ID, action, merge, by); err != nil {
+		r.Result = err.Error()
+		return r
+	}
+
+	r.Params = p.getParams(m.ID)
+
+	return r
+}
+
+// Status returns the status of group name
+func (gs *Groups) Status(name string) (GroupStatus, error) {
+
+	g, err := gs.Get(name)
+	if err != nil {
+		return GroupStatus{}, err
+	}
+
+	return gs.status(g), nil
+}
+
+// AllStatus returns status of all groups, by name
+func (gs *Groups) AllStatus() []GroupStatus {
+
+	var all []GroupStatus
+	for _, g := range gs.List() {
+		all = append(all, gs.status(g))
+	}
+
+	return all
+}
+
+func (gs *Groups) status(g Group) GroupStatus {
+
+	st := GroupStatus{Group: g, Total: len(g.Members)}
+
+	for _, m := range g.Members {
+		ms := MemberStatus{Member: m}
+
+		if p := findPath(gs.paths, m.Kind); p != nil {
+			ms.Running, _ = p.getParams(m.ID)["IsRunning"].(bool)
+			ms.Healthy = ms.Running && p.healthy(m.ID)
+		}
+
+		if ms.Healthy {
+			st.Up++
+		}
+
+		st.Status = append(st.Status, ms)
+	}
+
+	switch {
+	case st.Total == 0:
+		st.State = GroupEmpty
+	case st.Up == st.Total:
+		st.State = GroupUp
+	case st.Up == 0:
+		st.State = GroupDown
+	default:
+		st.State = GroupDegraded
+	}
+
+	return st
+}
+
+// check validates g
+func (gs *Groups) check(g *Group) error {
+
+	if !reGroupName.MatchString(g.Name) {
+		return errGroupBadName
+	}
+
+	seen := make(map[Member]bool)
+	for _, m := range g.Members {
+		p := findPath(gs.paths, m.Kind)
+		if p == nil {
+			return fmt.Errorf("%v: %s", errGroupBadKind, m.Kind)
+		}
+
+		valid := false
+		for _, id := range p.IDs() {
+			if id == m.ID {
+				valid = true
+				break
+			}
+		}
+
+		if !valid {
+			return fmt.Errorf("%v: %s %d", errGroupBadID, m.Kind, m.ID)
+		}
+
+		if seen[m] {
+			return fmt.Errorf("%v: %s %d", errGroupDup, m.Kind, m.ID)
+		}
+
+		seen[m] = true
+	}
+
+	return nil
+}
+
+// save writes file atomically
+func (gs *Groups) save() error {
+
+	buf, err := json.MarshalIndent(gs, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(gs.file), 0755); err != nil {
+		return err
+	}
+
+	tmp := gs.file + ".tmp"
+	if err := writeSync(tmp, buf); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, gs.file)
+}
@@ -0,0 +1,212 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/zhanglongx/Aqua/driver"
+)
+
+func TestGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aqua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "groups.json")
+
+	ep := &Path{kind: PathKind{Name: "encode"}, inUse: make(map[int]driver.Worker)}
+	ep.db.create()
+	for i := 0; i < 3; i++ {
+		ep.workers = append(ep.workers, &driver.DummyWorker{Slot: 3, WorkerID: i})
+	}
+	ep.db.Params["1"] = Params{"IsRunning": true}
+	ep.db.Params["2"] = Params{"IsRunning": false}
+
+	paths := []*Path{ep}
+
+	var gs Groups
+	if err := gs.Load(file, paths); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	news := Group{Name: "news", Title: "新闻", Members: []Member{{"encode", 1}, {"encode", 2}}}
+	if err := gs.Put(news); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	for _, bad := range []Group{
+		{Name: "a b"},
+		{Name: "bad", Members: []Member{{"nope", 1}}},
+		{Name: "bad", Members: []Member{{"encode", 4}}},
+		{Name: "bad", Members: []Member{{"encode", 1}, {"encode", 1}}},
+	} {
+		if err := gs.Put(bad); err == nil {
+			t.Errorf("Put(%v) no error", bad)
+		}
+	}
+
+	if err := gs.Put(Group{Name: "empty"}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	// not healthy without a StatusMonitor
+	st, err := gs.Status("news")
+	if err != nil || st.State != GroupDown || st.Total != 2 ||
+		!st.Status[0].Running || st.Status[1].Running {
+		t.Errorf("Status() = %v, %v", st, err)
+	}
+
+	if st, _ := gs.Status("empty"); st.State != GroupEmpty {
+		t.Errorf("Status() = %v", st)
+	}
+
+	if _, err := gs.Apply("news", "reboot", nil, Actor{}); err != errBadAction {
+		t.Errorf("Apply() error = %v", err)
+	}
+
+	if _, err := gs.Apply("news", ApplySet, nil, Actor{}); err != errGroupNoParams {
+		t.Errorf("Apply() error = %v", err)
+	}
+
+	if _, err := gs.Apply("nope", ApplyStart, nil, Actor{}); err != errGroupNotExists {
+		t.Errorf("Apply() error = %v", err)
+	}
+
+	if err := gs.Delete("empty"); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+
+	var gs2 Groups
+	if err := gs2.Load(file, paths); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	all := gs2.List()
+	if len(all) != 1 || all[0].Title != "新闻" || len(all[0].Members) != 2 {
+		t.Errorf("List() = %v", all)
+	}
+}
+
+// testDecoder is a decoder of this host, healthy while running.
+// It has no StatusMonitor, as decoders of a path
+type testDecoder struct {
+	driver.DummyWorker
+
+	lock    sync.Mutex
+	running bool
+}
+
+func (w *testDecoder) Control(c driver.CtlCmd, arg interface{}) interface{} {
+	switch c {
+	case driver.CtlCmdStart, driver.CtlCmdStop:
+		w.lock.Lock()
+		w.running = c == driver.CtlCmdStart
+		w.lock.Unlock()
+	case driver.CtlCmdName:
+		return fmt.Sprintf("%s_%d_%d", driver.LocalDecoderName, w.Slot, w.WorkerID)
+	case driver.CtlCmdIP:
+		return net.IPv4(127, 0, 0, 1)
+	case driver.CtlCmdWorkerID:
+		return w.WorkerID
+	}
+	return nil
+}
+
+func (w *testDecoder) Monitor() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.running
+}
+
+func (w *testDecoder) Decode(sess *driver.Session) error {
+	return nil
+}
+
+func TestGroups_applyDecode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aqua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// transit accepts all forwards
+	svr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var req struct{ ID uint64 }
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(rw).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID,
+			"result": map[string]interface{}{}})
+	}))
+	defer svr.Close()
+
+	saved := driver.TransURL
+	driver.TransURL = svr.URL
+	defer func() { driver.TransURL = saved }()
+
+	ep := &Path{kind: DecodeKind, inUse: make(map[int]driver.Worker),
+		statusMonitors: make(map[int]*driver.StatusMonitor)}
+	if err := ep.db.loadFromFile(dir, "decode.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer ep.db.close()
+
+	var members []Member
+	for i := 0; i < 4; i++ {
+		w := &testDecoder{DummyWorker: driver.DummyWorker{Slot: 7, WorkerID: i}}
+		ep.workers = append(ep.workers, w)
+		ep.db.Params[fmt.Sprint(i+1)] = Params{"WorkerName": driver.GetWorkerName(w),
+			"IsRunning": false}
+		members = append(members, Member{"decode", i + 1})
+	}
+
+	var gs Groups
+	if err := gs.Load(path.Join(dir, "groups.json"), []*Path{ep}); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if err := gs.Put(Group{Name: "wall", Members: members}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	// members are applied concurrently
+	results, err := gs.Apply("wall", ApplyStart, nil, Actor{User: "test"})
+	if err != nil || len(results) != 4 {
+		t.Fatalf("Apply() = %v, %v", results, err)
+	}
+	for _, r := range results {
+		if r.Result != "ok" || r.Params["IsRunning"] != true {
+			t.Errorf("Apply() %v = %s, %v", r.Member, r.Result, r.Params)
+		}
+	}
+
+	// healthy by Monitor without a StatusMonitor
+	if st, _ := gs.Status("wall"); st.State != GroupUp || st.Up != 4 {
+		t.Errorf("Status() = %v", st)
+	}
+
+	ep.workers[2].(*testDecoder).Control(driver.CtlCmdStop, nil)
+	if st, _ := gs.Status("wall"); st.State != GroupDegraded || st.Status[2].Healthy {
+		t.Errorf("Status() = %v", st)
+	}
+
+	if _, err := gs.Apply("wall", ApplyStop, nil, Actor{User: "test"}); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if st, _ := gs.Status("wall"); st.State != GroupDown || st.Status[0].Running {
+		t.Errorf("Status() = %v", st)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Actor is who makes a change, filled by the web layer
+type Actor struct {
+	User string
+
+	// Addr is the source IP
+	Addr string
+}
+
+// Revision is one change of a path's Params
+type Revision struct {
+	// Seq is assigned by Store, increasing in one kind
+	Seq int
+
+	Kind string
+	ID   int
+
+	User string
+	Addr string
+	Time time.Time
+
+	// Before is nil if the path was not set
+	Before Params
+	After  Params
+
+	Diff []Change
+}
+
+// Change is one field changed in a Revision. Card settings are
+// named as "Card.xxx"
+type Change struct {
+	Field string
+
+	Before interface{}
+	After  interface{}
+}
+
+var (
+	errRevisionNotExists = errors.New("Revision not exists")
+	errRevisionEmpty     = errors.New("Revision has no Params")
+)
+
+// diffParams returns all changed fields, sorted by name
+func diffParams(before Params, after Params) []Change {
+	var changes []Change
+
+	diffMap(before, after, "", &changes)
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+
+	return changes
+}
+
+func diffMap(before map[string]interface{}, after map[string]interface{},
+	prefix string, changes *[]Change) {
+
+	keys := make(map[string]bool)
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+
+	for k := range keys {
+		b, a := before[k], after[k]
+
+		bm, bok := b.(map[string]interface{})
+		am, aok := a.(map[string]interface{})
+		if (bok || b == nil) && (aok || a == nil) && (bok || aok) {
+			diffMap(bm, am, prefix+k+".", changes)
+			continue
+		}
+
+		if !equalValue(b, a) {
+			*changes = append(*changes, Change{Field: prefix + k, Before: b, After: a})
+		}
+	}
+}
+
+// equalValue treats int and float64 of JSON as the same
+func equalValue(a interface{}, b interface{}) bool {
+	if fa, ok := toFloat(a); ok {
+		if fb, ok := toFloat(b); ok {
+			return fa == fb
+		}
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+
+	return 0, false
+}
+
+// GetRevisions returns revisions of path ID, or of all paths if
+// ID < 0. The newest is first
+func (ep *Path) GetRevisions(ID int) ([]Revision, error) {
+
+	ep.lock.RLock()
+
+	defer ep.lock.RUnlock()
+
+	revs, err := ep.db.store.Revisions(ID)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(revs, func(i, j int) bool {
+		return revs[i].Seq > revs[j].Seq
+	})
+
+	return revs, nil
+}
+
+// Rollback re-applies Params after revision seq to path ID, by
+// the normal Set
+func (ep *Path) Rollback(ID int, seq int, by Actor) error {
+
+	revs, err := ep.GetRevisions(ID)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range revs {
+		if r.Seq != seq {
+			continue
+		}
+
+		if r.After == nil {
+			return errRevisionEmpty
+		}
+
+		params := make(Params)
+		for k, v := range r.After {
+			params[k] = v
+		}
+
+		return ep.Set(ID, params, by)
+	}
+
+	return errRevisionNotExists
+}
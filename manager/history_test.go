@@ -0,0 +1,149 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func Test_diffParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		before Params
+		after  Params
+		want   []Change
+	}{
+		{"same", Params{"BitRate": 2000}, Params{"BitRate": float64(2000)}, nil},
+		{
+			name:   "new",
+			before: nil,
+			after:  Params{"WorkerName": "C9830_3_0", "Card": map[string]interface{}{"BitRate": 2000}},
+			want: []Change{
+				{Field: "Card.BitRate", After: 2000},
+				{Field: "WorkerName", After: "C9830_3_0"},
+			},
+		},
+		{
+			name: "changed",
+			before: Params{"IsRunning": true,
+				"Card": map[string]interface{}{"rtsp_url": "rtsp://a", "BitRate": 2000}},
+			after: Params{"IsRunning": false,
+				"Card": map[string]interface{}{"rtsp_url": "rtsp://b", "BitRate": 2000}},
+			want: []Change{
+				{Field: "Card.rtsp_url", Before: "rtsp://a", After: "rtsp://b"},
+				{Field: "IsRunning", Before: true, After: false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffParams(tt.before, tt.after); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffParams() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDB_revisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aqua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := DB{}
+	db.create()
+	if err := db.loadFromFile(dir, "encode.json"); err != nil {
+		t.Fatalf("loadFromFile() error = %v", err)
+	}
+
+	for i, wn := range []string{"C9830_3_0", "C9830_3_1"} {
+		p := Params{"WorkerName": wn}
+		rev := Revision{Kind: "encode", ID: 1, User: "admin", Before: db.get(1),
+			After: p, Diff: diffParams(db.get(1), p)}
+		if err := db.setMulti(map[int]Params{1: p}, []Revision{rev}); err != nil {
+			t.Fatalf("setMulti() %d error = %v", i, err)
+		}
+	}
+
+	db.close()
+
+	db2 := DB{}
+	db2.create()
+	if err := db2.loadFromFile(dir, "encode.json"); err != nil {
+		t.Fatalf("loadFromFile() error = %v", err)
+	}
+	defer db2.close()
+
+	revs, err := db2.store.Revisions(1)
+	if err != nil || len(revs) != 2 {
+		t.Fatalf("Revisions() = %v, %v", revs, err)
+	}
+
+	if revs[1].Seq != revs[0].Seq+1 || revs[1].Before["WorkerName"] != "C9830_3_0" ||
+		revs[1].User != "admin" {
+		t.Errorf("Revisions() = %v", revs)
+	}
+
+	if revs, _ := db2.store.Revisions(2); len(revs) != 0 {
+		t.Errorf("Revisions(2) = %v", revs)
+	}
+
+	// revisions are in the DB file, with Params
+	if _, err := os.Stat(path.Join(dir, "encode.json.history")); !os.IsNotExist(err) {
+		t.Errorf("history file exists")
+	}
+
+	buf, _ := ioutil.ReadFile(path.Join(dir, "encode.json"))
+	var saved jsonStore
+	if err := json.Unmarshal(buf, &saved); err != nil || len(saved.History) != 2 ||
+		saved.Params["1"]["WorkerName"] != "C9830_3_1" {
+		t.Errorf("DB file = %s, %v", buf, err)
+	}
+}
+
+func TestDB_oldHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aqua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// revisions were appended to file.history
+	ioutil.WriteFile(path.Join(dir, "encode.json"),
+		[]byte(`{"Version": "`+DBVER+`", "Params": {"1": {"WorkerName": "C9830_3_1"}}}`), 0644)
+	ioutil.WriteFile(path.Join(dir, "encode.json.history"),
+		[]byte(`{"Seq": 7, "Kind": "encode", "ID": 1, "User": "admin"}`+"\n{broken\n"), 0644)
+
+	db := DB{}
+	db.create()
+	if err := db.loadFromFile(dir, "encode.json"); err != nil {
+		t.Fatalf("loadFromFile() error = %v", err)
+	}
+	defer db.close()
+
+	if revs, _ := db.store.Revisions(1); len(revs) != 1 || revs[0].Seq != 7 {
+		t.Fatalf("Revisions() = %v", revs)
+	}
+
+	p := Params{"WorkerName": "C9830_3_0"}
+	rev := Revision{Kind: "encode", ID: 1, Before: db.get(1), After: p}
+	if err := db.setMulti(map[int]Params{1: p}, []Revision{rev}); err != nil {
+		t.Fatalf("setMulti() error = %v", err)
+	}
+
+	if revs, _ := db.store.Revisions(1); len(revs) != 2 || revs[1].Seq != 8 {
+		t.Errorf("Revisions() = %v", revs)
+	}
+	if _, err := os.Stat(path.Join(dir, "encode.json.history")); !os.IsNotExist(err) {
+		t.Errorf("history file is not removed")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"github.com/zhanglongx/Aqua/comm"
+	"github.com/zhanglongx/Aqua/driver"
+)
+
+// PathKind describes a kind of Path, like encode or decode, and
+// the Params it takes. Adding a new kind of path should only need
+// a new PathKind
+type PathKind struct {
+	// Name identities the kind, and is used in URL
+	Name string
+
+	// Title is shown to the user
+	Title string
+
+	// Dir and File of DB
+	Dir  string
+	File string
+
+	// Need are the card names can be registered
+	Need []string
+
+	// Num is the number of paths, 0 to be the number of workers
+	Num int
+
+	// Fields are top-level Params. Params["Card"] is checked by
+	// the worker's driver.Schema instead
+	Fields []driver.Field
+}
+
+// fields shared by all kinds
+var (
+	// workerNameField is required, unless WorkerType is set
+	workerNameField = driver.Field{Name: "WorkerName", Label: "设备选择",
+		Type: driver.FieldWorker, Pattern: `^(\S+_\d+_\d+)?$`}
+
+	// placementFields request a worker by type, see placement.go
+	placementFields = []driver.Field{
+		{Name: "WorkerType", Label: "自动分配类型", Type: driver.FieldString,
+			Default: ""},
+		{Name: "Placement", Label: "分配策略", Type: driver.FieldString,
+			Enum: []string{PlaceLeastLoaded, PlaceSpread}},
+	}
+
+	isRunningField = driver.Field{Name: "IsRunning", Label: "是否启动",
+		Type: driver.FieldBool, Default: false}
+
+	// failoverFields are the redundancy of a path, see failover.go
+	failoverFields = []driver.Field{
+		{Name: "Standby", Label: "备用设备", Type: driver.FieldWorker,
+			Pattern: `^(\S+_\d+_\d+)?$`},
+		{Name: "BackupURLs", Label: "备用RTSP地址", Type: driver.FieldStrings,
+			Pattern: `^rtsp://\S+$`},
+		{Name: "FailAfter", Label: "故障切换(秒)", Type: driver.FieldInt,
+			Default: 10, Min: 2, Max: 3600},
+		{Name: "Failback", Label: "自动回切", Type: driver.FieldBool,
+			Default: false},
+		{Name: "RecoverAfter", Label: "回切等待(秒)", Type: driver.FieldInt,
+			Default: 60, Min: 2, Max: 86400},
+	}
+)
+
+// EncodeKind is the kind of encode path
+var EncodeKind = PathKind{
+	Name:  "encode",
+	Title: "编码通道",
+
+	Dir:  comm.AppCfg.EPDir,
+	File: comm.AppCfg.EPFile,
+	Need: comm.AppCfg.EPNeed,
+	Num:  comm.AppCfg.EPNum,
+
+	Fields: append([]driver.Field{
+		{Name: "PathName", Label: "通道名称", Type: driver.FieldString,
+			Default: ""},
+		workerNameField,
+		isRunningField,
+	}, append(placementFields, failoverFields...)...),
+}
+
+// DecodeKind is the kind of decode path
+var DecodeKind = PathKind{
+	Name:  "decode",
+	Title: "解码通道",
+
+	Dir:  comm.AppCfg.DPDir,
+	File: comm.AppCfg.DPFile,
+	Need: comm.AppCfg.DPNeed,
+	Num:  comm.AppCfg.DPNum,
+
+	Fields: append([]driver.Field{
+		workerNameField,
+		isRunningField,
+	}, append(placementFields, failoverFields...)...),
+}
+
+// Kinds are all PathKind supported
+var Kinds = []PathKind{EncodeKind, DecodeKind}
@@ -10,10 +10,11 @@ package manager
 import (
 	"errors"
 	"io"
-	"regexp"
+	"net/http"
 	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/xlab/treeprint"
 	"github.com/zhanglongx/Aqua/comm"
@@ -28,6 +29,8 @@ type Params map[string]interface{}
 type Path struct {
 	lock sync.RWMutex
 
+	kind PathKind
+
 	// db store settings
 	db DB
 
@@ -39,35 +42,56 @@ type Path struct {
 
 	// status contains status of workers
 	statusMonitors map[int]*driver.StatusMonitor
+
+	// lastSlot is the slot placed last, for PlaceSpread
+	lastSlot int
+
+	// failStates are tracked by watch() until stop
+	failLock   sync.Mutex
+	failStates map[int]*failState
+
+	stop chan struct{}
+	done chan struct{}
 }
 
+// actions of Apply
+const (
+	ApplyStart = "start"
+	ApplyStop  = "stop"
+	ApplySet   = "set"
+)
+
 var (
+	errBadAction       = errors.New("Bad action")
 	errBadParams       = errors.New("Params parse error")
 	errPathNotExists   = errors.New("Path not exists")
 	errWorkerNotExists = errors.New("Worker not exists")
 	errWorkerInUse     = errors.New("Worker in Use")
+	errPathNoStream    = errors.New("Path serves no stream")
 )
 
 // Create does registing, and loads cfg from file
-func (ep *Path) Create(dir string, file string, need []string) error {
+func (ep *Path) Create(kind PathKind) error {
+
+	ep.kind = kind
 
 	ep.inUse = make(map[int]driver.Worker)
 	ep.statusMonitors = make(map[int]*driver.StatusMonitor)
 
 	ep.workers = Workers{}
-	if err := ep.workers.register(need); err != nil {
+	if err := ep.workers.register(kind.Name, kind.Need); err != nil {
 		return err
 	}
 
 	ep.db.create()
-	if err := ep.db.loadFromFile(dir, file); err != nil {
+	if err := ep.db.loadFromFile(kind.Dir, kind.File); err != nil {
 		return err
 	}
 
 	for IDStr, params := range ep.db.Params {
 		id, _ := strconv.Atoi(IDStr)
 
-		if err := ep.Set(id, params); err != nil {
+		if err := ep.set(id, ep.placeParams(id, params), nil); err != nil {
 			comm.Error.Printf("Appling saved params in path %d failed", id)
 
 			// Just clear the path?
@@ -77,35 +101,139 @@ func (ep *Path) Create(dir string, file string, need []string) error {
 		}
 	}
 
+	collector.add(ep)
+
+	ep.stop, ep.done = make(chan struct{}), make(chan struct{})
+
+	go ep.watch(ep.stop, ep.done)
+
 	return nil
 }
 
-// Set processes data settings
-func (ep *Path) Set(ID int, params Params) error {
+// Close stops failover, and closes the DB. Workers are left as
+// they are
+func (ep *Path) Close() error {
+	if ep.stop == nil {
+		return nil
+	}
+
+	close(ep.stop)
+	<-ep.done
+
+	ep.stop = nil
+
+	ep.lock.Lock()
+
+	defer ep.lock.Unlock()
+
+	return ep.db.close()
+}
+
+// Set processes data settings, the change is recorded as a
+// Revision made by, and audited with the result
+func (ep *Path) Set(ID int, params Params, by Actor) error {
+
+	params = ep.placeParams(ID, params)
 
 	ep.lock.Lock()
 
 	defer ep.lock.Unlock()
 
+	return ep.setAudited(ID, params, by)
+}
+
+// Apply starts, stops, or merges settings into path ID, by Set.
+// merge is only used by ApplySet
+func (ep *Path) Apply(ID int, action string, merge Params, by Actor) error {
+
+	saved := ep.getParams(ID)
+
+	params, err := applyParams(saved, action, merge)
+	if err != nil {
+		return err
+	}
+
+	params = ep.placeParams(ID, params)
+
+	ep.lock.Lock()
+
+	defer ep.lock.Unlock()
+
+	// changed meanwhile, applied again
+	if now := ep.db.get(ID); len(diffParams(saved, now)) > 0 {
+		if params, err = applyParams(now, action, merge); err != nil {
+			return err
+		}
+	}
+
+	return ep.setAudited(ID, params, by)
+}
+
+// applyParams returns saved started, stopped, or merged by action
+func applyParams(saved Params, action string, merge Params) (Params, error) {
+
+	if saved == nil {
+		return nil, errPathNotExists
+	}
+
+	params := copyParams(saved)
+	switch action {
+	case ApplyStart:
+		params["IsRunning"] = true
+	case ApplyStop:
+		params["IsRunning"] = false
+	case ApplySet:
+		mergeParams(params, merge)
+	default:
+		return nil, errBadAction
+	}
+
+	return params, nil
+}
+
+// setAudited does set, and records the audit
+func (ep *Path) setAudited(ID int, params Params, by Actor) error {
+
+	before := ep.db.get(ID)
+
+	err := ep.set(ID, params, &by)
+
+	after := params
+	if err == nil {
+		after = ep.db.get(ID)
+	}
+
+	recordAudit(actionOf(before, after), ep.kind.Name, ID, by, before, after, err)
+
+	return err
+}
+
+// set does Set, no Revision is recorded if by is nil
+func (ep *Path) set(ID int, params Params, by *Actor) error {
+
 	if !isPathValid(ID) {
 		return errPathNotExists
 	}
 
-	if err := checkParams(params); err != nil {
+	var w driver.Worker
+	var err error
+	if params, w, err = ep.checkParams(ID, params); err != nil {
 		return err
 	}
 
-	w := ep.workers.findWorker(params["WorkerName"].(string))
-	if w == nil {
-		return errWorkerNotExists
-	}
-
 	if k := ep.isWorkerAlloc(w); k != -1 && k != ID {
 		return errWorkerInUse
 	}
 
 	if exists := ep.inUse[ID]; exists != w {
 		if exists != nil {
+			// the replaced one may be failed, so it's stopped
+			// anyway
+			if err := driver.SetWorkerRunning(exists, false); err != nil {
+				comm.Warning.Printf("Stop %s replaced in path %d failed: %v",
+					driver.GetWorkerName(exists), ID, err)
+			}
+
 			// un-do
 			if driver.IsWorkerDec(exists) {
 				pipe := driver.Pipes[driver.PipeEncoder]
@@ -121,6 +249,7 @@ func (ep *Path) Set(ID int, params Params) error {
 				}
 				if sm, ok := ep.statusMonitors[ID]; ok {
 					sm.StopMonitor()
+					delete(ep.statusMonitors, ID)
 				}
 			}
 
@@ -155,12 +284,20 @@ func (ep *Path) Set(ID int, params Params) error {
 		}
 	}
 
-	isRunning := params["IsRunning"].(bool)
+	isRunning, _ := params["IsRunning"].(bool)
 	if err := driver.SetWorkerRunning(w, isRunning); err != nil {
 		return err
 	}
 
-	if err := ep.db.set(ID, params); err != nil {
+	var revs []Revision
+	before := ep.db.get(ID)
+	if diff := diffParams(before, params); by != nil && len(diff) > 0 {
+		revs = append(revs, Revision{Kind: ep.kind.Name, ID: ID,
+			User: by.User, Addr: by.Addr, Time: time.Now(),
+			Before: before, After: params, Diff: diff})
+	}
+
+	if err := ep.db.setMulti(map[int]Params{ID: params}, revs); err != nil {
 		return err
 	}
 
@@ -187,6 +324,45 @@ func (ep *Path) Get(ID int) (Params, error) {
 	return saved, nil
 }
 
+// Kind returns the PathKind of path
+func (ep *Path) Kind() PathKind {
+	return ep.kind
+}
+
+// IDs returns all path IDs, which are 1 to PathKind.Num, or to
+// the number of workers if Num is 0. IDs already in DB are also
+// included
+func (ep *Path) IDs() []int {
+
+	ep.lock.RLock()
+
+	defer ep.lock.RUnlock()
+
+	return ep.ids()
+}
+
+func (ep *Path) ids() []int {
+	num := ep.kind.Num
+	if num <= 0 {
+		num = len(ep.workers)
+	}
+
+	var ids []int
+	for id := 1; id <= num; id++ {
+		ids = append(ids, id)
+	}
+
+	for IDStr := range ep.db.Params {
+		if id, err := strconv.Atoi(IDStr); err == nil && id > num {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Ints(ids)
+
+	return ids
+}
+
 // GetWorkers gets all workers registered under a path
 func (ep *Path) GetWorkers() []string {
 
@@ -204,6 +380,43 @@ func (ep *Path) GetWorkers() []string {
 	return all
 }
 
+// GetSchemas returns driver.Schema of all workers, by name
+func (ep *Path) GetSchemas() map[string]driver.Schema {
+
+	ep.lock.RLock()
+
+	defer ep.lock.RUnlock()
+
+	all := make(map[string]driver.Schema)
+	for _, w := range ep.workers {
+		all[driver.GetWorkerName(w)] = driver.GetWorkerSchema(w)
+	}
+
+	return all
+}
+
+// CardFields returns all Fields in Params["Card"] of all
+// workers, the first one is kept if names are duplicated
+func (ep *Path) CardFields() []driver.Field {
+
+	ep.lock.RLock()
+
+	defer ep.lock.RUnlock()
+
+	var all []driver.Field
+	seen := make(map[string]bool)
+	for _, w := range ep.workers {
+		for _, f := range driver.GetWorkerSchema(w) {
+			if !seen[f.Name] {
+				seen[f.Name] = true
+				all = append(all, f)
+			}
+		}
+	}
+
+	return all
+}
+
 // GetAllStatus return all status
 func (ep *Path) GetAllStatus() map[int]bool {
 	ep.lock.RLock()
@@ -216,6 +429,116 @@ func (ep *Path) GetAllStatus() map[int]bool {
 	return allStatus
 }
 
+// healthy tells if the worker of path ID is healthy, by its
+// StatusMonitor. Workers without one, like decoders, are asked
+// by Monitor out of ep.lock, which may block on a failed card
+func (ep *Path) healthy(ID int) bool {
+	ep.lock.RLock()
+	w, sm := ep.inUse[ID], ep.statusMonitors[ID]
+	ep.lock.RUnlock()
+
+	if sm != nil {
+		return sm.GetStatus()
+	}
+
+	if w != nil {
+		return w.Monitor()
+	}
+
+	return false
+}
+
+// GetAllReports returns reports of monitored paths, by ID
+func (ep *Path) GetAllReports() map[int][]string {
+	ep.lock.RLock()
+	defer ep.lock.RUnlock()
+
+	all := make(map[int][]string)
+	for i, sm := range ep.statusMonitors {
+		if r := sm.GetReport(); r != nil {
+			all[i] = r
+		}
+	}
+	return all
+}
+
+// GetLogs returns logs of the worker of path ID, nil if it keeps
+// none
+func (ep *Path) GetLogs(ID int) ([]string, error) {
+	ep.lock.RLock()
+	defer ep.lock.RUnlock()
+
+	w := ep.inUse[ID]
+	if w == nil {
+		return nil, errPathNotExists
+	}
+
+	return driver.GetWorkerLogs(w), nil
+}
+
+// GetRecordings returns recordings of the worker of path ID
+func (ep *Path) GetRecordings(ID int) ([]driver.Recording, error) {
+	ep.lock.RLock()
+	defer ep.lock.RUnlock()
+
+	w := ep.inUse[ID]
+	if w == nil {
+		return nil, errPathNotExists
+	}
+
+	return driver.GetWorkerRecordings(w)
+}
+
+// GetRecordingFile returns the file of recording name of path ID
+func (ep *Path) GetRecordingFile(ID int, name string) (string, error) {
+	ep.lock.RLock()
+	defer ep.lock.RUnlock()
+
+	w := ep.inUse[ID]
+	if w == nil {
+		return "", errPathNotExists
+	}
+
+	return driver.GetWorkerRecordingFile(w, name)
+}
+
+// DeleteRecording deletes recording name of path ID, which is
+// audited as made by
+func (ep *Path) DeleteRecording(ID int, name string, by Actor) error {
+	ep.lock.RLock()
+	w := ep.inUse[ID]
+	ep.lock.RUnlock()
+
+	err := errPathNotExists
+	if w != nil {
+		err = driver.DeleteWorkerRecording(w, name)
+	}
+
+	recordAudit(ActionRecordingDelete, ep.kind.Name, ID, by,
+		Params{"Name": name}, nil, err)
+
+	return err
+}
+
+// GetHandler returns the HTTP handler of the worker of path ID,
+// like HLS
+func (ep *Path) GetHandler(ID int) (http.Handler, error) {
+	ep.lock.RLock()
+	defer ep.lock.RUnlock()
+
+	w := ep.inUse[ID]
+	if w == nil {
+		return nil, errPathNotExists
+	}
+
+	h := driver.GetWorkerHandler(w)
+	if h == nil {
+		return nil, errPathNoStream
+	}
+
+	return h, nil
+}
+
 // isWorkerAlloc find if a worker is alloc
 func (ep *Path) isWorkerAlloc(w driver.Worker) int {
 	for k, exist := range ep.inUse {
@@ -260,21 +583,55 @@ func isPathValid(ID int) bool {
 	return true
 }
 
-// checkParams only do basic literal check, and leaves legal
-// checking alone
-func checkParams(params Params) error {
+// checkParams checks params against PathKind.Fields, and
+// Params["Card"] against the worker's driver.Schema. It returns
+// params with defaults filled and the worker, which must be placed
+// by placeParams if WorkerType is set
+func (ep *Path) checkParams(ID int, params Params) (Params, driver.Worker, error) {
 
 	if params == nil {
 		// TODO: un-do a path?
-		return errBadParams
+		return nil, nil, errBadParams
 	}
 
-	// TODO: unicode
-	wn := params["WorkerName"].(string)
-	matched, err := regexp.Match(`\S+_\d+_\d+`, []byte(wn))
-	if !matched || err != nil {
-		return errBadParams
+	out, pe := validate(ep.kind.Fields, params, "")
+	if len(pe) > 0 {
+		return nil, nil, pe
 	}
 
-	return nil
+	if err := ep.checkPlacement(ID, out); err != nil {
+		return nil, nil, err
+	}
+
+	wn, _ := out["WorkerName"].(string)
+	w := ep.workers.findWorker(wn)
+	if w == nil {
+		return nil, nil, ParamsError{{"WorkerName", errWorkerNotExists.Error()}}
+	}
+
+	if standby, _ := out["Standby"].(string); standby != "" {
+		if standby == wn {
+			return nil, nil, ParamsError{{"Standby", "must not be WorkerName"}}
+		}
+		if ep.workers.findWorker(standby) == nil {
+			return nil, nil, ParamsError{{"Standby", errWorkerNotExists.Error()}}
+		}
+	}
+
+	schema := driver.GetWorkerSchema(w)
+
+	card, ok := out["Card"].(map[string]interface{})
+	if out["Card"] != nil && !ok {
+		return nil, nil, ParamsError{{"Card", "must be an object"}}
+	}
+
+	if len(schema) > 0 || card != nil {
+		if card, pe = validate(schema, card, "Card."); len(pe) > 0 {
+			return nil, nil, pe
+		}
+
+		out["Card"] = card
+	}
+
+	return out, w, nil
 }
@@ -0,0 +1,162 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/zhanglongx/Aqua/driver"
+)
+
+// path states in metrics
+const (
+	stateUnset   = "unset"
+	stateStopped = "stopped"
+	stateRunning = "running"
+	stateFailed  = "failed"
+)
+
+// metrics of manager, registered to prometheus default registry
+var (
+	dbSaveDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "aqua",
+		Subsystem: "db",
+		Name:      "save_duration_seconds",
+		Help:      "Duration of saving DB, by file.",
+	}, []string{"file"})
+
+	cardsFound = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "aqua",
+		Subsystem: "cards",
+		Name:      "discovered",
+		Help:      "Cards found by register_server at the last registering, by kind, name and result.",
+	}, []string{"kind", "name", "result"})
+
+	failovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "aqua",
+		Subsystem: "path",
+		Name:      "failovers_total",
+		Help:      "Failover switches, by kind and result (failover, failback or failed).",
+	}, []string{"kind", "result"})
+
+	pathsDesc = prometheus.NewDesc("aqua_paths",
+		"Number of paths, by kind and state.",
+		[]string{"kind", "state"}, nil)
+
+	workerRunningDesc = prometheus.NewDesc("aqua_worker_running",
+		"1 if the worker is set running.",
+		[]string{"kind", "path", "worker"}, nil)
+
+	workerHealthyDesc = prometheus.NewDesc("aqua_worker_healthy",
+		"1 if StatusMonitor reports the worker healthy.",
+		[]string{"kind", "path", "worker"}, nil)
+)
+
+// pathCollector collects all Path created at scraping
+type pathCollector struct {
+	lock sync.Mutex
+
+	paths []*Path
+}
+
+var collector = &pathCollector{}
+
+func init() {
+	prometheus.MustRegister(dbSaveDuration, cardsFound, failovers, collector)
+}
+
+func (pc *pathCollector) add(p *Path) {
+	pc.lock.Lock()
+
+	defer pc.lock.Unlock()
+
+	pc.paths = append(pc.paths, p)
+}
+
+// Describe implements prometheus.Collector
+func (pc *pathCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pathsDesc
+	ch <- workerRunningDesc
+	ch <- workerHealthyDesc
+}
+
+// Collect implements prometheus.Collector
+func (pc *pathCollector) Collect(ch chan<- prometheus.Metric) {
+	pc.lock.Lock()
+
+	defer pc.lock.Unlock()
+
+	for _, p := range pc.paths {
+		p.collect(ch)
+	}
+}
+
+// collect sends metrics of ep
+func (ep *Path) collect(ch chan<- prometheus.Metric) {
+	ep.lock.RLock()
+
+	defer ep.lock.RUnlock()
+
+	kind := ep.kind.Name
+
+	states := map[string]int{stateUnset: 0, stateStopped: 0,
+		stateRunning: 0, stateFailed: 0}
+
+	for _, id := range ep.ids() {
+		params := ep.db.get(id)
+		if params == nil {
+			states[stateUnset]++
+			continue
+		}
+
+		isRunning, _ := params["IsRunning"].(bool)
+
+		healthy := true
+		if sm, ok := ep.statusMonitors[id]; ok {
+			healthy = sm.GetStatus()
+		}
+
+		switch {
+		case !isRunning:
+			states[stateStopped]++
+		case healthy:
+			states[stateRunning]++
+		default:
+			states[stateFailed]++
+		}
+
+		w := ep.inUse[id]
+		if w == nil {
+			continue
+		}
+
+		name := driver.GetWorkerName(w)
+		path := strconv.Itoa(id)
+
+		ch <- prometheus.MustNewConstMetric(workerRunningDesc,
+			prometheus.GaugeValue, b2f(isRunning), kind, path, name)
+
+		if sm, ok := ep.statusMonitors[id]; ok {
+			ch <- prometheus.MustNewConstMetric(workerHealthyDesc,
+				prometheus.GaugeValue, b2f(sm.GetStatus()), kind, path, name)
+		}
+	}
+
+	for state, n := range states {
+		ch <- prometheus.MustNewConstMetric(pathsDesc,
+			prometheus.GaugeValue, float64(n), kind, state)
+	}
+}
+
+func b2f(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
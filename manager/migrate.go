@@ -0,0 +1,131 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"errors"
+
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+// migration upgrades all Params in DB from version From to To.
+// Add one when DBVER is bumped, never change the old ones
+type migration struct {
+	From string
+	To   string
+
+	Up func(all map[string]Params) error
+}
+
+// migrations are applied one by one, until DBVER
+var migrations = []migration{
+	{From: "1.0.0", To: "1.1.0", Up: migrateCard},
+}
+
+var (
+	errDBVersion = errors.New("DB version not supported")
+)
+
+// migrate upgrades d to DBVER step by step. The original store
+// is kept as file.v{Version}. An unknown Version is an error, DB
+// is never discarded
+func (d *DB) migrate() error {
+
+	if d.Version == DBVER {
+		return nil
+	}
+
+	orig := d.Version
+
+	// before Params are changed in place
+	if err := d.store.Keep("v" + orig); err != nil {
+		comm.Error.Printf("Keep original DB ver %s failed", orig)
+		return err
+	}
+
+	version, err := migrateParams(d.Version, d.Params)
+	if err != nil {
+		return err
+	}
+
+	d.Version = version
+
+	all := make(map[string]Params)
+	for id, p := range d.Params {
+		all[id] = p
+	}
+
+	return d.store.Save(d.Version, all, nil)
+}
+
+// migrateParams upgrades all from version to DBVER in place, and
+// returns the version reached
+func migrateParams(version string, all map[string]Params) (string, error) {
+
+	for version != DBVER {
+		var m *migration
+		for i := range migrations {
+			if migrations[i].From == version {
+				m = &migrations[i]
+				break
+			}
+		}
+
+		if m == nil {
+			comm.Error.Printf("DB ver %s can't be upgraded to %s",
+				version, DBVER)
+			return version, errDBVersion
+		}
+
+		if err := m.Up(all); err != nil {
+			comm.Error.Printf("DB upgrading %s to %s failed", m.From, m.To)
+			return version, err
+		}
+
+		comm.Info.Printf("DB upgraded from %s to %s", m.From, m.To)
+
+		version = m.To
+	}
+
+	return version, nil
+}
+
+// migrateCard moves top-level "RTSPIn" and "BitRate" into
+// Params["Card"] as "rtsp_url" and "BitRate"
+func migrateCard(all map[string]Params) error {
+
+	moved := map[string]string{"RTSPIn": "rtsp_url", "BitRate": "BitRate"}
+
+	for _, params := range all {
+		card, ok := params["Card"].(map[string]interface{})
+		if params["Card"] != nil && !ok {
+			return errBadParams
+		}
+
+		for from, to := range moved {
+			v, ok := params[from]
+			if !ok {
+				continue
+			}
+
+			if card == nil {
+				card = make(map[string]interface{})
+			}
+
+			if _, exists := card[to]; !exists {
+				card[to] = v
+			}
+
+			delete(params, from)
+		}
+
+		if card != nil {
+			params["Card"] = card
+		}
+	}
+
+	return nil
+}
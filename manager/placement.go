@@ -0,0 +1,297 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/zhanglongx/Aqua/comm"
+	"github.com/zhanglongx/Aqua/driver"
+)
+
+// placement policies
+const (
+	// PlaceLeastLoaded picks a worker on the card with the lowest
+	// ratio of workers in use
+	PlaceLeastLoaded = "least-loaded"
+
+	// PlaceSpread picks a worker on the card with the fewest
+	// workers in use, rotating across slots on ties
+	PlaceSpread = "spread"
+)
+
+// WorkerTypeAny matches all workers in WorkerType
+const WorkerTypeAny = "any"
+
+var (
+	errNoFreeWorker = errors.New("No free healthy worker")
+)
+
+// candidate is a worker can be placed on
+type candidate struct {
+	name string
+
+	// card is "type_slot"
+	card string
+	slot int
+
+	// used and total are workers of the card
+	used  int
+	total int
+
+	w driver.Worker
+}
+
+// workerType returns the card type of a worker name, like
+// "C9830" of "C9830_3_0"
+func workerType(name string) string {
+	if m := reWorkerName.FindStringSubmatch(name); m != nil {
+		return m[1]
+	}
+
+	return ""
+}
+
+// matchType tells if worker name is of typ
+func matchType(name string, typ string) bool {
+	return typ == WorkerTypeAny || workerType(name) == typ
+}
+
+// place picks a free and healthy worker of typ for path ID by
+// policy, excluding those in exclude. ep.lock must not be held:
+// candidates are probed without it, as a failed card may not
+// answer soon, and checked again with it
+func (ep *Path) place(ID int, typ string, policy string,
+	exclude map[string]bool) (string, error) {
+
+	if policy == "" {
+		policy = comm.AppCfg.Placement
+	}
+
+	ep.lock.RLock()
+	cands := ep.ranked(ID, typ, policy, exclude)
+	ep.lock.RUnlock()
+
+	healthy := probe(cands)
+
+	ep.lock.Lock()
+
+	defer ep.lock.Unlock()
+
+	free := make(map[string]bool)
+	for _, c := range ep.candidates(ID, typ) {
+		free[c.name] = true
+	}
+
+	for i, c := range cands {
+		if !healthy[i] {
+			comm.Warning.Printf("Skip unhealthy worker %s", c.name)
+			continue
+		}
+
+		// used meanwhile
+		if !free[c.name] {
+			continue
+		}
+
+		ep.lastSlot = c.slot
+
+		comm.Info.Printf("Path %s %d placed on %s by %s", ep.kind.Name, ID, c.name, policy)
+
+		return c.name, nil
+	}
+
+	return "", errNoFreeWorker
+}
+
+// ranked returns candidates not in exclude, sorted by policy.
+// ep.lock must be held
+func (ep *Path) ranked(ID int, typ string, policy string,
+	exclude map[string]bool) []candidate {
+
+	var cands []candidate
+	for _, c := range ep.candidates(ID, typ) {
+		if !exclude[c.name] {
+			cands = append(cands, c)
+		}
+	}
+
+	switch policy {
+	case PlaceSpread:
+		last := ep.lastSlot
+		sort.SliceStable(cands, func(i, j int) bool {
+			a, b := cands[i], cands[j]
+			if a.used != b.used {
+				return a.used < b.used
+			}
+			// slots after the last placed one first
+			if (a.slot > last) != (b.slot > last) {
+				return a.slot > last
+			}
+			return a.slot < b.slot
+		})
+
+	default:
+		sort.SliceStable(cands, func(i, j int) bool {
+			a, b := cands[i], cands[j]
+			if ra, rb := a.used*b.total, b.used*a.total; ra != rb {
+				return ra < rb
+			}
+			return a.name < b.name
+		})
+	}
+
+	return cands
+}
+
+// probe calls Monitor of all cands at once, RPC of each is
+// limited by AppCfg.RPCTimeout
+func probe(cands []candidate) []bool {
+
+	healthy := make([]bool, len(cands))
+
+	var wg sync.WaitGroup
+	for i := range cands {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			healthy[i] = cands[i].w.Monitor()
+		}(i)
+	}
+	wg.Wait()
+
+	return healthy
+}
+
+// candidates returns free workers of typ, sorted by name
+func (ep *Path) candidates(ID int, typ string) []candidate {
+
+	used := make(map[driver.Worker]bool)
+	for id, w := range ep.inUse {
+		if w != nil && id != ID {
+			used[w] = true
+		}
+	}
+
+	// standby workers are reserved too
+	reserved := make(map[string]bool)
+	for IDStr, params := range ep.db.Params {
+		if id, _ := strconv.Atoi(IDStr); id == ID {
+			continue
+		}
+		if s, ok := params["Standby"].(string); ok && s != "" {
+			reserved[s] = true
+		}
+	}
+
+	usedOf := make(map[string]int)
+	totalOf := make(map[string]int)
+
+	var all []candidate
+	for _, w := range ep.workers {
+		name := driver.GetWorkerName(w)
+
+		m := reWorkerName.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+
+		card := m[1] + "_" + m[2]
+		totalOf[card]++
+		if used[w] || reserved[name] {
+			usedOf[card]++
+			continue
+		}
+
+		if matchType(name, typ) {
+			slot, _ := strconv.Atoi(m[2])
+			all = append(all, candidate{name: name, card: card, slot: slot, w: w})
+		}
+	}
+
+	for i := range all {
+		all[i].used = usedOf[all[i].card]
+		all[i].total = totalOf[all[i].card]
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+
+	return all
+}
+
+// placeParams places path ID if WorkerType is set, and
+// WorkerName is not a free worker of the type. ep.lock must not
+// be held. params is returned as is if it's not placed, then
+// checkPlacement tells why
+func (ep *Path) placeParams(ID int, params Params) Params {
+
+	typ, _ := params["WorkerType"].(string)
+	if typ == "" {
+		return params
+	}
+
+	wn, _ := params["WorkerName"].(string)
+
+	ep.lock.RLock()
+	free := ep.isFree(ID, typ, wn)
+	ep.lock.RUnlock()
+
+	if free {
+		return params
+	}
+
+	policy, _ := params["Placement"].(string)
+	standby, _ := params["Standby"].(string)
+
+	name, err := ep.place(ID, typ, policy, map[string]bool{standby: true})
+	if err != nil {
+		return params
+	}
+
+	out := copyParams(params)
+	out["WorkerName"] = name
+
+	return out
+}
+
+// checkPlacement checks WorkerName of out if WorkerType is set,
+// it must be a free worker of the type, which is placed by
+// placeParams. ep.lock must be held
+func (ep *Path) checkPlacement(ID int, out Params) error {
+
+	typ, _ := out["WorkerType"].(string)
+	wn, _ := out["WorkerName"].(string)
+
+	if typ == "" {
+		if wn == "" {
+			return ParamsError{{"WorkerName", "is required"}}
+		}
+		return nil
+	}
+
+	if !ep.isFree(ID, typ, wn) {
+		return ParamsError{{"WorkerType", errNoFreeWorker.Error()}}
+	}
+
+	return nil
+}
+
+// isFree tells if wn is a worker of typ, not used by paths other
+// than ID. ep.lock must be held
+func (ep *Path) isFree(ID int, typ string, wn string) bool {
+
+	if wn == "" || !matchType(wn, typ) {
+		return false
+	}
+
+	w := ep.workers.findWorker(wn)
+	k := ep.isWorkerAlloc(w)
+
+	return w != nil && (k == -1 || k == ID)
+}
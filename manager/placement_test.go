@@ -0,0 +1,75 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"testing"
+
+	"github.com/zhanglongx/Aqua/driver"
+)
+
+func TestPath_place(t *testing.T) {
+	// slot 3 has 2 workers, slot 5 has 4
+	ep := Path{kind: EncodeKind, inUse: make(map[int]driver.Worker)}
+	ep.db.create()
+	for _, s := range []struct{ slot, num int }{{3, 2}, {5, 4}} {
+		for i := 0; i < s.num; i++ {
+			ep.workers = append(ep.workers, &driver.DummyWorker{Slot: s.slot, WorkerID: i})
+		}
+	}
+
+	use := func(id int, name string) {
+		ep.inUse[id] = ep.workers.findWorker(name)
+	}
+
+	// slot 3 is 1/2 used, slot 5 is 1/4
+	use(1, "local_encoder_3_0")
+	use(2, "local_encoder_5_0")
+
+	got, err := ep.place(9, "local_encoder", PlaceLeastLoaded, nil)
+	if err != nil || got != "local_encoder_5_1" {
+		t.Errorf("place() least-loaded = %v, %v", got, err)
+	}
+
+	// slot 5 is after slot 3 placed last
+	ep.lastSlot = 3
+	use(3, "local_encoder_5_1")
+	use(4, "local_encoder_5_2")
+	got, err = ep.place(9, "any", PlaceSpread, nil)
+	if err != nil || got != "local_encoder_3_1" {
+		t.Errorf("place() spread = %v, %v", got, err)
+	}
+
+	got, err = ep.place(9, "any", PlaceSpread, map[string]bool{"local_encoder_3_1": true})
+	if err != nil || got != "local_encoder_5_3" {
+		t.Errorf("place() exclude = %v, %v", got, err)
+	}
+
+	if _, err := ep.place(9, "C9830", PlaceSpread, nil); err != errNoFreeWorker {
+		t.Errorf("place() error = %v", err)
+	}
+
+	// a free worker of the type is kept
+	params := Params{"WorkerType": "local_encoder", "WorkerName": "local_encoder_5_3"}
+	if err := ep.checkPlacement(9, params); err != nil || params["WorkerName"] != "local_encoder_5_3" {
+		t.Errorf("checkPlacement() = %v, %v", params, err)
+	}
+
+	// used by path 1, placed again
+	params = Params{"WorkerType": "local_encoder", "WorkerName": "local_encoder_3_0"}
+	if err := ep.checkPlacement(9, params); err == nil {
+		t.Errorf("checkPlacement() of a used worker")
+	}
+	placed := ep.placeParams(9, params)
+	if err := ep.checkPlacement(9, placed); err != nil || placed["WorkerName"] == "local_encoder_3_0" ||
+		params["WorkerName"] != "local_encoder_3_0" {
+		t.Errorf("placeParams() = %v, %v", placed, err)
+	}
+
+	if err := ep.checkPlacement(9, Params{}); err == nil {
+		t.Errorf("checkPlacement() no WorkerName")
+	}
+}
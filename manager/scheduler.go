@@ -0,0 +1,673 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+// job actions
+const (
+	JobStart = ApplyStart
+	JobStop  = ApplyStop
+
+	// JobSet merges Job.Params into the path's Params, e.g.
+	// {"Card": {"rtsp_url": "rtsp://..."}} or {"Card": {"BitRate": 4000}}
+	JobSet = ApplySet
+)
+
+// missed-run policies
+const (
+	// MissedSkip skips runs missed while Aqua is down
+	MissedSkip = "skip"
+
+	// MissedRun runs once at startup, if the latest missed run is
+	// within AppCfg.ScheduleGrace
+	MissedRun = "run"
+)
+
+// Job is one scheduled action on a path
+type Job struct {
+	ID string
+
+	Kind string
+	Path int
+
+	Action string
+	Params Params `json:",omitempty"`
+
+	// At is for one-off jobs, Cron for recurring ones in standard
+	// cron format or descriptors like "@daily". Only one is set
+	At   time.Time `json:",omitempty"`
+	Cron string    `json:",omitempty"`
+
+	Missed string
+
+	Created time.Time
+
+	// LastRun is the time of the last run, LastResult is "ok" or
+	// the error
+	LastRun    time.Time `json:",omitempty"`
+	LastResult string    `json:",omitempty"`
+
+	// Done is set after a one-off job runs
+	Done bool `json:",omitempty"`
+
+	sched cron.Schedule
+	next  time.Time
+}
+
+// Occurrence is one run of a Job in Calendar
+type Occurrence struct {
+	Time time.Time
+
+	Job    string
+	Kind   string
+	Path   int
+	Action string
+}
+
+// ConflictError is returned when a Job runs on the same path at
+// the same minute as another one, with a different action
+type ConflictError struct {
+	Job  string
+	Time time.Time
+}
+
+// Error implements error
+func (ce *ConflictError) Error() string {
+	return fmt.Sprintf("Conflicts with job %s at %s", ce.Job,
+		ce.Time.Format("2006-01-02 15:04"))
+}
+
+// Scheduler runs Jobs on paths, Jobs are kept in
+// AppCfg.ScheduleFile
+type Scheduler struct {
+	lock sync.Mutex
+
+	file string
+
+	paths []*Path
+
+	// NextID is the ID of the next added Job
+	NextID int
+
+	Jobs []*Job
+
+	// now is time.Now, replaced in tests
+	now func() time.Time
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+var (
+	errJobNotExists = errors.New("Job not exists")
+	errJobBadAction = errors.New("Bad job action")
+	errJobBadTime   = errors.New("Job needs one of At or Cron")
+	errJobPast      = errors.New("Job time is past")
+	errJobBadMissed = errors.New("Bad missed-run policy")
+	errJobNoParams  = errors.New("Job set needs Params")
+	errJobBadKind   = errors.New("Job kind not exists")
+)
+
+// Start loads jobs from file, handles missed runs, and starts
+// running jobs on paths
+func (s *Scheduler) Start(file string, paths []*Path) error {
+
+	s.file = file
+	s.paths = paths
+	if s.now == nil {
+		s.now = time.Now
+	}
+
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	s.catchUp()
+
+	s.wake = make(chan struct{}, 1)
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go s.loop()
+
+	return nil
+}
+
+// Stop stops running jobs
+func (s *Scheduler) Stop() {
+	if s.stop == nil {
+		return
+	}
+
+	close(s.stop)
+	<-s.done
+}
+
+// Add checks and adds a Job, its ID and Created are assigned. It's
+// audited
+func (s *Scheduler) Add(j Job, by Actor) (*Job, error) {
+
+	added, err := s.add(j)
+	if added != nil {
+		j = *added
+	}
+
+	recordAudit(ActionJobAdd, j.Kind, j.Path, by, nil, jobParams(j), err)
+
+	return added, err
+}
+
+func (s *Scheduler) add(j Job) (*Job, error) {
+
+	s.lock.Lock()
+
+	defer s.lock.Unlock()
+
+	if err := s.check(&j); err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+
+	j.Created = now
+	j.LastRun = time.Time{}
+	j.LastResult = ""
+	j.Done = false
+	j.next = j.nextAfter(now)
+
+	if j.next.IsZero() {
+		return nil, errJobPast
+	}
+
+	if err := s.conflicts(&j, now); err != nil {
+		return nil, err
+	}
+
+	s.NextID++
+	j.ID = strconv.Itoa(s.NextID)
+
+	s.Jobs = append(s.Jobs, &j)
+
+	if err := s.save(); err != nil {
+		s.Jobs = s.Jobs[:len(s.Jobs)-1]
+		return nil, err
+	}
+
+	s.poke()
+
+	added := j
+	return &added, nil
+}
+
+// Delete removes a Job, it's audited
+func (s *Scheduler) Delete(ID string, by Actor) error {
+
+	deleted, err := s.delete(ID)
+	if deleted == nil {
+		return err
+	}
+
+	recordAudit(ActionJobDelete, deleted.Kind, deleted.Path, by,
+		jobParams(*deleted), nil, err)
+
+	return err
+}
+
+// delete returns the Job removed, nil if not exists
+func (s *Scheduler) delete(ID string) (*Job, error) {
+
+	s.lock.Lock()
+
+	defer s.lock.Unlock()
+
+	for i, j := range s.Jobs {
+		if j.ID != ID {
+			continue
+		}
+
+		s.Jobs = append(s.Jobs[:i], s.Jobs[i+1:]...)
+		if err := s.save(); err != nil {
+			s.Jobs = append(s.Jobs[:i], append([]*Job{j}, s.Jobs[i:]...)...)
+			return j, err
+		}
+
+		s.poke()
+
+		return j, nil
+	}
+
+	return nil, errJobNotExists
+}
+
+// jobParams are what audited of j
+func jobParams(j Job) Params {
+	p := Params{"Job": j.ID, "Action": j.Action, "Missed": j.Missed}
+	if j.Params != nil {
+		p["Params"] = j.Params
+	}
+	if j.Cron != "" {
+		p["Cron"] = j.Cron
+	} else {
+		p["At"] = j.At.Format(time.RFC3339)
+	}
+
+	return p
+}
+
+// List returns copies of all Jobs
+func (s *Scheduler) List() []Job {
+
+	s.lock.Lock()
+
+	defer s.lock.Unlock()
+
+	var all []Job
+	for _, j := range s.Jobs {
+		all = append(all, *j)
+	}
+
+	return all
+}
+
+// Calendar returns all runs in [from, to), sorted by time
+func (s *Scheduler) Calendar(from time.Time, to time.Time) []Occurrence {
+
+	s.lock.Lock()
+
+	defer s.lock.Unlock()
+
+	var all []Occurrence
+	for _, j := range s.Jobs {
+		for _, t := range j.between(from, to) {
+			all = append(all, Occurrence{Time: t, Job: j.ID,
+				Kind: j.Kind, Path: j.Path, Action: j.Action})
+		}
+	}
+
+	sort.SliceStable(all, func(i, k int) bool {
+		return all[i].Time.Before(all[k].Time)
+	})
+
+	return all
+}
+
+// check validates j, and parses Cron
+func (s *Scheduler) check(j *Job) error {
+
+	if findPath(s.paths, j.Kind) == nil {
+		return errJobBadKind
+	}
+
+	if !isPathValid(j.Path) {
+		return errPathNotExists
+	}
+
+	switch j.Action {
+	case JobStart, JobStop:
+	case JobSet:
+		if len(j.Params) == 0 {
+			return errJobNoParams
+		}
+	default:
+		return errJobBadAction
+	}
+
+	switch j.Missed {
+	case "":
+		j.Missed = MissedSkip
+	case MissedSkip, MissedRun:
+	default:
+		return errJobBadMissed
+	}
+
+	if j.At.IsZero() == (j.Cron == "") {
+		return errJobBadTime
+	}
+
+	if j.Cron != "" {
+		sched, err := cron.ParseStandard(j.Cron)
+		if err != nil {
+			return err
+		}
+
+		j.sched = sched
+	}
+
+	return nil
+}
+
+// conflicts checks j against all jobs on the same path, within
+// AppCfg.ScheduleHorizon
+func (s *Scheduler) conflicts(j *Job, now time.Time) error {
+
+	to := now.Add(comm.AppCfg.ScheduleHorizon)
+
+	mine := make(map[time.Time]bool)
+	for _, t := range j.between(now, to) {
+		mine[t.Truncate(time.Minute)] = true
+	}
+
+	for _, other := range s.Jobs {
+		if other.Kind != j.Kind || other.Path != j.Path {
+			continue
+		}
+
+		if other.Action == j.Action && reflect.DeepEqual(other.Params, j.Params) {
+			continue
+		}
+
+		for _, t := range other.between(now, to) {
+			if mine[t.Truncate(time.Minute)] {
+				return &ConflictError{Job: other.ID, Time: t}
+			}
+		}
+	}
+
+	return nil
+}
+
+// nextAfter returns the next run after t, zero if no more
+func (j *Job) nextAfter(t time.Time) time.Time {
+	if j.Done {
+		return time.Time{}
+	}
+
+	if j.sched != nil {
+		return j.sched.Next(t)
+	}
+
+	if j.At.After(t) {
+		return j.At
+	}
+
+	return time.Time{}
+}
+
+// maxOccurrences limits runs of one Job returned by between
+const maxOccurrences = 10000
+
+// between returns all runs in [from, to), at most maxOccurrences
+func (j *Job) between(from time.Time, to time.Time) []time.Time {
+	var all []time.Time
+	for t := j.nextAfter(from.Add(-time.Nanosecond)); !t.IsZero() && t.Before(to); t = j.nextAfter(t) {
+		all = append(all, t)
+
+		if j.sched == nil || len(all) >= maxOccurrences {
+			break
+		}
+	}
+
+	return all
+}
+
+// lastBefore returns the last run in (from, to), zero if none. It's
+// searched back from to in growing windows, and past capped ones,
+// so it's not limited by maxOccurrences
+func (j *Job) lastBefore(from time.Time, to time.Time) time.Time {
+	for span := time.Minute; ; span *= 2 {
+		start := to.Add(-span)
+		reached := !start.After(from)
+		if reached {
+			start = from.Add(time.Nanosecond)
+		}
+
+		var last time.Time
+		for t := start; ; {
+			all := j.between(t, to)
+			if len(all) > 0 {
+				last = all[len(all)-1]
+				t = last.Add(time.Nanosecond)
+			}
+
+			if len(all) < maxOccurrences {
+				break
+			}
+		}
+
+		if !last.IsZero() || reached {
+			return last
+		}
+	}
+}
+
+// catchUp handles runs missed since the last run
+func (s *Scheduler) catchUp() {
+
+	s.lock.Lock()
+
+	now := s.now()
+
+	var due []Job
+
+	for _, j := range s.Jobs {
+		since := j.LastRun
+		if since.IsZero() {
+			since = j.Created
+		}
+
+		last := j.lastBefore(since, now)
+
+		j.next = j.nextAfter(now)
+
+		if last.IsZero() {
+			continue
+		}
+
+		if j.Missed == MissedRun && now.Sub(last) <= comm.AppCfg.ScheduleGrace {
+			comm.Info.Printf("Running missed job %s of %s", j.ID, last)
+			due = append(due, *j)
+			continue
+		}
+
+		comm.Warning.Printf("Job %s skipped missed runs, the last of %s", j.ID, last)
+
+		if j.sched == nil {
+			j.Done = true
+		}
+	}
+
+	if err := s.save(); err != nil {
+		comm.Error.Printf("Save schedule failed: %v", err)
+	}
+
+	s.lock.Unlock()
+
+	s.runAll(due, now)
+}
+
+func (s *Scheduler) loop() {
+
+	defer close(s.done)
+
+	for {
+		s.lock.Lock()
+		now := s.now()
+		var due []Job
+		for _, j := range s.Jobs {
+			if !j.next.IsZero() && !j.next.After(now) {
+				due = append(due, *j)
+			}
+		}
+		s.lock.Unlock()
+
+		s.runAll(due, now)
+
+		s.lock.Lock()
+		var next time.Time
+		for _, j := range s.Jobs {
+			if !j.next.IsZero() && (next.IsZero() || j.next.Before(next)) {
+				next = j.next
+			}
+		}
+		now = s.now()
+		s.lock.Unlock()
+
+		// wake up at least every minute, in case the clock jumps
+		wait := time.Minute
+		if !next.IsZero() && next.Sub(now) < wait {
+			wait = next.Sub(now)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		case <-s.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// poke wakes up loop to re-calculate
+func (s *Scheduler) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runAll runs copies of jobs due at now, without s.lock held as
+// Path.Apply may take long. Results are recorded to the jobs
+// which are not deleted meanwhile
+func (s *Scheduler) runAll(due []Job, now time.Time) {
+
+	for i := range due {
+		err := s.apply(&due[i])
+
+		s.lock.Lock()
+		s.record(due[i].ID, now, err)
+		if err := s.save(); err != nil {
+			comm.Error.Printf("Save schedule failed: %v", err)
+		}
+		s.lock.Unlock()
+	}
+}
+
+// record records a run of job ID, s.lock must be held
+func (s *Scheduler) record(ID string, now time.Time, err error) {
+
+	for _, j := range s.Jobs {
+		if j.ID != ID {
+			continue
+		}
+
+		j.LastRun = now
+		j.LastResult = "ok"
+		if err != nil {
+			comm.Error.Printf("Job %s on %s path %d failed: %v", j.ID, j.Kind, j.Path, err)
+			j.LastResult = err.Error()
+		}
+
+		if j.sched == nil {
+			j.Done = true
+		}
+
+		j.next = j.nextAfter(now)
+	}
+}
+
+func (s *Scheduler) apply(j *Job) error {
+
+	p := findPath(s.paths, j.Kind)
+	if p == nil {
+		return errJobBadKind
+	}
+
+	return p.Apply(j.Path, j.Action, j.Params, Actor{User: "scheduler", Addr: "job " + j.ID})
+}
+
+// mergeParams merges from into to, nested maps are merged too
+func mergeParams(to map[string]interface{}, from map[string]interface{}) {
+	for k, v := range from {
+		fm, fok := v.(map[string]interface{})
+		tm, tok := to[k].(map[string]interface{})
+		if fok && tok {
+			mergeParams(tm, fm)
+			continue
+		}
+
+		to[k] = v
+	}
+}
+
+// findPath returns the Path of kind in paths, nil if not found
+func findPath(paths []*Path, kind string) *Path {
+	for _, p := range paths {
+		if p.Kind().Name == kind {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// load reads file, and parses all Cron
+func (s *Scheduler) load() error {
+
+	buf, err := ioutil.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(buf, s); err != nil {
+		comm.Error.Printf("Decode schedule %s failed: %v", s.file, err)
+		return err
+	}
+
+	for _, j := range s.Jobs {
+		if j.Cron == "" {
+			continue
+		}
+
+		if j.sched, err = cron.ParseStandard(j.Cron); err != nil {
+			comm.Error.Printf("Job %s has bad cron %s", j.ID, j.Cron)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// save writes file atomically
+func (s *Scheduler) save() error {
+
+	buf, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(s.file), 0755); err != nil {
+		return err
+	}
+
+	tmp := s.file + ".tmp"
+	if err := writeSync(tmp, buf); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.file)
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+func TestScheduler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aqua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "schedule.json")
+	paths := []*Path{{kind: EncodeKind}}
+
+	now := time.Date(2020, 6, 1, 8, 0, 0, 0, time.Local)
+
+	s := Scheduler{now: func() time.Time { return now }}
+	if err := s.Start(file, paths); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	daily, err := s.Add(Job{Kind: "encode", Path: 1, Action: JobStart, Cron: "0 20 * * *"}, Actor{})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	at := time.Date(2020, 6, 3, 20, 0, 30, 0, time.Local)
+	if _, err := s.Add(Job{Kind: "encode", Path: 1, Action: JobStop, At: at}, Actor{}); err == nil {
+		t.Errorf("Add() conflict not found")
+	} else if ce, ok := err.(*ConflictError); !ok || ce.Job != daily.ID {
+		t.Errorf("Add() error = %v", err)
+	}
+
+	// another path, or another minute is fine
+	if _, err := s.Add(Job{Kind: "encode", Path: 2, Action: JobStop, At: at}, Actor{}); err != nil {
+		t.Errorf("Add() error = %v", err)
+	}
+
+	bitrate := Params{"Card": map[string]interface{}{"BitRate": 4000}}
+	if _, err := s.Add(Job{Kind: "encode", Path: 1, Action: JobSet, Params: bitrate,
+		At: at.Add(time.Minute), Missed: MissedRun}, Actor{}); err != nil {
+		t.Errorf("Add() error = %v", err)
+	}
+
+	for _, bad := range []Job{
+		{Kind: "encode", Path: 1, Action: JobStart},
+		{Kind: "encode", Path: 1, Action: JobSet, Cron: "@daily"},
+		{Kind: "encode", Path: 1, Action: "reboot", Cron: "@daily"},
+		{Kind: "nope", Path: 1, Action: JobStart, Cron: "@daily"},
+		{Kind: "encode", Path: 1, Action: JobStart, At: now.Add(-time.Hour)},
+		{Kind: "encode", Path: 1, Action: JobStart, Cron: "61 * * * *"},
+	} {
+		if _, err := s.Add(bad, Actor{}); err == nil {
+			t.Errorf("Add(%v) no error", bad)
+		}
+	}
+
+	cal := s.Calendar(now, now.Add(3*24*time.Hour))
+	if len(cal) != 5 || cal[0].Job != daily.ID || !cal[3].Time.Equal(at) {
+		t.Errorf("Calendar() = %v", cal)
+	}
+
+	s.Stop()
+
+	// restarted 5 minutes after the set job: only MissedRun runs
+	now = at.Add(6 * time.Minute)
+
+	s2 := Scheduler{now: func() time.Time { return now }}
+	if err := s2.Start(file, paths); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer s2.Stop()
+
+	for _, j := range s2.List() {
+		switch j.Action {
+		case JobSet:
+			// the path is never set, so Set fails
+			if !j.LastRun.Equal(now) || j.LastResult == "" || !j.Done {
+				t.Errorf("missed run job = %+v", j)
+			}
+		case JobStop:
+			if !j.LastRun.IsZero() || !j.Done {
+				t.Errorf("missed skip job = %+v", j)
+			}
+		}
+	}
+}
+
+func TestJob_lastBefore(t *testing.T) {
+	from := time.Date(2020, 6, 1, 8, 0, 0, 0, time.Local)
+	to := from.Add(8*24*time.Hour + 30*time.Second)
+
+	tests := []struct {
+		cron string
+		from time.Time
+		want time.Time
+	}{
+		// more than maxOccurrences are missed
+		{"* * * * *", from, from.Add(8 * 24 * time.Hour)},
+		{"0 20 * * *", from, time.Date(2020, 6, 8, 20, 0, 0, 0, time.Local)},
+		// dense runs long before to
+		{"* * 2 6 *", from, time.Date(2020, 6, 2, 23, 59, 0, 0, time.Local)},
+		{"* * * 1 *", from.AddDate(-1, 0, 0), time.Date(2020, 1, 31, 23, 59, 0, 0, time.Local)},
+		{"0 20 * * *", to.Add(-time.Hour), time.Time{}},
+	}
+	for _, tt := range tests {
+		sched, err := cron.ParseStandard(tt.cron)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		j := &Job{Cron: tt.cron, sched: sched}
+
+		if got := j.lastBefore(tt.from, to); !got.Equal(tt.want) {
+			t.Errorf("lastBefore() of %s = %v, want %v", tt.cron, got, tt.want)
+		}
+	}
+}
+
+func TestScheduler_catchUpMany(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aqua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "schedule.json")
+	paths := []*Path{{kind: EncodeKind}}
+
+	now := time.Date(2020, 6, 1, 8, 0, 0, 0, time.Local)
+
+	s := Scheduler{now: func() time.Time { return now }}
+	if err := s.Start(file, paths); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	if _, err := s.Add(Job{Kind: "encode", Path: 1, Action: JobStart, Cron: "* * * * *",
+		Missed: MissedRun}, Actor{}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	s.Stop()
+
+	// down for a week, the last missed run is a minute ago
+	now = now.Add(7*24*time.Hour + 90*time.Second)
+
+	s2 := Scheduler{now: func() time.Time { return now }}
+	if err := s2.Start(file, paths); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer s2.Stop()
+
+	if all := s2.List(); len(all) != 1 || !all[0].LastRun.Equal(now) {
+		t.Errorf("List() = %+v", all)
+	}
+}
+
+func Test_mergeParams(t *testing.T) {
+	to := map[string]interface{}{"IsRunning": true,
+		"Card": map[string]interface{}{"rtsp_url": "rtsp://a", "BitRate": 2000}}
+
+	mergeParams(to, Params{"Card": map[string]interface{}{"BitRate": 4000}})
+
+	card := to["Card"].(map[string]interface{})
+	if card["rtsp_url"] != "rtsp://a" || card["BitRate"] != 4000 || to["IsRunning"] != true {
+		t.Errorf("mergeParams() = %v", to)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/zhanglongx/Aqua/driver"
+)
+
+// FieldError is the error of one field in Params
+type FieldError struct {
+	// Field is the Field.Name, prefixed with "Card." for card
+	// settings
+	Field string
+
+	Msg string
+}
+
+// ParamsError contains all FieldError found in Params
+type ParamsError []FieldError
+
+// Error implements error
+func (pe ParamsError) Error() string {
+	var all []string
+	for _, fe := range pe {
+		all = append(all, fmt.Sprintf("%s: %s", fe.Field, fe.Msg))
+	}
+
+	return "Params error: " + strings.Join(all, "; ")
+}
+
+// Fields returns Field to Msg map
+func (pe ParamsError) Fields() map[string]string {
+	m := make(map[string]string)
+	for _, fe := range pe {
+		m[fe.Field] = fe.Msg
+	}
+
+	return m
+}
+
+// validate checks params against fields, and returns a copy of
+// params with defaults filled and numbers converted to int. Keys
+// not in fields are kept untouched
+func validate(fields []driver.Field, params map[string]interface{},
+	prefix string) (map[string]interface{}, ParamsError) {
+
+	out := make(map[string]interface{})
+	for k, v := range params {
+		out[k] = v
+	}
+
+	var pe ParamsError
+	for _, f := range fields {
+		v, ok := params[f.Name]
+		if !ok || v == nil {
+			if f.Required {
+				pe = append(pe, FieldError{prefix + f.Name, "is required"})
+				continue
+			}
+
+			if f.Default != nil {
+				out[f.Name] = f.Default
+			} else {
+				delete(out, f.Name)
+			}
+			continue
+		}
+
+		nv, msg := checkField(f, v)
+		if msg != "" {
+			pe = append(pe, FieldError{prefix + f.Name, msg})
+			continue
+		}
+
+		out[f.Name] = nv
+	}
+
+	return out, pe
+}
+
+// checkField checks one value, returns the converted value or
+// an error message
+func checkField(f driver.Field, v interface{}) (interface{}, string) {
+	switch f.Type {
+	case driver.FieldInt:
+		var i int
+		switch n := v.(type) {
+		case int:
+			i = n
+		case float64:
+			// JSON numbers
+			if n != math.Trunc(n) {
+				return nil, "must be an integer"
+			}
+			i = int(n)
+		default:
+			return nil, "must be an integer"
+		}
+
+		if f.Max > f.Min && (i < f.Min || i > f.Max) {
+			return nil, fmt.Sprintf("must be in [%d, %d]", f.Min, f.Max)
+		}
+
+		return i, ""
+
+	case driver.FieldBool:
+		if b, ok := v.(bool); ok {
+			return b, ""
+		}
+
+		return nil, "must be true or false"
+
+	case driver.FieldString, driver.FieldWorker:
+		s, ok := v.(string)
+		if !ok {
+			return nil, "must be a string"
+		}
+
+		if f.Type == driver.FieldWorker && s == "" && f.Required {
+			return nil, "is required"
+		}
+
+		if len(f.Enum) > 0 && (s != "" || f.Required) {
+			found := false
+			for _, e := range f.Enum {
+				if e == s {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				return nil, fmt.Sprintf("must be one of %s",
+					strings.Join(f.Enum, ", "))
+			}
+		}
+
+		if f.Pattern != "" {
+			if matched, err := regexp.MatchString(f.Pattern, s); !matched || err != nil {
+				return nil, "bad format"
+			}
+		}
+
+		return s, ""
+
+	case driver.FieldStrings:
+		var all []interface{}
+		switch l := v.(type) {
+		case []interface{}:
+			all = l
+		case []string:
+			for _, s := range l {
+				all = append(all, s)
+			}
+		default:
+			return nil, "must be a list of strings"
+		}
+
+		out := []interface{}{}
+		for _, e := range all {
+			s, ok := e.(string)
+			if !ok {
+				return nil, "must be a list of strings"
+			}
+
+			if f.Pattern != "" {
+				if matched, err := regexp.MatchString(f.Pattern, s); !matched || err != nil {
+					return nil, "bad format: " + s
+				}
+			}
+
+			out = append(out, s)
+		}
+
+		return out, ""
+	}
+
+	return v, ""
+}
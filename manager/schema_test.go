@@ -0,0 +1,99 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zhanglongx/Aqua/driver"
+)
+
+func Test_validate(t *testing.T) {
+	fields := []driver.Field{
+		{Name: "Name", Type: driver.FieldString, Default: ""},
+		{Name: "Worker", Type: driver.FieldWorker, Required: true, Pattern: `^\S+_\d+_\d+$`},
+		{Name: "Rate", Type: driver.FieldInt, Default: 2000, Min: 64, Max: 20000},
+		{Name: "Mode", Type: driver.FieldString, Enum: []string{"tcp", "udp"}},
+		{Name: "On", Type: driver.FieldBool, Default: false},
+		{Name: "URLs", Type: driver.FieldStrings, Pattern: `^rtsp://\S+$`},
+	}
+
+	tests := []struct {
+		name   string
+		params map[string]interface{}
+		want   map[string]interface{}
+		errs   map[string]string
+	}{
+		{
+			name:   "defaults",
+			params: map[string]interface{}{"Worker": "C9830_3_0"},
+			want: map[string]interface{}{"Name": "", "Worker": "C9830_3_0",
+				"Rate": 2000, "On": false},
+		},
+		{
+			name: "json number",
+			params: map[string]interface{}{"Worker": "C9830_3_0", "Rate": float64(4000),
+				"Mode": "udp", "On": true, "Extra": 1},
+			want: map[string]interface{}{"Name": "", "Worker": "C9830_3_0",
+				"Rate": 4000, "Mode": "udp", "On": true, "Extra": 1},
+		},
+		{
+			name:   "missing",
+			params: map[string]interface{}{},
+			errs:   map[string]string{"Worker": "is required"},
+		},
+		{
+			name: "bad",
+			params: map[string]interface{}{"Name": 1, "Worker": "C9830",
+				"Rate": "abc", "Mode": "rtp", "On": "yes"},
+			errs: map[string]string{"Name": "must be a string", "Worker": "bad format",
+				"Rate": "must be an integer", "Mode": "must be one of tcp, udp",
+				"On": "must be true or false"},
+		},
+		{
+			name:   "float",
+			params: map[string]interface{}{"Worker": "C9830_3_0", "Rate": 1.5},
+			errs:   map[string]string{"Rate": "must be an integer"},
+		},
+		{
+			name: "strings",
+			params: map[string]interface{}{"Worker": "C9830_3_0",
+				"URLs": []interface{}{"rtsp://a", "rtsp://b"}},
+			want: map[string]interface{}{"Name": "", "Worker": "C9830_3_0",
+				"Rate": 2000, "On": false, "URLs": []interface{}{"rtsp://a", "rtsp://b"}},
+		},
+		{
+			name: "bad strings",
+			params: map[string]interface{}{"Worker": "C9830_3_0",
+				"URLs": []interface{}{"rtsp://a", "http://b"}},
+			errs: map[string]string{"URLs": "bad format: http://b"},
+		},
+		{
+			name:   "range",
+			params: map[string]interface{}{"Worker": "C9830_3_0", "Rate": 30000},
+			errs:   map[string]string{"Rate": "must be in [64, 20000]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, pe := validate(fields, tt.params, "")
+			if tt.errs != nil {
+				if !reflect.DeepEqual(pe.Fields(), tt.errs) {
+					t.Errorf("validate() errors = %v, want %v", pe.Fields(), tt.errs)
+				}
+				return
+			}
+
+			if len(pe) > 0 {
+				t.Fatalf("validate() error = %v", pe)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+// Store is the storage backend of DB. Params are keyed by the
+// stringified path ID
+type Store interface {
+	// Load returns Version and all Params. An empty Version
+	// means the store is newly created
+	Load() (string, map[string]Params, error)
+
+	// Save writes version, changes and revs atomically. A nil
+	// Params in changes deletes the path. Revision.Seq in revs
+	// are assigned. Only the latest AppCfg.HistoryMax revisions
+	// are kept
+	Save(version string, changes map[string]Params, revs []Revision) error
+
+	// Revisions returns revisions of path ID, or of all paths if
+	// ID < 0, the oldest first
+	Revisions(ID int) ([]Revision, error)
+
+	// Keep keeps a copy of the whole store, tagged by name
+	Keep(name string) error
+
+	Close() error
+}
+
+// store backends
+const (
+	storeJSON = "json"
+	storeBolt = "bolt"
+)
+
+var (
+	errStoreUnknown = errors.New("Unknown DB backend")
+)
+
+// openStore opens the Store configured by AppCfg.DBBackend. file
+// is always the JSON one, other backends replace the extension
+func openStore(dir string, file string) (Store, error) {
+
+	switch comm.AppCfg.DBBackend {
+	case storeJSON, "":
+		return openJSONStore(path.Join(dir, file))
+
+	case storeBolt:
+		boltFile := strings.TrimSuffix(file, path.Ext(file)) + ".db"
+		return openBoltStore(path.Join(dir, boltFile), path.Join(dir, file))
+	}
+
+	return nil, errStoreUnknown
+}
@@ -0,0 +1,288 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+	bolt "go.etcd.io/bbolt"
+)
+
+// bolt buckets
+var (
+	bucketMeta    = []byte("meta")
+	bucketParams  = []byte("params")
+	bucketHistory = []byte("history")
+
+	keyVersion  = []byte("version")
+	keyImported = []byte("imported")
+)
+
+// boltOpenTimeout is how long to wait for the file lock
+const boltOpenTimeout = time.Second
+
+// boltStore keeps Params in an embedded bbolt file, one key for
+// each path. Save is one transaction, readers are never blocked
+type boltStore struct {
+	fullPathFile string
+
+	db *bolt.DB
+}
+
+// openBoltStore opens file, and imports jsonFile into it if it's
+// not imported yet
+func openBoltStore(fullPathFile string, jsonFile string) (*boltStore, error) {
+
+	db, err := bolt.Open(fullPathFile, 0644, &bolt.Options{Timeout: boltOpenTimeout})
+	if err == bolt.ErrTimeout {
+		comm.Error.Printf("Lock DB file %s failed", fullPathFile)
+		return nil, errDBLocked
+	} else if err != nil {
+		comm.Error.Printf("Open DB file %s failed", fullPathFile)
+		return nil, err
+	}
+
+	s := &boltStore{fullPathFile: fullPathFile, db: db}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketMeta, bucketParams, bucketHistory} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := s.importJSON(jsonFile); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// importJSON copies a jsonStore as it is, DB migrates it later.
+// The copy and the imported mark are in one transaction, so a
+// failed import is retried on the next open. A file saved
+// before the mark existed is taken as imported
+func (s *boltStore) importJSON(jsonFile string) error {
+
+	var imported bool
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bucketMeta)
+		imported = meta.Get(keyImported) != nil || meta.Get(keyVersion) != nil
+		return nil
+	}); err != nil || imported {
+		return err
+	}
+
+	if _, err := os.Stat(jsonFile); err != nil {
+		return s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(bucketMeta).Put(keyImported, []byte(jsonFile))
+		})
+	}
+
+	js, err := openJSONStore(jsonFile)
+	if err != nil {
+		return err
+	}
+
+	defer js.Close()
+
+	version, all, err := js.Load()
+	if err != nil {
+		return err
+	}
+
+	revs, err := js.Revisions(-1)
+	if err != nil {
+		return err
+	}
+
+	comm.Info.Printf("Importing DB %s into %s", jsonFile, s.fullPathFile)
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := saveTx(tx, version, all, nil); err != nil {
+			return err
+		}
+
+		for _, r := range revs {
+			if err := putRevision(tx.Bucket(bucketHistory), r); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(bucketMeta).Put(keyImported, []byte(jsonFile))
+	})
+}
+
+// Load implements Store
+func (s *boltStore) Load() (string, map[string]Params, error) {
+
+	var version string
+	all := make(map[string]Params)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		version = string(tx.Bucket(bucketMeta).Get(keyVersion))
+
+		return tx.Bucket(bucketParams).ForEach(func(k, v []byte) error {
+			var p Params
+			if err := json.Unmarshal(v, &p); err != nil {
+				comm.Error.Printf("Decode path %s in %s failed", k, s.fullPathFile)
+				return err
+			}
+
+			all[string(k)] = p
+			return nil
+		})
+	})
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	return version, all, nil
+}
+
+// Save implements Store
+func (s *boltStore) Save(version string, changes map[string]Params,
+	revs []Revision) error {
+
+	defer func(start time.Time) {
+		dbSaveDuration.WithLabelValues(s.fullPathFile).Observe(
+			time.Since(start).Seconds())
+	}(time.Now())
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return saveTx(tx, version, changes, revs)
+	})
+}
+
+// saveTx saves in tx, see Save
+func saveTx(tx *bolt.Tx, version string, changes map[string]Params,
+	revs []Revision) error {
+
+	if err := tx.Bucket(bucketMeta).Put(keyVersion, []byte(version)); err != nil {
+		return err
+	}
+
+	b := tx.Bucket(bucketParams)
+	for id, p := range changes {
+		if p == nil {
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		buf, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+
+		if err := b.Put([]byte(id), buf); err != nil {
+			return err
+		}
+	}
+
+	h := tx.Bucket(bucketHistory)
+	for i := range revs {
+		seq, err := h.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		revs[i].Seq = int(seq)
+		if err := putRevision(h, revs[i]); err != nil {
+			return err
+		}
+	}
+
+	// drop the oldest ones
+	if max := comm.AppCfg.HistoryMax; max > 0 {
+		var keys [][]byte
+		c := h.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+
+		for i := 0; i < len(keys)-max; i++ {
+			if err := h.Delete(keys[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Revisions implements Store
+func (s *boltStore) Revisions(ID int) ([]Revision, error) {
+
+	var revs []Revision
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketHistory).ForEach(func(k, v []byte) error {
+			var r Revision
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+
+			if ID < 0 || r.ID == ID {
+				revs = append(revs, r)
+			}
+			return nil
+		})
+	})
+
+	return revs, err
+}
+
+// putRevision puts r keyed by big-endian Seq, so keys are sorted
+func putRevision(b *bolt.Bucket, r Revision) error {
+
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(r.Seq))
+
+	if seq := b.Sequence(); uint64(r.Seq) > seq {
+		if err := b.SetSequence(uint64(r.Seq)); err != nil {
+			return err
+		}
+	}
+
+	return b.Put(key, buf)
+}
+
+// Keep implements Store
+func (s *boltStore) Keep(name string) error {
+
+	keep := fmt.Sprintf("%s.%s", s.fullPathFile, name)
+	if _, err := os.Stat(keep); err == nil {
+		return nil
+	}
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(keep, 0644)
+	})
+}
+
+// Close implements Store
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,381 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+// jsonStore keeps all Params, and revisions of them in one JSON
+// file, which is fully rewritten on each Save. So a revision is
+// never saved without its Params, or the other way
+type jsonStore struct {
+	fullPathFile string
+
+	// flock prevents two daemons from sharing the same file
+	flock *flock.Flock
+
+	// Version should be used to check DB's compatibility
+	Version string
+
+	// Store contains all path params
+	Params map[string]Params
+
+	// History holds the latest AppCfg.HistoryMax revisions
+	History []Revision `json:",omitempty"`
+
+	// oldHistory is set if History is loaded from file.history
+	oldHistory bool
+}
+
+// openJSONStore locks file
+func openJSONStore(fullPathFile string) (*jsonStore, error) {
+
+	s := &jsonStore{fullPathFile: fullPathFile,
+		Params: make(map[string]Params)}
+
+	s.flock = flock.New(fullPathFile + ".lock")
+	if locked, err := s.flock.TryLock(); err != nil || !locked {
+		comm.Error.Printf("Lock DB file %s failed", fullPathFile)
+		return nil, errDBLocked
+	}
+
+	return s, nil
+}
+
+// Load implements Store. If the file is broken, the latest good
+// backup is loaded
+func (s *jsonStore) Load() (string, map[string]Params, error) {
+
+	err := s.decodeFile(s.fullPathFile)
+	if err == nil {
+		if err := s.loadHistory(); err != nil {
+			return "", nil, err
+		}
+
+		return s.Version, s.copyParams(), nil
+	}
+
+	if !os.IsNotExist(err) {
+		comm.Error.Printf("Decode DB file %s failed: %v", s.fullPathFile, err)
+	}
+
+	for i := 1; i <= comm.AppCfg.DBBackups; i++ {
+		bak := backupFile(s.fullPathFile, i)
+		if e := s.decodeFile(bak); e != nil {
+			continue
+		}
+
+		comm.Warning.Printf("DB %s restored from backup %s", s.fullPathFile, bak)
+
+		if err := s.loadHistory(); err != nil {
+			return "", nil, err
+		}
+
+		// the broken file is put aside, not rotated into backups
+		if !os.IsNotExist(err) {
+			broken := s.fullPathFile + ".broken"
+			if e := os.Rename(s.fullPathFile, broken); e != nil {
+				return "", nil, e
+			}
+
+			comm.Warning.Printf("Broken DB file is kept as %s", broken)
+		}
+
+		if err := s.saveToFile(); err != nil {
+			return "", nil, err
+		}
+
+		return s.Version, s.copyParams(), nil
+	}
+
+	if os.IsNotExist(err) {
+		comm.Info.Printf("DB %s not exists, create", s.fullPathFile)
+		return "", make(map[string]Params), nil
+	}
+
+	return "", nil, err
+}
+
+// Save implements Store. Changes and revs are applied to a copy,
+// which replaces s only if it's written
+func (s *jsonStore) Save(version string, changes map[string]Params,
+	revs []Revision) error {
+
+	next := &jsonStore{fullPathFile: s.fullPathFile,
+		Version: version, Params: s.copyParams(), History: s.History}
+	for id, p := range changes {
+		if p == nil {
+			delete(next.Params, id)
+		} else {
+			next.Params[id] = p
+		}
+	}
+
+	next.appendHistory(revs)
+
+	if err := next.saveToFile(); err != nil {
+		return err
+	}
+
+	s.Version, s.Params, s.History = next.Version, next.Params, next.History
+
+	// revisions of an old file.history are in file now
+	if s.oldHistory {
+		if err := os.Remove(s.historyFile()); err != nil && !os.IsNotExist(err) {
+			comm.Warning.Printf("Remove %s failed: %v", s.historyFile(), err)
+		}
+
+		s.oldHistory = false
+	}
+
+	return nil
+}
+
+// Revisions implements Store
+func (s *jsonStore) Revisions(ID int) ([]Revision, error) {
+	var revs []Revision
+	for _, r := range s.History {
+		if ID < 0 || r.ID == ID {
+			revs = append(revs, r)
+		}
+	}
+
+	return revs, nil
+}
+
+// historyFile is where revisions were appended by old versions
+func (s *jsonStore) historyFile() string {
+	return s.fullPathFile + ".history"
+}
+
+// loadHistory reads an old file.history if file has no History, a
+// broken line (usually the last one) is skipped. It's removed on
+// the next Save
+func (s *jsonStore) loadHistory() error {
+
+	if len(s.History) > 0 {
+		return nil
+	}
+
+	buf, err := ioutil.ReadFile(s.historyFile())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, line := range bytes.Split(buf, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var r Revision
+		if err := json.Unmarshal(line, &r); err != nil {
+			comm.Warning.Printf("Skip broken revision in %s", s.historyFile())
+			continue
+		}
+
+		s.History = append(s.History, r)
+	}
+
+	s.oldHistory = true
+
+	return nil
+}
+
+// appendHistory assigns Seq of revs, and appends them to History,
+// which is cut to AppCfg.HistoryMax. History is not changed in
+// place, s may share it with the current store
+func (s *jsonStore) appendHistory(revs []Revision) {
+
+	if len(revs) == 0 {
+		return
+	}
+
+	all := append([]Revision{}, s.History...)
+	for i := range revs {
+		revs[i].Seq = 1
+		if n := len(all); n > 0 {
+			revs[i].Seq = all[n-1].Seq + 1
+		}
+
+		all = append(all, revs[i])
+	}
+
+	if max := comm.AppCfg.HistoryMax; max > 0 && len(all) > max {
+		all = all[len(all)-max:]
+	}
+
+	s.History = all
+}
+
+// Keep implements Store
+func (s *jsonStore) Keep(name string) error {
+
+	buf, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	keep := fmt.Sprintf("%s.%s", s.fullPathFile, name)
+	if _, err := os.Stat(keep); os.IsNotExist(err) {
+		return writeSync(keep, buf)
+	}
+
+	return nil
+}
+
+// Close implements Store, and releases the file lock
+func (s *jsonStore) Close() error {
+	return s.flock.Unlock()
+}
+
+func (s *jsonStore) copyParams() map[string]Params {
+	all := make(map[string]Params)
+	for id, p := range s.Params {
+		all[id] = p
+	}
+
+	return all
+}
+
+// decodeFile decodes file into s
+func (s *jsonStore) decodeFile(file string) error {
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	db := jsonStore{}
+	if err := json.Unmarshal(buf, &db); err != nil {
+		return err
+	}
+
+	s.Version = db.Version
+	s.Params = db.Params
+	s.History = db.History
+	if s.Params == nil {
+		s.Params = make(map[string]Params)
+	}
+
+	return nil
+}
+
+// saveToFile save JSON file to Cfg. The file is written to a
+// temp file and renamed, so it's never half written. The old
+// one is kept as the first backup
+func (s *jsonStore) saveToFile() error {
+
+	defer func(start time.Time) {
+		dbSaveDuration.WithLabelValues(s.fullPathFile).Observe(
+			time.Since(start).Seconds())
+	}(time.Now())
+
+	buf, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		comm.Error.Printf("Encode DB %s failed", s.fullPathFile)
+		return err
+	}
+
+	tmp := s.fullPathFile + ".tmp"
+	if err := writeSync(tmp, buf); err != nil {
+		comm.Error.Printf("Write DB file %s failed", tmp)
+		return err
+	}
+
+	if err := s.rotateBackups(); err != nil {
+		comm.Warning.Printf("Backup DB file %s failed: %v", s.fullPathFile, err)
+	}
+
+	if err := os.Rename(tmp, s.fullPathFile); err != nil {
+		comm.Error.Printf("Write DB file %s failed", s.fullPathFile)
+		return err
+	}
+
+	syncDir(path.Dir(s.fullPathFile))
+
+	return nil
+}
+
+// rotateBackups shifts file.bak.N, and keeps the current file
+// as file.bak.1
+func (s *jsonStore) rotateBackups() error {
+
+	n := comm.AppCfg.DBBackups
+	if n <= 0 {
+		return nil
+	}
+
+	if _, err := os.Stat(s.fullPathFile); err != nil {
+		return nil
+	}
+
+	os.Remove(backupFile(s.fullPathFile, n))
+	for i := n - 1; i >= 1; i-- {
+		if _, err := os.Stat(backupFile(s.fullPathFile, i)); err == nil {
+			if err := os.Rename(backupFile(s.fullPathFile, i),
+				backupFile(s.fullPathFile, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// hard link keeps the current file in place until renamed
+	bak := backupFile(s.fullPathFile, 1)
+	if err := os.Link(s.fullPathFile, bak); err != nil {
+		buf, err := ioutil.ReadFile(s.fullPathFile)
+		if err != nil {
+			return err
+		}
+
+		return writeSync(bak, buf)
+	}
+
+	return nil
+}
+
+func backupFile(file string, i int) string {
+	return fmt.Sprintf("%s.bak.%d", file, i)
+}
+
+// writeSync writes file and flushes it to disk
+func writeSync(file string, buf []byte) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// syncDir flushes a rename in dir to disk, not all OS support it
+func syncDir(dir string) {
+	if f, err := os.Open(dir); err == nil {
+		f.Sync()
+		f.Close()
+	}
+}
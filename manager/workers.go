@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 
 	"github.com/zhanglongx/Aqua/comm"
 	"github.com/zhanglongx/Aqua/driver"
@@ -31,8 +32,9 @@ var (
 	errNoCardFound = errors.New("no cards found")
 )
 
-// register accept sub-card's register
-func (ws *Workers) register(need []string) error {
+// register accept sub-card's register, cards found are counted
+// by kind once the registering is done
+func (ws *Workers) register(kind string, need []string) error {
 
 	var cards []regInfo
 	var err error
@@ -43,10 +45,18 @@ func (ws *Workers) register(need []string) error {
 	// tempz
 	cards = append(cards, regInfo{32, "local_encoder", net.IPv4(192, 165, 53, 35), ""})
 	cards = append(cards, regInfo{33, "local_decoder", net.IPv4(192, 165, 53, 35), ""})
+	cards = append(cards, softCards()...)
 
 	// FIXME: should be shared between path
 	alloced := make(map[int]bool)
 
+	results := make(map[[2]string]int)
+	defer func() {
+		for k, n := range results {
+			cardsFound.WithLabelValues(kind, k[0], k[1]).Set(float64(n))
+		}
+	}()
+
 	for _, found := range cards {
 		inNeed := false
 		for _, n := range need {
@@ -57,6 +67,7 @@ func (ws *Workers) register(need []string) error {
 		}
 
 		if inNeed == false {
+			results[[2]string{found.name, "skipped"}]++
 			continue
 		}
 
@@ -70,6 +81,30 @@ func (ws *Workers) register(need []string) error {
 			card = &driver.LocalD{Slot: found.slot,
 				IP: found.ip,
 			}
+		case driver.PatternName:
+			card = &driver.Pattern{Slot: found.slot,
+				IP: found.ip,
+			}
+		case driver.PlayoutName:
+			card = &driver.Playout{Slot: found.slot,
+				IP: found.ip,
+			}
+		case driver.SRTInName:
+			card = &driver.SRTIn{Slot: found.slot,
+				IP: found.ip,
+			}
+		case driver.SRTOutName:
+			card = &driver.SRTOut{Slot: found.slot,
+				IP: found.ip,
+			}
+		case driver.HLSName:
+			card = &driver.HLS{Slot: found.slot,
+				IP: found.ip,
+			}
+		case driver.RecorderName:
+			card = &driver.Recorder{Slot: found.slot,
+				IP: found.ip,
+			}
 		case "C9830":
 			card9830 := &driver.C9830{Slot: found.slot,
 				IP:  found.ip,
@@ -86,6 +121,7 @@ func (ws *Workers) register(need []string) error {
 			}
 		default:
 			comm.Error.Printf("Unknown card: %s", found.name)
+			results[[2]string{found.name, "unknown"}]++
 			continue
 		}
 
@@ -94,14 +130,17 @@ func (ws *Workers) register(need []string) error {
 
 		if alloced[found.slot] == true {
 			comm.Error.Printf("Slot %d already registered", found.slot)
+			results[[2]string{found.name, "duplicated"}]++
 			continue
 		}
 
 		if w, err := card.Open(); err == nil {
 			*ws = append(*ws, w...)
 			alloced[found.slot] = true
+			results[[2]string{found.name, "opened"}]++
 		} else {
 			comm.Error.Printf("Open card %s failed", found.name)
+			results[[2]string{found.name, "failed"}]++
 		}
 	}
 
@@ -124,6 +163,20 @@ func (ws *Workers) findWorker(name string) driver.Worker {
 	return nil
 }
 
+// softCards returns software-only cards of AppCfg.SoftSlots on
+// this host, by slot
+func softCards() []regInfo {
+
+	var cards []regInfo
+	for name, slot := range comm.AppCfg.SoftSlots {
+		cards = append(cards, regInfo{slot, name, comm.NetCfgInst.GetIPv4(), ""})
+	}
+
+	sort.Slice(cards, func(i, j int) bool { return cards[i].slot < cards[j].slot })
+
+	return cards
+}
+
 func onlineCards() ([]regInfo, error) {
 
 	args := map[string]interface{}{"cards": [0]int{}}
@@ -0,0 +1,375 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zhanglongx/Aqua/comm"
+	"github.com/zhanglongx/Aqua/driver"
+	"github.com/zhanglongx/Aqua/manager"
+)
+
+// API prefixes
+const (
+	apiPaths = "/api/paths/"
+	apiRevs  = "/api/revisions"
+)
+
+var (
+	errAPINotFound   = errors.New("API not found")
+	errAPIBadMethod  = errors.New("Method not allowed")
+	errAPIBadID      = errors.New("Bad path ID")
+	errAPIBadBody    = errors.New("Bad request body")
+	errAPIPathNotSet = errors.New("Path not set yet")
+)
+
+// pathInfo is one path in API
+type pathInfo struct {
+	ID int
+
+	// Params is nil if path is not set yet
+	Params manager.Params
+
+	// Status is from StatusMonitor, false if not monitored
+	Status bool
+
+	// Report is from StatusMonitor, like exit codes of processes
+	Report []string `json:",omitempty"`
+
+	// Failover is nil if the path is not running with redundancy
+	Failover *manager.FailoverState `json:",omitempty"`
+}
+
+// kindInfo is one PathKind in API, with all card settings
+type kindInfo struct {
+	manager.PathKind
+
+	Card []driver.Field
+}
+
+// pathList is the reply of GET /api/paths/{kind}
+type pathList struct {
+	Kind manager.PathKind
+
+	Workers []string
+
+	// Schemas are card settings of each worker
+	Schemas map[string]driver.Schema
+
+	Paths []pathInfo
+}
+
+// apiPath serves:
+//
+//	GET  /api/paths                   all PathKind
+//	GET  /api/paths/{kind}            all paths
+//	GET  /api/paths/{kind}/{id}       one path
+//	PUT  /api/paths/{kind}/{id}       set path with JSON Params
+//	POST /api/paths/{kind}/{id}/start start path
+//	POST /api/paths/{kind}/{id}/stop  stop path
+//	GET  /api/paths/{kind}/{id}/revisions  revisions of path
+//	POST /api/paths/{kind}/{id}/rollback   re-apply {"Seq": n}
+//	GET  /api/paths/{kind}/{id}/logs       logs of the worker
+//	GET  /api/paths/{kind}/{id}/recordings         recordings of the worker
+//	GET  /api/paths/{kind}/{id}/recordings/{name}  download a recording
+//	DELETE /api/paths/{kind}/{id}/recordings/{name} delete a recording
+func apiPath(w http.ResponseWriter, r *http.Request) {
+	args := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPaths), "/"), "/")
+
+	if args[0] == "" {
+		if r.Method != http.MethodGet {
+			replyErr(w, http.StatusMethodNotAllowed, errAPIBadMethod)
+			return
+		}
+
+		var kinds []kindInfo
+		for _, p := range paths {
+			kinds = append(kinds, kindInfo{PathKind: p.Kind(), Card: p.CardFields()})
+		}
+
+		replyJSON(w, kinds)
+		return
+	}
+
+	p := findPath(args[0])
+	if p == nil {
+		replyErr(w, http.StatusNotFound, errAPINotFound)
+		return
+	}
+
+	if len(args) == 1 {
+		if r.Method != http.MethodGet {
+			replyErr(w, http.StatusMethodNotAllowed, errAPIBadMethod)
+			return
+		}
+
+		list := pathList{Kind: p.Kind(), Workers: p.GetWorkers(),
+			Schemas: p.GetSchemas()}
+
+		status := p.GetAllStatus()
+		reports := p.GetAllReports()
+		fail := p.GetFailoverStates()
+		for _, id := range p.IDs() {
+			params, _ := p.Get(id)
+			info := pathInfo{ID: id, Params: params, Status: status[id],
+				Report: reports[id]}
+			if st, ok := fail[id]; ok {
+				info.Failover = &st
+			}
+
+			list.Paths = append(list.Paths, info)
+		}
+
+		replyJSON(w, list)
+		return
+	}
+
+	id, err := strconv.Atoi(args[1])
+	if err != nil || len(args) > 4 || (len(args) == 4 && args[2] != "recordings") {
+		replyErr(w, http.StatusNotFound, errAPIBadID)
+		return
+	}
+
+	var op, name string
+	if len(args) >= 3 {
+		op = args[2]
+	}
+	if len(args) == 4 {
+		name = args[3]
+	}
+
+	switch {
+	case op == "" && r.Method == http.MethodGet:
+		if _, err := p.Get(id); err != nil {
+			replyErr(w, http.StatusNotFound, err)
+			return
+		}
+
+		replyJSON(w, newPathInfo(p, id))
+
+	case op == "" && r.Method == http.MethodPut:
+		params := make(manager.Params)
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			replyErr(w, http.StatusBadRequest, errAPIBadBody)
+			return
+		}
+
+		apiSet(w, r, p, id, params)
+
+	case (op == "start" || op == "stop") && r.Method == http.MethodPost:
+		if _, err := p.Get(id); err != nil {
+			replyErr(w, http.StatusNotFound, errAPIPathNotSet)
+			return
+		}
+
+		// the same as groups and jobs do
+		action := manager.ApplyStop
+		if op == "start" {
+			action = manager.ApplyStart
+		}
+
+		if err := p.Apply(id, action, nil, actorOf(r)); err != nil {
+			comm.Error.Printf("Apply %s to path %d failed", action, id)
+			replyErr(w, http.StatusBadRequest, err)
+			return
+		}
+
+		replyJSON(w, newPathInfo(p, id))
+
+	case op == "revisions" && r.Method == http.MethodGet:
+		revs, err := p.GetRevisions(id)
+		if err != nil {
+			replyErr(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		replyJSON(w, revs)
+
+	case op == "logs" && r.Method == http.MethodGet:
+		logs, err := p.GetLogs(id)
+		if err != nil {
+			replyErr(w, http.StatusNotFound, err)
+			return
+		}
+
+		replyJSON(w, logs)
+
+	case op == "recordings" && name == "" && r.Method == http.MethodGet:
+		recs, err := p.GetRecordings(id)
+		if err != nil {
+			replyErr(w, http.StatusNotFound, err)
+			return
+		}
+
+		replyJSON(w, recs)
+
+	case op == "recordings" && name != "" && r.Method == http.MethodGet:
+		file, err := p.GetRecordingFile(id, name)
+		if err != nil {
+			replyErr(w, http.StatusNotFound, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		http.ServeFile(w, r, file)
+
+	case op == "recordings" && name != "" && r.Method == http.MethodDelete:
+		if err := p.DeleteRecording(id, name, actorOf(r)); err != nil {
+			comm.Error.Printf("Delete recording %s of path %d failed", name, id)
+			replyErr(w, http.StatusBadRequest, err)
+			return
+		}
+
+		replyJSON(w, M{"Name": name})
+
+	case op == "rollback" && r.Method == http.MethodPost:
+		var req struct{ Seq int }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			replyErr(w, http.StatusBadRequest, errAPIBadBody)
+			return
+		}
+
+		if err := p.Rollback(id, req.Seq, actorOf(r)); err != nil {
+			comm.Error.Printf("Rollback path %d to %d failed", id, req.Seq)
+			replyErr(w, http.StatusBadRequest, err)
+			return
+		}
+
+		replyJSON(w, newPathInfo(p, id))
+
+	default:
+		replyErr(w, http.StatusMethodNotAllowed, errAPIBadMethod)
+	}
+}
+
+func apiSet(w http.ResponseWriter, r *http.Request, p *manager.Path,
+	id int, params manager.Params) {
+
+	if err := p.Set(id, params, actorOf(r)); err != nil {
+		comm.Error.Printf("Set path %d failed", id)
+		replyErr(w, http.StatusBadRequest, err)
+		return
+	}
+
+	replyJSON(w, newPathInfo(p, id))
+}
+
+// newPathInfo returns pathInfo of path id
+func newPathInfo(p *manager.Path, id int) pathInfo {
+	params, _ := p.Get(id)
+
+	info := pathInfo{ID: id, Params: params, Status: p.GetAllStatus()[id],
+		Report: p.GetAllReports()[id]}
+	if st, ok := p.GetFailoverStates()[id]; ok {
+		info.Failover = &st
+	}
+
+	return info
+}
+
+// apiRevisions serves GET /api/revisions, revisions of all paths
+// newest first. ?kind= and ?limit= are optional
+func apiRevisions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		replyErr(w, http.StatusMethodNotAllowed, errAPIBadMethod)
+		return
+	}
+
+	kind := r.URL.Query().Get("kind")
+
+	var all []manager.Revision
+	for _, p := range paths {
+		if kind != "" && p.Kind().Name != kind {
+			continue
+		}
+
+		revs, err := p.GetRevisions(-1)
+		if err != nil {
+			replyErr(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		all = append(all, revs...)
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Time.After(all[j].Time)
+	})
+
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil &&
+		limit >= 0 && limit < len(all) {
+		all = all[:limit]
+	}
+
+	replyJSON(w, all)
+}
+
+// actorOf returns who makes the request. User is from HTTP basic
+// auth checked against WebUsers, or X-Remote-User set by one of
+// WebTrustedProxies. Otherwise only the address is known
+func actorOf(r *http.Request) manager.Actor {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+
+	user := "anonymous"
+	if name, password, ok := r.BasicAuth(); ok {
+		if want, ok := comm.AppCfg.WebUsers[name]; ok &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1 {
+			user = name
+		}
+	} else if name := r.Header.Get("X-Remote-User"); name != "" && isTrustedProxy(addr) {
+		user = name
+	}
+
+	return manager.Actor{User: user, Addr: addr}
+}
+
+// isTrustedProxy tells if addr is one of WebTrustedProxies
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, p := range comm.AppCfg.WebTrustedProxies {
+		if proxy := net.ParseIP(p); proxy != nil && proxy.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func replyJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		comm.Error.Printf("Encode reply failed: %v", err)
+	}
+}
+
+// replyErr replies {"Error": ...}, and "Fields" for a
+// manager.ParamsError
+func replyErr(w http.ResponseWriter, code int, err error) {
+	reply := M{"Error": err.Error()}
+	if pe, ok := err.(manager.ParamsError); ok {
+		reply["Fields"] = pe.Fields()
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(reply)
+}
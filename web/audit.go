@@ -0,0 +1,111 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+	"github.com/zhanglongx/Aqua/manager"
+)
+
+// audit and network API
+const (
+	apiAudit   = "/api/audit"
+	apiNetwork = "/api/network"
+)
+
+var (
+	errAPIBadFilter = errors.New("Bad filter")
+	errAPIBadIP     = errors.New("Bad IPv4 address")
+)
+
+// apiAuditLog serves GET /api/audit, filtered by ?kind= &id= &user=
+// &action= &since= &until= (RFC3339) &limit=
+func apiAuditLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		replyErr(w, http.StatusMethodNotAllowed, errAPIBadMethod)
+		return
+	}
+
+	q := r.URL.Query()
+	f := manager.AuditFilter{Kind: q.Get("kind"),
+		User:   q.Get("user"),
+		Action: q.Get("action"),
+		Limit:  100,
+	}
+
+	var err error
+	if s := q.Get("id"); s != "" {
+		if f.ID, err = strconv.Atoi(s); err != nil {
+			replyErr(w, http.StatusBadRequest, errAPIBadFilter)
+			return
+		}
+	}
+
+	if s := q.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil {
+			replyErr(w, http.StatusBadRequest, errAPIBadFilter)
+			return
+		}
+	}
+
+	for _, t := range []struct {
+		name string
+		to   *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		if s := q.Get(t.name); s != "" {
+			if *t.to, err = time.Parse(time.RFC3339, s); err != nil {
+				replyErr(w, http.StatusBadRequest, errAPIBadFilter)
+				return
+			}
+		}
+	}
+
+	replyJSON(w, manager.QueryAudit(f))
+}
+
+// apiNetworkCfg serves GET /api/network, and PUT /api/network with
+// body {"IP": "x.x.x.x"}, which replies 501 if it is not supported
+func apiNetworkCfg(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		replyJSON(w, M{"HW": comm.NetCfgInst.Name,
+			"IP": comm.NetCfgInst.GetIPv4().String()})
+
+	case http.MethodPut:
+		var req struct{ IP string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			replyErr(w, http.StatusBadRequest, errAPIBadBody)
+			return
+		}
+
+		ip := net.ParseIP(req.IP)
+		if ip == nil || ip.To4() == nil {
+			replyErr(w, http.StatusBadRequest, errAPIBadIP)
+			return
+		}
+
+		if err := manager.SetNetwork(ip, actorOf(r)); err == comm.ErrNotSupported {
+			replyErr(w, http.StatusNotImplemented, err)
+			return
+		} else if err != nil {
+			comm.Error.Printf("Set network %s failed", ip)
+			replyErr(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		replyJSON(w, M{"HW": comm.NetCfgInst.Name, "IP": ip.String()})
+
+	default:
+		replyErr(w, http.StatusMethodNotAllowed, errAPIBadMethod)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+	"github.com/zhanglongx/Aqua/manager"
+)
+
+// config API
+const (
+	apiExport = "/api/config/export"
+	apiImport = "/api/config/import"
+)
+
+// importReq is the body of POST /api/config/import
+type importReq struct {
+	Bundle *manager.Bundle
+
+	manager.ImportOptions
+}
+
+// apiConfigExport serves GET /api/config/export, the bundle is
+// sent as an attachment
+func apiConfigExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		replyErr(w, http.StatusMethodNotAllowed, errAPIBadMethod)
+		return
+	}
+
+	b := manager.ExportBundle(paths)
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=aqua-%s.json",
+		b.Created.Format("20060102-150405")))
+
+	replyJSON(w, b)
+}
+
+// apiConfigImport serves POST /api/config/import, replies
+// manager.ImportReport. With DryRun, it previews the mapping only
+func apiConfigImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		replyErr(w, http.StatusMethodNotAllowed, errAPIBadMethod)
+		return
+	}
+
+	var req importReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Bundle == nil {
+		replyErr(w, http.StatusBadRequest, errAPIBadBody)
+		return
+	}
+
+	start := time.Now()
+
+	report, err := manager.ImportBundle(paths, req.Bundle, req.ImportOptions, actorOf(r))
+	if err != nil {
+		comm.Error.Printf("Import bundle failed: %v", err)
+		replyErr(w, http.StatusBadRequest, err)
+		return
+	}
+
+	comm.Info.Printf("Bundle imported in %v, %d applied, %d unmapped, %d failed",
+		time.Since(start), report.Applied, len(report.Unmapped), len(report.Failed))
+
+	replyJSON(w, report)
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/zhanglongx/Aqua/comm"
+	"github.com/zhanglongx/Aqua/manager"
+)
+
+// group API
+const apiGroups = "/api/groups"
+
+// groups are named groups of paths
+var groups manager.Groups
+
+// apiGroup handles
+//
+//	GET    /api/groups                list all groups with status
+//	POST   /api/groups                add or replace a group, manager.Group as body
+//	GET    /api/groups/{name}         status of a group
+//	DELETE /api/groups/{name}         delete a group
+//	POST   /api/groups/{name}/start   start all members
+//	POST   /api/groups/{name}/stop    stop all members
+//	POST   /api/groups/{name}/set     merge Params body into all members
+func apiGroup(w http.ResponseWriter, r *http.Request) {
+	args := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiGroups), "/"), "/")
+
+	name := args[0]
+	op := ""
+	if len(args) > 1 {
+		op = args[1]
+	}
+
+	if len(args) > 2 {
+		replyErr(w, http.StatusNotFound, errAPINotFound)
+		return
+	}
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		replyJSON(w, groups.AllStatus())
+
+	case name == "" && r.Method == http.MethodPost:
+		var g manager.Group
+		if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+			replyErr(w, http.StatusBadRequest, errAPIBadBody)
+			return
+		}
+
+		if err := groups.Put(g); err != nil {
+			replyErr(w, http.StatusBadRequest, err)
+			return
+		}
+
+		comm.Info.Printf("Group %s put by %s", g.Name, actorOf(r).User)
+
+		st, _ := groups.Status(g.Name)
+		replyJSON(w, st)
+
+	case name != "" && op == "" && r.Method == http.MethodGet:
+		st, err := groups.Status(name)
+		if err != nil {
+			replyErr(w, http.StatusNotFound, err)
+			return
+		}
+
+		replyJSON(w, st)
+
+	case name != "" && op == "" && r.Method == http.MethodDelete:
+		if err := groups.Delete(name); err != nil {
+			replyErr(w, http.StatusNotFound, err)
+			return
+		}
+
+		comm.Info.Printf("Group %s deleted by %s", name, actorOf(r).User)
+
+		replyJSON(w, M{"Name": name})
+
+	case (op == manager.ApplyStart || op == manager.ApplyStop || op == manager.ApplySet) &&
+		r.Method == http.MethodPost:
+		var merge manager.Params
+		if op == manager.ApplySet {
+			if err := json.NewDecoder(r.Body).Decode(&merge); err != nil {
+				replyErr(w, http.StatusBadRequest, errAPIBadBody)
+				return
+			}
+		}
+
+		if _, err := groups.Get(name); err != nil {
+			replyErr(w, http.StatusNotFound, err)
+			return
+		}
+
+		results, err := groups.Apply(name, op, merge, actorOf(r))
+		if err != nil {
+			replyErr(w, http.StatusBadRequest, err)
+			return
+		}
+
+		st, _ := groups.Status(name)
+		replyJSON(w, M{"Results": results, "Status": st})
+
+	default:
+		replyErr(w, http.StatusMethodNotAllowed, errAPIBadMethod)
+	}
+}
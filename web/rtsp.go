@@ -0,0 +1,65 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/zhanglongx/Aqua/comm"
+	"github.com/zhanglongx/Aqua/driver"
+	"github.com/zhanglongx/Aqua/manager"
+)
+
+// RTSP API
+const apiRTSP = "/api/rtsp/sessions"
+
+// rtspSvr re-publishes encode paths
+var rtspSvr driver.RTSPServer
+
+// startRTSP serves encode paths as rtsp://host/path/{id}. A path
+// failed to publish is skipped
+func startRTSP(addr string, encode *manager.Path) error {
+	rtspSvr.IP = comm.NetCfgInst.GetIPv4()
+
+	if err := rtspSvr.Start(addr); err != nil {
+		return err
+	}
+
+	for _, id := range encode.IDs() {
+		if err := rtspSvr.Publish(id); err != nil {
+			comm.Warning.Printf("Publish path %d over RTSP failed: %v", id, err)
+		}
+	}
+
+	return nil
+}
+
+// apiRTSPSession handles
+//
+//	GET    /api/rtsp/sessions        list all sessions
+//	DELETE /api/rtsp/sessions/{id}   end a session
+func apiRTSPSession(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, apiRTSP), "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		replyJSON(w, rtspSvr.Sessions())
+
+	case id != "" && r.Method == http.MethodDelete:
+		if err := rtspSvr.Kick(id); err != nil {
+			replyErr(w, http.StatusNotFound, err)
+			return
+		}
+
+		comm.Info.Printf("RTSP session %s ended by %s", id, actorOf(r).User)
+
+		replyJSON(w, M{"ID": id})
+
+	default:
+		replyErr(w, http.StatusMethodNotAllowed, errAPIBadMethod)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+	"github.com/zhanglongx/Aqua/manager"
+)
+
+// schedule API
+const (
+	apiSchedules = "/api/schedules"
+	apiCalendar  = "/api/calendar"
+)
+
+// sched runs scheduled jobs on paths
+var sched manager.Scheduler
+
+// apiSchedule handles
+//
+//	GET    /api/schedules       list all jobs
+//	POST   /api/schedules       add a job, manager.Job as body
+//	DELETE /api/schedules/{id}  delete a job
+func apiSchedule(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, apiSchedules), "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		replyJSON(w, sched.List())
+
+	case id == "" && r.Method == http.MethodPost:
+		var j manager.Job
+		if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+			replyErr(w, http.StatusBadRequest, errAPIBadBody)
+			return
+		}
+
+		added, err := sched.Add(j, actorOf(r))
+		if err != nil {
+			code := http.StatusBadRequest
+			if _, ok := err.(*manager.ConflictError); ok {
+				code = http.StatusConflict
+			}
+
+			replyErr(w, code, err)
+			return
+		}
+
+		comm.Info.Printf("Job %s added by %s", added.ID, actorOf(r).User)
+
+		replyJSON(w, added)
+
+	case id != "" && r.Method == http.MethodDelete:
+		if err := sched.Delete(id, actorOf(r)); err != nil {
+			replyErr(w, http.StatusNotFound, err)
+			return
+		}
+
+		comm.Info.Printf("Job %s deleted by %s", id, actorOf(r).User)
+
+		replyJSON(w, M{"ID": id})
+
+	default:
+		replyErr(w, http.StatusMethodNotAllowed, errAPIBadMethod)
+	}
+}
+
+// apiCalendarList serves GET /api/calendar?from=&to= (RFC3339),
+// default to the coming AppCfg.ScheduleHorizon
+func apiCalendarList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		replyErr(w, http.StatusMethodNotAllowed, errAPIBadMethod)
+		return
+	}
+
+	from := time.Now()
+	to := from.Add(comm.AppCfg.ScheduleHorizon)
+
+	var err error
+	q := r.URL.Query()
+	if s := q.Get("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			replyErr(w, http.StatusBadRequest, errAPIBadFilter)
+			return
+		}
+	}
+	if s := q.Get("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			replyErr(w, http.StatusBadRequest, errAPIBadFilter)
+			return
+		}
+	}
+
+	replyJSON(w, sched.Calendar(from, to))
+}
@@ -0,0 +1,255 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/zhanglongx/Aqua/comm"
+)
+
+const (
+	selfCertFile = "aqua.crt"
+	selfKeyFile  = "aqua.key"
+
+	// selfCertValid is the lifetime of a self-signed cert
+	selfCertValid = 10 * 365 * 24 * time.Hour
+
+	shutdownTimeout = 5 * time.Second
+)
+
+var (
+	errNoListen = errors.New("No listen address")
+)
+
+// server holds all http.Server started by StartAPP
+type server struct {
+	svrs []*http.Server
+}
+
+// listen chooses tcp4 or tcp6 by addr's host, so that "0.0.0.0:port"
+// and "[::]:port" can be used together
+func listen(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	network := "tcp"
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			network = "tcp4"
+		} else {
+			network = "tcp6"
+		}
+	}
+
+	return net.Listen(network, addr)
+}
+
+// serve starts h on all addrs. If cfg is not nil, TLS is used
+func (s *server) serve(addrs []string, h http.Handler, cfg *tls.Config) error {
+	for _, addr := range addrs {
+		l, err := listen(addr)
+		if err != nil {
+			comm.Error.Printf("Listen on %s failed: %v", addr, err)
+			return err
+		}
+
+		svr := &http.Server{Addr: addr, Handler: h, TLSConfig: cfg}
+		s.svrs = append(s.svrs, svr)
+
+		go func() {
+			var err error
+			if cfg != nil {
+				comm.Info.Printf("Serving HTTPS on %s", l.Addr())
+				err = svr.ServeTLS(l, "", "")
+			} else {
+				comm.Info.Printf("Serving HTTP on %s", l.Addr())
+				err = svr.Serve(l)
+			}
+
+			if err != nil && err != http.ErrServerClosed {
+				comm.Error.Printf("Serve on %s failed: %v", l.Addr(), err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// shutdown gracefully stops all servers
+func (s *server) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, svr := range s.svrs {
+		wg.Add(1)
+		go func(svr *http.Server) {
+			defer wg.Done()
+			if err := svr.Shutdown(ctx); err != nil {
+				comm.Error.Printf("Shutdown %s failed: %v", svr.Addr, err)
+			}
+		}(svr)
+	}
+
+	wg.Wait()
+}
+
+// redirectHandler redirects to the HTTPS port of first WebListen
+func redirectHandler(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			host = "[" + host + "]"
+		}
+
+		if port != "443" {
+			host = host + ":" + port
+		}
+
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	})
+}
+
+// tlsConfig loads user-supplied cert, or a self-signed one
+func tlsConfig() (*tls.Config, error) {
+	certFile := comm.AppCfg.WebCertFile
+	keyFile := comm.AppCfg.WebKeyFile
+
+	if certFile == "" || keyFile == "" {
+		var err error
+		if certFile, keyFile, err = selfSigned(comm.AppCfg.WebCertDir); err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		comm.Error.Printf("Load cert %s failed", certFile)
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// selfSigned returns the self-signed cert and key in dir, and
+// generates them if not exist or expired
+func selfSigned(dir string) (string, string, error) {
+	certFile := path.Join(dir, selfCertFile)
+	keyFile := path.Join(dir, selfKeyFile)
+
+	if buf, err := ioutil.ReadFile(certFile); err == nil {
+		if b, _ := pem.Decode(buf); b != nil {
+			if c, err := x509.ParseCertificate(b.Bytes); err == nil &&
+				time.Now().Before(c.NotAfter) {
+				if _, err := os.Stat(keyFile); err == nil {
+					return certFile, keyFile, nil
+				}
+			}
+		}
+	}
+
+	comm.Info.Printf("Generating self-signed cert %s", certFile)
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", "", err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+
+	tpl := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"Aqua"}, CommonName: "Aqua"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(selfCertValid),
+
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	if ip := comm.NetCfgInst.GetIPv4(); ip != nil {
+		tpl.IPAddresses = append(tpl.IPAddresses, ip)
+	}
+
+	for _, addr := range comm.AppCfg.WebListen {
+		host, _, _ := net.SplitHostPort(addr)
+		if ip := net.ParseIP(host); ip != nil {
+			if !ip.IsUnspecified() {
+				tpl.IPAddresses = append(tpl.IPAddresses, ip)
+			}
+		} else if host != "" && host != "localhost" {
+			tpl.DNSNames = append(tpl.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tpl, &tpl, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		comm.Error.Printf("Write key file %s failed", keyFile)
+		return "", "", err
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		comm.Error.Printf("Write cert file %s failed", certFile)
+		return "", "", err
+	}
+
+	return certFile, keyFile, nil
+}
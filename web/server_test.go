@@ -0,0 +1,68 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func Test_selfSigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aqua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, key, err := selfSigned(dir)
+	if err != nil {
+		t.Fatalf("selfSigned() error = %v", err)
+	}
+
+	buf, _ := ioutil.ReadFile(cert)
+
+	// second call must reuse the persisted one
+	cert2, key2, err := selfSigned(dir)
+	if err != nil || cert2 != cert || key2 != key {
+		t.Fatalf("selfSigned() = %s %s %v", cert2, key2, err)
+	}
+
+	if buf2, _ := ioutil.ReadFile(cert2); string(buf2) != string(buf) {
+		t.Errorf("selfSigned() regenerated cert")
+	}
+}
+
+func Test_redirectHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		addr string
+		host string
+		want string
+	}{
+		{"v4", "0.0.0.0:8443", "10.1.1.1:8000", "https://10.1.1.1:8443/encode?ID=1"},
+		{"v6", "[::]:8443", "[fe80::1]:8000", "https://[fe80::1]:8443/encode?ID=1"},
+		{"443", "0.0.0.0:443", "aqua.local", "https://aqua.local/encode?ID=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/encode?ID=1", nil)
+			r.Host = tt.host
+
+			w := httptest.NewRecorder()
+			redirectHandler(tt.addr).ServeHTTP(w, r)
+
+			if w.Code != http.StatusMovedPermanently {
+				t.Errorf("code = %d", w.Code)
+			}
+			if got := w.Header().Get("Location"); got != tt.want {
+				t.Errorf("Location = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
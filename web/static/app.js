@@ -0,0 +1,414 @@
+// Aqua dashboard, driven by /api/paths only
+
+"use strict";
+
+const REFRESH = 3000;
+
+// KINDS holds columns of each kind, built from PathKind. Card
+// fields go to Params.Card. IsRunning is shown as state instead
+const KINDS = {};
+
+// SCHEMAS holds card settings of each worker, by kind
+const SCHEMAS = {};
+
+function columns(kind) {
+	const cols = [];
+	for (const f of kind.Fields || []) {
+		if (f.Name !== "IsRunning") {
+			cols.push({ name: f.Name, label: f.Label, type: f.Type });
+		}
+	}
+	for (const f of kind.Card || []) {
+		cols.push({ name: f.Name, label: f.Label, type: f.Type, card: true });
+	}
+	return cols;
+}
+
+function makeSection(kind) {
+	const sec = document.createElement("section");
+	sec.dataset.kind = kind.Name;
+
+	const h = document.createElement("h2");
+	h.textContent = kind.Title;
+	sec.appendChild(h);
+
+	const table = document.createElement("table");
+	const tr = table.createTHead().insertRow();
+	for (const label of ["通道", ...KINDS[kind.Name].map((c) => c.label), "状态", ""]) {
+		const th = document.createElement("th");
+		th.textContent = label;
+		tr.appendChild(th);
+	}
+	table.appendChild(document.createElement("tbody"));
+	sec.appendChild(table);
+
+	document.querySelector("main").appendChild(sec);
+}
+
+function toast(msg, ok) {
+	const t = document.createElement("div");
+	t.className = ok ? "toast ok" : "toast";
+	t.textContent = msg;
+	document.getElementById("toasts").appendChild(t);
+	setTimeout(() => t.remove(), ok ? 2000 : 6000);
+}
+
+async function call(method, url, body) {
+	const opt = { method: method, headers: {} };
+	if (body !== undefined) {
+		opt.headers["Content-Type"] = "application/json";
+		opt.body = JSON.stringify(body);
+	}
+
+	const resp = await fetch(url, opt);
+	const data = await resp.json();
+	if (!resp.ok) {
+		const err = new Error(data.Error || resp.statusText);
+		err.data = data;
+		throw err;
+	}
+	return data;
+}
+
+function fieldValue(params, f) {
+	if (!params) {
+		return "";
+	}
+	const src = f.card ? (params.Card || {}) : params;
+	const v = src[f.name];
+	return v === undefined || v === null ? "" : v;
+}
+
+function makeInput(f, workers) {
+	let el;
+	if (f.type === "worker") {
+		el = document.createElement("select");
+		el.appendChild(new Option("", ""));
+		for (const w of workers) {
+			el.appendChild(new Option(w, w));
+		}
+	} else if (f.type === "bool") {
+		el = document.createElement("input");
+		el.type = "checkbox";
+	} else {
+		el = document.createElement("input");
+		el.type = f.type === "int" ? "number" : "text";
+	}
+	el.name = f.name;
+	el.addEventListener("input", () => el.classList.add("dirty"));
+	el.addEventListener("change", () => el.classList.add("dirty"));
+	return el;
+}
+
+function stateOf(p) {
+	if (!p.Params) {
+		return ["未配置", ""];
+	}
+	if (!p.Params.IsRunning) {
+		return ["停止", "stopped"];
+	}
+	const [text, cls] = p.Status ? ["运行", "up"] : ["运行(异常)", "fail"];
+	const fo = p.Failover;
+	const side = { standby: " · 备用设备", backup: " · 备用源", replaced: " · 重新分配" };
+	if (fo && side[fo.Active]) {
+		return [text + side[fo.Active], cls];
+	}
+	return [text, cls];
+}
+
+// hasCard tells if the selected worker of row takes card field f
+function hasCard(kind, row, f) {
+	const wn = row.querySelector('[name="WorkerName"]');
+	const wt = row.querySelector('[name="WorkerType"]');
+	if (wn && wn.value === "" && wt && wt.value !== "") {
+		// to be placed, the worker is not known yet
+		return true;
+	}
+	const schema = (SCHEMAS[kind] || {})[wn ? wn.value : ""] || [];
+	return schema.some((c) => c.Name === f.name);
+}
+
+function collect(kind, row, running) {
+	const params = { IsRunning: running, Card: {} };
+	for (const f of KINDS[kind]) {
+		if (f.card && !hasCard(kind, row, f)) {
+			continue;
+		}
+		const el = row.querySelector(`[name="${f.name}"]`);
+		let v = el.value;
+		if (f.type === "bool") {
+			v = el.checked;
+		} else if (f.type === "int") {
+			v = v === "" ? 0 : Number(v);
+		} else if (f.type === "strings") {
+			v = v.split(/[\s,]+/).filter((s) => s !== "");
+		}
+		if (f.card) {
+			params.Card[f.name] = v;
+		} else {
+			params[f.name] = v;
+		}
+	}
+	if (Object.keys(params.Card).length === 0) {
+		delete params.Card;
+	}
+	return params;
+}
+
+function clearDirty(row) {
+	row.querySelectorAll(".dirty").forEach((el) => el.classList.remove("dirty"));
+}
+
+function clearErrors(row) {
+	row.querySelectorAll(".invalid").forEach((el) => el.classList.remove("invalid"));
+	row.querySelectorAll(".field-error").forEach((el) => el.remove());
+}
+
+// showErrors shows FieldError next to the offending input
+function showErrors(row, fields) {
+	for (const [name, msg] of Object.entries(fields || {})) {
+		const el = row.querySelector(`[name="${name.replace(/^Card\./, "")}"]`);
+		if (!el) {
+			continue;
+		}
+		el.classList.add("invalid");
+		const span = document.createElement("div");
+		span.className = "field-error";
+		span.textContent = msg;
+		el.parentNode.appendChild(span);
+	}
+}
+
+// applicable disables card inputs the selected worker doesn't take
+function applicable(kind, row) {
+	for (const f of KINDS[kind]) {
+		if (f.card) {
+			row.querySelector(`[name="${f.name}"]`).disabled = !hasCard(kind, row, f);
+		}
+	}
+}
+
+async function act(kind, row, op) {
+	const id = row.dataset.id;
+	clearErrors(row);
+	try {
+		let p;
+		if (op === "save") {
+			const running = row.dataset.running === "true";
+			p = await call("PUT", `/api/paths/${kind}/${id}`, collect(kind, row, running));
+		} else {
+			p = await call("POST", `/api/paths/${kind}/${id}/${op}`);
+		}
+		clearDirty(row);
+		update(kind, row, p, true);
+		toast(`通道 ${id} 设置成功`, true);
+	} catch (e) {
+		if (e.data) {
+			showErrors(row, e.data.Fields);
+		}
+		toast(`通道 ${id}: ${e.message}`);
+	}
+}
+
+function fmtValue(v) {
+	return v === undefined || v === null ? "-" : JSON.stringify(v);
+}
+
+// history toggles the revision list below row, each with rollback
+async function history(kind, row) {
+	const next = row.nextElementSibling;
+	if (next && next.classList.contains("history")) {
+		next.remove();
+		return;
+	}
+
+	const id = row.dataset.id;
+	let revs;
+	try {
+		revs = await call("GET", `/api/paths/${kind}/${id}/revisions`);
+	} catch (e) {
+		toast(`通道 ${id}: ${e.message}`);
+		return;
+	}
+
+	const tr = document.createElement("tr");
+	tr.className = "history";
+	const td = tr.insertCell();
+	td.colSpan = row.cells.length;
+
+	if (!revs || revs.length === 0) {
+		td.textContent = "无历史记录";
+	}
+	for (const r of revs || []) {
+		const div = document.createElement("div");
+		const diff = (r.Diff || []).map((c) =>
+			`${c.Field}: ${fmtValue(c.Before)} → ${fmtValue(c.After)}`).join("; ");
+		div.textContent = `#${r.Seq} ${new Date(r.Time).toLocaleString()} ` +
+			`${r.User}@${r.Addr} ${diff} `;
+
+		const b = document.createElement("button");
+		b.textContent = "回滚";
+		b.addEventListener("click", async () => {
+			try {
+				const p = await call("POST", `/api/paths/${kind}/${id}/rollback`, { Seq: r.Seq });
+				clearDirty(row);
+				update(kind, row, p, true);
+				tr.remove();
+				toast(`通道 ${id} 已回滚到 #${r.Seq}`, true);
+			} catch (e) {
+				toast(`通道 ${id}: ${e.message}`);
+			}
+		});
+		div.appendChild(b);
+		td.appendChild(div);
+	}
+
+	row.after(tr);
+}
+
+function makeRow(kind, p, workers) {
+	const row = document.createElement("tr");
+	row.dataset.id = p.ID;
+
+	const id = document.createElement("td");
+	id.textContent = p.ID;
+	row.appendChild(id);
+
+	for (const f of KINDS[kind]) {
+		const td = document.createElement("td");
+		const el = makeInput(f, workers);
+		if (f.name === "WorkerName" || f.name === "WorkerType") {
+			el.addEventListener("change", () => applicable(kind, row));
+		}
+		td.appendChild(el);
+		row.appendChild(td);
+	}
+
+	const st = document.createElement("td");
+	st.innerHTML = '<span class="state"></span>';
+	row.appendChild(st);
+
+	const ops = document.createElement("td");
+	ops.className = "ops";
+	for (const [op, label] of [["save", "保存"], ["start", "启动"], ["stop", "停止"]]) {
+		const b = document.createElement("button");
+		b.textContent = label;
+		b.addEventListener("click", () => act(kind, row, op));
+		ops.appendChild(b);
+	}
+	const hb = document.createElement("button");
+	hb.textContent = "历史";
+	hb.addEventListener("click", () => history(kind, row));
+	ops.appendChild(hb);
+	row.appendChild(ops);
+
+	return row;
+}
+
+// update refreshes row from p, edited inputs are kept unless force
+function update(kind, row, p, force) {
+	row.dataset.running = p.Params ? String(!!p.Params.IsRunning) : "false";
+
+	for (const f of KINDS[kind]) {
+		const el = row.querySelector(`[name="${f.name}"]`);
+		if (force || !el.classList.contains("dirty")) {
+			if (f.type === "bool") {
+				el.checked = !!fieldValue(p.Params, f);
+			} else if (f.type === "strings") {
+				const v = fieldValue(p.Params, f);
+				el.value = Array.isArray(v) ? v.join(", ") : v;
+			} else {
+				el.value = fieldValue(p.Params, f);
+			}
+		}
+	}
+
+	applicable(kind, row);
+
+	const [text, cls] = stateOf(p);
+	const st = row.querySelector(".state");
+	st.textContent = text;
+	st.className = "state " + cls;
+	st.title = (p.Report || []).join("\n");
+}
+
+async function refresh(kind) {
+	const tbody = document.querySelector(`section[data-kind="${kind}"] tbody`);
+	const list = await call("GET", `/api/paths/${kind}`);
+	SCHEMAS[kind] = list.Schemas || {};
+
+	for (const p of list.Paths) {
+		let row = tbody.querySelector(`tr[data-id="${p.ID}"]`);
+		if (!row) {
+			row = makeRow(kind, p, list.Workers || []);
+			tbody.appendChild(row);
+		}
+		update(kind, row, p, false);
+	}
+}
+
+async function refreshAll() {
+	try {
+		await Promise.all(Object.keys(KINDS).map(refresh));
+		document.getElementById("updated").textContent =
+			"更新于 " + new Date().toLocaleTimeString();
+	} catch (e) {
+		toast("刷新失败: " + e.message);
+	}
+}
+
+function reportText(r) {
+	const lines = [];
+	for (const [from, to] of Object.entries(r.Mapped || {})) {
+		lines.push(`${from} → ${to}`);
+	}
+	for (const u of r.Unmapped || []) {
+		lines.push(`未映射 ${u.Kind} ${u.ID} ${u.WorkerName}: ${u.Reason}`);
+	}
+	for (const f of r.Failed || []) {
+		lines.push(`失败 ${f.Kind} ${f.ID} ${f.WorkerName}: ${f.Reason}`);
+	}
+	return lines.join("\n");
+}
+
+// importBundle previews the mapping first, then imports if confirmed
+async function importBundle(file) {
+	try {
+		const bundle = JSON.parse(await file.text());
+		const preview = await call("POST", "/api/config/import", { Bundle: bundle, DryRun: true });
+		if (!confirm("导入配置?\n" + reportText(preview))) {
+			return;
+		}
+		const r = await call("POST", "/api/config/import", { Bundle: bundle });
+		toast(`导入 ${r.Applied} 个通道`, (r.Failed || []).length === 0);
+		refreshAll();
+	} catch (e) {
+		toast("导入失败: " + e.message);
+	}
+}
+
+async function init() {
+	const imp = document.getElementById("import");
+	imp.addEventListener("change", () => {
+		if (imp.files.length > 0) {
+			importBundle(imp.files[0]);
+		}
+		imp.value = "";
+	});
+
+	try {
+		const kinds = await call("GET", "/api/paths");
+		for (const kind of kinds) {
+			KINDS[kind.Name] = columns(kind);
+			makeSection(kind);
+		}
+	} catch (e) {
+		toast("加载失败: " + e.message);
+		return;
+	}
+
+	refreshAll();
+	setInterval(refreshAll, REFRESH);
+}
+
+init();
@@ -0,0 +1,52 @@
+// Copyright 2020 Longxiao Zhang <zhanglongx@gmail.com>.
+// All rights reserved.
+// Use of this source code is governed by a GPLv3-style
+// license that can be found in the LICENSE file.
+
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// streamPrefix is where paths serve streams
+const streamPrefix = "/hls/"
+
+// streamPath handles
+//
+//	GET /hls/{kind}/{id}/index.m3u8   HLS playlist of path
+//	GET /hls/{kind}/{id}/{seq}.ts     HLS segment of path
+func streamPath(w http.ResponseWriter, r *http.Request) {
+	args := strings.SplitN(strings.TrimPrefix(r.URL.Path, streamPrefix), "/", 3)
+	if len(args) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		replyErr(w, http.StatusMethodNotAllowed, errAPIBadMethod)
+		return
+	}
+
+	p := findPath(args[0])
+	if p == nil {
+		replyErr(w, http.StatusNotFound, errAPINotFound)
+		return
+	}
+
+	id, err := strconv.Atoi(args[1])
+	if err != nil {
+		replyErr(w, http.StatusNotFound, errAPIBadID)
+		return
+	}
+
+	h, err := p.GetHandler(id)
+	if err != nil {
+		replyErr(w, http.StatusNotFound, err)
+		return
+	}
+
+	http.StripPrefix(streamPrefix+args[0]+"/"+args[1], h).ServeHTTP(w, r)
+}
@@ -6,240 +6,348 @@
 package web
 
 import (
+	"context"
+	"fmt"
 	"html/template"
-	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"unicode"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/zhanglongx/Aqua/comm"
+	"github.com/zhanglongx/Aqua/driver"
 	"github.com/zhanglongx/Aqua/manager"
 )
 
 // M is shortcut for map
 type M map[string]interface{}
 
-// pointers to Path
-var (
-	ep = &manager.Path{}
-	dp = &manager.Path{}
-)
+// paths are all Path, one for each manager.Kinds
+var paths []*manager.Path
+
+// StartAPP launch Web App, and blocks until ctx is done. Then
+// all servers are shut down gracefully
+func StartAPP(ctx context.Context) error {
+
+	for _, kind := range manager.Kinds {
+		p := &manager.Path{}
+		if err := p.Create(kind); err != nil {
+			comm.Error.Panicf("Create %s path failed: %v", kind.Name, err)
+		}
+
+		defer p.Close()
+
+		paths = append(paths, p)
+
+		http.HandleFunc("/"+kind.Name, pathIdx(p))
+	}
+
+	if err := sched.Start(comm.AppCfg.ScheduleFile, paths); err != nil {
+		return err
+	}
+
+	defer sched.Stop()
 
-// StartAPP launch Web App
-func StartAPP() {
+	if comm.AppCfg.RTSPListen != "" {
+		if err := startRTSP(comm.AppCfg.RTSPListen, findPath(manager.EncodeKind.Name)); err != nil {
+			return err
+		}
 
-	if err := ep.Create(comm.AppCfg.EPDir, comm.AppCfg.EPFile,
-		comm.AppCfg.EPNeed); err != nil {
-		comm.Error.Panicf("Create EncodePath failed: %v", err)
+		defer rtspSvr.Stop()
 	}
 
-	if err := dp.Create(comm.AppCfg.DPDir, comm.AppCfg.DPFile,
-		comm.AppCfg.DPNeed); err != nil {
-		comm.Error.Panicf("Create DecodePath failed: %v", err)
+	if err := groups.Load(comm.AppCfg.GroupFile, paths); err != nil {
+		return err
 	}
-	http.HandleFunc("/encode", encodeIdx)
-	http.HandleFunc("/decode", decodeIdx)
+
+	http.HandleFunc(apiPaths, apiPath)
+	http.HandleFunc(apiRevs, apiRevisions)
+	http.HandleFunc(apiExport, apiConfigExport)
+	http.HandleFunc(apiImport, apiConfigImport)
+	http.HandleFunc(apiAudit, apiAuditLog)
+	http.HandleFunc(apiNetwork, apiNetworkCfg)
+	http.HandleFunc(apiSchedules, apiSchedule)
+	http.HandleFunc(apiSchedules+"/", apiSchedule)
+	http.HandleFunc(apiCalendar, apiCalendarList)
+	http.HandleFunc(apiGroups, apiGroup)
+	http.HandleFunc(apiGroups+"/", apiGroup)
+	http.HandleFunc(apiRTSP, apiRTSPSession)
+	http.HandleFunc(apiRTSP+"/", apiRTSPSession)
+	http.HandleFunc(streamPrefix, streamPath)
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/", dashboard())
 
 	if comm.AppCfg.IsHTTPPipeOn {
 		http.HandleFunc("/Pipe", pipeIdx)
 	}
 
-	log.Fatal(http.ListenAndServe("localhost:8000", nil))
-}
+	if len(comm.AppCfg.WebListen) == 0 {
+		return errNoListen
+	}
 
-// TODO: to make a unified idx func
-func encodeIdx(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
-	IDStr := r.Form.Get("ID")
-	set := r.Form.Get("set")
+	svr := server{}
 
-	var allErr []error
-	if set == "设置参数" {
-		if err := setEP(r.Form); err != nil {
-			allErr = append(allErr, err)
+	defer svr.shutdown()
+
+	if comm.AppCfg.WebTLS {
+		cfg, err := tlsConfig()
+		if err != nil {
+			return err
 		}
-	}
 
-	data := make(map[interface{}]interface{})
+		if err := svr.serve(comm.AppCfg.WebListen, nil, cfg); err != nil {
+			return err
+		}
 
-	var content M
-	var err error
-	if content, err = getEP(IDStr); err != nil {
-		allErr = append(allErr, err)
+		if err := svr.serve(comm.AppCfg.WebRedirect,
+			redirectHandler(comm.AppCfg.WebListen[0]), nil); err != nil {
+			return err
+		}
+	} else {
+		if err := svr.serve(comm.AppCfg.WebListen, nil, nil); err != nil {
+			return err
+		}
 	}
 
-	if len(allErr) > 0 {
-		content["Error"] = allErr
-	}
+	<-ctx.Done()
 
-	data["Content"] = content
+	comm.Info.Printf("Shutting down web")
 
-	execTpl(w, data, epTpl)
+	return nil
 }
 
-func decodeIdx(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
-	IDStr := r.Form.Get("ID")
-	set := r.Form.Get("set")
-
-	var allErr []error
-	if set == "设置参数" {
-		if err := setDP(r.Form); err != nil {
-			allErr = append(allErr, err)
+// findPath finds a Path by kind name
+func findPath(name string) *manager.Path {
+	for _, p := range paths {
+		if p.Kind().Name == name {
+			return p
 		}
 	}
 
-	data := make(map[interface{}]interface{})
+	return nil
+}
 
-	var content M
-	var err error
-	if content, err = getDP(IDStr); err != nil {
-		allErr = append(allErr, err)
-	}
+// pathIdx returns the form handler of p
+func pathIdx(p *manager.Path) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		IDStr := r.Form.Get("ID")
+		set := r.Form.Get("set")
+
+		var allErr []error
+		var shown manager.Params
+		var fieldErr map[string]string
+		if set == "设置参数" {
+			if params, err := setForm(p, r.Form, actorOf(r)); err != nil {
+				allErr = append(allErr, err)
+
+				// show what user input, with errors next to it
+				if pe, ok := err.(manager.ParamsError); ok {
+					shown = params
+					fieldErr = pe.Fields()
+				}
+			}
+		}
 
-	if len(allErr) > 0 {
-		content["Error"] = allErr
-	}
+		data := make(map[interface{}]interface{})
 
-	data["Content"] = content
+		var content M
+		var err error
+		if content, err = getForm(p, IDStr, shown, fieldErr); err != nil {
+			allErr = append(allErr, err)
+		}
+
+		if len(allErr) > 0 {
+			content["Error"] = allErr
+		}
 
-	execTpl(w, data, dpTpl)
+		data["Content"] = content
+
+		execTpl(w, data, pathTpl)
+	}
 }
 
 func pipeIdx(w http.ResponseWriter, r *http.Request) {
 	manager.GetPipeInfo(w)
 }
 
-func setEP(val url.Values) error {
+// fieldView is a Field with its value in form
+type fieldView struct {
+	driver.Field
+
+	Value interface{}
+
+	// Options are choices of FieldWorker, selected first
+	Options []string
+
+	// Error is the FieldError.Msg of the field
+	Error string
+}
+
+// formValue converts form value by f.Type. A bad int is kept
+// as string, so manager can report it
+func formValue(f driver.Field, val url.Values) (interface{}, bool) {
+	if _, ok := val[f.Name]; !ok && f.Type != driver.FieldBool {
+		return nil, false
+	}
+
+	switch f.Type {
+	case driver.FieldBool:
+		return val.Get(f.Name) == "1", true
+	case driver.FieldStrings:
+		return strings.FieldsFunc(val.Get(f.Name), func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		}), true
+	case driver.FieldInt:
+		if i, err := strconv.Atoi(val.Get(f.Name)); err == nil {
+			return i, true
+		}
+		if val.Get(f.Name) == "" {
+			return nil, false
+		}
+		return val.Get(f.Name), true
+	default:
+		return val.Get(f.Name), true
+	}
+}
+
+// setForm sets path with form values, and returns the Params
+// built from the form
+func setForm(p *manager.Path, val url.Values, by manager.Actor) (manager.Params, error) {
 
 	IDStr := val.Get("ID")
 
 	if IDStr == "" {
-		return nil
+		return nil, nil
 	}
 
 	id, _ := strconv.Atoi(IDStr)
 
-	// FIXME: more checks?
-	params := make(manager.Params)
-	params["PathName"] = val.Get("PathName")
-	params["WorkerName"] = val.Get("WorkerName")
+	kind := p.Kind()
 
-	if val.Get("IsRunning") == "1" {
-		params["IsRunning"] = true
-	} else {
-		params["IsRunning"] = false
+	params := make(manager.Params)
+	for _, f := range kind.Fields {
+		if v, ok := formValue(f, val); ok {
+			params[f.Name] = v
+		}
 	}
 
-	card := make(map[string]interface{})
-	card["rtsp_url"] = val.Get("rtsp_url")
-	card["BitRate"], _ = strconv.Atoi(val.Get("BitRate"))
+	// only settings of the selected worker are sent, or all if
+	// the worker is to be placed
+	wn, _ := params["WorkerName"].(string)
+	schema := p.GetSchemas()[wn]
+	if typ, _ := params["WorkerType"].(string); wn == "" && typ != "" {
+		schema = p.CardFields()
+	}
+	if len(schema) > 0 {
+		card := make(map[string]interface{})
+		for _, f := range schema {
+			if v, ok := formValue(f, val); ok {
+				card[f.Name] = v
+			}
+		}
 
-	params["Card"] = card
+		params["Card"] = card
+	}
 
-	if err := ep.Set(id, params); err != nil {
-		comm.Error.Printf("Set path %d failed", id)
-		return err
+	if err := p.Set(id, params, by); err != nil {
+		comm.Error.Printf("Set %s path %d failed", kind.Name, id)
+		return params, err
 	}
 
-	return nil
+	return params, nil
 }
 
-func getEP(IDStr string) (M, error) {
+// getForm builds content of pathTpl. If shown is nil, Params in
+// DB are shown
+func getForm(p *manager.Path, IDStr string, shown manager.Params,
+	fieldErr map[string]string) (M, error) {
 
 	content := make(M)
 
-	// default
-	content["ID"] = []int{1, 2, 3, 4}
-	content["PathName"] = ""
-	content["WorkerName"] = ep.GetWorkers()
-	content["IsRunning"] = false
+	kind := p.Kind()
+	ids := p.IDs()
 
-	card := make(M)
-	card["rtsp_url"] = ""
-	card["BitRate"] = 0
+	content["Title"] = kind.Title
 
-	content["Card"] = card
-
-	if IDStr == "" {
-		return content, nil
+	var id int
+	if IDStr != "" {
+		id, _ = strconv.Atoi(IDStr)
+	} else if len(ids) > 0 {
+		id = ids[0]
 	}
 
-	id, _ := strconv.Atoi(IDStr)
+	content["ID"] = selectInt(ids, id)
+
+	params := shown
 
-	var params manager.Params
 	var err error
-	if params, err = ep.Get(id); err != nil {
-		comm.Error.Printf("Get path %d failed", id)
-		return content, err
+	if params == nil {
+		if params, err = p.Get(id); err != nil {
+			if IDStr == "" {
+				// default to an empty path
+				err = nil
+			} else {
+				comm.Error.Printf("Get %s path %d failed", kind.Name, id)
+			}
+		}
 	}
 
-	content["ID"] = selectInt(content["ID"].([]int), id)
-	content["PathName"] = params["PathName"]
-	content["WorkerName"] = selectStr(content["WorkerName"].([]string),
-		params["WorkerName"].(string))
-	content["IsRunning"] = params["IsRunning"]
-
-	content["Card"] = params["Card"]
-
-	return content, nil
-}
-
-func setDP(val url.Values) error {
-
-	IDStr := val.Get("ID")
+	card, _ := params["Card"].(map[string]interface{})
 
-	if IDStr == "" {
-		return nil
+	var fields []fieldView
+	for _, f := range kind.Fields {
+		view := newFieldView(p, f, params[f.Name])
+		view.Error = fieldErr[f.Name]
+		fields = append(fields, view)
 	}
-
-	id, _ := strconv.Atoi(IDStr)
-
-	// FIXME: more checks?
-	params := make(manager.Params)
-	params["WorkerName"] = val.Get("WorkerName")
-	if val.Get("IsRunning") == "1" {
-		params["IsRunning"] = true
-	} else {
-		params["IsRunning"] = false
+	for _, f := range p.CardFields() {
+		view := newFieldView(p, f, card[f.Name])
+		view.Error = fieldErr["Card."+f.Name]
+		fields = append(fields, view)
 	}
 
-	if err := dp.Set(id, params); err != nil {
-		comm.Error.Printf("Set path %d failed", id)
-		return err
-	}
+	content["Fields"] = fields
 
-	return nil
+	return content, err
 }
 
-func getDP(IDStr string) (M, error) {
-
-	content := make(M)
-
-	// default
-	content["ID"] = []int{1, 2, 3, 4}
-	content["WorkerName"] = dp.GetWorkers()
-	content["IsRunning"] = false
-
-	if IDStr == "" {
-		return content, nil
+func newFieldView(p *manager.Path, f driver.Field, v interface{}) fieldView {
+	if v == nil {
+		if f.Type == driver.FieldBool {
+			v = false
+		} else {
+			v = ""
+		}
 	}
 
-	id, _ := strconv.Atoi(IDStr)
+	view := fieldView{Field: f, Value: v}
 
-	var params manager.Params
-	var err error
-	if params, err = dp.Get(id); err != nil {
-		comm.Error.Printf("Get path %d failed", id)
-		return content, err
+	switch f.Type {
+	case driver.FieldWorker:
+		s, _ := v.(string)
+		workers := p.GetWorkers()
+		if !f.Required {
+			workers = append([]string{""}, workers...)
+		}
+		view.Options = selectStr(workers, s)
+
+	case driver.FieldStrings:
+		var all []string
+		switch l := v.(type) {
+		case []interface{}:
+			for _, s := range l {
+				all = append(all, fmt.Sprint(s))
+			}
+		case []string:
+			all = l
+		}
+		view.Value = strings.Join(all, ", ")
 	}
 
-	content["ID"] = selectInt(content["ID"].([]int), id)
-	content["WorkerName"] = selectStr(content["WorkerName"].([]string),
-		params["WorkerName"].(string))
-	content["IsRunning"] = params["IsRunning"]
-
-	return content, nil
+	return view
 }
 
 // beego: https://github.com/astaxie/beego
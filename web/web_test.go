@@ -6,8 +6,13 @@
 package web
 
 import (
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/zhanglongx/Aqua/comm"
+	"github.com/zhanglongx/Aqua/driver"
 )
 
 func Test_selectStr(t *testing.T) {
@@ -71,3 +76,65 @@ func Test_selectStr(t *testing.T) {
 		})
 	}
 }
+
+func Test_pathTpl(t *testing.T) {
+	content := M{
+		"Title": "编码通道",
+		"ID":    []int{2, 1},
+		"Fields": []fieldView{
+			{Field: driver.Field{Name: "PathName", Type: driver.FieldString}, Value: "a"},
+			{Field: driver.Field{Name: "WorkerName", Type: driver.FieldWorker},
+				Value: "C9830_3_1", Options: []string{"C9830_3_1", "C9830_3_0"}},
+			{Field: driver.Field{Name: "IsRunning", Type: driver.FieldBool}, Value: true},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	execTpl(w, map[interface{}]interface{}{"Content": content}, pathTpl)
+
+	body := w.Body.String()
+	for _, want := range []string{`name=PathName value=a`,
+		`<option value=C9830_3_1 selected="selected"`, "checked"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("pathTpl missing %s in:\n%s", want, body)
+		}
+	}
+}
+
+func Test_actorOf(t *testing.T) {
+	users, proxies := comm.AppCfg.WebUsers, comm.AppCfg.WebTrustedProxies
+	defer func() {
+		comm.AppCfg.WebUsers, comm.AppCfg.WebTrustedProxies = users, proxies
+	}()
+	comm.AppCfg.WebUsers = map[string]string{"admin": "pass"}
+	comm.AppCfg.WebTrustedProxies = []string{"10.0.0.1"}
+
+	tests := []struct {
+		addr     string
+		user     string
+		password string
+		remote   string
+		want     string
+	}{
+		{"10.0.0.2:1000", "admin", "pass", "", "admin"},
+		{"10.0.0.2:1000", "admin", "bad", "", "anonymous"},
+		{"10.0.0.2:1000", "root", "", "", "anonymous"},
+		{"10.0.0.1:1000", "", "", "bob", "bob"},
+		{"10.0.0.2:1000", "", "", "bob", "anonymous"},
+		{"10.0.0.1:1000", "admin", "bad", "bob", "anonymous"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("PUT", "/api/network", nil)
+		r.RemoteAddr = tt.addr
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.password)
+		}
+		if tt.remote != "" {
+			r.Header.Set("X-Remote-User", tt.remote)
+		}
+
+		if got := actorOf(r); got.User != tt.want || got.Addr != strings.Split(tt.addr, ":")[0] {
+			t.Errorf("actorOf(%v) = %v, want %s", tt, got, tt.want)
+		}
+	}
+}
@@ -16,81 +16,14 @@ var mainTpl = `
 </html>
 `
 
-var epTpl = `
+// pathTpl renders any path by its fields
+var pathTpl = `
 {{define "content"}}
 
-<form>
-
-* 首次启动后数据为fake，需要至少先查询一次参数
-<br></br>
-* 每次设置参数前都需要先查询参数
-<br></br>
-
-通道选择：
-<select name="ID">
-	{{range $k, $v := .Content.ID}}
-		{{if eq $k 0}}
-			<option value={{$v}} selected="selected"}>{{$v}}</option>
-		{{else}}
-			<option value={{$v}}>{{$v}}</option>
-		{{end}}
-	{{end}}
-</select>
-<br></br>
-
-通道名称：
-{{with $pn := .Content.PathName}}
-	<input type="text" name="PathName" value={{$pn}}>
-{{else}}
-	<input type="text" name="PathName">
-{{end}}
-<br></br>
-
-设备选择： 
-<select name="WorkerName">
-	{{range $k, $v := .Content.WorkerName}}
-		{{if eq $k 0}}
-			<option value={{$v}} selected="selected"}>{{$v}}</option>
-		{{else}}
-			<option value={{$v}}>{{$v}}</option>
-		{{end}}
-	{{end}}
-</select>
-<br></br>
-
-RTSP地址：
-<input type="text" name="rtsp_url" value={{.Content.Card.rtsp_url}}>
-<br></br>
-
-是否启动：
-{{if eq .Content.IsRunning true}}
-	<input type="checkbox" name="IsRunning" value=1 checked>
-{{else}}
-	<input type="checkbox" name="IsRunning" value=1>
-{{end}}
-<br></br>
-
-<input type="submit" name="get" value="查询参数">
-<input type="submit" name="set" value="设置参数">
-<br></br>
-
-</form>
-
-{{range $e := .Content.Error}} {{$e}}<br></br> {{end}}
-
-{{end}}
-`
-
-var dpTpl = `
-{{define "content"}}
+<h3>{{.Content.Title}}</h3>
 
 <form>
 
-* 首次启动后数据为fake，需要至少先查询一次参数
-<br></br>
-* 每次设置参数前都需要先查询参数
-<br></br>
-
 通道选择：
 <select name="ID">
 	{{range $k, $v := .Content.ID}}
@@ -103,25 +36,30 @@ var dpTpl = `
 </select>
 <br></br>
 
-设备选择： 
-<select name="WorkerName">
-	{{range $k, $v := .Content.WorkerName}}
-		{{if eq $k 0}}
-			<option value={{$v}} selected="selected"}>{{$v}}</option>
-		{{else}}
-			<option value={{$v}}>{{$v}}</option>
+{{range $f := .Content.Fields}}
+{{$f.Label}}：
+{{if eq $f.Type "worker"}}
+	<select name={{$f.Name}}>
+		{{range $k, $v := $f.Options}}
+			{{if eq $k 0}}
+				<option value={{$v}} selected="selected"}>{{$v}}</option>
+			{{else}}
+				<option value={{$v}}>{{$v}}</option>
+			{{end}}
 		{{end}}
+	</select>
+{{else if eq $f.Type "bool"}}
+	{{if $f.Value}}
+		<input type="checkbox" name={{$f.Name}} value=1 checked>
+	{{else}}
+		<input type="checkbox" name={{$f.Name}} value=1>
 	{{end}}
-</select>
-<br></br>
-
-是否启动：
-{{if eq .Content.IsRunning true}}
-	<input type="checkbox" name="IsRunning" value=1 checked>
 {{else}}
-	<input type="checkbox" name="IsRunning" value=1>
+	<input type="text" name={{$f.Name}} value={{$f.Value}}>
 {{end}}
+{{with $f.Error}}<font color="red">{{.}}</font>{{end}}
 <br></br>
+{{end}}
 
 <input type="submit" name="get" value="查询参数">
 <input type="submit" name="set" value="设置参数">